@@ -0,0 +1,671 @@
+package main
+
+// APU - Audio Processing Unit of 2A03, stepped every CPU cycle
+// http://wiki.nesdev.com/w/index.php/APU
+type APU struct {
+	apuState
+	console *Console
+}
+
+// all the state of APU, the fields are exported for encoding/binary
+type apuState struct {
+	Pulse    [2]apuPulse
+	Triangle apuTriangle
+	Noise    apuNoise
+	DMC      apuDMC
+
+	// http://wiki.nesdev.com/w/index.php/APU_Frame_Counter
+	FrameMode    byte   // 0 for 4-step, 1 for 5-step sequence
+	FrameInhibit bool   // frame IRQ disabled
+	FrameIRQ     bool   // frame IRQ flag
+	FrameCycle   uint16 // CPU cycle of the sequence
+	FrameReset   byte   // CPU cycles until a write of $4017 restarts the sequence
+	Cycle        uint64
+}
+
+// audioMapper is implemented by mappers with expansion audio, which is
+// clocked with APU every CPU cycle and mixed into its output. The output
+// is at the scale of APU output, see mix
+type audioMapper interface {
+	audioStep()
+	audioOutput() float32
+}
+
+// http://wiki.nesdev.com/w/index.php/APU_Length_Counter
+var lengthTable = [32]byte{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+var dutyTable = [4][8]byte{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+var triangleTable = [32]byte{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// periods of noise and DMC in CPU cycles, NTSC
+var noiseTable = [16]uint16{
+	4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068,
+}
+
+var dmcTable = [16]uint16{
+	428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
+}
+
+// lookup tables of the nonlinear mixer
+// http://wiki.nesdev.com/w/index.php/APU_Mixer
+var pulseMix, tndMix = func() (p [31]float32, t [203]float32) {
+	for i := 1; i < len(p); i++ {
+		p[i] = 95.52 / (8128/float32(i) + 100)
+	}
+	for i := 1; i < len(t); i++ {
+		t[i] = 163.67 / (24329/float32(i) + 100)
+	}
+	return
+}()
+
+// Attach APU to console, mapping its registers at $4000-$4013 and $4015.
+// $4017 is shared with the second controller, CPU forwards writes of it
+func (apu *APU) Attach(con *Console) error {
+	con.APU = apu
+	apu.console = con
+	con.Bus.Map(0x4000, 0x4013, BusHandler{
+		Write: func(addr uint16, val byte) { apu.writeRegister(addr, val) },
+	})
+	con.Bus.Map(0x4015, 0x4015, BusHandler{
+		Read:  func(uint16) byte { return apu.readStatus() },
+		Write: func(_ uint16, val byte) { apu.writeControl(val) },
+		Peek:  func(uint16) (byte, bool) { return apu.status(), true },
+	})
+	apu.Reset()
+	return nil
+}
+
+// Reset APU to power up state
+// http://wiki.nesdev.com/w/index.php/CPU_power_up_state
+func (apu *APU) Reset() {
+	apu.apuState = apuState{}
+	apu.Pulse[0].Channel = 1
+	apu.Pulse[1].Channel = 2
+	apu.Noise.Shift = 1
+	apu.DMC.BitsLeft = 8
+	apu.DMC.BufferEmpty = true
+	apu.DMC.Rate = dmcTable[0]
+}
+
+func (apu *APU) writeRegister(addr uint16, val byte) {
+	switch {
+	case addr < 0x4008:
+		apu.Pulse[addr>>2&1].write(addr&3, val)
+	case addr < 0x400C:
+		apu.Triangle.write(addr&3, val)
+	case addr < 0x4010:
+		apu.Noise.write(addr&3, val)
+	default:
+		apu.DMC.write(addr&3, val)
+		apu.updateIRQ()
+	}
+}
+
+// writeControl enable channels by $4015, a disabled channel is silenced
+// at once
+func (apu *APU) writeControl(val byte) {
+	for i := range apu.Pulse {
+		apu.Pulse[i].setEnabled(val>>uint(i)&1 != 0)
+	}
+	apu.Triangle.Enabled = val&0x04 != 0
+	if !apu.Triangle.Enabled {
+		apu.Triangle.Length = 0
+	}
+	apu.Noise.Enabled = val&0x08 != 0
+	if !apu.Noise.Enabled {
+		apu.Noise.Length = 0
+	}
+	d := &apu.DMC
+	d.IRQ = false
+	if val&0x10 == 0 {
+		d.Remaining = 0
+	} else if d.Remaining == 0 {
+		d.restart()
+	}
+	apu.updateIRQ()
+}
+
+// status of $4015: length counters, DMC active and IRQ flags
+func (apu *APU) status() byte {
+	var val byte
+	for i := range apu.Pulse {
+		if apu.Pulse[i].Length > 0 {
+			val |= 1 << uint(i)
+		}
+	}
+	if apu.Triangle.Length > 0 {
+		val |= 0x04
+	}
+	if apu.Noise.Length > 0 {
+		val |= 0x08
+	}
+	if apu.DMC.Remaining > 0 {
+		val |= 0x10
+	}
+	if apu.FrameIRQ {
+		val |= 0x40
+	}
+	if apu.DMC.IRQ {
+		val |= 0x80
+	}
+	return val
+}
+
+// readStatus read $4015, which acknowledges frame IRQ
+func (apu *APU) readStatus() byte {
+	val := apu.status()
+	apu.FrameIRQ = false
+	apu.updateIRQ()
+	return val
+}
+
+// writeFrameCounter write $4017, restarting the sequence 3 CPU cycles
+// later on an APU cycle, 4 between them. 5-step mode clocks the units then
+func (apu *APU) writeFrameCounter(val byte) {
+	apu.FrameMode = val >> 7
+	apu.FrameInhibit = val&0x40 != 0
+	if apu.FrameInhibit {
+		apu.FrameIRQ = false
+	}
+	apu.FrameReset = 4 - byte(apu.Cycle&1)
+	apu.updateIRQ()
+}
+
+func (apu *APU) updateIRQ() {
+	cpu := apu.console.CPU
+	cpu.setIRQ(irqFrame, apu.FrameIRQ)
+	cpu.setIRQ(irqDMC, apu.DMC.IRQ)
+}
+
+// step run a CPU cycle
+func (apu *APU) step() {
+	apu.Cycle++
+	apu.stepFrameCounter()
+	apu.Triangle.clock()
+	if apu.Cycle%2 == 0 {
+		apu.Pulse[0].clock()
+		apu.Pulse[1].clock()
+	}
+	apu.Noise.clock()
+	apu.stepDMC()
+	if apu.console.audio != nil {
+		apu.console.audio.audioStep()
+	}
+}
+
+func (apu *APU) stepFrameCounter() {
+	if apu.FrameReset > 0 {
+		if apu.FrameReset--; apu.FrameReset == 0 {
+			apu.FrameCycle = 0
+			if apu.FrameMode == 1 {
+				apu.quarterFrame()
+				apu.halfFrame()
+			}
+			return
+		}
+	}
+	apu.FrameCycle++
+	switch apu.FrameCycle {
+	case 7457, 22371:
+		apu.quarterFrame()
+	case 14913:
+		apu.quarterFrame()
+		apu.halfFrame()
+	case 29828:
+		apu.frameInterrupt()
+	case 29829:
+		if apu.FrameMode == 0 {
+			apu.quarterFrame()
+			apu.halfFrame()
+			apu.frameInterrupt()
+		}
+	case 29830:
+		if apu.FrameMode == 0 {
+			apu.frameInterrupt()
+			apu.FrameCycle = 0
+		}
+	case 37281:
+		apu.quarterFrame()
+		apu.halfFrame()
+	case 37282:
+		apu.FrameCycle = 0
+	}
+}
+
+// frameInterrupt raise the frame IRQ flag, it is raised on the last 3
+// cycles of the 4-step sequence, so a read of $4015 between them does not
+// keep it clear
+// https://www.nesdev.org/wiki/APU_Frame_Counter
+func (apu *APU) frameInterrupt() {
+	if apu.FrameMode == 0 && !apu.FrameInhibit {
+		apu.FrameIRQ = true
+		apu.updateIRQ()
+	}
+}
+
+// quarterFrame clock envelopes and the linear counter
+func (apu *APU) quarterFrame() {
+	apu.Pulse[0].Envelope.clock()
+	apu.Pulse[1].Envelope.clock()
+	apu.Noise.Envelope.clock()
+	apu.Triangle.clockLinear()
+}
+
+// halfFrame clock length counters and sweeps
+func (apu *APU) halfFrame() {
+	for i := range apu.Pulse {
+		apu.Pulse[i].clockLength()
+		apu.Pulse[i].clockSweep()
+	}
+	apu.Triangle.clockLength()
+	apu.Noise.clockLength()
+}
+
+// stepDMC fill the sample buffer by DMA when it is empty, CPU is stalled
+// for the read
+func (apu *APU) stepDMC() {
+	d := &apu.DMC
+	if d.BufferEmpty && d.Remaining > 0 {
+		con := apu.console
+		d.Buffer = con.CPU.readBus(d.Addr)
+		if con.cdl != nil {
+			con.cdl.logPCM(con, d.Addr)
+		}
+		con.CPU.stall += 4
+		d.BufferEmpty = false
+		d.Addr++
+		if d.Addr == 0 {
+			d.Addr = 0x8000
+		}
+		d.Remaining--
+		if d.Remaining == 0 {
+			if d.Loop {
+				d.restart()
+			} else if d.IRQEnabled {
+				d.IRQ = true
+				apu.updateIRQ()
+			}
+		}
+	}
+	d.clock()
+}
+
+// Output return the mixed level of channels, 0 to about 1, with expansion
+// audio of the cartridge
+func (apu *APU) Output() float32 {
+	out := mix(apu.Pulse[0].output(), apu.Pulse[1].output(), apu.Triangle.output(), apu.Noise.output(), apu.DMC.Output)
+	if apu.console.audio != nil {
+		out += apu.console.audio.audioOutput()
+	}
+	return out
+}
+
+// stems return the level of each channel as mixed alone, and that of
+// expansion audio, in the order of StemPulse1
+func (apu *APU) stems() (levels [stemCount]float32) {
+	levels[StemPulse1] = pulseMix[apu.Pulse[0].output()]
+	levels[StemPulse2] = pulseMix[apu.Pulse[1].output()]
+	levels[StemTriangle] = tndMix[3*int(apu.Triangle.output())]
+	levels[StemNoise] = tndMix[2*int(apu.Noise.output())]
+	levels[StemDMC] = tndMix[apu.DMC.Output]
+	if apu.console.audio != nil {
+		levels[StemExpansion] = apu.console.audio.audioOutput()
+	}
+	return
+}
+
+// mix channel outputs by the nonlinear mixer, pulses are 0-15, DMC 0-127.
+// Both pulses at full volume are about 0.26, DMC alone about 0.56
+func mix(pulse1, pulse2, triangle, noise, dmc byte) float32 {
+	return pulseMix[pulse1+pulse2] + tndMix[3*int(triangle)+2*int(noise)+int(dmc)]
+}
+
+// apuEnvelope - volume of pulse and noise, a constant or a decay
+// http://wiki.nesdev.com/w/index.php/APU_Envelope
+type apuEnvelope struct {
+	Start    bool
+	Loop     bool // also halts the length counter
+	Constant bool
+	Volume   byte // constant volume, or period of decay
+	Divider  byte
+	Decay    byte
+}
+
+func (e *apuEnvelope) write(val byte) {
+	e.Loop = val&0x20 != 0
+	e.Constant = val&0x10 != 0
+	e.Volume = val & 0x0F
+}
+
+func (e *apuEnvelope) clock() {
+	switch {
+	case e.Start:
+		e.Start = false
+		e.Decay = 15
+		e.Divider = e.Volume
+	case e.Divider > 0:
+		e.Divider--
+	default:
+		e.Divider = e.Volume
+		if e.Decay > 0 {
+			e.Decay--
+		} else if e.Loop {
+			e.Decay = 15
+		}
+	}
+}
+
+func (e *apuEnvelope) output() byte {
+	if e.Constant {
+		return e.Volume
+	}
+	return e.Decay
+}
+
+// apuPulse - pulse channel, also used by MMC5 which has no sweep
+// http://wiki.nesdev.com/w/index.php/APU_Pulse
+type apuPulse struct {
+	Envelope apuEnvelope
+	Enabled  bool
+	Channel  byte // 1 or 2, sweep of pulse 1 negates by ones' complement
+	NoSweep  bool
+	Duty     byte
+	DutyPos  byte
+	Timer    uint16
+	Period   uint16
+	Length   byte
+
+	SweepEnabled bool
+	SweepNegate  bool
+	SweepReload  bool
+	SweepPeriod  byte
+	SweepShift   byte
+	SweepDivider byte
+}
+
+func (p *apuPulse) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		p.Duty = val >> 6
+		p.Envelope.write(val)
+	case 1:
+		p.SweepEnabled = val&0x80 != 0
+		p.SweepPeriod = val >> 4 & 0x07
+		p.SweepNegate = val&0x08 != 0
+		p.SweepShift = val & 0x07
+		p.SweepReload = true
+	case 2:
+		p.Period = p.Period&0x0700 | uint16(val)
+	case 3:
+		p.Period = p.Period&0x00FF | uint16(val&0x07)<<8
+		if p.Enabled {
+			p.Length = lengthTable[val>>3]
+		}
+		p.DutyPos = 0
+		p.Envelope.Start = true
+	}
+}
+
+func (p *apuPulse) setEnabled(enabled bool) {
+	p.Enabled = enabled
+	if !enabled {
+		p.Length = 0
+	}
+}
+
+// clock the timer, every other CPU cycle
+func (p *apuPulse) clock() {
+	if p.Timer == 0 {
+		p.Timer = p.Period
+		p.DutyPos = (p.DutyPos + 1) & 7
+	} else {
+		p.Timer--
+	}
+}
+
+func (p *apuPulse) clockLength() {
+	if !p.Envelope.Loop && p.Length > 0 {
+		p.Length--
+	}
+}
+
+// http://wiki.nesdev.com/w/index.php/APU_Sweep
+func (p *apuPulse) sweepTarget() uint16 {
+	change := p.Period >> p.SweepShift
+	if !p.SweepNegate {
+		return p.Period + change
+	}
+	if p.Channel == 1 {
+		change++
+	}
+	if change > p.Period {
+		return 0
+	}
+	return p.Period - change
+}
+
+func (p *apuPulse) muted() bool {
+	return !p.NoSweep && (p.Period < 8 || p.sweepTarget() > 0x7FF)
+}
+
+func (p *apuPulse) clockSweep() {
+	if p.SweepDivider == 0 && p.SweepEnabled && p.SweepShift > 0 && !p.muted() {
+		p.Period = p.sweepTarget()
+	}
+	if p.SweepDivider == 0 || p.SweepReload {
+		p.SweepDivider = p.SweepPeriod
+		p.SweepReload = false
+	} else {
+		p.SweepDivider--
+	}
+}
+
+func (p *apuPulse) output() byte {
+	if p.Length == 0 || p.muted() || dutyTable[p.Duty][p.DutyPos] == 0 {
+		return 0
+	}
+	return p.Envelope.output()
+}
+
+// apuTriangle - triangle channel
+// http://wiki.nesdev.com/w/index.php/APU_Triangle
+type apuTriangle struct {
+	Enabled      bool
+	Control      bool // halts the length counter and linear reload
+	LinearReload byte
+	Linear       byte
+	Reload       bool
+	Timer        uint16
+	Period       uint16
+	Length       byte
+	Step         byte
+}
+
+func (t *apuTriangle) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		t.Control = val&0x80 != 0
+		t.LinearReload = val & 0x7F
+	case 2:
+		t.Period = t.Period&0x0700 | uint16(val)
+	case 3:
+		t.Period = t.Period&0x00FF | uint16(val&0x07)<<8
+		if t.Enabled {
+			t.Length = lengthTable[val>>3]
+		}
+		t.Reload = true
+	}
+}
+
+// clock the timer, every CPU cycle
+func (t *apuTriangle) clock() {
+	if t.Timer > 0 {
+		t.Timer--
+		return
+	}
+	t.Timer = t.Period
+	if t.Length > 0 && t.Linear > 0 {
+		t.Step = (t.Step + 1) & 31
+	}
+}
+
+func (t *apuTriangle) clockLinear() {
+	if t.Reload {
+		t.Linear = t.LinearReload
+	} else if t.Linear > 0 {
+		t.Linear--
+	}
+	if !t.Control {
+		t.Reload = false
+	}
+}
+
+func (t *apuTriangle) clockLength() {
+	if !t.Control && t.Length > 0 {
+		t.Length--
+	}
+}
+
+func (t *apuTriangle) output() byte {
+	return triangleTable[t.Step]
+}
+
+// apuNoise - noise channel, a linear feedback shift register
+// http://wiki.nesdev.com/w/index.php/APU_Noise
+type apuNoise struct {
+	Envelope apuEnvelope
+	Enabled  bool
+	Mode     bool // short sequence, feedback from bit 6
+	Shift    uint16
+	Timer    uint16
+	Period   uint16
+	Length   byte
+}
+
+func (n *apuNoise) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		n.Envelope.write(val)
+	case 2:
+		n.Mode = val&0x80 != 0
+		n.Period = noiseTable[val&0x0F]
+	case 3:
+		if n.Enabled {
+			n.Length = lengthTable[val>>3]
+		}
+		n.Envelope.Start = true
+	}
+}
+
+// clock the timer, every CPU cycle
+func (n *apuNoise) clock() {
+	if n.Timer > 0 {
+		n.Timer--
+		return
+	}
+	n.Timer = n.Period - 1
+	bit := uint(1)
+	if n.Mode {
+		bit = 6
+	}
+	feedback := (n.Shift ^ n.Shift>>bit) & 1
+	n.Shift = n.Shift>>1 | feedback<<14
+}
+
+func (n *apuNoise) clockLength() {
+	if !n.Envelope.Loop && n.Length > 0 {
+		n.Length--
+	}
+}
+
+func (n *apuNoise) output() byte {
+	if n.Length == 0 || n.Shift&1 != 0 {
+		return 0
+	}
+	return n.Envelope.output()
+}
+
+// apuDMC - delta modulation channel, playing 1-bit samples read from
+// memory by DMA
+// http://wiki.nesdev.com/w/index.php/APU_DMC
+type apuDMC struct {
+	IRQEnabled   bool
+	IRQ          bool
+	Loop         bool
+	Rate         uint16 // period in CPU cycles
+	Timer        uint16
+	Output       byte // 0-127
+	SampleAddr   uint16
+	SampleLength uint16
+	Addr         uint16 // of the next sample byte
+	Remaining    uint16 // bytes of the sample left to read
+	Buffer       byte
+	BufferEmpty  bool
+	Shift        byte
+	BitsLeft     byte
+	Silence      bool
+}
+
+func (d *apuDMC) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		d.IRQEnabled = val&0x80 != 0
+		if !d.IRQEnabled {
+			d.IRQ = false
+		}
+		d.Loop = val&0x40 != 0
+		d.Rate = dmcTable[val&0x0F]
+	case 1:
+		d.Output = val & 0x7F
+	case 2:
+		d.SampleAddr = 0xC000 | uint16(val)<<6
+	case 3:
+		d.SampleLength = uint16(val)<<4 | 1
+	}
+}
+
+func (d *apuDMC) restart() {
+	d.Addr = d.SampleAddr
+	d.Remaining = d.SampleLength
+}
+
+// clock the timer, every CPU cycle, shifting a bit of the sample to the
+// output level
+func (d *apuDMC) clock() {
+	if d.Timer > 0 {
+		d.Timer--
+		return
+	}
+	d.Timer = d.Rate - 1
+	if !d.Silence {
+		if d.Shift&1 != 0 {
+			if d.Output <= 125 {
+				d.Output += 2
+			}
+		} else if d.Output >= 2 {
+			d.Output -= 2
+		}
+	}
+	d.Shift >>= 1
+	d.BitsLeft--
+	if d.BitsLeft == 0 {
+		d.BitsLeft = 8
+		d.Silence = d.BufferEmpty
+		if !d.BufferEmpty {
+			d.Shift = d.Buffer
+			d.BufferEmpty = true
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFrameIRQ(t *testing.T) {
+	code, err := Assemble(`
+        LDA #0
+        STA $4017
+        CLI
+wait:   JMP wait
+irq:    INC $10
+        LDA $4015
+        RTI
+`, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, false)
+	con.Cartridge.PRG[0x3FFE], con.Cartridge.PRG[0x3FFF] = 0x09, 0xC0
+	if err := con.Connect(new(APU)); err != nil {
+		t.Fatal(err)
+	}
+	for con.CPU.cycles < 4*29830 {
+		con.Step()
+	}
+	if n := con.CPU.ram[0x10]; n != 3 && n != 4 {
+		t.Errorf("%d frame IRQs, want 3 or 4", n)
+	}
+	if con.CPU.irq != 0 {
+		t.Errorf("IRQ line %02X, want acknowledged", con.CPU.irq)
+	}
+}
+
+func TestFrameIRQFlag(t *testing.T) {
+	con, apu := newAPUTest(t)
+	for apu.FrameReset > 0 {
+		apu.step()
+	}
+	for apu.FrameCycle < 29827 {
+		apu.step()
+	}
+	if apu.FrameIRQ {
+		t.Fatalf("frame IRQ at cycle %d", apu.FrameCycle)
+	}
+	for _, cycle := range []uint16{29828, 29829, 0} {
+		apu.step()
+		if apu.FrameCycle != cycle || !apu.FrameIRQ || con.CPU.irq&irqFrame == 0 {
+			t.Errorf("cycle %d: frame IRQ %v, want raised at %d", apu.FrameCycle, apu.FrameIRQ, cycle)
+		}
+		con.CPU.read(0x4015)
+	}
+	apu.step()
+	if apu.FrameIRQ {
+		t.Error("frame IRQ raised after the sequence restarted")
+	}
+}
+
+func TestAPUChannels(t *testing.T) {
+	con := newProgramConsole(t, new(CPU), []byte{0xEA}, false)
+	apu := new(APU)
+	con.Connect(apu)
+	cpu := con.CPU
+
+	cpu.write(0x4015, 0x0F)
+	cpu.write(0x4000, 0xBF) // duty 50%, halt length, constant volume 15
+	cpu.write(0x4002, 0x40)
+	cpu.write(0x4003, 0x08)
+	if v := con.Peek(0x4015); v&0x01 == 0 {
+		t.Errorf("$4015 = %02X, want pulse 1 playing", v)
+	}
+	high := false
+	for i := 0; i < 0x82*8*2; i++ {
+		apu.step()
+		high = high || apu.Pulse[0].output() == 15
+	}
+	if !high {
+		t.Error("pulse 1 never output volume 15")
+	}
+	cpu.write(0x4015, 0)
+	if v := con.Peek(0x4015); v&0x0F != 0 || apu.Pulse[0].output() != 0 {
+		t.Errorf("$4015 = %02X, pulse 1 at %d after disabling channels", v, apu.Pulse[0].output())
+	}
+
+	// a sample of one byte, raising IRQ at its end
+	cpu.write(0x4010, 0x8F)
+	cpu.write(0x4012, 0x00)
+	cpu.write(0x4013, 0x00)
+	cpu.write(0x4015, 0x10)
+	apu.step()
+	if cpu.stall != 4 {
+		t.Errorf("DMC stalled CPU %d cycles, want 4", cpu.stall)
+	}
+	if v := con.Peek(0x4015); v != 0x80 || cpu.irq != irqDMC {
+		t.Errorf("$4015 = %02X, IRQ line %02X after the sample, want DMC IRQ", v, cpu.irq)
+	}
+	cpu.write(0x4015, 0)
+	if cpu.irq != 0 {
+		t.Error("writing $4015 did not acknowledge DMC IRQ")
+	}
+}
+
+// newAPUTest connect an APU to a console looping at $C000, with pulse 1
+// enabled and its length counter loaded with 10
+func newAPUTest(t *testing.T) (*Console, *APU) {
+	con := newProgramConsole(t, new(CPU), []byte{0x4C, 0x00, 0xC0}, false)
+	apu := new(APU)
+	con.Connect(apu)
+	con.CPU.write(0x4015, 0x01)
+	con.CPU.write(0x4000, 0x1F) // length counter not halted
+	con.CPU.write(0x4003, 0x00)
+	return con, apu
+}
+
+func TestLengthCounter(t *testing.T) {
+	con, apu := newAPUTest(t)
+	if apu.Pulse[0].Length != 10 {
+		t.Fatalf("length %d, want 10 of index 0", apu.Pulse[0].Length)
+	}
+	// 4-step sequence clocks length counters twice in 29830 cycles
+	for i := 0; i < 4*29830; i++ {
+		apu.step()
+	}
+	if l := apu.Pulse[0].Length; l != 2 || con.Peek(0x4015)&0x01 == 0 {
+		t.Errorf("length %d after 4 sequences, want 2 and playing", l)
+	}
+	for i := 0; i < 29830; i++ {
+		apu.step()
+	}
+	if l := apu.Pulse[0].Length; l != 0 || con.Peek(0x4015)&0x01 != 0 {
+		t.Errorf("length %d after 5 sequences, want 0 and silent", l)
+	}
+
+	con.CPU.write(0x4000, 0x3F) // halt
+	con.CPU.write(0x4003, 0x08)
+	for i := 0; i < 29830; i++ {
+		apu.step()
+	}
+	if l := apu.Pulse[0].Length; l != 254 {
+		t.Errorf("halted length %d, want 254", l)
+	}
+	con.CPU.write(0x4015, 0)
+	con.CPU.write(0x4003, 0x08)
+	if l := apu.Pulse[0].Length; l != 0 {
+		t.Errorf("length %d loaded while disabled, want 0", l)
+	}
+}
+
+func TestFiveStepSequence(t *testing.T) {
+	con, apu := newAPUTest(t)
+	for apu.FrameReset > 0 {
+		apu.step()
+	}
+	con.CPU.write(0x4017, 0x80)
+	delay := 3 + int(apu.Cycle&1^1)
+	for i := 1; i < delay; i++ {
+		apu.step()
+	}
+	if l := apu.Pulse[0].Length; l != 10 {
+		t.Fatalf("length %d before the write of $4017 took effect, want 10", l)
+	}
+	apu.step()
+	if l := apu.Pulse[0].Length; l != 9 {
+		t.Fatalf("length %d after the write of $4017, want 9 clocked at once", l)
+	}
+
+	var halves []uint16
+	for i := 0; i < 2*37282; i++ {
+		l := apu.Pulse[0].Length
+		apu.step()
+		if apu.Pulse[0].Length != l {
+			halves = append(halves, apu.FrameCycle)
+		}
+	}
+	if want := []uint16{14913, 37281, 14913, 37281}; fmt.Sprint(halves) != fmt.Sprint(want) {
+		t.Errorf("half frames at cycles %v, want %v", halves, want)
+	}
+	if apu.FrameIRQ || con.CPU.irq != 0 {
+		t.Error("frame IRQ in 5-step mode")
+	}
+}
+
+func TestDMCStall(t *testing.T) {
+	con, apu := newAPUTest(t)
+	cpu := con.CPU
+	cpu.write(0x4010, 0x0F) // 432 cycles a byte
+	cpu.write(0x4013, 0x01) // 17 bytes
+	cpu.write(0x4015, 0x10)
+	start, stalls := cpu.cycles, 0
+	for cpu.cycles-start < 17*432+100 {
+		if cpu.stall > 0 {
+			stalls++
+			if cpu.Step() != 4 {
+				t.Fatalf("DMA stalled CPU %d cycles, want 4", cpu.stall)
+			}
+			continue
+		}
+		con.Step()
+	}
+	if stalls != 17 || apu.DMC.Remaining != 0 || con.Peek(0x4015)&0x10 != 0 {
+		t.Errorf("%d DMA reads, %d bytes remaining, want 17 and done", stalls, apu.DMC.Remaining)
+	}
+}
+
+func TestIRQLatency(t *testing.T) {
+	code, err := Assemble(`
+        CLI
+        SEI
+        NOP
+irq:    JMP irq
+`, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, false)
+	con.Cartridge.PRG[0x3FFE], con.Cartridge.PRG[0x3FFF] = 0x03, 0xC0
+	cpu := con.CPU
+	cpu.setIRQ(irqMapper, true)
+	cpu.Step()
+	cpu.Step()
+	if cpu.PC != 0xC002 {
+		t.Fatalf("PC %04X after CLI, SEI, want C002 before IRQ is taken", cpu.PC)
+	}
+	cpu.Step()
+	if ret := uint16(cpu.ram[0x1FD])<<8 | uint16(cpu.ram[0x1FC]); cpu.PC != 0xC003 || ret != 0xC002 {
+		t.Errorf("PC %04X returning to %04X, want IRQ after SEI returning to C002", cpu.PC, ret)
+	}
+	if p := cpu.ram[0x1FB]; p&0x04 == 0 {
+		t.Errorf("pushed status %02X, want I set by SEI", p)
+	}
+
+	// reset masks IRQ at once
+	cpu.I, cpu.irqMask = 0, 0
+	con.SoftReset()
+	cpu.Step()
+	if cpu.PC != 0xC001 {
+		t.Errorf("PC %04X after reset, want C001 of CLI before IRQ is taken", cpu.PC)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// opcodes by mnemonic and address mode, official opcodes are preferred
+// where an instruction has more than one encoding, e.g. SBC #imm or NOP
+var asmOpcodes = make(map[string]map[uint8]byte)
+
+func init() {
+	add := func(name string, op int) {
+		if asmOpcodes[name] == nil {
+			asmOpcodes[name] = make(map[uint8]byte)
+		}
+		asmOpcodes[name][instructions[op].addrMode] = byte(op)
+	}
+	for _, official := range []bool{false, true} {
+		for op := 255; op >= 0; op-- {
+			ins := instructions[op]
+			if ins.cycles == 0 && ins.id != insKIL || unofficial(byte(op)) == official {
+				continue
+			}
+			add(instructionNames[ins.id], op)
+			if name, ok := unofficialNames[ins.id]; ok && !official {
+				add(name, op)
+			}
+		}
+	}
+}
+
+// syntax of operands, each allows some address modes
+const (
+	asmNone = iota
+	asmAccumulator
+	asmImmediate
+	asmPlain
+	asmIndexX
+	asmIndexY
+	asmIndirect
+	asmIndirectX
+	asmIndirectY
+)
+
+type asmStatement struct {
+	line    int
+	label   string
+	name    string // upper case mnemonic or directive, "=" to define name
+	syntax  int
+	force   byte // 'a' or 'z' to force absolute or zero page addressing
+	args    []expr
+	strings map[int]string // string arguments of .byte by index
+	pc      int
+	mode    uint8
+	size    int
+}
+
+type assembler struct {
+	symbols   map[string]int
+	pc        int
+	undefined string
+}
+
+// Assemble assemble 6502 source to machine code placed at org, e.g.
+//
+//	count = 4
+//	start:  LDX #count      ; comment
+//	loop:   LDA table-1,X
+//	        STA $0200,X
+//	        DEX
+//	        BNE loop
+//	        JMP (vector)
+//	        .org $C010
+//	table:  .byte 1, 2, "text"
+//	vector: .word start, *+2
+//
+// Mnemonics are official and unofficial ones, by names of both
+// http://nesdev.com/undocumented_opcodes.txt and Nintendulator. Expressions
+// are those of debugger conditions with names of labels, * for the address
+// of the statement, and < and > for low and high byte. Operands prefixed
+// with a: or z: force absolute or zero page addressing.
+func Assemble(src string, org uint16) ([]byte, error) {
+	a := &assembler{symbols: make(map[string]int)}
+	var stmts []*asmStatement
+	for i, line := range strings.Split(src, "\n") {
+		s, err := a.parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if s != nil {
+			s.line = i + 1
+			stmts = append(stmts, s)
+		}
+	}
+
+	// first pass places labels, an operand not yet known takes absolute
+	// addressing
+	a.pc = int(org)
+	var constants []*asmStatement
+	for _, s := range stmts {
+		s.pc = a.pc
+		if err := a.place(s); err != nil {
+			return nil, fmt.Errorf("line %d: %v", s.line, err)
+		}
+		if s.name == "=" {
+			constants = append(constants, s)
+		}
+		a.pc += s.size
+	}
+	// names defined by labels after them
+	for i := 0; i < 2; i++ {
+		for _, s := range constants {
+			if v, err := a.eval(s, s.args[0]); err == nil {
+				a.symbols[s.label] = v
+			}
+		}
+	}
+
+	var out []byte
+	for _, s := range stmts {
+		if s.pc < int(org) || s.pc-int(org) < len(out) {
+			return nil, fmt.Errorf("line %d: $%04X overlaps code before", s.line, s.pc)
+		}
+		for len(out) < s.pc-int(org) {
+			out = append(out, 0)
+		}
+		b, err := a.emit(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", s.line, err)
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// parse split a line into label, mnemonic or directive and operands
+func (a *assembler) parse(line string) (*asmStatement, error) {
+	if i := indexOutsideQuotes(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+	s := new(asmStatement)
+	if n := asmIdentifier(line); n > 0 {
+		rest := strings.TrimSpace(line[n:])
+		switch {
+		case strings.HasPrefix(rest, ":="), strings.HasPrefix(rest, "="):
+			s.label, s.name = line[:n], "="
+			e, err := a.compile(strings.TrimLeft(rest, ":="))
+			if err != nil {
+				return nil, err
+			}
+			s.args = []expr{e}
+			return s, nil
+		case strings.HasPrefix(rest, ":"):
+			s.label = line[:n]
+			line = strings.TrimSpace(rest[1:])
+		}
+	}
+	if line == "" {
+		return s, nil
+	}
+
+	name := line
+	operand := ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, operand = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	s.name = strings.ToUpper(name)
+	switch s.name {
+	case ".DB":
+		s.name = ".BYTE"
+	case ".DW":
+		s.name = ".WORD"
+	}
+	switch s.name {
+	case ".BYTE", ".WORD", ".ORG":
+		args := splitOutsideQuotes(operand)
+		if operand == "" || s.name == ".ORG" && len(args) != 1 {
+			return nil, fmt.Errorf("%s needs arguments", strings.ToLower(s.name))
+		}
+		for i, arg := range args {
+			arg = strings.TrimSpace(arg)
+			if s.name == ".BYTE" && len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"' {
+				if s.strings == nil {
+					s.strings = make(map[int]string)
+				}
+				s.strings[i] = arg[1 : len(arg)-1]
+				s.args = append(s.args, nil)
+				continue
+			}
+			e, err := a.compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			s.args = append(s.args, e)
+		}
+		return s, nil
+	}
+	if strings.HasPrefix(s.name, ".") {
+		return nil, fmt.Errorf("unknown directive %s", name)
+	}
+	modes, ok := asmOpcodes[s.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %s", name)
+	}
+
+	op := strings.ReplaceAll(strings.ReplaceAll(operand, " ", ""), "\t", "")
+	upper := strings.ToUpper(op)
+	var arg string
+	switch {
+	case op == "":
+		s.syntax = asmNone
+	case upper == "A":
+		s.syntax = asmAccumulator
+	case op[0] == '#':
+		s.syntax, arg = asmImmediate, op[1:]
+	case op[0] == '(' && strings.HasSuffix(upper, ",X)"):
+		s.syntax, arg = asmIndirectX, op[1:len(op)-3]
+	case op[0] == '(' && strings.HasSuffix(upper, "),Y"):
+		s.syntax, arg = asmIndirectY, op[1:len(op)-3]
+	case op[0] == '(' && op[len(op)-1] == ')' && hasMode(modes, addrIndirect):
+		s.syntax, arg = asmIndirect, op[1:len(op)-1]
+	case strings.HasSuffix(upper, ",X"):
+		s.syntax, arg = asmIndexX, op[:len(op)-2]
+	case strings.HasSuffix(upper, ",Y"):
+		s.syntax, arg = asmIndexY, op[:len(op)-2]
+	default:
+		s.syntax, arg = asmPlain, op
+	}
+	if len(arg) > 2 && arg[1] == ':' && (arg[0] == 'a' || arg[0] == 'z') {
+		s.force, arg = arg[0], arg[2:]
+	}
+	if arg == "" && s.syntax > asmAccumulator {
+		return nil, errors.New("missing operand")
+	}
+	if arg != "" {
+		e, err := a.compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		s.args = []expr{e}
+	}
+	return s, nil
+}
+
+func (a *assembler) compile(src string) (expr, error) {
+	p := &exprParser{src: src, names: func(name string) expr {
+		if name == "*" {
+			return func(*exprContext) int { return a.pc }
+		}
+		return func(*exprContext) int {
+			v, ok := a.symbols[name]
+			if !ok && a.undefined == "" {
+				a.undefined = name
+			}
+			return v
+		}
+	}}
+	return p.compile()
+}
+
+// eval evaluate an expression of a statement, an error tells of undefined
+// names
+func (a *assembler) eval(s *asmStatement, e expr) (int, error) {
+	a.pc, a.undefined = s.pc, ""
+	v := e(nil)
+	if a.undefined != "" {
+		return v, fmt.Errorf("undefined name %s", a.undefined)
+	}
+	return v, nil
+}
+
+// place define the label of a statement and find its size
+func (a *assembler) place(s *asmStatement) error {
+	if s.label != "" {
+		if _, ok := a.symbols[s.label]; ok {
+			return fmt.Errorf("%s is already defined", s.label)
+		}
+		if s.name != "=" {
+			a.symbols[s.label] = s.pc
+		}
+	}
+	switch s.name {
+	case "":
+	case "=":
+		if v, err := a.eval(s, s.args[0]); err == nil {
+			a.symbols[s.label] = v
+		}
+	case ".ORG":
+		v, err := a.eval(s, s.args[0])
+		if err != nil {
+			return errors.New(".org address must be defined before")
+		}
+		if v < s.pc || v > 0xFFFF {
+			return fmt.Errorf(".org $%04X is before $%04X", v, s.pc)
+		}
+		s.size = v - s.pc
+	case ".BYTE":
+		for i := range s.args {
+			if str, ok := s.strings[i]; ok {
+				s.size += len(str)
+			} else {
+				s.size++
+			}
+		}
+	case ".WORD":
+		s.size = 2 * len(s.args)
+	default:
+		mode, err := a.selectMode(s)
+		if err != nil {
+			return err
+		}
+		s.mode = mode
+		s.size = int(instructionSizes[mode])
+	}
+	return nil
+}
+
+// selectMode find the address mode of an instruction by its operand, zero
+// page addressing is taken for operands known to be in zero page
+func (a *assembler) selectMode(s *asmStatement) (uint8, error) {
+	modes := asmOpcodes[s.name]
+	var candidates []uint8
+	switch s.syntax {
+	case asmNone:
+		candidates = []uint8{addrImplied, addrAccumulator}
+	case asmAccumulator:
+		candidates = []uint8{addrAccumulator}
+	case asmImmediate:
+		candidates = []uint8{addrImmediate}
+	case asmIndirect:
+		candidates = []uint8{addrIndirect}
+	case asmIndirectX:
+		candidates = []uint8{addrIndexedIndirect}
+	case asmIndirectY:
+		candidates = []uint8{addrIndirectIndexed}
+	case asmPlain:
+		candidates = []uint8{addrRelative, addrZeroPage, addrAbsolute}
+	case asmIndexX:
+		candidates = []uint8{addrZeroPageX, addrAbsoluteX}
+	case asmIndexY:
+		candidates = []uint8{addrZeroPageY, addrAbsoluteY}
+	}
+
+	zeroPage := s.force == 'z'
+	if s.force == 0 && len(s.args) > 0 {
+		v, err := a.eval(s, s.args[0])
+		zeroPage = err == nil && v >= 0 && v < 0x100
+	}
+	var found []uint8
+	for _, mode := range candidates {
+		if !hasMode(modes, mode) {
+			continue
+		}
+		switch mode {
+		case addrZeroPage, addrZeroPageX, addrZeroPageY:
+			if s.force == 'a' {
+				continue
+			}
+		case addrAbsolute, addrAbsoluteX, addrAbsoluteY:
+			if s.force == 'z' {
+				continue
+			}
+		}
+		found = append(found, mode)
+	}
+	switch {
+	case len(found) == 0:
+		return 0, fmt.Errorf("%s does not take this operand", s.name)
+	case len(found) > 1 && !zeroPage:
+		return found[1], nil // absolute
+	default:
+		return found[0], nil
+	}
+}
+
+func hasMode(modes map[uint8]byte, mode uint8) bool {
+	_, ok := modes[mode]
+	return ok
+}
+
+// emit encode a statement
+func (a *assembler) emit(s *asmStatement) ([]byte, error) {
+	var out []byte
+	switch s.name {
+	case "", "=":
+	case ".ORG":
+		out = make([]byte, s.size)
+	case ".BYTE":
+		for i, e := range s.args {
+			if str, ok := s.strings[i]; ok {
+				out = append(out, str...)
+				continue
+			}
+			v, err := a.eval(s, e)
+			if err != nil {
+				return nil, err
+			}
+			if v < -0x80 || v > 0xFF {
+				return nil, fmt.Errorf("%d does not fit in a byte", v)
+			}
+			out = append(out, byte(v))
+		}
+	case ".WORD":
+		for _, e := range s.args {
+			v, err := a.eval(s, e)
+			if err != nil {
+				return nil, err
+			}
+			if v < -0x8000 || v > 0xFFFF {
+				return nil, fmt.Errorf("%d does not fit in a word", v)
+			}
+			out = append(out, byte(v), byte(v>>8))
+		}
+	default:
+		out = append(out, asmOpcodes[s.name][s.mode])
+		if len(s.args) == 0 {
+			break
+		}
+		v, err := a.eval(s, s.args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch s.mode {
+		case addrRelative:
+			offset := v - (s.pc + 2)
+			if offset > 0x7F {
+				return nil, fmt.Errorf("branch to $%04X is %d bytes too far", v, offset-0x7F)
+			}
+			if offset < -0x80 {
+				return nil, fmt.Errorf("branch to $%04X is %d bytes too far", v, -0x80-offset)
+			}
+			out = append(out, byte(offset))
+		case addrImmediate:
+			if v < -0x80 || v > 0xFF {
+				return nil, fmt.Errorf("#%d does not fit in a byte", v)
+			}
+			out = append(out, byte(v))
+		case addrZeroPage, addrZeroPageX, addrZeroPageY, addrIndexedIndirect, addrIndirectIndexed:
+			if v < 0 || v > 0xFF {
+				return nil, fmt.Errorf("$%X is not in zero page", v)
+			}
+			out = append(out, byte(v))
+		default:
+			if v < 0 || v > 0xFFFF {
+				return nil, fmt.Errorf("$%X is not an address", v)
+			}
+			out = append(out, byte(v), byte(v>>8))
+		}
+	}
+	return out, nil
+}
+
+// asmIdentifier return the length of the name a line starts with
+func asmIdentifier(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+func indexOutsideQuotes(s string, c byte) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == c && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitOutsideQuotes(s string) []string {
+	var parts []string
+	for {
+		i := indexOutsideQuotes(s, ',')
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	src := `
+count = 4
+ptr = $10
+start:  LDX #count      ; comment
+loop:   LDA table-1,X
+        STA $0200,X
+        STA a:ptr
+        LDA (ptr),Y
+        DEX
+        BNE loop
+        JMP (vector)
+        .org $C020
+table:  .byte 1, 2, "ab", <vector, >vector
+vector: .word start, *+2
+`
+	want := []byte{
+		0xA2, 0x04,
+		0xBD, 0x1F, 0xC0,
+		0x9D, 0x00, 0x02,
+		0x8D, 0x10, 0x00,
+		0xB1, 0x10,
+		0xCA,
+		0xD0, 0xF2,
+		0x6C, 0x26, 0xC0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x01, 0x02, 'a', 'b', 0x26, 0xC0,
+		0x00, 0xC0, 0x28, 0xC0,
+	}
+	got, err := Assemble(src, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n% X\nwant\n% X", got, want)
+	}
+}
+
+// TestAssembleOpcodes assemble every opcode by its mnemonic
+func TestAssembleOpcodes(t *testing.T) {
+	for op := 0; op < 256; op++ {
+		ins := instructions[op]
+		if ins.cycles == 0 && ins.id != insKIL {
+			continue
+		}
+		operand := map[uint8]string{
+			addrAbsolute:        "$3412",
+			addrAbsoluteX:       "$3412,X",
+			addrAbsoluteY:       "$3412,Y",
+			addrAccumulator:     "A",
+			addrImmediate:       "#$12",
+			addrIndexedIndirect: "($12,X)",
+			addrIndirect:        "($3412)",
+			addrIndirectIndexed: "($12),Y",
+			addrRelative:        "*+$14",
+			addrZeroPage:        "$12",
+			addrZeroPageX:       "$12,X",
+			addrZeroPageY:       "$12,Y",
+		}[ins.addrMode]
+		src := strings.TrimSpace(mnemonic(byte(op)) + " " + operand)
+		got, err := Assemble(src, 0x8000)
+		if err != nil {
+			t.Errorf("%02X %s: %v", op, src, err)
+			continue
+		}
+		want := []byte{byte(op), 0x12, 0x34}[:instructionSizes[ins.addrMode]]
+		if got[0] != byte(op) && asmOpcodes[mnemonic(byte(op))][ins.addrMode] == got[0] && unofficial(byte(op)) {
+			continue // another encoding of the same instruction
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got % X, want % X", src, got, want)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for _, test := range []struct {
+		src, err string
+	}{
+		{"LDA #$100", "line 1: #256 does not fit in a byte"},
+		{"NOP\nFOO $10", "line 2: unknown instruction FOO"},
+		{"STX $1234,X", "line 1: STX does not take this operand"},
+		{"JMP nowhere", "line 1: undefined name nowhere"},
+		{"a: NOP\na: NOP", "line 2: a is already defined"},
+		{"BNE *+200", "line 1: branch to $80C8 is 71 bytes too far"},
+		{"LDA ($1234),Y", "line 1: $1234 is not in zero page"},
+		{".org $7000", "line 1: .org $7000 is before $8000"},
+		{".fill 3", "line 1: unknown directive .fill"},
+	} {
+		_, err := Assemble(test.src, 0x8000)
+		if fmt.Sprint(err) != test.err {
+			t.Errorf("%q: got error %v, want %s", test.src, err, test.err)
+		}
+	}
+}
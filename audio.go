@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// AudioSink - receiver of audio of console, as frames of a sample of each
+// channel, interleaved, of -1 to 1. A sink of a channel gets the mix of
+// all channels, one of stemCount channels a stem of each, in the order of
+// StemPulse1. Samples are only valid during the call
+type AudioSink interface {
+	Format() (rate, channels int)
+	WriteAudio(samples []float32) error
+}
+
+// stems, channels of APU each mixed alone, and expansion audio
+const (
+	StemPulse1 = iota
+	StemPulse2
+	StemTriangle
+	StemNoise
+	StemDMC
+	StemExpansion
+	stemCount
+)
+
+// StemNames name stems, for files they are written to
+var StemNames = [stemCount]string{"pulse1", "pulse2", "triangle", "noise", "dmc", "expansion"}
+
+// band-limited steps, of a windowed sinc of blipTaps samples, at
+// blipPhases between samples
+const (
+	blipTaps   = 16
+	blipPhases = 64
+	blipCutoff = 0.9 // of half the rate
+)
+
+// samples resampled before they are filtered and written to the sink
+const audioBlock = 512
+
+// audioRecorder resample the levels of APU every CPU cycle to the rate of
+// a sink, as blip_buf does: a change of level adds a step, band-limited
+// so harmonics above half the rate do not alias, to the samples around
+// it, which are summed as they are written. They are then filtered as
+// the console's output is
+// http://wiki.nesdev.com/w/index.php/APU_Mixer
+type audioRecorder struct {
+	sink    AudioSink
+	ratio   float64 // samples per CPU cycle
+	time    float64 // of the next cycle, in samples from the start of buf
+	levels  []float32
+	sums    []float32
+	buf     [][]float32 // deltas, of each channel
+	filters [][3]audioFilter
+	out     []float32
+	frames  int64 // written
+	err     error
+}
+
+// audioFilter - first-order high-pass or low-pass filter
+type audioFilter struct {
+	highPass bool
+	a        float32
+	x, y     float32
+}
+
+var blipKernel = func() (k [blipPhases][blipTaps]float32) {
+	const half = blipTaps / 2
+	for p := range k {
+		var h [blipTaps]float64
+		var sum float64
+		for j := range h {
+			x := float64(j-half) - float64(p)/blipPhases
+			if x <= -half || x >= half {
+				continue
+			}
+			h[j] = blipCutoff * sinc(blipCutoff*x) * (0.42 + 0.5*math.Cos(math.Pi*x/half) + 0.08*math.Cos(2*math.Pi*x/half))
+			sum += h[j]
+		}
+		for j := range h {
+			k[p][j] = float32(h[j] / sum)
+		}
+	}
+	return
+}()
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// StartAudio write audio to a sink, the mix of all channels if it has a
+// channel, stems if it has stemCount. Audio already being written is
+// stopped first
+func (con *Console) StartAudio(sink AudioSink) error {
+	if con.APU == nil {
+		return errors.New("no APU")
+	}
+	rate, channels := sink.Format()
+	if rate < 8000 || rate > 192000 {
+		return errors.New("invalid audio sample rate")
+	}
+	if channels != 1 && channels != stemCount {
+		return errors.New("audio sink of neither a mix nor stems")
+	}
+	if err := con.StopAudio(); err != nil {
+		return err
+	}
+	// from the levels as they are, so starting does not click
+	levels := []float32{con.APU.Output()}
+	if channels == stemCount {
+		stems := con.APU.stems()
+		levels = stems[:]
+	}
+	r := &audioRecorder{
+		sink:    sink,
+		ratio:   float64(rate) / cpuClock,
+		levels:  levels,
+		sums:    append([]float32(nil), levels...),
+		buf:     make([][]float32, channels),
+		filters: make([][3]audioFilter, channels),
+		out:     make([]float32, 0, audioBlock*channels),
+	}
+	for i := range r.buf {
+		r.buf[i] = make([]float32, audioBlock+blipTaps)
+		r.filters[i] = [3]audioFilter{
+			newAudioFilter(true, 90, rate),
+			newAudioFilter(true, 440, rate),
+			newAudioFilter(false, 14000, rate),
+		}
+		r.filters[i][0].x = levels[i]
+	}
+	con.recorder = r
+	return nil
+}
+
+// StopAudio write samples left to the sink, and close it if it is an
+// io.Closer. The first error writing is returned
+func (con *Console) StopAudio() error {
+	r := con.recorder
+	if r == nil {
+		return nil
+	}
+	con.recorder = nil
+	r.write(int(r.time))
+	if c, ok := r.sink.(io.Closer); ok {
+		if err := c.Close(); r.err == nil {
+			r.err = err
+		}
+	}
+	return r.err
+}
+
+// AudioFrames return the number of frames written to the sink
+func (con *Console) AudioFrames() int64 {
+	if con.recorder == nil {
+		return 0
+	}
+	return con.recorder.frames
+}
+
+// cycle add levels of a CPU cycle, writing samples whenever a block is
+// complete
+func (r *audioRecorder) cycle(apu *APU) {
+	if len(r.levels) == 1 {
+		r.add(0, apu.Output())
+	} else {
+		stems := apu.stems()
+		for i, level := range stems {
+			r.add(i, level)
+		}
+	}
+	if r.time += r.ratio; r.time >= audioBlock {
+		r.write(audioBlock)
+	}
+}
+
+// add a step of the change of level of a channel, at the offset of the
+// cycle between samples
+func (r *audioRecorder) add(ch int, level float32) {
+	delta := level - r.levels[ch]
+	if delta == 0 {
+		return
+	}
+	r.levels[ch] = level
+	i := int(r.time)
+	kernel := &blipKernel[int((r.time-float64(i))*blipPhases)]
+	buf := r.buf[ch][i : i+blipTaps]
+	for j, k := range kernel {
+		buf[j] += delta * k
+	}
+}
+
+// write n samples, which no later step changes, summing deltas, through
+// the filters, then move those left to the start
+func (r *audioRecorder) write(n int) {
+	r.out = r.out[:0]
+	for i := 0; i < n; i++ {
+		for ch, buf := range r.buf {
+			r.sums[ch] += buf[i]
+			x := r.sums[ch]
+			for f := range r.filters[ch] {
+				x = r.filters[ch][f].filter(x)
+			}
+			r.out = append(r.out, x)
+		}
+	}
+	for _, buf := range r.buf {
+		copy(buf, buf[n:])
+		for i := len(buf) - n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+	}
+	r.time -= float64(n)
+	r.frames += int64(n)
+	if r.err == nil && n > 0 {
+		r.err = r.sink.WriteAudio(r.out)
+	}
+}
+
+// newAudioFilter make a filter of a cutoff frequency at a sample rate
+func newAudioFilter(highPass bool, cutoff, rate int) audioFilter {
+	rc := 1 / (2 * math.Pi * float64(cutoff))
+	dt := 1 / float64(rate)
+	if highPass {
+		return audioFilter{highPass: true, a: float32(rc / (rc + dt))}
+	}
+	return audioFilter{a: float32(dt / (rc + dt))}
+}
+
+func (f *audioFilter) filter(x float32) float32 {
+	if f.highPass {
+		f.y = f.a * (f.y + x - f.x)
+		f.x = x
+	} else {
+		f.y += f.a * (x - f.y)
+	}
+	return f.y
+}
+
+// MemorySink - sink keeping samples in memory
+type MemorySink struct {
+	Rate     int
+	Channels int
+	Samples  []float32
+}
+
+// Format return rate and channels of the sink
+func (s *MemorySink) Format() (int, int) {
+	return s.Rate, s.Channels
+}
+
+// WriteAudio append samples
+func (s *MemorySink) WriteAudio(samples []float32) error {
+	s.Samples = append(s.Samples, samples...)
+	return nil
+}
+
+// SplitSink - sink writing each channel to a sink of its own, such as
+// stems to files of their own. Sinks are of a channel and the same rate
+type SplitSink []AudioSink
+
+// Format return the rate of the first sink and a channel of each
+func (s SplitSink) Format() (int, int) {
+	rate, _ := s[0].Format()
+	return rate, len(s)
+}
+
+// WriteAudio write every channel to its sink
+func (s SplitSink) WriteAudio(samples []float32) error {
+	channel := make([]float32, len(samples)/len(s))
+	for ch, sink := range s {
+		for i := range channel {
+			channel[i] = samples[i*len(s)+ch]
+		}
+		if err := sink.WriteAudio(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close close sinks which are io.Closer
+func (s SplitSink) Close() error {
+	var err error
+	for _, sink := range s {
+		if c, ok := sink.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
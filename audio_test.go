@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newAudioConsole make a console of APU playing pulse 1 at constant volume
+// 15 and a period of 254 cycles, 440 Hz
+func newAudioConsole(t *testing.T) *Console {
+	t.Helper()
+	con := newProgramConsole(t, new(CPU), []byte{0x4C, 0x00, 0xC0}, false)
+	con.Connect(new(APU))
+	cpu := con.CPU
+	cpu.write(0x4015, 0x01)
+	cpu.write(0x4000, 0xBF)
+	cpu.write(0x4002, 0xFD)
+	cpu.write(0x4003, 0x08)
+	return con
+}
+
+func TestBlipKernel(t *testing.T) {
+	for p, kernel := range blipKernel {
+		var sum float32
+		for _, k := range kernel {
+			sum += k
+		}
+		if sum < 0.9999 || sum > 1.0001 {
+			t.Errorf("phase %d sums to %v, want 1", p, sum)
+		}
+	}
+}
+
+func TestAudioRecorder(t *testing.T) {
+	con := newAudioConsole(t)
+	sink := &MemorySink{Rate: 48000, Channels: 1}
+	if err := con.StartAudio(sink); err != nil {
+		t.Fatal(err)
+	}
+	for con.CPU.cycles < cpuClock/2 {
+		con.Step()
+	}
+	// deltas summed so far and those pending add up to the level
+	level, sum := con.APU.Output(), con.recorder.sums[0]
+	for _, delta := range con.recorder.buf[0] {
+		sum += delta
+	}
+	if sum < level-0.001 || sum > level+0.001 {
+		t.Errorf("resampled level %v, want %v", sum, level)
+	}
+	if err := con.StopAudio(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.Samples); n < 24000-blipTaps || n > 24000 {
+		t.Errorf("%d samples in half a second, want 24000", n)
+	}
+	// filtered to no DC offset, going from high to low twice a period
+	crossings, high := 0, false
+	for _, x := range sink.Samples[4800:] {
+		if x > 0.02 && !high || x < -0.02 && high {
+			high = !high
+			crossings++
+		}
+	}
+	if want := 2 * 440 * (len(sink.Samples) - 4800) / 48000; crossings < want-4 || crossings > want+4 {
+		t.Errorf("%d zero crossings, want %d of 440 Hz", crossings, want)
+	}
+	if con.AudioFrames() != 0 || con.StopAudio() != nil {
+		t.Error("audio written after it was stopped")
+	}
+
+	if err := con.StartAudio(&MemorySink{Rate: 44100, Channels: 2}); err == nil {
+		t.Error("started audio of 2 channels")
+	}
+	if err := con.StartAudio(&MemorySink{Rate: 100, Channels: 1}); err == nil {
+		t.Error("started audio at 100 Hz")
+	}
+}
+
+func TestAudioStems(t *testing.T) {
+	con := newAudioConsole(t)
+	var sinks SplitSink
+	for range StemNames {
+		sinks = append(sinks, &MemorySink{Rate: 44100, Channels: 1})
+	}
+	if err := con.StartAudio(sinks); err != nil {
+		t.Fatal(err)
+	}
+	for con.AudioFrames() < 4410 {
+		con.Step()
+	}
+	if err := con.StopAudio(); err != nil {
+		t.Fatal(err)
+	}
+	for i, sink := range sinks {
+		var peak float32
+		for _, x := range sink.(*MemorySink).Samples {
+			if x > peak {
+				peak = x
+			}
+		}
+		if playing := i == StemPulse1; (peak > 0.01) != playing {
+			t.Errorf("stem %s peak %v, want playing %v", StemNames[i], peak, playing)
+		}
+	}
+}
+
+func TestAudioSinks(t *testing.T) {
+	var buf bytes.Buffer
+	pcm := NewPCMSink(&buf, 44100, 2)
+	if err := pcm.WriteAudio([]float32{0, 0.5, -2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := []int16{0, 16383, -32767, 32767}
+	got := make([]int16, 4)
+	binary.Read(&buf, binary.LittleEndian, got)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("PCM %v, want %v", got, want)
+			break
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "out.wav")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	wav, err := NewWAVSink(file, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wav.WriteAudio([]float32{0.5, 0.5, 0.5})
+	wav.WriteAudio([]float32{0.5})
+	if err := wav.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	var h wavHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &h)
+	if h != *newWAVHeader(48000, 1, 8) || len(data) != 44+8 {
+		t.Errorf("WAV header %+v of %d bytes", h, len(data))
+	}
+
+	split := SplitSink{&MemorySink{Rate: 44100, Channels: 1}, &MemorySink{Rate: 44100, Channels: 1}}
+	split.WriteAudio([]float32{1, 2, 3, 4})
+	if l, r := split[0].(*MemorySink).Samples, split[1].(*MemorySink).Samples; len(l) != 2 || l[1] != 3 || r[1] != 4 {
+		t.Errorf("split to %v and %v", l, r)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// BusHandler - access to a range of CPU addresses by a device. A nil Read
+// reads open bus, a nil Write ignores the write, and a nil Peek tells the
+// address can not be read without side effect. Poke changes memory behind
+// an address, such as RAM or ROM, but never a register, nil if there is
+// none
+type BusHandler struct {
+	Read  func(addr uint16) byte
+	Write func(addr uint16, val byte)
+	Peek  func(addr uint16) (byte, bool)
+	Poke  func(addr uint16, val byte)
+}
+
+// Bus - CPU address space, decoded to handlers mapped by devices
+// http://wiki.nesdev.com/w/index.php/CPU_memory_map
+type Bus struct {
+	handlers []BusHandler
+	index    [0x10000]uint8 // handler of each address, 1-based, 0 for none
+}
+
+// Device - hardware connected to console, which maps its registers and
+// memory to the bus when attached
+type Device interface {
+	Attach(con *Console) error
+}
+
+// Map handle addresses lo to hi inclusive by h, in place of handlers
+// mapped before. A device taking over part of a range, such as a cheat
+// device, can get the handler it replaces with Handler
+func (b *Bus) Map(lo, hi uint16, h BusHandler) {
+	b.Unmap(lo, hi)
+	used := make([]bool, len(b.handlers))
+	for _, i := range b.index {
+		if i != 0 {
+			used[i-1] = true
+		}
+	}
+	i := 0
+	for i < len(used) && used[i] {
+		i++
+	}
+	switch {
+	case i < len(b.handlers):
+		b.handlers[i] = h // slot of a handler no longer mapped
+	case i < 0xFF:
+		b.handlers = append(b.handlers, h)
+	default:
+		panic("bus: too many handlers")
+	}
+	for addr := int(lo); addr <= int(hi); addr++ {
+		b.index[addr] = uint8(i + 1)
+	}
+}
+
+// Unmap remove handlers of addresses lo to hi inclusive
+func (b *Bus) Unmap(lo, hi uint16) {
+	for addr := int(lo); addr <= int(hi); addr++ {
+		b.index[addr] = 0
+	}
+}
+
+// Handler return the handler mapped to addr
+func (b *Bus) Handler(addr uint16) BusHandler {
+	if i := b.index[addr]; i != 0 {
+		return b.handlers[i-1]
+	}
+	return BusHandler{}
+}
+
+// Read a byte at addr
+func (b *Bus) Read(addr uint16) byte {
+	if i := b.index[addr]; i != 0 {
+		if read := b.handlers[i-1].Read; read != nil {
+			return read(addr)
+		}
+	}
+	return 0
+}
+
+// Write a byte to addr
+func (b *Bus) Write(addr uint16, val byte) {
+	if i := b.index[addr]; i != 0 {
+		if write := b.handlers[i-1].Write; write != nil {
+			write(addr, val)
+		}
+	}
+}
+
+// Peek read a byte at addr without side effect, false if it can not be
+func (b *Bus) Peek(addr uint16) (byte, bool) {
+	if i := b.index[addr]; i != 0 {
+		if peek := b.handlers[i-1].Peek; peek != nil {
+			return peek(addr)
+		}
+	}
+	return 0, false
+}
+
+// Poke change memory at addr without side effect, if there is memory
+func (b *Bus) Poke(addr uint16, val byte) {
+	if i := b.index[addr]; i != 0 {
+		if poke := b.handlers[i-1].Poke; poke != nil {
+			poke(addr, val)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+// debugPort collects bytes written to $401F, as a test ROM would print
+type debugPort struct {
+	out []byte
+}
+
+func (p *debugPort) Attach(con *Console) error {
+	con.Bus.Map(0x401F, 0x401F, BusHandler{
+		Write: func(_ uint16, val byte) { p.out = append(p.out, val) },
+	})
+	return nil
+}
+
+func TestBusDevice(t *testing.T) {
+	code, err := Assemble(`
+        LDX #0
+print:  LDA msg,X
+        BEQ done
+        STA $401F
+        INX
+        BNE print
+done:   JMP done
+msg:    .byte "hi", 0
+`, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, false)
+	port := new(debugPort)
+	if err := con.Connect(port); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		con.CPU.Step()
+	}
+	if string(port.out) != "hi" {
+		t.Errorf("port got %q, want %q", port.out, "hi")
+	}
+
+	// replace a byte of PRG, passing other addresses to the cartridge
+	cart := con.Bus.Handler(0xC000)
+	con.Bus.Map(0x8000, 0xFFFF, BusHandler{
+		Read: func(addr uint16) byte {
+			if addr == 0xC001 {
+				return 0x42
+			}
+			return cart.Read(addr)
+		},
+	})
+	if v := con.Bus.Read(0xC001); v != 0x42 {
+		t.Errorf("$C001 = %02X, want 42", v)
+	}
+	if v := con.Bus.Read(0xC000); v != code[0] {
+		t.Errorf("$C000 = %02X, want %02X", v, code[0])
+	}
+	if _, ok := con.Bus.Peek(0xC000); ok {
+		t.Error("$C000 can be peeked without a peek handler")
+	}
+	if v, ok := con.Bus.Peek(0x0800); !ok || v != con.CPU.ram[0] {
+		t.Errorf("$0800 peeked %02X %v, want %02X of RAM", v, ok, con.CPU.ram[0])
+	}
+	con.Bus.Unmap(0x8000, 0xFFFF)
+	if v := con.Bus.Read(0xC000); v != 0 {
+		t.Errorf("unmapped $C000 = %02X, want 0", v)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// flags of PRG bytes in a code/data log
+const (
+	cdlCode         = 0x01
+	cdlData         = 0x02
+	cdlBankMask     = 0x0C // 8 KiB window of $8000-$FFFF last mapped at
+	cdlIndirectCode = 0x10
+	cdlIndirectData = 0x20
+	cdlPCM          = 0x40
+)
+
+// flags of CHR bytes in a code/data log
+const (
+	cdlRendered = 0x01
+	cdlRead     = 0x02 // through $2007
+)
+
+// CodeDataLogger - record how each byte of PRG and CHR ROM is used, in
+// format of FCEUX .cdl files, PRG flags followed by CHR flags
+// http://fceux.com/web/help/CodeDataLogger.html
+type CodeDataLogger struct {
+	PRG []byte
+	CHR []byte
+
+	pc, size     uint16 // instruction being executed
+	indirect     bool   // instruction reads data by a pointer
+	jumpIndirect bool   // next instruction is reached by JMP ($nnnn)
+}
+
+// NewCodeDataLogger create an empty log of a cartridge, CHR RAM is not
+// logged
+func NewCodeDataLogger(cart *Cartridge) *CodeDataLogger {
+	l := &CodeDataLogger{PRG: make([]byte, len(cart.PRG))}
+	if !cart.ChrRAM {
+		l.CHR = make([]byte, len(cart.Chr))
+	}
+	return l
+}
+
+// ReadCDL read a .cdl file of a cartridge
+func ReadCDL(r io.Reader, cart *Cartridge) (*CodeDataLogger, error) {
+	l := NewCodeDataLogger(cart)
+	if _, err := io.ReadFull(r, l.PRG); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, l.CHR); err != nil {
+		return nil, err
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("code/data log larger than ROM")
+	}
+	return l, nil
+}
+
+// Write write the log as a .cdl file
+func (l *CodeDataLogger) Write(w io.Writer) error {
+	if _, err := w.Write(l.PRG); err != nil {
+		return err
+	}
+	_, err := w.Write(l.CHR)
+	return err
+}
+
+// Reset clear the log
+func (l *CodeDataLogger) Reset() {
+	for i := range l.PRG {
+		l.PRG[i] = 0
+	}
+	for i := range l.CHR {
+		l.CHR[i] = 0
+	}
+}
+
+// SetCodeDataLogger log PRG and CHR use to l, nil to stop
+func (con *Console) SetCodeDataLogger(l *CodeDataLogger) {
+	con.cdl = l
+}
+
+func (l *CodeDataLogger) logPRG(con *Console, addr uint16, flags byte) {
+	m, ok := con.Mapper.(prgMapper)
+	if !ok || addr < 0x8000 {
+		return
+	}
+	if off := m.prgOffset(addr); off >= 0 && off < len(l.PRG) {
+		l.PRG[off] = l.PRG[off]&^cdlBankMask | flags | byte(addr>>13&3)<<2
+	}
+}
+
+// logCode record the instruction at pc before it is executed
+func (l *CodeDataLogger) logCode(con *Console, pc uint16, ins instruction) {
+	flags := byte(cdlCode)
+	if l.jumpIndirect {
+		flags |= cdlIndirectCode
+	}
+	l.pc, l.size = pc, uint16(instructionSizes[ins.addrMode])
+	for i := uint16(0); i < l.size; i++ {
+		l.logPRG(con, pc+i, flags)
+	}
+	l.jumpIndirect = ins.id == insJMP && ins.addrMode == addrIndirect
+	l.indirect = ins.addrMode == addrIndexedIndirect || ins.addrMode == addrIndirectIndexed
+}
+
+func (l *CodeDataLogger) logData(con *Console, addr uint16) {
+	if addr-l.pc < l.size {
+		return // immediate operand
+	}
+	if l.indirect {
+		l.logPRG(con, addr, cdlData|cdlIndirectData)
+	} else {
+		l.logPRG(con, addr, cdlData)
+	}
+}
+
+// logPCM record a DPCM sample byte fetched by the DMC
+func (l *CodeDataLogger) logPCM(con *Console, addr uint16) {
+	l.logPRG(con, addr, cdlData|cdlPCM)
+}
+
+func (l *CodeDataLogger) logCHR(con *Console, addr uint16, flags byte) {
+	m, ok := con.Mapper.(chrMapper)
+	if !ok {
+		return
+	}
+	if off := m.chrOffset(addr); off >= 0 && off < len(l.CHR) {
+		l.CHR[off] |= flags
+	}
+}
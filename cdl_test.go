@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// cdlProgram reads CHR through PPUDATA, PRG directly and by pointer, then
+// jumps indirectly to a loop with background rendering enabled
+const cdlProgram = `
+        LDA #0
+        STA $2006
+        STA $2006
+        LDA $2007
+        LDA #<table
+        STA $00
+        LDA #>table
+        STA $01
+        LDY #1
+        LDA ($00),Y
+        LDA table
+        LDA #$08
+        STA $2001
+        JMP (vector)
+vector: .word target
+table:  .byte 1, 2
+target: JMP target
+`
+
+// offsets in PRG of cdlProgram
+const (
+	cdlImmediate = 0x0C // operand of LDA #<table
+	cdlVector    = 0x22
+	cdlTable     = 0x24
+	cdlTarget    = 0x26
+)
+
+func TestCodeDataLogger(t *testing.T) {
+	code, err := Assemble(cdlProgram, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, true)
+	con.Cartridge.ChrRAM = false
+	l := NewCodeDataLogger(con.Cartridge)
+	con.SetCodeDataLogger(l)
+	con.StepFrame()
+	con.StepFrame()
+
+	window := byte(2 << 2) // $C000-$DFFF
+	for _, tt := range []struct {
+		name  string
+		off   int
+		flags byte
+	}{
+		{"opcode", 0, cdlCode | window},
+		{"immediate operand", cdlImmediate, cdlCode | window},
+		{"table read by pointer", cdlTable + 1, cdlData | cdlIndirectData | window},
+		{"table read directly", cdlTable, cdlData | window},
+		{"indirect jump target", cdlTarget, cdlCode | cdlIndirectCode | window},
+		{"vector", cdlVector, cdlData | window},
+		{"unreached", cdlTarget + 3, 0},
+	} {
+		if f := l.PRG[tt.off]; f != tt.flags {
+			t.Errorf("%s: PRG flags %02X, want %02X", tt.name, f, tt.flags)
+		}
+	}
+	if f := l.CHR[0]; f != cdlRead|cdlRendered {
+		t.Errorf("CHR flags %02X, want read and rendered", f)
+	}
+	if f := l.CHR[0x1000]; f != 0 {
+		t.Errorf("CHR flags %02X of the unused pattern table, want 0", f)
+	}
+
+	var buf bytes.Buffer
+	if err := l.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(con.Cartridge.PRG)+len(con.Cartridge.Chr) {
+		t.Errorf(".cdl of %d bytes, want PRG and CHR", buf.Len())
+	}
+	read, err := ReadCDL(bytes.NewReader(buf.Bytes()), con.Cartridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.PRG, l.PRG) || !bytes.Equal(read.CHR, l.CHR) {
+		t.Error(".cdl read differs from the log written")
+	}
+	if _, err := ReadCDL(bytes.NewReader(buf.Bytes()[1:]), con.Cartridge); err == nil {
+		t.Error("read .cdl smaller than ROM")
+	}
+	if _, err := ReadCDL(bytes.NewReader(append(buf.Bytes(), 0)), con.Cartridge); err == nil {
+		t.Error("read .cdl larger than ROM")
+	}
+
+	l.Reset()
+	if l.PRG[0] != 0 || l.CHR[0] != 0 {
+		t.Error("log not cleared by Reset")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Cheat - a code changing memory, either by substituting what CPU reads
+// from ROM, or by writing RAM at the start of every frame. Only Enabled
+// can be changed once the cheat is added to console
+type Cheat struct {
+	Name       string
+	Addr       uint16
+	Value      byte
+	Compare    int  // byte ROM must read to be substituted, -1 for any
+	Substitute bool // reads are substituted, otherwise RAM is written
+	Enabled    bool
+}
+
+// cheatList - cheats of console, with addresses of substitutions in a bit
+// set so reads of other addresses are not slowed down
+type cheatList struct {
+	cheats []*Cheat
+	subs   [0x10000 / 64]uint64
+}
+
+// letters of Game Genie codes, by the nibble they encode
+const gameGenieLetters = "APZLGITYEOXUKSVN"
+
+// ParseCheat decode a cheat code: a Game Genie code of 6 or 8 letters, a
+// Pro Action Replay or raw code AAAA:VV, or AAAA?CC:VV which substitutes
+// only when CC is read. AAAA:VV writes RAM every frame if AAAA is below
+// $8000, and substitutes reads of ROM otherwise
+// http://wiki.nesdev.com/w/index.php/Game_Genie
+func ParseCheat(code string) (*Cheat, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if c, ok := parseGameGenie(code); ok {
+		return c, nil
+	}
+	c := &Cheat{Compare: -1, Enabled: true}
+	addr, val := code, ""
+	if i := strings.IndexByte(code, ':'); i >= 0 {
+		addr, val = code[:i], code[i+1:]
+	}
+	if i := strings.IndexByte(addr, '?'); i >= 0 {
+		cmp, err := strconv.ParseUint(addr[i+1:], 16, 8)
+		if err != nil || i+1 == len(addr) {
+			return nil, fmt.Errorf("invalid cheat code %q", code)
+		}
+		addr, c.Compare = addr[:i], int(cmp)
+	}
+	a, err1 := strconv.ParseUint(addr, 16, 16)
+	v, err2 := strconv.ParseUint(val, 16, 8)
+	if err1 != nil || err2 != nil || len(addr) != 4 {
+		return nil, fmt.Errorf("invalid cheat code %q", code)
+	}
+	c.Addr, c.Value = uint16(a), byte(v)
+	c.Substitute = c.Addr >= 0x8000 || c.Compare >= 0
+	return c, nil
+}
+
+func parseGameGenie(code string) (*Cheat, bool) {
+	if len(code) != 6 && len(code) != 8 {
+		return nil, false
+	}
+	var n [8]uint16
+	for i := 0; i < len(code); i++ {
+		d := strings.IndexByte(gameGenieLetters, code[i])
+		if d < 0 {
+			return nil, false
+		}
+		n[i] = uint16(d)
+	}
+	c := &Cheat{Compare: -1, Substitute: true, Enabled: true}
+	c.Addr = 0x8000 + (n[3]&7<<12 | n[5]&7<<8 | n[4]&8<<8 |
+		n[2]&7<<4 | n[1]&8<<4 | n[4]&7 | n[3]&8)
+	value := n[1]&7<<4 | n[0]&8<<4 | n[0]&7
+	if len(code) == 6 {
+		value |= n[5] & 8
+	} else {
+		value |= n[7] & 8
+		c.Compare = int(n[7]&7<<4 | n[6]&8<<4 | n[6]&7 | n[5]&8)
+	}
+	c.Value = byte(value)
+	return c, true
+}
+
+// AddCheat apply a cheat to console
+func (con *Console) AddCheat(c *Cheat) {
+	if con.cheats == nil {
+		con.cheats = new(cheatList)
+	}
+	con.cheats.cheats = append(con.cheats.cheats, c)
+	con.cheats.index()
+}
+
+// RemoveCheat stop applying a cheat, memory written by it is kept
+func (con *Console) RemoveCheat(c *Cheat) {
+	if con.cheats == nil {
+		return
+	}
+	cheats := con.cheats.cheats[:0]
+	for _, other := range con.cheats.cheats {
+		if other != c {
+			cheats = append(cheats, other)
+		}
+	}
+	if len(cheats) == 0 {
+		con.cheats = nil
+		return
+	}
+	con.cheats.cheats = cheats
+	con.cheats.index()
+}
+
+// Cheats return cheats added to console
+func (con *Console) Cheats() []*Cheat {
+	if con.cheats == nil {
+		return nil
+	}
+	return append([]*Cheat(nil), con.cheats.cheats...)
+}
+
+func (l *cheatList) index() {
+	l.subs = [len(l.subs)]uint64{}
+	for _, c := range l.cheats {
+		if c.Substitute {
+			l.subs[c.Addr/64] |= 1 << (c.Addr % 64)
+		}
+	}
+}
+
+// substitute return what CPU reads at addr instead of data
+func (l *cheatList) substitute(addr uint16, data byte) byte {
+	if l.subs[addr/64]&(1<<(addr%64)) == 0 {
+		return data
+	}
+	read := data
+	for _, c := range l.cheats {
+		if c.Enabled && c.Substitute && c.Addr == addr && (c.Compare < 0 || c.Compare == int(read)) {
+			data = c.Value
+		}
+	}
+	return data
+}
+
+// apply write RAM cheats, at the start of a frame
+func (l *cheatList) apply(con *Console) {
+	for _, c := range l.cheats {
+		if c.Enabled && !c.Substitute {
+			con.Poke(c.Addr, c.Value)
+		}
+	}
+}
+
+// LoadCheats read a cheat file, of FCEUX or libretro format
+func LoadCheats(path string) ([]*Cheat, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key := strings.TrimSpace(strings.SplitN(line, "=", 2)[0]); key == "cheats" {
+			return ReadLibretroCheats(bytes.NewReader(data))
+		}
+	}
+	return ReadFCEUXCheats(bytes.NewReader(data))
+}
+
+// ReadFCEUXCheats read a .cht file of FCEUX, each line is
+// [S][C][:]AAAA:VV[:CC]:NAME, S for substitution, C if there is a compare
+// value, and a colon before address if the cheat is disabled
+// http://fceux.com/web/help/CheatSearch.html
+func ReadFCEUXCheats(r io.Reader) ([]*Cheat, error) {
+	var cheats []*Cheat
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		c := &Cheat{Compare: -1, Enabled: true}
+		compare := false
+		if strings.HasPrefix(line, "S") {
+			c.Substitute, line = true, line[1:]
+		}
+		if strings.HasPrefix(line, "C") {
+			compare, line = true, line[1:]
+		}
+		if strings.HasPrefix(line, ":") {
+			c.Enabled, line = false, line[1:]
+		}
+		fields := 3
+		if compare {
+			fields = 4
+		}
+		f := strings.SplitN(line, ":", fields)
+		if len(f) < fields {
+			return nil, fmt.Errorf("line %d: invalid cheat", n)
+		}
+		addr, err1 := strconv.ParseUint(f[0], 16, 16)
+		val, err2 := strconv.ParseUint(f[1], 16, 8)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("line %d: invalid cheat", n)
+		}
+		c.Addr, c.Value, c.Name = uint16(addr), byte(val), f[fields-1]
+		if compare {
+			cmp, err := strconv.ParseUint(f[2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid cheat", n)
+			}
+			c.Compare = int(cmp)
+		}
+		cheats = append(cheats, c)
+	}
+	return cheats, s.Err()
+}
+
+// ReadLibretroCheats read a .cht file of libretro, whose codes may be of
+// several cheats joined by +
+// https://docs.libretro.com/guides/cheat-codes/
+func ReadLibretroCheats(r io.Reader) ([]*Cheat, error) {
+	values := map[string]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(values["cheats"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid count of cheats %q", values["cheats"])
+	}
+	var cheats []*Cheat
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("cheat%d_", i)
+		enabled := values[key+"enable"] == "true"
+		for _, code := range strings.Split(values[key+"code"], "+") {
+			c, err := ParseCheat(code)
+			if err != nil {
+				return nil, fmt.Errorf("cheat %d: %v", i, err)
+			}
+			c.Name, c.Enabled = values[key+"desc"], enabled
+			cheats = append(cheats, c)
+		}
+	}
+	return cheats, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCheat(t *testing.T) {
+	tests := []struct {
+		code       string
+		addr       uint16
+		value      byte
+		compare    int
+		substitute bool
+	}{
+		{"SXIOPO", 0x91D9, 0xAD, -1, true}, // Super Mario Bros. infinite lives
+		{"sxiopo", 0x91D9, 0xAD, -1, true},
+		{"AAEAULPA", 0x8B03, 0x00, 0x01, true},
+		{"075A:09", 0x075A, 0x09, -1, false},
+		{"C010:EA", 0xC010, 0xEA, -1, true},
+		{"6000?12:34", 0x6000, 0x34, 0x12, true},
+	}
+	for _, tt := range tests {
+		c, err := ParseCheat(tt.code)
+		if err != nil {
+			t.Errorf("%s: %v", tt.code, err)
+			continue
+		}
+		if c.Addr != tt.addr || c.Value != tt.value || c.Compare != tt.compare || c.Substitute != tt.substitute {
+			t.Errorf("%s = %04X:%02X compare %d substitute %v, want %04X:%02X compare %d substitute %v",
+				tt.code, c.Addr, c.Value, c.Compare, c.Substitute, tt.addr, tt.value, tt.compare, tt.substitute)
+		}
+	}
+	for _, code := range []string{"SXIOP", "075A", "75A:09", "075A:100", "075A?:09", "QQQQQQ"} {
+		if _, err := ParseCheat(code); err == nil {
+			t.Errorf("%s: no error", code)
+		}
+	}
+}
+
+func TestCheats(t *testing.T) {
+	code, err := Assemble(`
+loop:   LDA data
+        STA $10
+        JMP loop
+data:   .byte $01
+`, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, false)
+	sub, _ := ParseCheat("C008?01:07")
+	ram, _ := ParseCheat("0012:80")
+	con.AddCheat(sub)
+	con.AddCheat(ram)
+	con.StepFrame()
+	if con.RAM()[0x10] != 0x07 || con.Peek(0xC008) != 0x01 {
+		t.Errorf("$10 = %02X, ROM $C008 = %02X, want 07 read from unchanged 01", con.RAM()[0x10], con.Peek(0xC008))
+	}
+	con.RAM()[0x12] = 0
+	con.StepFrame()
+	if v := con.RAM()[0x12]; v != 0x80 {
+		t.Errorf("$12 = %02X, want 80 written every frame", v)
+	}
+
+	sub.Enabled = false
+	con.StepFrame()
+	if con.RAM()[0x10] != 0x01 {
+		t.Errorf("$10 = %02X with cheat disabled, want 01", con.RAM()[0x10])
+	}
+	con.RemoveCheat(sub)
+	con.RemoveCheat(ram)
+	if con.Cheats() != nil || con.cheats != nil {
+		t.Errorf("cheats left after removing all: %v", con.Cheats())
+	}
+}
+
+func TestReadCheatFiles(t *testing.T) {
+	cheats, err := ReadFCEUXCheats(strings.NewReader(
+		"075a:09:Lives\nSC:c010:ea:a9:Skip: check\n\nS91d9:ad:Infinite\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Cheat{
+		{"Lives", 0x075A, 0x09, -1, false, true},
+		{"Skip: check", 0xC010, 0xEA, 0xA9, true, false},
+		{"Infinite", 0x91D9, 0xAD, -1, true, true},
+	}
+	if len(cheats) != len(want) {
+		t.Fatalf("%d FCEUX cheats, want %d", len(cheats), len(want))
+	}
+	for i, c := range cheats {
+		if *c != want[i] {
+			t.Errorf("FCEUX cheat %d = %+v, want %+v", i, *c, want[i])
+		}
+	}
+
+	cheats, err = ReadLibretroCheats(strings.NewReader(`cheats = 2
+
+cheat0_desc = "Infinite Lives"
+cheat0_code = "SXIOPO"
+cheat0_enable = true
+
+cheat1_desc = "Start on World 8"
+cheat1_code = "075F:07+0760:03"
+cheat1_enable = false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cheats) != 3 || cheats[0].Name != "Infinite Lives" || !cheats[0].Enabled ||
+		cheats[2].Addr != 0x0760 || cheats[2].Name != "Start on World 8" || cheats[2].Enabled {
+		t.Errorf("libretro cheats not read as expected: %+v", cheats)
+	}
+}
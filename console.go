@@ -1,34 +1,163 @@
 package main
 
-import (
-	"errors"
-)
+// NTSC frame is 341*262 PPU cycles, each CPU cycle is 3 PPU cycles
+const cyclesPerFrame = 341 * 262 / 3
+
+// CPU clock of NTSC in Hz
+const cpuClock = 1789773
 
 // Console of NES
 type Console struct {
-	CPU       *CPU
-	Cartridge *Cartridge
-	Mapper    Mapper
+	CPU         *CPU
+	PPU         *PPU
+	APU         *APU
+	Cartridge   *Cartridge
+	Mapper      Mapper
+	Controllers [2]Controller
+	Bus         Bus
+
+	frame    uint64
+	frameEnd uint64 // CPU cycle the current frame ends at
+	rewind   *rewindBuffer
+	movie    *moviePlayer
+	cdl      *CodeDataLogger
+	cheats   *cheatList
+	recorder *audioRecorder
+	fetcher  fetchMapper // mapper if it watches pattern fetches
+
+	// mapper if it maps nametables, renders, has expansion audio, or is
+	// clocked by CPU
+	nameTables nameTableMapper
+	renderer   renderMapper
+	audio      audioMapper
+	clocked    cycleMapper
+
+	mirroring byte // of nametables, by cartridge then changed by mapper
 }
 
 // Connect a device to console
-func (con *Console) Connect(device interface{}) error {
-	switch device.(type) {
-	case *CPU:
-		cpu := device.(*CPU)
-		cpu.console = con
-		cpu.Reset()
-	case *Cartridge:
-		cart := device.(*Cartridge)
-		mapper, err := GetMapper(int(cart.Mapper))
-		if err != nil {
-			return err
+func (con *Console) Connect(device Device) error {
+	return device.Attach(con)
+}
+
+// Reset power cycle the console, CPU RAM is cleared so runs are reproducible.
+// The frame count keeps going, so it can still be used to order states.
+func (con *Console) Reset() {
+	cpu := con.CPU
+	cpu.ram = [2048]byte{}
+	con.Controllers = [2]Controller{}
+	if con.APU != nil {
+		con.APU.Reset()
+	}
+	cpu.Reset()
+	if con.PPU != nil {
+		con.PPU.Reset()
+	}
+	if con.Mapper != nil {
+		con.mirroring = con.Cartridge.Mirroring
+		con.Mapper.Init(con)
+		cpu.PC = cpu.read16(0xFFFC)
+	}
+	cpu.cycles = 7
+	con.frameEnd = cyclesPerFrame
+}
+
+// SoftReset act as the reset button
+// http://wiki.nesdev.com/w/index.php/CPU_power_up_state#After_reset
+func (con *Console) SoftReset() {
+	cpu := con.CPU
+	cpu.S -= 3
+	cpu.I, cpu.irqMask = 1, 1
+	cpu.halted = false
+	cpu.waiting = false
+	if cpu.Variant == CPU65C02 {
+		cpu.D = 0
+	}
+	cpu.PC = cpu.read16(0xFFFC)
+	cpu.cycles += 7
+}
+
+// Frame return count of frames the console has run
+func (con *Console) Frame() uint64 {
+	return con.frame
+}
+
+// Step execute an instruction and run PPU, APU and the mapper for the same
+// time, the number of CPU cycles taken is returned
+func (con *Console) Step() int {
+	cycles := con.CPU.Step()
+	if con.PPU != nil {
+		for i := 0; i < cycles*3; i++ {
+			con.PPU.step()
+		}
+	}
+	if con.clocked != nil {
+		for i := 0; i < cycles; i++ {
+			con.clocked.cpuCycle()
 		}
-		con.Cartridge = cart
-		con.Mapper = mapper
-		mapper.Init(con)
-	default:
-		return errors.New("unknown device")
 	}
-	return nil
+	if con.APU != nil {
+		for i := 0; i < cycles; i++ {
+			con.APU.step()
+			if con.recorder != nil {
+				con.recorder.cycle(con.APU)
+			}
+		}
+	}
+	return cycles
+}
+
+// StepFrame run the console until the end of current frame. Frames are
+// counted by PPU, or by CPU cycles if there is no PPU.
+func (con *Console) StepFrame() {
+	if con.movie != nil {
+		con.movie.before(con)
+	}
+	if con.rewind != nil {
+		con.rewind.recordInput(con)
+	}
+	if con.cheats != nil {
+		con.cheats.apply(con)
+	}
+	if ppu := con.PPU; ppu != nil {
+		for frame := ppu.Frame; ppu.Frame == frame; {
+			con.Step()
+		}
+	} else {
+		for con.CPU.cycles < con.frameEnd {
+			con.Step()
+		}
+	}
+	con.frame++
+	con.frameEnd += cyclesPerFrame
+	if con.movie != nil {
+		con.movie.after(con)
+	}
+	if con.rewind != nil {
+		con.rewind.capture(con)
+	}
+}
+
+// prgBank return the 16 KiB PRG ROM bank a CPU address is mapped to,
+// -1 if it is not mapped to PRG ROM
+func (con *Console) prgBank(addr uint16) int {
+	m, ok := con.Mapper.(prgMapper)
+	if !ok {
+		return -1
+	}
+	offset := m.prgOffset(addr)
+	if offset < 0 {
+		return -1
+	}
+	return offset / 0x4000
+}
+
+// ppuPosition return the scanline and dot PPU is at, derived from CPU
+// cycles if there is no PPU
+func (con *Console) ppuPosition() (scanline, dot int) {
+	if con.PPU != nil {
+		return int(con.PPU.ScanLine), int(con.PPU.Cycle)
+	}
+	dots := int(con.CPU.cycles-(con.frameEnd-cyclesPerFrame)) * 3
+	return dots / 341 % 262, dots % 341
 }
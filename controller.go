@@ -0,0 +1,65 @@
+package main
+
+// buttons of standard controller, in the order they are reported
+const (
+	ButtonA = iota
+	ButtonB
+	ButtonSelect
+	ButtonStart
+	ButtonUp
+	ButtonDown
+	ButtonLeft
+	ButtonRight
+)
+
+// Controller - standard NES controller
+// http://wiki.nesdev.com/w/index.php/Standard_controller
+type Controller struct {
+	buttons byte
+	index   byte
+	strobe  byte
+}
+
+// SetButton press or release a button
+func (c *Controller) SetButton(button int, pressed bool) {
+	if pressed {
+		c.buttons |= 1 << uint(button)
+	} else {
+		c.buttons &^= 1 << uint(button)
+	}
+}
+
+// SetButtons set state of all buttons, bit n is button n
+func (c *Controller) SetButtons(buttons byte) {
+	c.buttons = buttons
+}
+
+// Buttons return state of all buttons, bit n is button n
+func (c *Controller) Buttons() byte {
+	return c.buttons
+}
+
+func (c *Controller) read() byte {
+	data := c.peek()
+	if c.strobe&1 == 1 {
+		c.index = 0
+	} else if c.index < 8 {
+		c.index++
+	}
+	return data
+}
+
+// peek return the bit the next read reports
+func (c *Controller) peek() byte {
+	if c.index < 8 {
+		return c.buttons >> c.index & 1
+	}
+	return 1 // official controllers report 1 after 8 reads
+}
+
+func (c *Controller) write(val byte) {
+	c.strobe = val
+	if c.strobe&1 == 1 {
+		c.index = 0
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
-import (
-	"fmt"
-	"os"
+import "fmt"
+
+// variants of 6502
+const (
+	CPU2A03  = iota // NES CPU, NMOS 6502 without decimal mode
+	CPUNMOS         // NMOS 6502 with decimal mode
+	CPU65C02        // CMOS 65C02 with Rockwell and WDC instructions
 )
 
 // CPU - MOS6502
@@ -10,8 +14,18 @@ import (
 type CPU struct {
 	cpuRegister
 	cpuFlag
-	console *Console
-	cycles  uint64
+	Variant  int // CPU2A03 by default
+	console  *Console
+	cycles   uint64
+	halted   bool // jammed by KIL or STP until reset
+	waiting  bool // stopped by WAI until an interrupt
+	opcode   byte // of the instruction being executed
+	nmi      bool // NMI is pending
+	irq      byte // IRQ line, a bit for each source holding it low
+	irqMask  byte // I as IRQ is polled, CLI, SEI and PLP change it an instruction late
+	stall    int  // cycles CPU is suspended for, by DMC DMA
+	tracer   *Tracer
+	debugger *Debugger
 
 	// sample CPU RAM allocation
 	// see http://wiki.nesdev.com/w/index.php/Sample_RAM_map
@@ -29,224 +43,367 @@ type cpuFlag struct {
 	C, Z, I, D, N, V byte
 }
 
-type stepInfo struct {
-	opcode byte
-	ins    instruction
-	addr   uint16
-	PC     uint16
-	opnums []byte
+// Attach CPU to console, mapping its RAM and the controller ports
+func (cpu *CPU) Attach(con *Console) error {
+	con.CPU = cpu
+	cpu.console = con
+	con.Bus.Map(0x0000, 0x1FFF, BusHandler{
+		Read:  func(addr uint16) byte { return cpu.ram[addr&0x07FF] },
+		Write: func(addr uint16, val byte) { cpu.ram[addr&0x07FF] = val },
+		Peek:  func(addr uint16) (byte, bool) { return cpu.ram[addr&0x07FF], true },
+		Poke:  func(addr uint16, val byte) { cpu.ram[addr&0x07FF] = val },
+	})
+	con.Bus.Map(0x4016, 0x4017, BusHandler{
+		Read: func(addr uint16) byte { return con.Controllers[addr-0x4016].read() },
+		Peek: func(addr uint16) (byte, bool) { return con.Controllers[addr-0x4016].peek(), true },
+		Write: func(addr uint16, val byte) {
+			switch {
+			case addr == 0x4016:
+				con.Controllers[0].write(val)
+				con.Controllers[1].write(val)
+			case con.APU != nil:
+				con.APU.writeFrameCounter(val)
+			}
+		},
+	})
+	cpu.Reset()
+	con.frameEnd = cpu.cycles + cyclesPerFrame
+	return nil
+}
+
+// sources of IRQ
+const (
+	irqFrame  = 1 << iota // APU frame counter
+	irqDMC                // APU DMC sample end
+	irqMapper             // cartridge
+)
+
+// Step execute an instruction, the number of CPU cycles taken is returned
+func (cpu *CPU) Step() int {
+	cycles := cpu.cycles
+	cpu.step()
+	return int(cpu.cycles - cycles)
 }
 
-func (cpu *CPU) step() stepInfo {
-	opcode := cpu.read(cpu.PC)
-	ins := instructions[opcode]
-	size := instructionSizes[ins.addrMode]
+func (cpu *CPU) step() {
+	if cpu.stall > 0 {
+		cpu.cycles += uint64(cpu.stall)
+		cpu.stall = 0
+		return
+	}
+	if cpu.halted {
+		cpu.cycles++
+		return
+	}
+	if cpu.nmi {
+		cpu.nmi = false
+		cpu.waiting = false
+		cpu.interrupt(0xFFFA)
+		return
+	}
+	if cpu.irq != 0 && cpu.irqMask == 0 {
+		cpu.waiting = false
+		cpu.interrupt(0xFFFE)
+		return
+	}
+	if cpu.waiting && cpu.irq == 0 {
+		cpu.cycles++
+		return
+	}
+	cpu.waiting = false
+	if cpu.debugger != nil {
+		cpu.debugger.step(cpu)
+	}
+	if cpu.tracer != nil {
+		cpu.tracer.trace(cpu)
+	}
 
-	var opnums []byte
-	var addr uint16
-	if size > 1 {
-		opnums = make([]byte, size-1)
-		for i := 0; i < int(size-1); i++ {
-			opnums[i] = cpu.read(cpu.PC + 1 + uint16(i))
-			addr |= uint16(opnums[i]) << uint16(i*8)
-		}
+	pc := cpu.PC
+	opcode := cpu.fetch(pc)
+	cpu.opcode = opcode
+	ins := cpu.table()[opcode]
+	size := instructionSizes[ins.addrMode]
+	var arg uint16
+	switch size {
+	case 2:
+		arg = uint16(cpu.fetch(pc + 1))
+	case 3:
+		arg = uint16(cpu.fetch(pc+1)) | uint16(cpu.fetch(pc+2))<<8
+	}
+	if cpu.console.cdl != nil {
+		cpu.console.cdl.logCode(cpu.console, pc, ins)
 	}
-	info := stepInfo{opcode, ins, addr, cpu.PC, opnums}
 
 	cpu.PC += uint16(size)
 	cpu.cycles += uint64(ins.cycles)
+	op := cpuOps[ins.id]
+	if op == nil {
+		if cpu.tracer != nil {
+			cpu.tracer.Dump()
+		}
+		panic(fmt.Sprintf("unknown opcode: %02X at %04X", opcode, pc))
+	}
+	i := cpu.I
+	op(cpu, cpu.address(ins, arg), ins.addrMode)
+	// http://wiki.nesdev.com/w/index.php/CPU_interrupts#Delayed_IRQ_response_after_CLI.2C_SEI.2C_and_PLP
+	cpu.irqMask = cpu.I
+	switch ins.id {
+	case insCLI, insSEI, insPLP:
+		cpu.irqMask = i
+	}
+}
+
+// table return the opcodes of CPU variant
+func (cpu *CPU) table() *[256]instruction {
+	if cpu.Variant == CPU65C02 {
+		return &instructions65C02
+	}
+	return &instructions
+}
+
+// opcodeBit return the bit of memory tested or changed by BBR, BBS, RMB
+// and SMB, numbered in their opcode
+func (cpu *CPU) opcodeBit() byte {
+	return 1 << (cpu.opcode >> 4 & 7)
+}
 
+// address resolve the operand address of an instruction, adding a cycle
+// for page crossing where the instruction takes it
+func (cpu *CPU) address(ins instruction, arg uint16) uint16 {
 	switch ins.addrMode {
-	case addrAbsolute, addrZeroPage, addrImplied, addrAccumulator:
-		// do nothing
 	case addrAbsoluteX, addrAbsoluteY:
-		var offset uint16
-		if ins.addrMode == addrAbsoluteX {
-			offset = uint16(cpu.X)
-		} else {
+		offset := uint16(cpu.X)
+		if ins.addrMode == addrAbsoluteY {
 			offset = uint16(cpu.Y)
 		}
-		if addr&0xFF00 != (addr+offset)&0xFF00 {
+		if arg&0xFF00 != (arg+offset)&0xFF00 {
 			cpu.cycles += uint64(ins.exCyc)
 		}
-		addr += offset
+		return arg + offset
 	case addrIndexedIndirect:
-		addr = cpu.bugRead((addr + uint16(cpu.X)) & 0x00FF)
+		return cpu.bugRead((arg + uint16(cpu.X)) & 0x00FF)
 	case addrIndirect:
-		addr = cpu.bugRead(addr)
+		if cpu.Variant == CPU65C02 {
+			return cpu.read16(arg)
+		}
+		return cpu.bugRead(arg)
+	case addrZeroPageIndirect:
+		return cpu.bugRead(arg) // wraps in zero page
+	case addrAbsoluteIndexedIndirect:
+		return cpu.read16(arg + uint16(cpu.X))
 	case addrIndirectIndexed:
-		addr = cpu.bugRead(addr)
+		addr := cpu.bugRead(arg)
 		offset := uint16(cpu.Y)
 		if addr&0xFF00 != (addr+offset)&0xFF00 {
 			cpu.cycles += uint64(ins.exCyc)
 		}
-		addr += offset
+		return addr + offset
 	case addrImmediate:
-		addr = cpu.PC - 1
+		return cpu.PC - 1
 	case addrRelative:
-		offset := int8(addr)
-		addr = uint16(int32(cpu.PC) + int32(offset))
-		pc := cpu.PC
-		defer func() {
-			if cpu.PC != pc {
-				cpu.cycles++ // cycles +1 if branch succeeds
-				if pc&0xFF00 != addr&0xFF00 {
-					cpu.cycles++ // +2 if to a new page
-				}
-			}
-		}()
+		return cpu.PC + uint16(int8(arg))
+	case addrZeroPageRelative:
+		return arg // resolved by bbr and bbs
 	case addrZeroPageX:
-		addr = (addr + uint16(cpu.X)) & 0x00FF
+		return (arg + uint16(cpu.X)) & 0x00FF
 	case addrZeroPageY:
-		addr = (addr + uint16(cpu.Y)) & 0x00FF
-		fmt.Printf("=== %04X ===\n", addr)
-	default:
-		fmt.Printf("\nunknown address mode: %d, %02X\n", ins.addrMode, opcode)
-		os.Exit(0)
+		return (arg + uint16(cpu.Y)) & 0x00FF
 	}
+	return arg
+}
+
+// cpuOps - instructions by id, called with the operand address resolved,
+// nil for those not implemented
+var cpuOps [insWAI + 1]func(cpu *CPU, addr uint16, mode uint8)
+
+func init() {
+	cpuOps = [insWAI + 1]func(cpu *CPU, addr uint16, mode uint8){
+		insADC: func(cpu *CPU, addr uint16, _ uint8) { cpu.adc(addr) },
+		insAND: func(cpu *CPU, addr uint16, _ uint8) { cpu.and(addr) },
+		insASL: (*CPU).asl,
+		insBCC: func(cpu *CPU, addr uint16, _ uint8) { cpu.bcc(addr) },
+		insBCS: func(cpu *CPU, addr uint16, _ uint8) { cpu.bcs(addr) },
+		insBEQ: func(cpu *CPU, addr uint16, _ uint8) { cpu.beq(addr) },
+		insBIT: (*CPU).bit,
+		insBMI: func(cpu *CPU, addr uint16, _ uint8) { cpu.bmi(addr) },
+		insBNE: func(cpu *CPU, addr uint16, _ uint8) { cpu.bne(addr) },
+		insBPL: func(cpu *CPU, addr uint16, _ uint8) { cpu.bpl(addr) },
+		insBRK: func(cpu *CPU, _ uint16, _ uint8) { cpu.brk() },
+		insBVC: func(cpu *CPU, addr uint16, _ uint8) { cpu.bvc(addr) },
+		insBVS: func(cpu *CPU, addr uint16, _ uint8) { cpu.bvs(addr) },
+		insCLC: func(cpu *CPU, _ uint16, _ uint8) { cpu.C = 0 },
+		insCLD: func(cpu *CPU, _ uint16, _ uint8) { cpu.D = 0 },
+		insCLI: func(cpu *CPU, _ uint16, _ uint8) { cpu.I = 0 },
+		insCLV: func(cpu *CPU, _ uint16, _ uint8) { cpu.V = 0 },
+		insCMP: func(cpu *CPU, addr uint16, _ uint8) { cpu.cmp(addr) },
+		insCPX: func(cpu *CPU, addr uint16, _ uint8) { cpu.cpx(addr) },
+		insCPY: func(cpu *CPU, addr uint16, _ uint8) { cpu.cpy(addr) },
+		insDEC: func(cpu *CPU, addr uint16, mode uint8) {
+			if mode == addrAccumulator {
+				cpu.setValueNZ(&cpu.A, cpu.A-1)
+			} else {
+				cpu.dec(addr)
+			}
+		},
+		insDEX: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.X-1) },
+		insDEY: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.Y, cpu.Y-1) },
+		insEOR: func(cpu *CPU, addr uint16, _ uint8) { cpu.eor(addr) },
+		insINC: func(cpu *CPU, addr uint16, mode uint8) {
+			if mode == addrAccumulator {
+				cpu.setValueNZ(&cpu.A, cpu.A+1)
+			} else {
+				cpu.inc(addr)
+			}
+		},
+		insINX: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.X+1) },
+		insINY: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.Y, cpu.Y+1) },
+		insJMP: func(cpu *CPU, addr uint16, _ uint8) { cpu.jmp(addr) },
+		insJSR: func(cpu *CPU, addr uint16, _ uint8) { cpu.jsr(addr) },
+		insLDA: func(cpu *CPU, addr uint16, _ uint8) { cpu.setValueNZ(&cpu.A, cpu.read(addr)) },
+		insLDX: func(cpu *CPU, addr uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.read(addr)) },
+		insLDY: func(cpu *CPU, addr uint16, _ uint8) { cpu.setValueNZ(&cpu.Y, cpu.read(addr)) },
+		insLSR: (*CPU).lsr,
+		insNOP: func(*CPU, uint16, uint8) {},
+		insORA: func(cpu *CPU, addr uint16, _ uint8) { cpu.ora(addr) },
+		insPHA: func(cpu *CPU, _ uint16, _ uint8) { cpu.push(cpu.A) },
+		insPHP: func(cpu *CPU, _ uint16, _ uint8) { cpu.push(cpu.flag() | 0x30) }, // set B flag
+		insPLA: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.A, cpu.pull()) },
+		insPLP: func(cpu *CPU, _ uint16, _ uint8) { cpu.setFlags(cpu.pull()) },
+		insROL: (*CPU).rol,
+		insROR: (*CPU).ror,
+		insRTI: func(cpu *CPU, _ uint16, _ uint8) { cpu.rti() },
+		insRTS: func(cpu *CPU, _ uint16, _ uint8) { cpu.rts() },
+		insSBC: func(cpu *CPU, addr uint16, _ uint8) { cpu.sbc(addr) },
+		insSEC: func(cpu *CPU, _ uint16, _ uint8) { cpu.C = 1 },
+		insSED: func(cpu *CPU, _ uint16, _ uint8) { cpu.D = 1 }, // useless on 2A03
+		insSEI: func(cpu *CPU, _ uint16, _ uint8) { cpu.I = 1 },
+		insSTA: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.A) },
+		insSTX: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.X) },
+		insSTY: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.Y) },
+		insTAX: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.A) },
+		insTAY: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.Y, cpu.A) },
+		insTSX: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.S) },
+		insTXA: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.A, cpu.X) },
+		insTXS: func(cpu *CPU, _ uint16, _ uint8) { cpu.S = cpu.X },
+		insTYA: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.A, cpu.Y) },
+
+		// unofficial instructions
+		insDOP: func(*CPU, uint16, uint8) {},
+		insTOP: func(*CPU, uint16, uint8) {},
+		insAAX: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.X&cpu.A) },
+		insDCP: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.dec(addr)
+			cpu.cmp(addr)
+		},
+		insISC: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.inc(addr)
+			cpu.sbc(addr)
+		},
+		insLAX: func(cpu *CPU, addr uint16, _ uint8) {
+			val := cpu.read(addr)
+			cpu.setValueNZ(&cpu.A, val)
+			cpu.setValueNZ(&cpu.X, val)
+		},
+		insRLA: func(cpu *CPU, addr uint16, mode uint8) {
+			cpu.rol(addr, mode)
+			cpu.and(addr)
+		},
+		insRRA: func(cpu *CPU, addr uint16, mode uint8) {
+			cpu.ror(addr, mode)
+			cpu.adc(addr)
+		},
+		insSLO: func(cpu *CPU, addr uint16, mode uint8) {
+			cpu.asl(addr, mode)
+			cpu.ora(addr)
+		},
+		insSRE: func(cpu *CPU, addr uint16, mode uint8) {
+			cpu.lsr(addr, mode)
+			cpu.eor(addr)
+		},
+		insAAC: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.and(addr)
+			cpu.C = cpu.N
+		},
+		insASR: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.and(addr)
+			cpu.lsr(addr, addrAccumulator)
+		},
+		insARR: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.and(addr)
+			cpu.setValueNZ(&cpu.A, cpu.A>>1|cpu.C<<7)
+			cpu.C = cpu.A >> 6 & 1
+			cpu.V = cpu.C ^ cpu.A>>5&1
+		},
+		insATX: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.setValueNZ(&cpu.A, (cpu.A|lxaMagic)&cpu.read(addr))
+			cpu.X = cpu.A
+		},
+		insXAA: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.setValueNZ(&cpu.A, (cpu.A|aneMagic)&cpu.X&cpu.read(addr))
+		},
+		insAXS: func(cpu *CPU, addr uint16, _ uint8) {
+			val := cpu.read(addr)
+			ax := cpu.A & cpu.X
+			cpu.C = 0
+			if ax >= val {
+				cpu.C = 1
+			}
+			cpu.setValueNZ(&cpu.X, ax-val)
+		},
+		insLAR: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.setValueNZ(&cpu.A, cpu.read(addr)&cpu.S)
+			cpu.X, cpu.S = cpu.A, cpu.A
+		},
+		insSXA: func(cpu *CPU, addr uint16, _ uint8) { cpu.storeHigh(addr, cpu.Y, cpu.X) },
+		insSYA: func(cpu *CPU, addr uint16, _ uint8) { cpu.storeHigh(addr, cpu.X, cpu.Y) },
+		insAXA: func(cpu *CPU, addr uint16, _ uint8) { cpu.storeHigh(addr, cpu.Y, cpu.A&cpu.X) },
+		insXAS: func(cpu *CPU, addr uint16, _ uint8) {
+			cpu.S = cpu.A & cpu.X
+			cpu.storeHigh(addr, cpu.Y, cpu.S)
+		},
+		insKIL: func(cpu *CPU, _ uint16, _ uint8) {
+			cpu.halted = true
+			cpu.PC--
+			if cpu.tracer != nil {
+				cpu.tracer.Dump()
+			}
+		},
 
-	switch ins.id {
-	case insNOP:
-		// do nothing
-	case insADC:
-		cpu.adc(addr)
-	case insAND:
-		cpu.and(addr)
-	case insASL:
-		cpu.asl(addr, ins.addrMode)
-	case insBCC:
-		cpu.bcc(addr)
-	case insBCS:
-		cpu.bcs(addr)
-	case insBEQ:
-		cpu.beq(addr)
-	case insBIT:
-		cpu.bit(addr)
-	case insBMI:
-		cpu.bmi(addr)
-	case insBNE:
-		cpu.bne(addr)
-	case insBPL:
-		cpu.bpl(addr)
-	case insBVC:
-		cpu.bvc(addr)
-	case insBVS:
-		cpu.bvs(addr)
-	case insCLC:
-		cpu.C = 0
-	case insCLD:
-		cpu.D = 0
-	case insCLV:
-		cpu.V = 0
-	case insCMP:
-		cpu.cmp(addr)
-	case insCPX:
-		cpu.cpx(addr)
-	case insCPY:
-		cpu.cpy(addr)
-	case insDEC:
-		cpu.dec(addr)
-	case insDEX:
-		cpu.setValueNZ(&cpu.X, cpu.X-1)
-	case insDEY:
-		cpu.setValueNZ(&cpu.Y, cpu.Y-1)
-	case insEOR:
-		cpu.eor(addr)
-	case insINC:
-		cpu.inc(addr)
-	case insINX:
-		cpu.setValueNZ(&cpu.X, cpu.X+1)
-	case insINY:
-		cpu.setValueNZ(&cpu.Y, cpu.Y+1)
-	case insJMP:
-		cpu.jmp(addr)
-	case insJSR:
-		cpu.jsr(addr)
-	case insLDA:
-		cpu.setValueNZ(&cpu.A, cpu.read(addr))
-	case insLDX:
-		cpu.setValueNZ(&cpu.X, cpu.read(addr))
-	case insLDY:
-		cpu.setValueNZ(&cpu.Y, cpu.read(addr))
-	case insLSR:
-		cpu.lsr(addr, ins.addrMode)
-	case insORA:
-		cpu.ora(addr)
-	case insPHA:
-		cpu.push(cpu.A)
-	case insPHP:
-		cpu.push(cpu.flag() | 0x30) // set B flag
-	case insPLA:
-		cpu.setValueNZ(&cpu.A, cpu.pull())
-	case insPLP:
-		cpu.setFlags(cpu.pull())
-	case insROL:
-		cpu.rol(addr, ins.addrMode)
-	case insROR:
-		cpu.ror(addr, ins.addrMode)
-	case insRTI:
-		cpu.rti()
-	case insRTS:
-		cpu.rts()
-	case insSBC:
-		cpu.sbc(addr)
-	case insSEC:
-		cpu.C = 1
-	case insSED:
-		cpu.D = 1 // useless on NES
-	case insSEI:
-		cpu.I = 1
-	case insSTA:
-		cpu.write(addr, cpu.A)
-	case insSTX:
-		cpu.write(addr, cpu.X)
-	case insSTY:
-		cpu.write(addr, cpu.Y)
-	case insTAX:
-		cpu.setValueNZ(&cpu.X, cpu.A)
-	case insTAY:
-		cpu.setValueNZ(&cpu.Y, cpu.A)
-	case insTSX:
-		cpu.setValueNZ(&cpu.X, cpu.S)
-	case insTXA:
-		cpu.setValueNZ(&cpu.A, cpu.X)
-	case insTXS:
-		cpu.S = cpu.X
-	case insTYA:
-		cpu.setValueNZ(&cpu.A, cpu.Y)
-
-	// unofficial instruction
-	case insDOP, insTOP:
-		// do nothing
-	case insAAX:
-		cpu.write(addr, cpu.X&cpu.A)
-	case insDCP:
-		cpu.dec(addr)
-		cpu.cmp(addr)
-	case insISC:
-		cpu.inc(addr)
-		cpu.sbc(addr)
-	case insLAX:
-		val := cpu.read(addr)
-		cpu.setValueNZ(&cpu.A, val)
-		cpu.setValueNZ(&cpu.X, val)
-	case insRLA:
-		cpu.rol(addr, ins.addrMode)
-		cpu.and(addr)
-	case insRRA:
-		cpu.ror(addr, ins.addrMode)
-		cpu.adc(addr)
-	case insSLO:
-		cpu.asl(addr, ins.addrMode)
-		cpu.ora(addr)
-	case insSRE:
-		cpu.lsr(addr, ins.addrMode)
-		cpu.eor(addr)
-	default:
-		panic(fmt.Sprintf("unknown opcode: %02X at %04X", opcode, cpu.PC))
-	}
-
-	return info
+		// 65C02 instructions
+		insBBR: func(cpu *CPU, arg uint16, _ uint8) {
+			if cpu.read(arg&0xFF)&cpu.opcodeBit() == 0 {
+				cpu.branch(cpu.PC + uint16(int8(arg>>8)))
+			}
+		},
+		insBBS: func(cpu *CPU, arg uint16, _ uint8) {
+			if cpu.read(arg&0xFF)&cpu.opcodeBit() != 0 {
+				cpu.branch(cpu.PC + uint16(int8(arg>>8)))
+			}
+		},
+		insBRA: func(cpu *CPU, addr uint16, _ uint8) { cpu.branch(addr) },
+		insPHX: func(cpu *CPU, _ uint16, _ uint8) { cpu.push(cpu.X) },
+		insPHY: func(cpu *CPU, _ uint16, _ uint8) { cpu.push(cpu.Y) },
+		insPLX: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.X, cpu.pull()) },
+		insPLY: func(cpu *CPU, _ uint16, _ uint8) { cpu.setValueNZ(&cpu.Y, cpu.pull()) },
+		insRMB: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.read(addr)&^cpu.opcodeBit()) },
+		insSMB: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, cpu.read(addr)|cpu.opcodeBit()) },
+		insSTP: func(cpu *CPU, _ uint16, _ uint8) {
+			cpu.halted = true
+			cpu.PC--
+		},
+		insSTZ: func(cpu *CPU, addr uint16, _ uint8) { cpu.write(addr, 0) },
+		insTRB: func(cpu *CPU, addr uint16, _ uint8) {
+			val := cpu.read(addr)
+			cpu.setZ(val & cpu.A)
+			cpu.write(addr, val&^cpu.A)
+		},
+		insTSB: func(cpu *CPU, addr uint16, _ uint8) {
+			val := cpu.read(addr)
+			cpu.setZ(val & cpu.A)
+			cpu.write(addr, val|cpu.A)
+		},
+		insWAI: func(cpu *CPU, _ uint16, _ uint8) { cpu.waiting = true },
+	}
 }
 
 func (f *cpuFlag) setFlags(val byte) {
@@ -281,35 +438,72 @@ func (f *cpuFlag) setZ(test byte) {
 }
 
 func (cpu *CPU) read(addr uint16) byte {
-	var data byte
-	switch {
-	case addr < 0x2000:
-		data = cpu.ram[addr&0x07FF]
-	case addr < 0x4000:
-		// NES PPU registers
-	case addr < 0x4018:
-		// NES APU & I/O registers
-	case addr < 0x4020:
-		// ignote
-	default:
-		data = cpu.console.Mapper.Read(addr)
+	if cpu.console.cdl != nil {
+		cpu.console.cdl.logData(cpu.console, addr)
+	}
+	data := cpu.fetch(addr)
+	if cpu.debugger != nil && !cpu.immediate(addr) {
+		cpu.debugger.access(addr, data, false)
+	}
+	return data
+}
+
+// fetch read a byte of the instruction, it is code rather than data
+func (cpu *CPU) fetch(addr uint16) byte {
+	data := cpu.readBus(addr)
+	if cpu.console.cheats != nil {
+		data = cpu.console.cheats.substitute(addr, data)
 	}
 	return data
 }
 
+// immediate tell if addr is the operand of the instruction being executed
+// in immediate mode, which is read as data but fetched with the opcode
+func (cpu *CPU) immediate(addr uint16) bool {
+	return addr == cpu.PC-1 && cpu.table()[cpu.opcode].addrMode == addrImmediate
+}
+
+func (cpu *CPU) readBus(addr uint16) byte {
+	return cpu.console.Bus.Read(addr)
+}
+
 func (cpu *CPU) write(addr uint16, val byte) {
-	switch {
-	case addr < 0x2000:
-		cpu.ram[addr&0x07FF] = val
-	case addr < 0x4000:
-		// NES PPU registers
-	case addr < 0x4018:
-		// NES APU & I/O registers
-	case addr < 0x4020:
-		// ignore
-	default:
-		cpu.console.Mapper.Write(addr, val)
+	if cpu.debugger != nil {
+		cpu.debugger.access(addr, val, true)
+	}
+	cpu.writeBus(addr, val)
+}
+
+func (cpu *CPU) writeBus(addr uint16, val byte) {
+	cpu.console.Bus.Write(addr, val)
+}
+
+func (cpu *CPU) triggerNMI() {
+	cpu.nmi = true
+}
+
+// setIRQ hold IRQ line low by source, or release it. IRQ is level
+// triggered, so it is taken as long as a source holds it and I is clear
+func (cpu *CPU) setIRQ(source byte, active bool) {
+	if active {
+		cpu.irq |= source
+	} else {
+		cpu.irq &^= source
+	}
+}
+
+// interrupt push PC and status, then jump to the handler of vector
+// http://wiki.nesdev.com/w/index.php/CPU_interrupts
+func (cpu *CPU) interrupt(vector uint16) {
+	cpu.push(byte(cpu.PC >> 8))
+	cpu.push(byte(cpu.PC))
+	cpu.push(cpu.flag() | 0x20)
+	cpu.I, cpu.irqMask = 1, 1
+	if cpu.Variant == CPU65C02 {
+		cpu.D = 0
 	}
+	cpu.PC = cpu.read16(vector)
+	cpu.cycles += 7
 }
 
 func (cpu *CPU) writeNZ(addr uint16, val byte) {
@@ -318,6 +512,30 @@ func (cpu *CPU) writeNZ(addr uint16, val byte) {
 	cpu.setZ(val)
 }
 
+func (cpu *CPU) read16(addr uint16) uint16 {
+	return uint16(cpu.read(addr+1))<<8 | uint16(cpu.read(addr))
+}
+
+// unstable ANE and LXA OR A with a value which varies by chip and
+// temperature before ANDing, these are what most 2A03s do
+// http://wiki.nesdev.com/w/index.php/Programming_with_unofficial_opcodes
+const (
+	aneMagic = 0xEE
+	lxaMagic = 0xFF
+)
+
+// storeHigh store val ANDed with the high byte of the base address plus
+// one, as SHX, SHY, AHX and TAS do. When indexing crosses a page, the high
+// byte of the address is replaced by the value stored
+func (cpu *CPU) storeHigh(addr uint16, index byte, val byte) {
+	base := addr - uint16(index)
+	val &= byte(base>>8) + 1
+	if base&0xFF00 != addr&0xFF00 {
+		addr = uint16(val)<<8 | addr&0x00FF
+	}
+	cpu.write(addr, val)
+}
+
 // there is a bug of indirect mode needs to be implemented
 // see http://nesdev.com/6502bugs.txt
 func (cpu *CPU) bugRead(addr uint16) uint16 {
@@ -352,10 +570,16 @@ func (cpu *CPU) setValueNZ(reg *byte, val byte) {
 // http://wiki.nesdev.com/w/index.php/CPU_power_up_state
 func (cpu *CPU) Reset() {
 	cpu.setFlags(0x34)
+	cpu.irqMask = cpu.I
 	cpu.A = 0
 	cpu.X = 0
 	cpu.Y = 0
 	cpu.S = 0xFD
+	cpu.halted = false
+	cpu.waiting = false
+	cpu.nmi = false
+	cpu.irq = 0
+	cpu.stall = 0
 	cpu.write(0x4017, 0)
 	cpu.write(0x4015, 0)
 	for i := 0x4000; i <= 0x400F; i++ {
@@ -365,6 +589,10 @@ func (cpu *CPU) Reset() {
 
 func (cpu *CPU) adc(addr uint16) {
 	val := cpu.read(addr)
+	if cpu.D != 0 && cpu.Variant != CPU2A03 {
+		cpu.adcDecimal(val)
+		return
+	}
 	t := int16(cpu.A) + int16(val) + int16(cpu.C)
 	if t > 0xFF {
 		cpu.C = 1
@@ -397,56 +625,72 @@ func (cpu *CPU) asl(addr uint16, addrMode uint8) {
 
 func (cpu *CPU) bcc(addr uint16) {
 	if cpu.C == 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) bpl(addr uint16) {
 	if cpu.N == 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) bvc(addr uint16) {
 	if cpu.V == 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) bcs(addr uint16) {
 	if cpu.C != 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) beq(addr uint16) {
 	if cpu.Z != 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
-func (cpu *CPU) bit(addr uint16) {
+func (cpu *CPU) bit(addr uint16, addrMode uint8) {
 	val := cpu.read(addr)
-	cpu.setN(val)
 	cpu.setZ(val & cpu.A)
-	cpu.V = (val >> 6) & 1
+	if addrMode != addrImmediate { // BIT #imm of 65C02 sets Z only
+		cpu.setN(val)
+		cpu.V = (val >> 6) & 1
+	}
+}
+
+// brk push PC of the byte after signature and status with B flag, then
+// jump to IRQ handler, 65C02 also clears D
+func (cpu *CPU) brk() {
+	cpu.PC++
+	cpu.push(byte(cpu.PC >> 8))
+	cpu.push(byte(cpu.PC))
+	cpu.push(cpu.flag() | 0x30)
+	cpu.I = 1
+	if cpu.Variant == CPU65C02 {
+		cpu.D = 0
+	}
+	cpu.PC = cpu.read16(0xFFFE)
 }
 
 func (cpu *CPU) bmi(addr uint16) {
 	if cpu.N != 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) bne(addr uint16) {
 	if cpu.Z == 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
 func (cpu *CPU) bvs(addr uint16) {
 	if cpu.V != 0 {
-		cpu.jmp(addr)
+		cpu.branch(addr)
 	}
 }
 
@@ -497,6 +741,15 @@ func (cpu *CPU) inc(addr uint16) {
 	cpu.writeNZ(addr, val)
 }
 
+// branch jump to addr taking a cycle more, and another if to a new page
+func (cpu *CPU) branch(addr uint16) {
+	cpu.cycles++
+	if cpu.PC&0xFF00 != addr&0xFF00 {
+		cpu.cycles++
+	}
+	cpu.PC = addr
+}
+
 func (cpu *CPU) jmp(addr uint16) {
 	cpu.PC = addr
 }
@@ -564,6 +817,10 @@ func (cpu *CPU) rts() {
 
 func (cpu *CPU) sbc(addr uint16) {
 	val := cpu.read(addr)
+	if cpu.D != 0 && cpu.Variant != CPU2A03 {
+		cpu.sbcDecimal(val)
+		return
+	}
 	t := int16(cpu.A) - int16(val) - int16(1-cpu.C)
 	if t < 0 {
 		cpu.C = 0
@@ -579,3 +836,82 @@ func (cpu *CPU) sbc(addr uint16) {
 	cpu.setN(cpu.A)
 	cpu.setZ(cpu.A)
 }
+
+// adcDecimal add in BCD. NMOS 6502 sets N and V from the sum before the
+// high digit is adjusted, and Z from the binary sum; 65C02 sets N and Z
+// from the result, taking a cycle more
+// http://www.6502.org/tutorials/decimal_mode.html#A
+func (cpu *CPU) adcDecimal(val byte) {
+	a, b, c := int(cpu.A), int(val), int(cpu.C)
+	lo := a&0x0F + b&0x0F + c
+	if lo >= 0x0A {
+		lo = (lo+0x06)&0x0F + 0x10
+	}
+	t := a&0xF0 + b&0xF0 + lo
+	signed := int(int8(a&0xF0)) + int(int8(b&0xF0)) + lo
+	if signed < -128 || signed > 127 {
+		cpu.V = 1
+	} else {
+		cpu.V = 0
+	}
+	if t >= 0xA0 {
+		t += 0x60
+	}
+	if t >= 0x100 {
+		cpu.C = 1
+	} else {
+		cpu.C = 0
+	}
+	if cpu.Variant == CPU65C02 {
+		cpu.setN(byte(t))
+		cpu.setZ(byte(t))
+		cpu.cycles++
+	} else {
+		cpu.setN(byte(signed))
+		cpu.setZ(byte(a + b + c))
+	}
+	cpu.A = byte(t)
+}
+
+// sbcDecimal subtract in BCD. Flags are those of binary subtraction, but
+// N and Z of 65C02, which are from the result, taking a cycle more
+// http://www.6502.org/tutorials/decimal_mode.html#A
+func (cpu *CPU) sbcDecimal(val byte) {
+	a, b, borrow := int(cpu.A), int(val), 1-int(cpu.C)
+	binary := a - b - borrow
+	lo := a&0x0F - b&0x0F - borrow
+	var t int
+	if cpu.Variant == CPU65C02 {
+		t = binary
+		if t < 0 {
+			t -= 0x60
+		}
+		if lo < 0 {
+			t -= 0x06
+		}
+		cpu.setN(byte(t))
+		cpu.setZ(byte(t))
+		cpu.cycles++
+	} else {
+		if lo < 0 {
+			lo = (lo-0x06)&0x0F - 0x10
+		}
+		t = a&0xF0 - b&0xF0 + lo
+		if t < 0 {
+			t -= 0x60
+		}
+		cpu.setN(byte(binary))
+		cpu.setZ(byte(binary))
+	}
+	if binary < 0 {
+		cpu.C = 0
+	} else {
+		cpu.C = 1
+	}
+	if (a^b)&0x80 != 0 && (a^binary)&0x80 != 0 {
+		cpu.V = 1
+	} else {
+		cpu.V = 0
+	}
+	cpu.A = byte(t)
+}
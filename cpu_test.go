@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// benchProgram keeps CPU busy with a mix of address modes, with rendering
+// enabled when run with PPU
+const benchProgram = `
+        LDA #$1E
+        STA $2001
+        LDA #3
+        STA $11
+loop:   LDX #0
+fill:   TXA
+        STA $0300,X
+        ADC $10
+        STA $10
+        LDY $0300,X
+        INC $12
+        LDA ($10),Y
+        EOR #$55
+        ROL A
+        DEX
+        BNE fill
+        JSR sub
+        JMP loop
+sub:    PHA
+        PLA
+        RTS
+`
+
+func newBenchConsole(tb testing.TB, ppu bool) *Console {
+	code, err := Assemble(benchProgram, 0xC000)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return newProgramConsole(tb, new(CPU), code, ppu)
+}
+
+// newProgramConsole run code at $C000 of an NROM cartridge
+func newProgramConsole(tb testing.TB, cpu *CPU, code []byte, ppu bool) *Console {
+	cart := &Cartridge{PRG: make([]byte, 0x4000), Chr: make([]byte, 0x2000), ChrRAM: true}
+	copy(cart.PRG, code)
+	cart.PRG[0x3FFC], cart.PRG[0x3FFD] = 0x00, 0xC0
+	con := new(Console)
+	con.Connect(cpu)
+	if ppu {
+		con.Connect(new(PPU))
+	}
+	if err := con.Connect(cart); err != nil {
+		tb.Fatal(err)
+	}
+	con.Reset()
+	return con
+}
+
+func TestDecimalMode(t *testing.T) {
+	tests := []struct {
+		variant     int
+		sbc         bool
+		a, val, c   byte
+		result      byte
+		c2, z, n, v byte
+	}{
+		{CPU2A03, false, 0x09, 0x01, 0, 0x0A, 0, 0, 0, 0},
+		{CPUNMOS, false, 0x09, 0x01, 0, 0x10, 0, 0, 0, 0},
+		{CPUNMOS, false, 0x58, 0x46, 1, 0x05, 1, 0, 1, 1},
+		{CPUNMOS, false, 0x99, 0x01, 0, 0x00, 1, 0, 1, 0},
+		{CPUNMOS, false, 0x79, 0x00, 1, 0x80, 0, 0, 1, 1},
+		{CPU65C02, false, 0x99, 0x01, 0, 0x00, 1, 1, 0, 0},
+		{CPU65C02, false, 0x79, 0x00, 1, 0x80, 0, 0, 1, 1},
+		{CPUNMOS, true, 0x00, 0x01, 1, 0x99, 0, 0, 1, 0},
+		{CPUNMOS, true, 0x46, 0x12, 1, 0x34, 1, 0, 0, 0},
+		{CPUNMOS, true, 0x40, 0x13, 1, 0x27, 1, 0, 0, 0},
+		{CPU65C02, true, 0x00, 0x01, 1, 0x99, 0, 0, 1, 0},
+		{CPU65C02, true, 0x21, 0x21, 1, 0x00, 1, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		con := newProgramConsole(t, &CPU{Variant: tt.variant}, nil, false)
+		cpu := con.CPU
+		cpu.A, cpu.C, cpu.D = tt.a, tt.c, 1
+		cpu.ram[0x10] = tt.val
+		name := "ADC"
+		if tt.sbc {
+			name = "SBC"
+			cpu.sbc(0x10)
+		} else {
+			cpu.adc(0x10)
+		}
+		if cpu.A != tt.result || cpu.C != tt.c2 || cpu.Z != tt.z || cpu.N != tt.n || cpu.V != tt.v {
+			t.Errorf("variant %d: %02X %s %02X with C=%d = %02X C=%d Z=%d N=%d V=%d, want %02X C=%d Z=%d N=%d V=%d",
+				tt.variant, tt.a, name, tt.val, tt.c, cpu.A, cpu.C, cpu.Z, cpu.N, cpu.V,
+				tt.result, tt.c2, tt.z, tt.n, tt.v)
+		}
+	}
+}
+
+func Test65C02(t *testing.T) {
+	for op, ins := range instructions65C02 {
+		if ins.cycles == 0 {
+			t.Errorf("opcode %02X is not defined", op)
+		}
+	}
+
+	code := []byte{
+		0xA9, 0xF0, // LDA #$F0
+		0x64, 0x11, // STZ $11
+		0x04, 0x11, // TSB $11
+		0x47, 0x11, // RMB4 $11
+		0x87, 0x11, // SMB0 $11
+		0x8F, 0x11, 0x02, // BBS0 $11,+2
+		0xA9, 0x00, // LDA #0
+		0x1A,       // INC A
+		0xAA,       // TAX
+		0xDA,       // PHX
+		0x7A,       // PLY
+		0xA9, 0x11, // LDA #$11
+		0x85, 0x20, // STA $20
+		0x64, 0x21, // STZ $21
+		0xB2, 0x20, // LDA ($20)
+		0x80, 0x01, // BRA +1
+		0xEA, // NOP
+		0xDB, // STP
+	}
+	con := newProgramConsole(t, &CPU{Variant: CPU65C02}, code, false)
+	cpu := con.CPU
+	for i := 0; i < 20 && !cpu.halted; i++ {
+		cpu.Step()
+	}
+	if !cpu.halted || cpu.PC != 0xC000+uint16(len(code))-1 {
+		t.Fatalf("PC = %04X, want STP at end of program", cpu.PC)
+	}
+	if cpu.ram[0x11] != 0xE1 || cpu.A != 0xE1 || cpu.Y != 0xF1 {
+		t.Errorf("$11 = %02X A = %02X Y = %02X, want E1, E1, F1", cpu.ram[0x11], cpu.A, cpu.Y)
+	}
+
+	// JMP ($02FF) reads $0300 rather than $0200 for high byte on 65C02
+	cpu.ram[0x2FF], cpu.ram[0x300], cpu.ram[0x200] = 0x34, 0x12, 0x56
+	if addr := cpu.address(instructions65C02[0x6C], 0x02FF); addr != 0x1234 {
+		t.Errorf("65C02 JMP ($02FF) to %04X, want 1234", addr)
+	}
+	cpu.Variant = CPUNMOS
+	if addr := cpu.address(instructions[0x6C], 0x02FF); addr != 0x5634 {
+		t.Errorf("NMOS JMP ($02FF) to %04X, want 5634", addr)
+	}
+}
+
+func TestUnofficialOpcodes(t *testing.T) {
+	for op, ins := range instructions {
+		if cpuOps[ins.id] == nil {
+			t.Errorf("opcode %02X is not implemented", op)
+		}
+	}
+
+	tests := []struct {
+		code       string
+		a, x, y, p byte
+		want       string // registers and $0200, $0110 after
+	}{
+		{"ANC #$80", 0xFF, 0, 0, 0, "A:80 X:00 S:FD P:A5 0200:00 0110:00"},
+		{"ALR #$03", 0xFF, 0, 0, 0, "A:01 X:00 S:FD P:25 0200:00 0110:00"},
+		{"ARR #$FF", 0xC0, 0, 0, 1, "A:E0 X:00 S:FD P:A5 0200:00 0110:00"},
+		{"ARR #$FF", 0x40, 0, 0, 0, "A:20 X:00 S:FD P:64 0200:00 0110:00"},
+		{"LXA #$5A", 0x00, 0, 0, 0, "A:5A X:5A S:FD P:24 0200:00 0110:00"},
+		{"ANE #$0F", 0x01, 0xFF, 0, 0, "A:0F X:FF S:FD P:24 0200:00 0110:00"},
+		{"SBX #$02", 0x0F, 0x05, 0, 0, "A:0F X:03 S:FD P:25 0200:00 0110:00"},
+		{"LAS $0200,Y", 0, 0, 0, 0, "A:00 X:00 S:00 P:26 0200:00 0110:00"},
+		{"SHX $0200,Y", 0, 0xFF, 0, 0, "A:00 X:FF S:FD P:24 0200:03 0110:00"},
+		{"SHY $02F0,X", 0, 0x20, 0x01, 0, "A:00 X:20 S:FD P:24 0200:00 0110:01"},
+		{"TAS $0200,Y", 0xF7, 0x7F, 0, 0, "A:F7 X:7F S:77 P:24 0200:03 0110:00"},
+		{"AHX ($10),Y", 0xFF, 0xFF, 0, 0, "A:FF X:FF S:FD P:24 0200:03 0110:00"},
+	}
+	for _, tt := range tests {
+		code, err := Assemble(tt.code, 0xC000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu := newProgramConsole(t, new(CPU), code, false).CPU
+		cpu.A, cpu.X, cpu.Y = tt.a, tt.x, tt.y
+		cpu.setFlags(0x24 | tt.p)
+		cpu.ram[0x10], cpu.ram[0x11] = 0x00, 0x02
+		cpu.Step()
+		got := fmt.Sprintf("A:%02X X:%02X S:%02X P:%02X 0200:%02X 0110:%02X",
+			cpu.A, cpu.X, cpu.S, cpu.flag()|0x20, cpu.ram[0x200], cpu.ram[0x110])
+		if got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestStepAllocs(t *testing.T) {
+	con := newBenchConsole(t, true)
+	if n := testing.AllocsPerRun(10000, func() { con.Step() }); n != 0 {
+		t.Errorf("Step allocates %v times per instruction", n)
+	}
+}
+
+func BenchmarkCPUStep(b *testing.B) {
+	con := newBenchConsole(b, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		con.CPU.Step()
+	}
+}
+
+func BenchmarkFrame(b *testing.B) {
+	con := newBenchConsole(b, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		con.StepFrame()
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "frames/s")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// kinds of breakpoint, watchpoints can be both read and write
+const (
+	BreakExec = 1 << iota
+	BreakRead
+	BreakWrite
+)
+
+// address spaces of watchpoints
+const (
+	SpaceCPU = iota
+	SpacePPU // accessed through PPUDATA
+)
+
+// reasons of a break
+const (
+	BreakPaused = iota
+	BreakStep
+	BreakBreakpoint
+	BreakWatchpoint
+	BreakScanline
+)
+
+// stepping modes
+const (
+	debugRun = iota
+	debugStepInto
+	debugStepOver
+	debugStepOut
+	debugScanline
+)
+
+// Breakpoint - stop execution when CPU executes or accesses an address
+type Breakpoint struct {
+	ID       int
+	Kind     int
+	Space    int
+	From, To uint16
+	Bank     int    // 16 KiB PRG bank of execution breakpoints, -1 for any
+	Cond     string // optional condition, see expr
+	Enabled  bool
+
+	cond expr
+}
+
+// BreakEvent describe why execution stopped
+type BreakEvent struct {
+	Reason     int
+	Breakpoint *Breakpoint // for BreakBreakpoint and BreakWatchpoint
+	PC         uint16      // PC of next instruction
+
+	// the access that hit a watchpoint
+	Space int
+	Addr  uint16
+	Value byte
+	Write bool
+}
+
+// Debugger - breakpoints, watchpoints and stepping of CPU.
+// Execution stops before an instruction, the emulation goroutine is
+// blocked in CPU.step until Resume or a step method is called from
+// another goroutine. Watchpoints stop before the instruction following
+// the access, they are hit by data accesses, not by fetches of
+// instructions.
+type Debugger struct {
+	// OnBreak is called from the emulation goroutine when it stops
+	OnBreak func(e *BreakEvent)
+
+	console     *Console
+	mu          sync.Mutex
+	resumed     *sync.Cond
+	breakpoints []*Breakpoint
+	nextID      int
+
+	paused   bool
+	pauseReq bool
+	detached bool        // removed from CPU by the emulation goroutine
+	hit      *BreakEvent // watchpoint hit by the current instruction
+	last     *BreakEvent
+
+	mode     int
+	targetPC uint16 // step over
+	targetS  byte   // step over and out
+	prevOp   byte
+	line     int // scanline to run to
+	prevLine int
+}
+
+// NewDebugger attach a debugger to the console, before it runs or from
+// the goroutine running it
+func NewDebugger(con *Console) *Debugger {
+	d := &Debugger{console: con}
+	d.resumed = sync.NewCond(&d.mu)
+	con.CPU.debugger = d
+	return d
+}
+
+// Detach remove the debugger from console and resume execution. It may be
+// called from any goroutine, the CPU drops the debugger before its next
+// instruction
+func (d *Debugger) Detach() {
+	d.mu.Lock()
+	d.detached = true
+	d.paused = false
+	d.mode = debugRun
+	d.resumed.Broadcast()
+	d.mu.Unlock()
+}
+
+// AddBreakpoint stop before executing addr in bank, -1 for any bank, when
+// the condition is met, empty for always
+func (d *Debugger) AddBreakpoint(addr uint16, bank int, cond string) (int, error) {
+	return d.add(&Breakpoint{Kind: BreakExec, Space: SpaceCPU, From: addr, To: addr, Bank: bank, Cond: cond})
+}
+
+// AddWatchpoint stop after reading or writing an address in [from, to] of
+// CPU or PPU address space, when the condition is met
+func (d *Debugger) AddWatchpoint(space, kind int, from, to uint16, cond string) (int, error) {
+	if kind&^(BreakRead|BreakWrite) != 0 || kind == 0 {
+		return 0, errors.New("invalid watchpoint kind")
+	}
+	return d.add(&Breakpoint{Kind: kind, Space: space, From: from, To: to, Bank: -1, Cond: cond})
+}
+
+func (d *Debugger) add(b *Breakpoint) (int, error) {
+	if b.Cond != "" {
+		cond, err := compileExpr(b.Cond)
+		if err != nil {
+			return 0, err
+		}
+		b.cond = cond
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	b.ID = d.nextID
+	b.Enabled = true
+	d.breakpoints = append(d.breakpoints, b)
+	return b.ID, nil
+}
+
+// RemoveBreakpoint remove a breakpoint or watchpoint by id
+func (d *Debugger) RemoveBreakpoint(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, b := range d.breakpoints {
+		if b.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+// EnableBreakpoint enable or disable a breakpoint or watchpoint by id
+func (d *Debugger) EnableBreakpoint(id int, enabled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, b := range d.breakpoints {
+		if b.ID == id {
+			b.Enabled = enabled
+		}
+	}
+}
+
+// Breakpoints return copies of all breakpoints and watchpoints
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Breakpoint, len(d.breakpoints))
+	for i, b := range d.breakpoints {
+		list[i] = *b
+	}
+	return list
+}
+
+// Pause stop before the next instruction
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	d.pauseReq = true
+	d.mu.Unlock()
+}
+
+// Paused tell if execution is stopped, and why
+func (d *Debugger) Paused() (bool, *BreakEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused, d.last
+}
+
+// Resume continue execution
+func (d *Debugger) Resume() {
+	d.resume(debugRun)
+}
+
+// StepInto execute an instruction
+func (d *Debugger) StepInto() error {
+	return d.resume(debugStepInto)
+}
+
+// StepOver execute an instruction, a subroutine called by JSR is executed
+// as a whole
+func (d *Debugger) StepOver() error {
+	return d.resume(debugStepOver)
+}
+
+// StepOut run until the current subroutine or interrupt handler returns
+func (d *Debugger) StepOut() error {
+	return d.resume(debugStepOut)
+}
+
+// RunToScanline run until PPU enters a scanline
+func (d *Debugger) RunToScanline(line int) error {
+	d.mu.Lock()
+	d.line = line
+	d.prevLine, _ = d.console.ppuPosition()
+	d.mu.Unlock()
+	return d.resume(debugScanline)
+}
+
+func (d *Debugger) resume(mode int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.paused && mode != debugRun {
+		return errors.New("not paused")
+	}
+	cpu := d.console.CPU
+	d.mode = mode
+	d.pauseReq = false
+	switch mode {
+	case debugStepOver:
+		if instructions[cpu.readBus(cpu.PC)].id == insJSR {
+			d.targetPC = cpu.PC + 3
+			d.targetS = cpu.S
+		} else {
+			d.mode = debugStepInto
+		}
+	case debugStepOut:
+		d.targetS = cpu.S
+	}
+	d.paused = false
+	d.resumed.Broadcast()
+	return nil
+}
+
+// step is called before each instruction
+func (d *Debugger) step(cpu *CPU) {
+	d.mu.Lock()
+	if d.detached {
+		cpu.debugger = nil
+		d.mu.Unlock()
+		return
+	}
+	e := d.check(cpu)
+	d.prevOp = cpu.readBus(cpu.PC)
+	if e == nil {
+		d.mu.Unlock()
+		return
+	}
+
+	d.hit = nil
+	d.pauseReq = false
+	d.mode = debugRun
+	d.paused = true
+	d.last = e
+	onBreak := d.OnBreak
+	d.mu.Unlock()
+
+	if cpu.tracer != nil {
+		cpu.tracer.Dump()
+	}
+	if onBreak != nil {
+		onBreak(e)
+	}
+
+	d.mu.Lock()
+	for d.paused {
+		d.resumed.Wait()
+	}
+	if d.detached {
+		cpu.debugger = nil
+	}
+	d.mu.Unlock()
+}
+
+func (d *Debugger) check(cpu *CPU) *BreakEvent {
+	if d.hit != nil {
+		d.hit.PC = cpu.PC
+		return d.hit
+	}
+	if d.pauseReq {
+		return &BreakEvent{Reason: BreakPaused, PC: cpu.PC}
+	}
+
+	switch d.mode {
+	case debugStepInto:
+		return &BreakEvent{Reason: BreakStep, PC: cpu.PC}
+	case debugStepOver:
+		if cpu.PC == d.targetPC && cpu.S == d.targetS {
+			return &BreakEvent{Reason: BreakStep, PC: cpu.PC}
+		}
+	case debugStepOut:
+		if id := instructions[d.prevOp].id; (id == insRTS || id == insRTI) && cpu.S > d.targetS {
+			return &BreakEvent{Reason: BreakStep, PC: cpu.PC}
+		}
+	case debugScanline:
+		line, _ := d.console.ppuPosition()
+		if line == d.line && d.prevLine != d.line {
+			return &BreakEvent{Reason: BreakScanline, PC: cpu.PC}
+		}
+		d.prevLine = line
+	}
+
+	var bank = -2
+	for _, b := range d.breakpoints {
+		if !b.Enabled || b.Kind != BreakExec || cpu.PC < b.From || cpu.PC > b.To {
+			continue
+		}
+		if b.Bank >= 0 {
+			if bank == -2 {
+				bank = d.console.prgBank(cpu.PC)
+			}
+			if b.Bank != bank {
+				continue
+			}
+		}
+		if b.cond != nil && b.cond(&exprContext{con: d.console}) == 0 {
+			continue
+		}
+		return &BreakEvent{Reason: BreakBreakpoint, Breakpoint: b, PC: cpu.PC}
+	}
+	return nil
+}
+
+// access is called on each data read and write of CPU
+func (d *Debugger) access(addr uint16, val byte, write bool) {
+	d.watch(SpaceCPU, addr, val, write)
+}
+
+// ppuAccess is called on each access of PPU memory through PPUDATA
+func (d *Debugger) ppuAccess(addr uint16, val byte, write bool) {
+	d.watch(SpacePPU, addr, val, write)
+}
+
+func (d *Debugger) watch(space int, addr uint16, val byte, write bool) {
+	kind := BreakRead
+	if write {
+		kind = BreakWrite
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hit != nil || d.detached {
+		return
+	}
+	for _, b := range d.breakpoints {
+		if !b.Enabled || b.Kind&kind == 0 || b.Space != space || addr < b.From || addr > b.To {
+			continue
+		}
+		if b.cond != nil && b.cond(&exprContext{d.console, addr, val}) == 0 {
+			continue
+		}
+		d.hit = &BreakEvent{
+			Reason:     BreakWatchpoint,
+			Breakpoint: b,
+			Space:      space,
+			Addr:       addr,
+			Value:      val,
+			Write:      write,
+		}
+		return
+	}
+}
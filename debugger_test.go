@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// debugProgram calls nested subroutines, then writes and reads $10
+const debugProgram = `
+        LDX #0
+loop:   JSR sub
+        INX
+        STX $10
+        LDA $10
+        JMP loop
+sub:    LDA #$10
+        JSR inner
+        RTS
+inner:  NOP
+        RTS
+`
+
+// addresses of debugProgram
+const (
+	debugLoop  = 0xC002
+	debugINX   = 0xC005
+	debugSTX   = 0xC006
+	debugJMP   = 0xC00A
+	debugSub   = 0xC00D
+	debugRTS   = 0xC012
+	debugInner = 0xC013
+)
+
+type debugTest struct {
+	t      *testing.T
+	con    *Console
+	d      *Debugger
+	breaks chan *BreakEvent
+	stop   int32
+	done   chan struct{}
+}
+
+// newDebugTest run debugProgram in a goroutine, as a frontend does
+func newDebugTest(t *testing.T) *debugTest {
+	code, err := Assemble(debugProgram, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := &debugTest{
+		t:      t,
+		con:    newProgramConsole(t, new(CPU), code, false),
+		breaks: make(chan *BreakEvent, 1),
+		done:   make(chan struct{}),
+	}
+	dt.d = NewDebugger(dt.con)
+	dt.d.OnBreak = func(e *BreakEvent) { dt.breaks <- e }
+	go func() {
+		defer close(dt.done)
+		for atomic.LoadInt32(&dt.stop) == 0 {
+			dt.con.Step()
+		}
+	}()
+	t.Cleanup(func() {
+		atomic.StoreInt32(&dt.stop, 1)
+		dt.d.Detach()
+		<-dt.done
+	})
+	return dt
+}
+
+// expect wait for a break of reason at pc
+func (dt *debugTest) expect(reason int, pc uint16) *BreakEvent {
+	dt.t.Helper()
+	select {
+	case e := <-dt.breaks:
+		if e.Reason != reason || e.PC != pc {
+			dt.t.Fatalf("break %d at $%04X, want %d at $%04X", e.Reason, e.PC, reason, pc)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		dt.t.Fatalf("no break, want %d at $%04X", reason, pc)
+	}
+	return nil
+}
+
+func (dt *debugTest) check(err error) {
+	dt.t.Helper()
+	if err != nil {
+		dt.t.Fatal(err)
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	dt := newDebugTest(t)
+	d := dt.d
+	id, err := d.AddBreakpoint(debugInner, -1, "")
+	dt.check(err)
+	dt.expect(BreakBreakpoint, debugInner)
+	if paused, e := d.Paused(); !paused || e.Breakpoint.ID != id {
+		t.Errorf("paused %v by %+v, want breakpoint %d", paused, e, id)
+	}
+
+	dt.check(d.StepOut())
+	dt.expect(BreakStep, debugRTS)
+	dt.check(d.StepOut())
+	dt.expect(BreakStep, debugINX)
+	dt.check(d.StepInto())
+	dt.expect(BreakStep, debugSTX)
+
+	d.RemoveBreakpoint(id)
+	id, err = d.AddBreakpoint(debugLoop, -1, "X == 3")
+	dt.check(err)
+	d.Resume()
+	dt.expect(BreakBreakpoint, debugLoop)
+	if x := dt.con.CPU.X; x != 3 {
+		t.Errorf("break with X = %d, want 3", x)
+	}
+	dt.check(d.StepOver())
+	dt.expect(BreakStep, debugINX)
+	if s := dt.con.CPU.S; s != 0xFD {
+		t.Errorf("SP %02X after stepping over JSR, want FD", s)
+	}
+	if _, err := d.AddBreakpoint(debugLoop, -1, "X =="); err == nil {
+		t.Error("added breakpoint of an invalid condition")
+	}
+}
+
+func TestDebuggerWatchpoints(t *testing.T) {
+	dt := newDebugTest(t)
+	d := dt.d
+	// fetches of opcodes and operands, including LDA #$10, are not reads
+	_, err := d.AddWatchpoint(SpaceCPU, BreakRead, debugSub, debugInner, "")
+	dt.check(err)
+	_, err = d.AddWatchpoint(SpaceCPU, BreakRead, 0x10, 0x10, "VALUE == 2")
+	dt.check(err)
+	e := dt.expect(BreakWatchpoint, debugJMP)
+	if e.Addr != 0x10 || e.Value != 2 || e.Write {
+		t.Errorf("watchpoint hit by %+v, want read of 2 at $10", e)
+	}
+
+	_, err = d.AddWatchpoint(SpaceCPU, BreakWrite, 0x10, 0x10, "")
+	dt.check(err)
+	d.Resume()
+	e = dt.expect(BreakWatchpoint, 0xC008)
+	if e.Addr != 0x10 || e.Value != 3 || !e.Write {
+		t.Errorf("watchpoint hit by %+v, want write of 3 at $10", e)
+	}
+	if _, err := d.AddWatchpoint(SpaceCPU, BreakExec, 0, 0, ""); err == nil {
+		t.Error("added watchpoint of execution")
+	}
+
+	d.Detach()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case e := <-dt.breaks:
+		t.Errorf("break %+v after detach", e)
+	default:
+	}
+}
+
+func TestExpr(t *testing.T) {
+	con := newProgramConsole(t, new(CPU), nil, false)
+	cpu := con.CPU
+	cpu.A, cpu.X, cpu.PC, cpu.Z = 0x20, 4, 0xC123, 1
+	con.Poke(0x10, 0x42)
+	tests := []struct {
+		src  string
+		want int
+	}{
+		{"A == $20 && X > 3", 1},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"%101 | 0x10", 21},
+		{"[$10] - 2", 0x40},
+		{"!Z || -X == -4", 1},
+		{"~0 & $FF", 0xFF},
+		{"PC >> 8 == $C1", 1},
+		{"7 % 0 + 9 / 2", 4},
+		{"addr + value", 0x1005},
+	}
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %s", tt.src, err)
+			continue
+		}
+		if v := e(&exprContext{con, 0x1000, 5}); v != tt.want {
+			t.Errorf("%s = %d, want %d", tt.src, v, tt.want)
+		}
+	}
+	for _, src := range []string{"", "A ==", "(1", "[2", "$G", "B"} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("compiled %q", src)
+		}
+	}
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kinds of PRG bytes found by the disassembler
+const (
+	disasmUnknown = uint8(iota)
+	disasmOpcode
+	disasmOperand
+	disasmData
+)
+
+// Disassembler - recursive descent disassembler of PRG. Code is followed
+// from the reset, NMI and IRQ vectors of each bank mapped at $E000-$FFFF
+// through jumps, branches and subroutine calls, what is not reached is data.
+//
+// PRG is split into banks of BankSize bytes, the last bank is assumed to be
+// fixed at the end of CPU address space, and others switchable below it.
+type Disassembler struct {
+	BankSize int
+
+	cart    *Cartridge
+	cdl     *CodeDataLogger
+	origins map[int]uint16
+	entries []disasmRef
+	kind    []uint8
+	labels  map[disasmRef]*disasmLabel
+	names   map[string]disasmRef
+}
+
+// disasmRef - CPU address in a PRG bank, bank -1 for addresses outside PRG
+type disasmRef struct {
+	bank int
+	addr uint16
+}
+
+type disasmLabel struct {
+	name    string
+	comment string
+}
+
+// names of CPU registers, used when no symbol file names them
+var hardwareLabels = map[uint16]string{
+	0x2000: "PPUCTRL", 0x2001: "PPUMASK", 0x2002: "PPUSTATUS", 0x2003: "OAMADDR",
+	0x2004: "OAMDATA", 0x2005: "PPUSCROLL", 0x2006: "PPUADDR", 0x2007: "PPUDATA",
+	0x4014: "OAMDMA", 0x4016: "JOY1", 0x4017: "JOY2",
+}
+
+// NewDisassembler create a disassembler of cartridge PRG in 16 KiB banks
+func NewDisassembler(cart *Cartridge) *Disassembler {
+	d := &Disassembler{
+		BankSize: 0x4000,
+		cart:     cart,
+		origins:  make(map[int]uint16),
+		labels:   make(map[disasmRef]*disasmLabel),
+		names:    make(map[string]disasmRef),
+	}
+	if len(cart.PRG) < d.BankSize {
+		d.BankSize = len(cart.PRG)
+	}
+	for addr, name := range hardwareLabels {
+		d.AddLabel(-1, addr, name, "")
+	}
+	return d
+}
+
+func (d *Disassembler) banks() int {
+	if d.BankSize == 0 {
+		return 0
+	}
+	return (len(d.cart.PRG) + d.BankSize - 1) / d.BankSize
+}
+
+// SetOrigin set the CPU address a bank is mapped at
+func (d *Disassembler) SetOrigin(bank int, addr uint16) {
+	d.origins[bank] = addr
+}
+
+// Origin return the CPU address a bank is mapped at
+func (d *Disassembler) Origin(bank int) uint16 {
+	if addr, ok := d.origins[bank]; ok {
+		return addr
+	}
+	if bank == d.banks()-1 {
+		return uint16(0x10000 - d.BankSize)
+	}
+	if addr := 0x10000 - 2*d.BankSize; addr >= 0x8000 {
+		return uint16(addr)
+	}
+	return 0x8000
+}
+
+// UseCDL separate code from data by a code/data log, bytes it logged as
+// code are followed too, and those logged only as data are not decoded.
+// Banks take the origin they were last mapped at when logged.
+func (d *Disassembler) UseCDL(l *CodeDataLogger) {
+	d.cdl = l
+	for bank := 0; bank < d.banks(); bank++ {
+		if _, ok := d.origins[bank]; ok {
+			continue
+		}
+		start := bank * d.BankSize
+		for off := start; off < start+d.bankLen(bank) && off < len(l.PRG); off++ {
+			if l.PRG[off]&(cdlCode|cdlData) == 0 {
+				continue
+			}
+			window := 0x8000 + int(l.PRG[off]&cdlBankMask>>2)*0x2000
+			origin := window - (off-start)&^0x1FFF
+			if origin >= 0x8000 && origin+d.bankLen(bank) <= 0x10000 {
+				d.origins[bank] = uint16(origin)
+			}
+			break
+		}
+	}
+}
+
+// AddEntry add a code entry point besides the vectors
+func (d *Disassembler) AddEntry(bank int, addr uint16) {
+	d.entries = append(d.entries, disasmRef{bank, addr})
+}
+
+// AddLabel name an address of a PRG bank, bank -1 for RAM and registers. A
+// name already used elsewhere gets the address appended.
+func (d *Disassembler) AddLabel(bank int, addr uint16, name, comment string) {
+	ref := disasmRef{bank, addr}
+	if old, ok := d.labels[ref]; ok {
+		if name == "" {
+			name = old.name
+		}
+		if comment == "" {
+			comment = old.comment
+		}
+		delete(d.names, old.name)
+	}
+	if name == "" {
+		return
+	}
+	if other, ok := d.names[name]; ok && other != ref {
+		if bank >= 0 && d.banks() > 1 {
+			name = fmt.Sprintf("%s_%02X_%04X", name, bank, addr)
+		} else {
+			name = fmt.Sprintf("%s_%04X", name, addr)
+		}
+	}
+	d.labels[ref] = &disasmLabel{name, comment}
+	d.names[name] = ref
+}
+
+// Label return the name of an address in a bank, as seen by the code of
+// that bank
+func (d *Disassembler) Label(bank int, addr uint16) string {
+	if l := d.label(bank, addr); l != nil {
+		return l.name
+	}
+	return ""
+}
+
+func (d *Disassembler) label(bank int, addr uint16) *disasmLabel {
+	if addr >= 0x8000 {
+		if b, ok := d.resolve(bank, addr); ok {
+			return d.labels[disasmRef{b, addr}]
+		}
+		return nil
+	}
+	if l, ok := d.labels[disasmRef{-1, addr}]; ok {
+		return l
+	}
+	switch {
+	case addr < 0x2000:
+		return d.labels[disasmRef{-1, addr & 0x07FF}]
+	case addr < 0x4000:
+		return d.labels[disasmRef{-1, addr & 0x2007}]
+	}
+	return nil
+}
+
+// resolve find the bank an address refers to from code of a bank, the bank
+// itself, the only bank mapped there, or the fixed bank
+func (d *Disassembler) resolve(bank int, addr uint16) (int, bool) {
+	if addr < 0x8000 || bank < 0 {
+		return 0, false
+	}
+	n := d.banks()
+	if n == 1 {
+		return 0, true // mirrored
+	}
+	if d.contains(bank, addr) {
+		return bank, true
+	}
+	found := -1
+	for b := 0; b < n; b++ {
+		if !d.contains(b, addr) {
+			continue
+		}
+		if b == n-1 {
+			return b, true
+		}
+		if found >= 0 {
+			return 0, false
+		}
+		found = b
+	}
+	return found, found >= 0
+}
+
+func (d *Disassembler) contains(bank int, addr uint16) bool {
+	origin := int(d.Origin(bank))
+	return int(addr) >= origin && int(addr) < origin+d.bankLen(bank)
+}
+
+func (d *Disassembler) bankLen(bank int) int {
+	if n := len(d.cart.PRG) - bank*d.BankSize; n < d.BankSize {
+		return n
+	}
+	return d.BankSize
+}
+
+// offset return the PRG offset of an address in a bank, -1 if outside
+func (d *Disassembler) offset(bank int, addr uint16) int {
+	if bank < 0 || bank >= d.banks() {
+		return -1
+	}
+	rel := int(addr) - int(d.Origin(bank))
+	if d.banks() == 1 && addr >= 0x8000 {
+		rel = (rel%d.BankSize + d.BankSize) % d.BankSize // mirrored
+	}
+	if rel < 0 || rel >= d.bankLen(bank) {
+		return -1
+	}
+	return bank*d.BankSize + rel
+}
+
+func (d *Disassembler) autoLabel(prefix string, bank int, addr uint16) {
+	ref := disasmRef{bank, addr}
+	if _, ok := d.labels[ref]; ok {
+		return
+	}
+	if d.banks() > 1 {
+		d.AddLabel(bank, addr, fmt.Sprintf("%s%02X_%04X", prefix, bank, addr), "")
+	} else {
+		d.AddLabel(bank, addr, fmt.Sprintf("%s%04X", prefix, addr), "")
+	}
+}
+
+// Run follow code from the entry points
+func (d *Disassembler) Run() {
+	d.kind = make([]uint8, len(d.cart.PRG))
+	var queue []disasmRef
+	vectors := []struct {
+		addr uint16
+		name string
+	}{{0xFFFA, "nmi"}, {0xFFFC, "reset"}, {0xFFFE, "irq"}}
+	for bank := 0; bank < d.banks(); bank++ {
+		if d.offset(bank, 0xFFFF) < 0 || d.offset(bank, 0xFFFA) < 0 {
+			continue
+		}
+		for _, v := range vectors {
+			off := d.offset(bank, v.addr)
+			d.kind[off], d.kind[off+1] = disasmData, disasmData
+			target := uint16(d.cart.PRG[off+1])<<8 | uint16(d.cart.PRG[off])
+			if b, ok := d.resolve(bank, target); ok {
+				if d.labels[disasmRef{b, target}] == nil {
+					d.AddLabel(b, target, v.name, "")
+				}
+				queue = append(queue, disasmRef{b, target})
+			}
+		}
+	}
+	queue = append(queue, d.entries...)
+	if d.cdl != nil {
+		n := len(d.kind)
+		if len(d.cdl.PRG) < n {
+			n = len(d.cdl.PRG)
+		}
+		for off := n - 1; off >= 0; off-- {
+			flags := d.cdl.PRG[off]
+			switch {
+			case flags&cdlCode != 0:
+				if off == 0 || d.cdl.PRG[off-1]&cdlCode == 0 {
+					bank := off / d.BankSize
+					queue = append(queue, disasmRef{bank, d.Origin(bank) + uint16(off%d.BankSize)})
+				}
+			case flags&cdlData != 0:
+				d.kind[off] = disasmData
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		ref := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		queue = d.trace(ref, queue)
+	}
+
+	// name data referenced by code
+	for off := 0; off < len(d.kind); off++ {
+		if d.kind[off] != disasmOpcode {
+			continue
+		}
+		ins := instructions[d.cart.PRG[off]]
+		if ins.id == insJMP || ins.id == insJSR {
+			continue
+		}
+		switch ins.addrMode {
+		case addrAbsolute, addrAbsoluteX, addrAbsoluteY:
+			bank := off / d.BankSize
+			addr := uint16(d.cart.PRG[off+2])<<8 | uint16(d.cart.PRG[off+1])
+			if b, ok := d.resolve(bank, addr); ok {
+				if o := d.offset(b, addr); o >= 0 && d.kind[o] != disasmOpcode && d.kind[o] != disasmOperand {
+					d.autoLabel("D", b, addr)
+				}
+			}
+		}
+	}
+	for off, k := range d.kind {
+		if k == disasmUnknown {
+			d.kind[off] = disasmData
+		}
+	}
+}
+
+// trace decode instructions from an address until flow ends, and return
+// queue with targets of jumps and branches added
+func (d *Disassembler) trace(ref disasmRef, queue []disasmRef) []disasmRef {
+	bank, pc := ref.bank, ref.addr
+	for {
+		off := d.offset(bank, pc)
+		if off < 0 || d.kind[off] != disasmUnknown {
+			return queue
+		}
+		op := d.cart.PRG[off]
+		ins := instructions[op]
+		size := int(instructionSizes[ins.addrMode])
+		if ins.id == insKIL || d.offset(bank, pc+uint16(size)-1) != off+size-1 {
+			return queue
+		}
+		for i := 1; i < size; i++ {
+			if d.kind[off+i] != disasmUnknown {
+				return queue // overlaps decoded code or data
+			}
+		}
+		d.kind[off] = disasmOpcode
+		for i := 1; i < size; i++ {
+			d.kind[off+i] = disasmOperand
+		}
+
+		var arg uint16
+		if size > 1 {
+			arg = uint16(d.cart.PRG[off+1])
+		}
+		if size > 2 {
+			arg |= uint16(d.cart.PRG[off+2]) << 8
+		}
+		follow := func(target uint16) {
+			if b, ok := d.resolve(bank, target); ok {
+				d.autoLabel("L", b, target)
+				queue = append(queue, disasmRef{b, target})
+			}
+		}
+		next := pc + uint16(size)
+		switch {
+		case ins.addrMode == addrRelative:
+			follow(next + uint16(int8(arg)))
+		case ins.id == insJSR:
+			follow(arg)
+		case ins.id == insJMP && ins.addrMode == addrAbsolute:
+			follow(arg)
+			return queue
+		case ins.id == insJMP, ins.id == insRTS, ins.id == insRTI, ins.id == insBRK:
+			return queue
+		}
+		pc = next
+	}
+}
+
+// IsCode tell if a PRG offset was found to be code, after Run
+func (d *Disassembler) IsCode(offset int) bool {
+	return d.kind != nil && (d.kind[offset] == disasmOpcode || d.kind[offset] == disasmOperand)
+}
+
+// operand format the operand of an instruction at pc of a bank, with labels
+// for addresses. ca65 forces absolute addressing of zero page addresses.
+func (d *Disassembler) operand(bank int, pc uint16, ins instruction, arg uint16, ca65 bool) string {
+	name := func(addr uint16, digits int) string {
+		s := fmt.Sprintf("$%0*X", digits, addr)
+		if l := d.label(bank, addr); l != nil {
+			s = l.name
+		}
+		if ca65 && digits == 4 && addr < 0x100 {
+			s = "a:" + s
+		}
+		return s
+	}
+	switch ins.addrMode {
+	case addrAccumulator:
+		return "A"
+	case addrImmediate:
+		return fmt.Sprintf("#$%02X", arg)
+	case addrZeroPage:
+		return name(arg, 2)
+	case addrZeroPageX:
+		return name(arg, 2) + ",X"
+	case addrZeroPageY:
+		return name(arg, 2) + ",Y"
+	case addrAbsolute:
+		return name(arg, 4)
+	case addrAbsoluteX:
+		return name(arg, 4) + ",X"
+	case addrAbsoluteY:
+		return name(arg, 4) + ",Y"
+	case addrIndirect:
+		return "(" + name(arg, 4) + ")"
+	case addrIndexedIndirect:
+		return "(" + name(arg, 2) + ",X)"
+	case addrIndirectIndexed:
+		return "(" + name(arg, 2) + "),Y"
+	case addrRelative:
+		return name(pc+2+uint16(int8(arg)), 4)
+	}
+	return ""
+}
+
+// mnemonic return name of an opcode, as Nintendulator does for unofficial
+func mnemonic(op byte) string {
+	ins := instructions[op]
+	if unofficial(op) {
+		if name, ok := unofficialNames[ins.id]; ok {
+			return name
+		}
+	}
+	return instructionNames[ins.id]
+}
+
+// disasmLine - a line of code or data at an address of a bank
+type disasmLine struct {
+	bank   int
+	addr   uint16
+	offset int
+	size   int
+	code   bool
+}
+
+// lines split a bank into instructions and rows of data, rows end at
+// labels
+func (d *Disassembler) lines(bank int) []disasmLine {
+	var lines []disasmLine
+	origin := d.Origin(bank)
+	start := bank * d.BankSize
+	end := start + d.bankLen(bank)
+	for off := start; off < end; {
+		addr := origin + uint16(off-start)
+		if d.kind[off] == disasmOpcode {
+			size := int(instructionSizes[instructions[d.cart.PRG[off]].addrMode])
+			lines = append(lines, disasmLine{bank, addr, off, size, true})
+			off += size
+			continue
+		}
+		size := 1
+		for off+size < end && size < 8 && d.kind[off+size] != disasmOpcode &&
+			d.labels[disasmRef{bank, addr + uint16(size)}] == nil {
+			size++
+		}
+		lines = append(lines, disasmLine{bank, addr, off, size, false})
+		off += size
+	}
+	return lines
+}
+
+// Listing write code of all banks with bank numbered addresses, e.g.
+//
+//	reset:
+//	01:C000  78        SEI
+//	01:C001  D0 FE     BNE reset
+func (d *Disassembler) Listing(w io.Writer) error {
+	if d.kind == nil {
+		d.Run()
+	}
+	bw := bufio.NewWriter(w)
+	for bank := 0; bank < d.banks(); bank++ {
+		for _, line := range d.lines(bank) {
+			if l := d.labels[disasmRef{bank, line.addr}]; l != nil {
+				fmt.Fprintf(bw, "%s:", l.name)
+				if l.comment != "" {
+					fmt.Fprintf(bw, " ; %s", l.comment)
+				}
+				bw.WriteByte('\n')
+			}
+			b := d.cart.PRG[line.offset : line.offset+line.size]
+			if !line.code {
+				fmt.Fprintf(bw, "%02X:%04X  .byte %s\n", bank, line.addr, strings.ReplaceAll(hexBytes(b, "$"), " ", ","))
+				continue
+			}
+			text := mnemonic(b[0])
+			if op := d.operand(bank, line.addr, instructions[b[0]], lineArg(b), false); op != "" {
+				text += " " + op
+			}
+			fmt.Fprintf(bw, "%02X:%04X  %-8s  %s\n", bank, line.addr, hexBytes(b, ""), text)
+		}
+	}
+	return bw.Flush()
+}
+
+func lineArg(b []byte) uint16 {
+	var arg uint16
+	if len(b) > 1 {
+		arg = uint16(b[1])
+	}
+	if len(b) > 2 {
+		arg |= uint16(b[2]) << 8
+	}
+	return arg
+}
+
+// WriteCA65 write source reassembling to PRG with ca65. Each bank is put
+// in segment BANKnn, to be placed by the linker config in order. Unofficial
+// opcodes are written as bytes, since some have more than an encoding.
+func (d *Disassembler) WriteCA65(w io.Writer) error {
+	if d.kind == nil {
+		d.Run()
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "; %d PRG banks of %d bytes\n\n", d.banks(), d.BankSize)
+
+	// labels not at the start of a line are defined by value
+	defined := make(map[disasmRef]bool)
+	bankLines := make([][]disasmLine, d.banks())
+	for bank := range bankLines {
+		bankLines[bank] = d.lines(bank)
+		for _, line := range bankLines[bank] {
+			defined[disasmRef{bank, line.addr}] = true
+		}
+	}
+	refs := make([]disasmRef, 0, len(d.labels))
+	for ref := range d.labels {
+		if !defined[ref] {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].bank != refs[j].bank {
+			return refs[i].bank < refs[j].bank
+		}
+		return refs[i].addr < refs[j].addr
+	})
+	for _, ref := range refs {
+		l := d.labels[ref]
+		fmt.Fprintf(bw, "%s = $%04X", l.name, ref.addr)
+		if l.comment != "" {
+			fmt.Fprintf(bw, " ; %s", l.comment)
+		}
+		bw.WriteByte('\n')
+	}
+
+	for bank, lines := range bankLines {
+		fmt.Fprintf(bw, "\n.segment \"BANK%02X\"\n.org $%04X\n", bank, d.Origin(bank))
+		for _, line := range lines {
+			if l := d.labels[disasmRef{bank, line.addr}]; l != nil {
+				fmt.Fprintf(bw, "%s:", l.name)
+				if l.comment != "" {
+					fmt.Fprintf(bw, " ; %s", l.comment)
+				}
+				bw.WriteByte('\n')
+			}
+			b := d.cart.PRG[line.offset : line.offset+line.size]
+			switch {
+			case !line.code:
+				fmt.Fprintf(bw, "\t.byte %s\n", strings.ReplaceAll(hexBytes(b, "$"), " ", ","))
+			case unofficial(b[0]):
+				fmt.Fprintf(bw, "\t.byte %s ; %s\n", strings.ReplaceAll(hexBytes(b, "$"), " ", ","),
+					strings.TrimSpace(mnemonic(b[0])+" "+d.operand(bank, line.addr, instructions[b[0]], lineArg(b), false)))
+			default:
+				text := strings.ToLower(mnemonic(b[0]))
+				if op := d.operand(bank, line.addr, instructions[b[0]], lineArg(b), true); op != "" {
+					text += " " + op
+				}
+				fmt.Fprintf(bw, "\t%s\n", text)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadLabels import labels from a symbol file by its extension, ca65 .dbg,
+// Mesen .mlb or FCEUX .nl, named like game.nes.1.nl for bank 1 and
+// game.nes.ram.nl for RAM
+func (d *Disassembler) LoadLabels(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".dbg":
+		return d.ReadCA65Labels(file)
+	case ".mlb":
+		return d.ReadMesenLabels(file)
+	case ".nl":
+		bank := -1
+		name := strings.TrimSuffix(path, filepath.Ext(path))
+		if b := strings.TrimPrefix(filepath.Ext(name), "."); b != "ram" {
+			n, err := strconv.ParseUint(b, 16, 16)
+			if err != nil {
+				return fmt.Errorf("%s: no bank number in name", path)
+			}
+			bank = int(n)
+		}
+		return d.ReadFCEUXLabels(file, bank)
+	default:
+		return fmt.Errorf("%s: unknown symbol file type", path)
+	}
+}
+
+// ReadFCEUXLabels import FCEUX name list of a bank, -1 for RAM, lines like
+//
+//	$C000#Reset#comment
+//
+// http://fceux.com/web/help/NLFilesFormat.html
+func (d *Disassembler) ReadFCEUXLabels(r io.Reader, bank int) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "#", 3)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "$") {
+			return fmt.Errorf("line %d: invalid name list entry", n)
+		}
+		addr := strings.SplitN(fields[0][1:], "/", 2)[0]
+		v, err := strconv.ParseUint(addr, 16, 16)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address %q", n, addr)
+		}
+		var comment string
+		if len(fields) > 2 {
+			comment = strings.TrimSpace(fields[2])
+		}
+		if v < 0x8000 {
+			d.AddLabel(-1, uint16(v), fields[1], comment)
+		} else {
+			d.AddLabel(bank, uint16(v), fields[1], comment)
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadMesenLabels import Mesen labels, lines like
+//
+//	P:0010:Label:comment
+//
+// with memory type P (PRG ROM offset), R (internal RAM), W/S (PRG RAM) or
+// G (register), or their Mesen 2 names NesPrgRom, NesInternalRam...
+func (d *Disassembler) ReadMesenLabels(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: invalid label entry", n)
+		}
+		addr := strings.SplitN(fields[1], "-", 2)[0]
+		v, err := strconv.ParseUint(addr, 16, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address %q", n, addr)
+		}
+		var comment string
+		if len(fields) > 3 {
+			comment = strings.ReplaceAll(fields[3], `\n`, " ")
+		}
+		if fields[2] == "" {
+			continue // comment only
+		}
+		switch fields[0] {
+		case "P", "NesPrgRom":
+			if d.BankSize == 0 || int(v) >= len(d.cart.PRG) {
+				return fmt.Errorf("line %d: PRG offset %X out of range", n, v)
+			}
+			bank := int(v) / d.BankSize
+			d.AddLabel(bank, d.Origin(bank)+uint16(int(v)%d.BankSize), fields[2], comment)
+		case "R", "NesInternalRam":
+			d.AddLabel(-1, uint16(v&0x07FF), fields[2], comment)
+		case "W", "S", "NesWorkRam", "NesSaveRam":
+			d.AddLabel(-1, 0x6000+uint16(v&0x1FFF), fields[2], comment)
+		case "G", "NesMemory":
+			d.AddLabel(-1, uint16(v), fields[2], comment)
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadCA65Labels import labels of a ld65 debug file (--dbgfile), symbols
+// in ROM segments are placed by their offset in the output file
+func (d *Disassembler) ReadCA65Labels(r io.Reader) error {
+	type segment struct {
+		start  int
+		offset int // -1 if not in ROM
+	}
+	segments := make(map[string]segment)
+	var syms []map[string]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			continue
+		}
+		kind := line[:i]
+		if kind != "seg" && kind != "sym" {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, kv := range strings.Split(strings.TrimSpace(line[i:]), ",") {
+			if j := strings.IndexByte(kv, '='); j > 0 {
+				attrs[kv[:j]] = strings.Trim(kv[j+1:], `"`)
+			}
+		}
+		if kind == "sym" {
+			syms = append(syms, attrs)
+			continue
+		}
+		seg := segment{offset: -1}
+		start, _ := strconv.ParseInt(attrs["start"], 0, 32)
+		seg.start = int(start)
+		if ooffs, ok := attrs["ooffs"]; ok && attrs["type"] == "ro" {
+			off, _ := strconv.ParseInt(ooffs, 0, 32)
+			seg.offset = int(off) - 16 - len(d.cart.Trainer)
+		}
+		segments[attrs["id"]] = seg
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, sym := range syms {
+		if sym["type"] != "lab" || strings.HasPrefix(sym["name"], "@") {
+			continue
+		}
+		v, err := strconv.ParseInt(sym["val"], 0, 32)
+		if err != nil || v < 0 || v > 0xFFFF {
+			continue
+		}
+		addr := uint16(v)
+		seg, ok := segments[sym["seg"]]
+		if !ok || seg.offset < 0 {
+			d.AddLabel(-1, addr, sym["name"], "")
+			continue
+		}
+		off := seg.offset + int(addr) - seg.start
+		if off < 0 || off >= len(d.cart.PRG) || d.BankSize == 0 {
+			continue
+		}
+		d.AddLabel(off/d.BankSize, addr, sym["name"], "")
+	}
+	return nil
+}
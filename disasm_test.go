@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// disasmProgram has a table only reached as data, and an unofficial NOP
+const disasmProgram = `
+reset:  SEI
+        LDX #0
+loop:   LDA table,X
+        BEQ done
+        JSR sub
+        INX
+        BNE loop
+done:   JMP done
+sub:    STA $2007
+        .byte $04, $10
+        RTS
+table:  .byte 1, 2, 0
+nmi:    RTI
+`
+
+// addresses of disasmProgram
+const (
+	disasmLoop  = 0xC003
+	disasmDone  = 0xC00E
+	disasmSub   = 0xC011
+	disasmTable = 0xC017
+	disasmNMI   = 0xC01A
+)
+
+// newDisasmCart put disasmProgram in a 16 KiB PRG with its vectors
+func newDisasmCart(t *testing.T) *Cartridge {
+	t.Helper()
+	code, err := Assemble(disasmProgram, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart := &Cartridge{PRG: make([]byte, 0x4000)}
+	copy(cart.PRG, code)
+	copy(cart.PRG[0x3FFA:], []byte{disasmNMI & 0xFF, disasmNMI >> 8, 0x00, 0xC0, disasmNMI & 0xFF, disasmNMI >> 8})
+	return cart
+}
+
+func TestDisasmFlow(t *testing.T) {
+	d := NewDisassembler(newDisasmCart(t))
+	d.Run()
+	for addr, code := range map[uint16]bool{
+		0xC000: true, disasmLoop + 1: true, disasmSub: true, disasmSub + 3: true, disasmNMI: true,
+		disasmTable: false, disasmTable + 2: false, disasmNMI + 1: false, 0xFFFC: false,
+	} {
+		if d.IsCode(int(addr-0xC000)) != code {
+			t.Errorf("$%04X is code %v, want %v", addr, !code, code)
+		}
+	}
+	for addr, want := range map[uint16]string{
+		0xC000: "reset", disasmNMI: "nmi", disasmLoop: "LC003", disasmSub: "LC011", disasmTable: "DC017", 0x2007: "PPUDATA",
+	} {
+		if l := d.Label(0, addr); l != want {
+			t.Errorf("label of $%04X %q, want %q", addr, l, want)
+		}
+	}
+
+	var listing bytes.Buffer
+	if err := d.Listing(&listing); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"reset:\n00:C000  78        SEI\n",
+		"00:C003  BD 17 C0  LDA DC017,X\n",
+		"00:C011  8D 07 20  STA PPUDATA\n",
+		"00:C00E  4C 0E C0  JMP LC00E\n",
+		"DC017:\n00:C017  .byte $01,$02,$00\n",
+	} {
+		if !strings.Contains(listing.String(), want) {
+			t.Errorf("listing without %q:\n%s", want, listing.String())
+		}
+	}
+}
+
+func TestDisasmLabels(t *testing.T) {
+	d := NewDisassembler(newDisasmCart(t))
+	dir := t.TempDir()
+	files := map[string]string{
+		"game.nes.0.nl":   "$C000#Start#entry point\n$C003#Loop#\n",
+		"game.nes.ram.nl": "$0010#counter#\n",
+		"game.mlb":        "P:0011:Sub:writes a tile\nR:0811:Other\nW:0000:Save\nG:2007:Data\n",
+		"game.dbg": "version\tmajor=2,minor=0\n" +
+			"seg\tid=0,name=\"CODE\",start=0x00C000,size=0x4000,addrsize=absolute,type=ro,oname=\"game.nes\",ooffs=16\n" +
+			"seg\tid=1,name=\"ZEROPAGE\",start=0x000000,size=0x0010,addrsize=zeropage,type=rw\n" +
+			"sym\tid=0,name=\"table\",addrsize=absolute,scope=0,def=1,val=0xC017,seg=0,type=lab\n" +
+			"sym\tid=1,name=\"ptr\",addrsize=zeropage,scope=0,def=2,val=0x2,seg=1,type=lab\n" +
+			"sym\tid=2,name=\"@skip\",addrsize=absolute,scope=0,def=3,val=0xC00E,seg=0,type=lab\n" +
+			"sym\tid=3,name=\"SIZE\",addrsize=zeropage,scope=0,def=4,val=0x3,type=equ\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.LoadLabels(path); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	for addr, want := range map[uint16]string{
+		0xC000: "Start", disasmLoop: "Loop", 0x10: "counter", disasmSub: "Sub", 0x0011: "Other",
+		0x6000: "Save", 0x2007: "Data", disasmTable: "table", 0x0002: "ptr", disasmDone: "", 0x0003: "",
+	} {
+		if l := d.Label(0, addr); l != want {
+			t.Errorf("label of $%04X %q, want %q", addr, l, want)
+		}
+	}
+	if l := d.label(0, 0xC000); l.comment != "entry point" {
+		t.Errorf("comment %q, want that of the name list", l.comment)
+	}
+	d.AddLabel(-1, 0x20, "Loop", "")
+	if l := d.Label(0, 0x20); l != "Loop_0020" {
+		t.Errorf("label %q of a name used elsewhere, want Loop_0020", l)
+	}
+
+	bad := filepath.Join(dir, "game.nes.x.nl")
+	os.WriteFile(bad, nil, 0644)
+	if err := d.LoadLabels(bad); err == nil {
+		t.Error("loaded name list without bank number")
+	}
+	if err := d.ReadFCEUXLabels(strings.NewReader("C000#NoDollar#\n"), 0); err == nil {
+		t.Error("read invalid name list entry")
+	}
+}
+
+func TestDisasmCA65(t *testing.T) {
+	d := NewDisassembler(newDisasmCart(t))
+	d.AddLabel(-1, 0x10, "counter", "frames")
+	var src bytes.Buffer
+	if err := d.WriteCA65(&src); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"counter = $0010 ; frames\n",
+		"PPUDATA = $2007\n",
+		".segment \"BANK00\"\n.org $C000\n",
+		"reset:\n\tsei\n\tldx #$00\nLC003:\n\tlda DC017,X\n",
+		"\tjmp LC00E\n",
+		"\t.byte $04,$10 ; NOP counter\n",
+		"DC017:\n\t.byte $01,$02,$00\n",
+		"nmi:\n\trti\n",
+	} {
+		if !strings.Contains(src.String(), want) {
+			t.Errorf("ca65 source without %q:\n%s", want, src.String())
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a compiled condition of debugger, e.g. "A == $20 && X > 3".
+// Numbers are decimal, $hex, 0xhex or %binary. Names are registers A, X,
+// Y, SP, P, PC, flags C, Z, I, D, V, N, and SCANLINE, DOT, FRAME, CYCLE,
+// ADDR and VALUE of the memory access. [addr] reads a byte of memory.
+// Operators and their precedence are the same as C.
+type expr func(ctx *exprContext) int
+
+type exprContext struct {
+	con   *Console
+	addr  uint16
+	value byte
+}
+
+var exprNames = map[string]expr{
+	"A":  func(c *exprContext) int { return int(c.con.CPU.A) },
+	"X":  func(c *exprContext) int { return int(c.con.CPU.X) },
+	"Y":  func(c *exprContext) int { return int(c.con.CPU.Y) },
+	"SP": func(c *exprContext) int { return int(c.con.CPU.S) },
+	"S":  func(c *exprContext) int { return int(c.con.CPU.S) },
+	"P":  func(c *exprContext) int { return int(c.con.CPU.flag() | 0x20) },
+	"PC": func(c *exprContext) int { return int(c.con.CPU.PC) },
+	"C":  func(c *exprContext) int { return int(c.con.CPU.C) },
+	"Z":  func(c *exprContext) int { return int(c.con.CPU.Z) },
+	"I":  func(c *exprContext) int { return int(c.con.CPU.I) },
+	"D":  func(c *exprContext) int { return int(c.con.CPU.D) },
+	"V":  func(c *exprContext) int { return int(c.con.CPU.V) },
+	"N":  func(c *exprContext) int { return int(c.con.CPU.N) },
+	"SCANLINE": func(c *exprContext) int {
+		line, _ := c.con.ppuPosition()
+		return line
+	},
+	"DOT": func(c *exprContext) int {
+		_, dot := c.con.ppuPosition()
+		return dot
+	},
+	"FRAME": func(c *exprContext) int { return int(c.con.frame) },
+	"CYCLE": func(c *exprContext) int { return int(c.con.CPU.cycles) },
+	"ADDR":  func(c *exprContext) int { return int(c.addr) },
+	"VALUE": func(c *exprContext) int { return int(c.value) },
+}
+
+// binary operators by precedence, higher binds tighter
+var exprOperators = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+type exprParser struct {
+	src    string
+	tokens []string
+	pos    int
+
+	// names resolve names instead of exprNames, and enable assembler
+	// syntax, * for the program counter and < > for low and high byte
+	names func(name string) expr
+}
+
+func compileExpr(src string) (expr, error) {
+	return (&exprParser{src: src}).compile()
+}
+
+func (p *exprParser) compile() (expr, error) {
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	e, err := p.parse(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos], p.src)
+	}
+	return e, nil
+}
+
+func (p *exprParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case isExprWord(c) || c == '$':
+			j := i + 1
+			for j < len(s) && isExprWord(s[j]) {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		case c == '%' && (len(p.tokens) == 0 || !p.operand(len(p.tokens)-1)) && i+1 < len(s) && isExprWord(s[i+1]):
+			// binary number where an operand is expected
+			j := i + 1
+			for j < len(s) && isExprWord(s[j]) {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		default:
+			if i+1 < len(s) {
+				if _, ok := exprOperators[s[i:i+2]]; ok {
+					p.tokens = append(p.tokens, s[i:i+2])
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("|^&<>+-*/%!~()[]", rune(c)) {
+				return fmt.Errorf("unexpected %q in %q", c, p.src)
+			}
+			p.tokens = append(p.tokens, s[i:i+1])
+			i++
+		}
+	}
+	return nil
+}
+
+// operand tell if the i-th token ends an operand
+func (p *exprParser) operand(i int) bool {
+	t := p.tokens[i]
+	return t == ")" || t == "]" || isExprWord(t[0]) || t[0] == '$'
+}
+
+func isExprWord(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func (p *exprParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// parse parse operators of precedence at least prec
+func (p *exprParser) parse(prec int) (expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		opPrec, ok := exprOperators[op]
+		if !ok || opPrec < prec {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parse(opPrec + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = binaryExpr(op, lhs, rhs)
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	t := p.next()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of %q", p.src)
+	case "!", "~", "-":
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case "!":
+			return func(c *exprContext) int { return exprBool(e(c) == 0) }, nil
+		case "~":
+			return func(c *exprContext) int { return ^e(c) }, nil
+		default:
+			return func(c *exprContext) int { return -e(c) }, nil
+		}
+	case "(", "[":
+		if t == "[" && p.names != nil {
+			return nil, fmt.Errorf("unexpected %q in %q", t, p.src)
+		}
+		e, err := p.parse(1)
+		if err != nil {
+			return nil, err
+		}
+		closing := map[string]string{"(": ")", "[": "]"}[t]
+		if p.next() != closing {
+			return nil, fmt.Errorf("missing %q in %q", closing, p.src)
+		}
+		if t == "(" {
+			return e, nil
+		}
+		return func(c *exprContext) int {
+			return int(c.con.Peek(uint16(e(c))))
+		}, nil
+	}
+
+	if p.names != nil {
+		switch t {
+		case "*":
+			return p.names(t), nil
+		case "<", ">":
+			e, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			if t == "<" {
+				return func(c *exprContext) int { return e(c) & 0xFF }, nil
+			}
+			return func(c *exprContext) int { return e(c) >> 8 & 0xFF }, nil
+		}
+		if c := t[0]; c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			return p.names(t), nil
+		}
+	} else if f, ok := exprNames[strings.ToUpper(t)]; ok {
+		return f, nil
+	}
+	var (
+		n   int64
+		err error
+	)
+	switch {
+	case t[0] == '$':
+		n, err = strconv.ParseInt(t[1:], 16, 64)
+	case t[0] == '%':
+		n, err = strconv.ParseInt(t[1:], 2, 64)
+	default:
+		n, err = strconv.ParseInt(t, 0, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q in %q", t, p.src)
+	}
+	v := int(n)
+	return func(*exprContext) int { return v }, nil
+}
+
+func binaryExpr(op string, l, r expr) expr {
+	switch op {
+	case "||":
+		return func(c *exprContext) int { return exprBool(l(c) != 0 || r(c) != 0) }
+	case "&&":
+		return func(c *exprContext) int { return exprBool(l(c) != 0 && r(c) != 0) }
+	case "|":
+		return func(c *exprContext) int { return l(c) | r(c) }
+	case "^":
+		return func(c *exprContext) int { return l(c) ^ r(c) }
+	case "&":
+		return func(c *exprContext) int { return l(c) & r(c) }
+	case "==":
+		return func(c *exprContext) int { return exprBool(l(c) == r(c)) }
+	case "!=":
+		return func(c *exprContext) int { return exprBool(l(c) != r(c)) }
+	case "<":
+		return func(c *exprContext) int { return exprBool(l(c) < r(c)) }
+	case "<=":
+		return func(c *exprContext) int { return exprBool(l(c) <= r(c)) }
+	case ">":
+		return func(c *exprContext) int { return exprBool(l(c) > r(c)) }
+	case ">=":
+		return func(c *exprContext) int { return exprBool(l(c) >= r(c)) }
+	case "<<":
+		return func(c *exprContext) int { return l(c) << uint(r(c)&63) }
+	case ">>":
+		return func(c *exprContext) int { return l(c) >> uint(r(c)&63) }
+	case "+":
+		return func(c *exprContext) int { return l(c) + r(c) }
+	case "-":
+		return func(c *exprContext) int { return l(c) - r(c) }
+	case "*":
+		return func(c *exprContext) int { return l(c) * r(c) }
+	case "/":
+		return func(c *exprContext) int {
+			if d := r(c); d != 0 {
+				return l(c) / d
+			}
+			return 0
+		}
+	default: // "%"
+		return func(c *exprContext) int {
+			if d := r(c); d != 0 {
+				return l(c) % d
+			}
+			return 0
+		}
+	}
+}
+
+func exprBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
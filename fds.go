@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// Famicom Disk System images, .fds files are sides of 65500 bytes of
+// blocks without the gaps and CRCs a drive reads between them, after an
+// optional header of fwNES
+// http://wiki.nesdev.com/w/index.php/FDS_file_format
+const (
+	fdsSideSize   = 65500
+	fdsTrackSize  = 80000     // bytes a drive reads of a side, gaps and CRCs included
+	fdsLeadIn     = 28300 / 8 // gap before the first block
+	fdsBlockGap   = 976 / 8   // gap after a block
+	fdsHeaderSize = 16
+	fdsMapper     = 20 // iNES mapper reserved for FDS
+	fdsBIOSFile   = "disksys.rom"
+)
+
+var fdsMagic = []byte("FDS\x1a")
+
+// fdsImage - disk of a Famicom Disk System, its sides as loaded and as
+// tracks a drive reads and writes
+type fdsImage struct {
+	Header []byte   // of fwNES, nil if the file has none
+	Sides  [][]byte // as loaded, for writes to be saved as a patch
+	Tracks [][]byte
+}
+
+// loadFDSFile load a disk image to run with the BIOS of RAM adapter,
+// disksys.rom, at biosPath
+func loadFDSFile(path, biosPath string) (*Cartridge, error) {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bios, err := os.ReadFile(biosPath)
+	if err != nil {
+		return nil, err
+	}
+	return loadFDS(image, bios)
+}
+
+// loadFDS make a cartridge of RAM adapter, its BIOS in PRG at $E000 and
+// 32 KiB of PRG RAM at $6000-$DFFF as SRAM, with a disk inserted
+func loadFDS(image, bios []byte) (*Cartridge, error) {
+	if len(bios) != 0x2000 {
+		return nil, errors.New("invalid FDS BIOS")
+	}
+	disk := new(fdsImage)
+	if bytes.HasPrefix(image, fdsMagic) {
+		disk.Header = append([]byte(nil), image[:fdsHeaderSize]...)
+		image = image[fdsHeaderSize:]
+	}
+	for len(image) >= fdsSideSize {
+		side := append([]byte(nil), image[:fdsSideSize]...)
+		if side[0] != 1 {
+			return nil, errors.New("invalid FDS disk side")
+		}
+		disk.Sides = append(disk.Sides, side)
+		image = image[fdsSideSize:]
+	}
+	if len(disk.Sides) == 0 {
+		return nil, errors.New("invalid FDS image")
+	}
+	disk.buildTracks()
+	return &Cartridge{
+		Mapper:    fdsMapper,
+		Mirroring: mirrorHorizontal,
+		PRG:       append([]byte(nil), bios...),
+		Chr:       make([]byte, 0x2000),
+		ChrRAM:    true,
+		SRAM:      make([]byte, 0x8000),
+		Disk:      disk,
+	}, nil
+}
+
+func (d *fdsImage) buildTracks() {
+	d.Tracks = make([][]byte, len(d.Sides))
+	for i, side := range d.Sides {
+		d.Tracks[i] = fdsTrack(side)
+	}
+}
+
+// fdsTrack add gaps, a mark ending each gap and CRC of each block, as a
+// drive reads a side, up to the first block of an unknown type
+func fdsTrack(side []byte) []byte {
+	track := make([]byte, fdsLeadIn, fdsTrackSize)
+	for i := 0; i < len(side); {
+		n := fdsBlockSize(side[i], side[:i])
+		if n == 0 || i+n > len(side) || len(track)+n+3+fdsBlockGap > fdsTrackSize {
+			break
+		}
+		block := side[i : i+n]
+		crc := fdsCRC(0, 0x80)
+		for _, b := range block {
+			crc = fdsCRC(crc, b)
+		}
+		crc = fdsCRC(fdsCRC(crc, 0), 0)
+		track = append(track, 0x80)
+		track = append(track, block...)
+		track = append(track, byte(crc), byte(crc>>8))
+		track = append(track, make([]byte, fdsBlockGap)...)
+		i += n
+	}
+	return track[:fdsTrackSize]
+}
+
+// fdsBlockSize return the size of a block of a type, 0 if unknown, after
+// the blocks of a side before it. The size of a file, block 4, is in the
+// file header, block 3, just before
+func fdsBlockSize(kind byte, before []byte) int {
+	switch n := len(before); {
+	case kind == 1:
+		return 56
+	case kind == 2:
+		return 2
+	case kind == 3:
+		return 16
+	case kind == 4 && n >= 16 && before[n-16] == 3:
+		return 1 + (int(before[n-3]) | int(before[n-2])<<8)
+	}
+	return 0
+}
+
+// fdsSide strip gaps and CRCs of a track, reverse of fdsTrack, return the
+// blocks of the side
+func fdsSide(track []byte) []byte {
+	var side []byte
+	for i := 0; i < len(track); {
+		if track[i] != 0x80 {
+			i++
+			continue
+		}
+		i++
+		n := 0
+		if i < len(track) {
+			n = fdsBlockSize(track[i], side)
+		}
+		if n == 0 || i+n > len(track) || len(side)+n > fdsSideSize {
+			break
+		}
+		side = append(side, track[i:i+n]...)
+		i += n + 2
+	}
+	return side
+}
+
+// fdsCRC add a byte to CRC-16 of the drive, of polynomial $8408 shifted
+// in from the top
+func fdsCRC(crc uint16, val byte) uint16 {
+	for bit := byte(1); bit != 0; bit <<= 1 {
+		carry := crc & 1
+		crc >>= 1
+		if carry != 0 {
+			crc ^= 0x8408
+		}
+		if val&bit != 0 {
+			crc ^= 0x8000
+		}
+	}
+	return crc
+}
+
+// image return the .fds file of the disk as loaded, or as written, over
+// what is left of the side past its last block
+func (d *fdsImage) image(written bool) []byte {
+	image := append([]byte(nil), d.Header...)
+	for i, side := range d.Sides {
+		n := len(image)
+		image = append(image, side...)
+		if written {
+			copy(image[n:], fdsSide(d.Tracks[i]))
+		}
+	}
+	return image
+}
+
+// SaveDiskIPS write what was written to the disk as an IPS patch of the
+// .fds file, which is left untouched
+// http://fileformats.archiveteam.org/wiki/IPS_(binary_patch_format)
+func (c *Cartridge) SaveDiskIPS(w io.Writer) error {
+	if c.Disk == nil {
+		return errors.New("no FDS disk")
+	}
+	from, to := c.Disk.image(false), c.Disk.image(true)
+	bw := bufio.NewWriter(w)
+	bw.WriteString("PATCH")
+	for i := 0; i < len(to); {
+		if from[i] == to[i] {
+			i++
+			continue
+		}
+		if i == 0x454F46 { // would read as "EOF"
+			i--
+		}
+		n := 0
+		for i+n < len(to) && n < 0xFFFF && (from[i+n] != to[i+n] || n == 0) {
+			n++
+		}
+		bw.Write([]byte{byte(i >> 16), byte(i >> 8), byte(i), byte(n >> 8), byte(n)})
+		bw.Write(to[i : i+n])
+		i += n
+	}
+	bw.WriteString("EOF")
+	return bw.Flush()
+}
+
+// loadDiskIPSFile apply the IPS patch at path, if there is one
+func (c *Cartridge) loadDiskIPSFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.LoadDiskIPS(file)
+}
+
+// saveDiskIPSFile write the IPS patch of the disk at path
+func (c *Cartridge) saveDiskIPSFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := c.SaveDiskIPS(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadDiskIPS apply an IPS patch, as written by SaveDiskIPS, to the disk
+// as loaded
+func (c *Cartridge) LoadDiskIPS(r io.Reader) error {
+	if c.Disk == nil {
+		return errors.New("no FDS disk")
+	}
+	image := c.Disk.image(false)
+	br := bufio.NewReader(r)
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != "PATCH" {
+		return errors.New("invalid IPS patch")
+	}
+	for {
+		var rec [5]byte
+		if _, err := io.ReadFull(br, rec[:3]); err != nil {
+			return err
+		}
+		if string(rec[:3]) == "EOF" {
+			break
+		}
+		if _, err := io.ReadFull(br, rec[3:]); err != nil {
+			return err
+		}
+		off := int(rec[0])<<16 | int(rec[1])<<8 | int(rec[2])
+		n := int(rec[3])<<8 | int(rec[4])
+		data := make([]byte, n)
+		if n == 0 { // run of a byte
+			var run [3]byte
+			if _, err := io.ReadFull(br, run[:]); err != nil {
+				return err
+			}
+			n = int(run[0])<<8 | int(run[1])
+			data = bytes.Repeat(run[2:], n)
+		} else if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		if off+n > len(image) {
+			return errors.New("IPS patch out of FDS image")
+		}
+		copy(image[off:], data)
+	}
+	image = image[len(c.Disk.Header):]
+	for i := range c.Disk.Tracks {
+		c.Disk.Tracks[i] = fdsTrack(image[i*fdsSideSize : (i+1)*fdsSideSize])
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFDSImage make an image of two sides, each of a file of 4 bytes
+func testFDSImage(header bool) []byte {
+	side := make([]byte, fdsSideSize)
+	copy(side, "\x01*NINTENDO-HVC*")
+	copy(side[56:], []byte{2, 1})
+	copy(side[58:], []byte{3, 0, 0, 'F', 'I', 'L', 'E', ' ', ' ', ' ', ' ', 0, 0x60, 4, 0, 0})
+	copy(side[74:], []byte{4, 0xDE, 0xAD, 0xBE, 0xEF})
+	var image []byte
+	if header {
+		image = append([]byte("FDS\x1a\x02"), make([]byte, 11)...)
+	}
+	return append(append(image, side...), side...)
+}
+
+func newFDSConsole(t *testing.T, image []byte) *Console {
+	t.Helper()
+	cart, err := loadFDS(image, make([]byte, 0x2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := new(Console)
+	con.Connect(new(CPU))
+	con.Connect(new(PPU))
+	if err := con.Connect(cart); err != nil {
+		t.Fatal(err)
+	}
+	con.Reset()
+	return con
+}
+
+func TestFDSImage(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		cart, err := loadFDS(testFDSImage(header), make([]byte, 0x2000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cart.Disk.Tracks); n != 2 || (cart.Disk.Header != nil) != header {
+			t.Errorf("header %v: %d sides, header %v", header, n, cart.Disk.Header != nil)
+		}
+	}
+	if _, err := loadFDS(testFDSImage(false), make([]byte, 0x1000)); err == nil {
+		t.Error("loaded with BIOS of 4 KiB")
+	}
+	if _, err := loadFDS(testFDSImage(false)[:1000], make([]byte, 0x2000)); err == nil {
+		t.Error("loaded image without a side")
+	}
+
+	side := testFDSImage(false)[:fdsSideSize]
+	track := fdsTrack(side)
+	if len(track) != fdsTrackSize || track[fdsLeadIn-1] != 0 || track[fdsLeadIn] != 0x80 || track[fdsLeadIn+1] != 1 {
+		t.Fatalf("track of %d bytes, lead-in %v", len(track), track[fdsLeadIn-1:fdsLeadIn+2])
+	}
+	var crc uint16
+	for _, b := range track[fdsLeadIn : fdsLeadIn+1+56+2] {
+		crc = fdsCRC(crc, b)
+	}
+	if crc != 0 {
+		t.Errorf("CRC of block with its CRC %04X, want 0", crc)
+	}
+	if got := fdsSide(track); !bytes.Equal(got, side[:79]) {
+		t.Errorf("side of track %d bytes, want the 79 bytes of its blocks", len(got))
+	}
+}
+
+func TestFDSDiskIPS(t *testing.T) {
+	image := testFDSImage(true)
+	con := newFDSConsole(t, image)
+	disk := con.Cartridge.Disk
+	// file of side B rewritten, at its first byte past the block type
+	track := disk.Tracks[1]
+	i := bytes.Index(track, []byte{4, 0xDE, 0xAD})
+	track[i+1], track[i+2] = 0x12, 0x34
+
+	var patch bytes.Buffer
+	if err := con.Cartridge.SaveDiskIPS(&patch); err != nil {
+		t.Fatal(err)
+	}
+	off := fdsHeaderSize + fdsSideSize + 75
+	want := "PATCH" + string([]byte{byte(off >> 16), byte(off >> 8), byte(off), 0, 2, 0x12, 0x34}) + "EOF"
+	if got := patch.String(); got != want {
+		t.Errorf("patch %q, want %q", got, want)
+	}
+	if !bytes.Equal(disk.image(false), image) {
+		t.Error("image as loaded changed")
+	}
+
+	var state bytes.Buffer
+	if err := con.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	track[i+1] = 0
+	if err := con.LoadState(&state); err != nil || track[i+1] != 0x12 {
+		t.Errorf("track written %02X after loading state, want 12: %v", track[i+1], err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "game.fds"), image, 0644)
+	os.WriteFile(filepath.Join(dir, fdsBIOSFile), make([]byte, 0x2000), 0644)
+	if err := con.Cartridge.saveDiskIPSFile(filepath.Join(dir, "game.ips")); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := loadCartridge(filepath.Join(dir, "game.fds"), GameDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cart.loadDiskIPSFile(filepath.Join(dir, "game.ips")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fdsSide(cart.Disk.Tracks[1]), fdsSide(track)) || !bytes.Equal(cart.Disk.Tracks[0], disk.Tracks[0]) {
+		t.Error("sides patched differ from those written")
+	}
+}
+
+func TestFDSDrive(t *testing.T) {
+	con := newFDSConsole(t, testFDSImage(false))
+	cpu, m := con.CPU, con.Mapper.(*FDS)
+	cpu.write(0x4023, 0x01)
+	cpu.write(0x4025, fdsDiskIRQ|fdsReady|fdsMirror|fdsRead|fdsMotor)
+	if con.mirroring != mirrorHorizontal {
+		t.Errorf("mirroring %d, want horizontal", con.mirroring)
+	}
+	next := func() (byte, int) {
+		n := 0
+		for cpu.irq == 0 && n < 1e6 {
+			m.cpuCycle()
+			n++
+		}
+		if con.Peek(0x4030)&0x02 == 0 {
+			t.Error("transfer not flagged")
+		}
+		return cpu.read(0x4031), n
+	}
+	if v, n := next(); v != 1 || n < fdsHeadTime+fdsLeadIn*fdsByteTime {
+		t.Errorf("read %02X after %d cycles, want 01 past the lead-in gap", v, n)
+	}
+	if cpu.irq != 0 {
+		t.Error("IRQ not acknowledged by reading $4031")
+	}
+	if v, n := next(); v != '*' || n != fdsByteTime+1 {
+		t.Errorf("read %02X after %d cycles, want 2A after %d", v, n, fdsByteTime+1)
+	}
+	if v := cpu.read(0x4032); v&0x07 != 0 {
+		t.Errorf("drive status %02X, want inserted and ready", v)
+	}
+
+	// write a block of file count with its CRC
+	pos := m.Position
+	cpu.write(0x4025, fdsDiskIRQ|fdsReady|fdsMotor)
+	for _, b := range []byte{0x80, 2, 5} {
+		cpu.write(0x4024, b)
+		next()
+	}
+	cpu.write(0x4025, fdsDiskIRQ|fdsReady|fdsCRCCtl|fdsMotor)
+	for i := 0; i < 2*(fdsByteTime+1); i++ {
+		m.cpuCycle()
+	}
+	crc := fdsCRC(fdsCRC(fdsCRC(fdsCRC(fdsCRC(0, 0x80), 2), 5), 0), 0)
+	want := []byte{0x80, 2, 5, byte(crc), byte(crc >> 8)}
+	if got := con.Cartridge.Disk.Tracks[0][pos : pos+5]; !bytes.Equal(got, want) {
+		t.Errorf("wrote % X, want % X", got, want)
+	}
+
+	if err := con.EjectDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if v := cpu.read(0x4032); v&0x07 != 0x07 || con.DiskSide() != -1 {
+		t.Errorf("drive status %02X without disk, want 07", v)
+	}
+	con.InsertDisk(1)
+	if s := con.DiskSide(); s != 1 {
+		t.Errorf("side %d inserted, want 1", s)
+	}
+	con.InsertDisk(0)
+	if s := con.DiskSide(); s != -1 {
+		t.Errorf("side %d as sides are switched, want none", s)
+	}
+	for i := 0; i < fdsSwapTime; i++ {
+		m.cpuCycle()
+	}
+	if s := con.DiskSide(); s != 0 || con.DiskSides() != 2 {
+		t.Errorf("side %d of %d after a second, want 0 of 2", s, con.DiskSides())
+	}
+	if err := newMapperConsole(t, 0, 0, 2, 1).InsertDisk(0); err == nil {
+		t.Error("inserted disk to NROM")
+	}
+}
+
+func TestFDSTimerIRQ(t *testing.T) {
+	con := newFDSConsole(t, testFDSImage(false))
+	cpu, m := con.CPU, con.Mapper.(*FDS)
+	cpu.write(0x4020, 10)
+	cpu.write(0x4022, 0x02)
+	if m.TimerCtl != 0 {
+		t.Error("timer enabled with disk registers disabled")
+	}
+	cpu.write(0x4023, 0x01)
+	cpu.write(0x4020, 10)
+	cpu.write(0x4021, 0)
+	cpu.write(0x4022, 0x02)
+	for i := 0; i < 10; i++ {
+		m.cpuCycle()
+	}
+	if cpu.irq != 0 {
+		t.Error("IRQ before timer runs out")
+	}
+	m.cpuCycle()
+	if cpu.irq == 0 || m.TimerCtl&2 != 0 {
+		t.Errorf("IRQ %02X timer control %02X, want IRQ and timer stopped", cpu.irq, m.TimerCtl)
+	}
+	if v := cpu.read(0x4030); v&1 == 0 || cpu.irq != 0 {
+		t.Errorf("status %02X IRQ %02X, want timer flagged then acknowledged", v, cpu.irq)
+	}
+}
+
+func TestFDSAudio(t *testing.T) {
+	con := newFDSConsole(t, testFDSImage(false))
+	con.Connect(new(APU))
+	cpu, m := con.CPU, con.Mapper.(*FDS)
+	cpu.write(0x4023, 0x03)
+	cpu.write(0x4089, 0x80)
+	for i := uint16(0); i < 64; i++ {
+		cpu.write(0x4040+i, byte(i))
+	}
+	cpu.write(0x4089, 0x00)
+	cpu.write(0x4080, 0xA0) // gain 32
+	cpu.write(0x4082, 0x00)
+	cpu.write(0x4083, 0x04) // a step of wave every 64 cycles
+	if v := con.Peek(0x4090); v != 0x60 {
+		t.Errorf("volume gain %02X, want 60", v)
+	}
+	for i := 0; i < 64*10; i++ {
+		con.APU.step()
+	}
+	if p := m.Audio.WavePos; p != 10 {
+		t.Errorf("wave at %d, want 10", p)
+	}
+	if out := m.audioOutput(); out != 10*32*fdsLevel {
+		t.Errorf("output %v, want %v", out, 10*32*fdsLevel)
+	}
+	m.Audio.Counter = 16
+	cpu.write(0x4084, 0x80|0x20)
+	if p := m.Audio.pitch(); p != 0x400+0x400*32/64 {
+		t.Errorf("pitch %X modulated, want %X", p, 0x400+0x400*32/64)
+	}
+}
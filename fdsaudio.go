@@ -0,0 +1,195 @@
+package main
+
+// fdsAudio - wavetable synthesis of FDS, a wave of 64 samples of 6 bits
+// whose pitch is bent by a modulator stepping through a table of 64
+// adjustments, each with an envelope of gain
+// http://wiki.nesdev.com/w/index.php/FDS_audio
+type fdsAudio struct {
+	Wave     [64]byte
+	ModTable [64]byte
+	Volume   fdsEnvelope // $4080
+	Mod      fdsEnvelope // $4084
+	Freq     uint16      // $4082-$4083
+	WaveCtl  byte        // $4083: bit 7 halts wave, bit 6 envelopes
+	ModFreq  uint16      // $4086-$4087
+	ModCtl   byte        // $4087: bit 7 halts modulator
+	Counter  int8        // modulator, 7 bits signed
+	ModPos   byte
+	ModAccum uint32
+	WavePos  byte
+	WaveAcc  uint32
+	Master   byte // $4089: bit 7 enables wave writes, bits 0-1 volume
+	EnvSpeed byte // $408A
+}
+
+type fdsEnvelope struct {
+	Control byte // bit 7 disables, bit 6 increases, bits 0-5 speed, or gain
+	Gain    byte
+	Timer   uint32
+}
+
+// modulator adjustments to counter, 4 resets it
+var fdsModSteps = [8]int{0, 1, 2, 4, 0, -4, -2, -1}
+
+var fdsMasterVolumes = [4]float32{2.0 / 2, 2.0 / 3, 2.0 / 4, 2.0 / 5}
+
+// at full volume about 2.4 times an APU pulse at full volume
+var fdsLevel = 2.4 * pulseMix[15] / (63 * 32)
+
+func (a *fdsAudio) reset() {
+	*a = fdsAudio{EnvSpeed: 0xE8}
+}
+
+func (a *fdsAudio) read(addr uint16) (byte, bool) {
+	switch {
+	case addr < 0x4080:
+		return a.Wave[addr&0x3F] | 0x40, true
+	case addr == 0x4090:
+		return a.Volume.Gain | 0x40, true
+	case addr == 0x4092:
+		return a.Mod.Gain | 0x40, true
+	}
+	return 0, false
+}
+
+func (a *fdsAudio) write(addr uint16, val byte) {
+	switch {
+	case addr < 0x4080:
+		if a.Master&0x80 != 0 {
+			a.Wave[addr&0x3F] = val & 0x3F
+		}
+	case addr == 0x4080:
+		a.Volume.write(val)
+	case addr == 0x4082:
+		a.Freq = a.Freq&0x0F00 | uint16(val)
+	case addr == 0x4083:
+		a.Freq = a.Freq&0x00FF | uint16(val&0x0F)<<8
+		a.WaveCtl = val & 0xC0
+		if val&0x80 != 0 {
+			a.WavePos, a.WaveAcc = 0, 0
+		}
+		if val&0x40 != 0 {
+			a.Volume.Timer, a.Mod.Timer = 0, 0
+		}
+	case addr == 0x4084:
+		a.Mod.write(val)
+	case addr == 0x4085:
+		a.Counter = int8(val<<1) >> 1
+	case addr == 0x4086:
+		a.ModFreq = a.ModFreq&0x0F00 | uint16(val)
+	case addr == 0x4087:
+		a.ModFreq = a.ModFreq&0x00FF | uint16(val&0x0F)<<8
+		a.ModCtl = val & 0x80
+		if val&0x80 != 0 {
+			a.ModAccum = 0
+		}
+	case addr == 0x4088:
+		if a.ModCtl&0x80 != 0 {
+			a.ModTable[a.ModPos] = val & 7
+			a.ModTable[(a.ModPos+1)&0x3F] = val & 7
+			a.ModPos = (a.ModPos + 2) & 0x3F
+		}
+	case addr == 0x4089:
+		a.Master = val
+	case addr == 0x408A:
+		a.EnvSpeed = val
+	}
+}
+
+// step a CPU cycle: envelopes, the modulator, and the wave unless halted
+// or being written
+func (a *fdsAudio) step() {
+	if a.WaveCtl == 0 && a.EnvSpeed != 0 {
+		a.Volume.clock(a.EnvSpeed)
+		a.Mod.clock(a.EnvSpeed)
+	}
+	if a.ModCtl == 0 && a.ModFreq != 0 {
+		if a.ModAccum += uint32(a.ModFreq); a.ModAccum >= 0x10000 {
+			a.ModAccum &= 0xFFFF
+			a.stepMod()
+		}
+	}
+	if a.WaveCtl&0x80 != 0 || a.Master&0x80 != 0 {
+		return
+	}
+	if a.WaveAcc += uint32(a.pitch()); a.WaveAcc >= 0x10000 {
+		a.WaveAcc &= 0xFFFF
+		a.WavePos = (a.WavePos + 1) & 0x3F
+	}
+}
+
+func (a *fdsAudio) stepMod() {
+	step := a.ModTable[a.ModPos]
+	a.ModPos = (a.ModPos + 1) & 0x3F
+	if step == 4 {
+		a.Counter = 0
+		return
+	}
+	c := int(a.Counter) + fdsModSteps[step]
+	a.Counter = int8((c+64)&0x7F - 64)
+}
+
+// pitch return frequency bent by modulator counter times its gain, as
+// the hardware rounds it
+func (a *fdsAudio) pitch() int {
+	temp := int(a.Counter) * int(a.Mod.Gain)
+	rem := temp & 0x0F
+	temp >>= 4
+	if rem > 0 && temp&0x80 == 0 {
+		if a.Counter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= int(a.Freq)
+	rem = temp & 0x3F
+	temp >>= 6
+	if rem >= 32 {
+		temp++
+	}
+	if p := int(a.Freq) + temp; p > 0 {
+		return p
+	}
+	return 0
+}
+
+// output sample of wave times gain, up to 32, and master volume
+func (a *fdsAudio) output() float32 {
+	gain := a.Volume.Gain
+	if gain > 32 {
+		gain = 32
+	}
+	return float32(a.Wave[a.WavePos]) * float32(gain) * fdsMasterVolumes[a.Master&3] * fdsLevel
+}
+
+// write control, with gain itself if the envelope is disabled
+func (e *fdsEnvelope) write(val byte) {
+	e.Control = val
+	e.Timer = 0
+	if val&0x80 != 0 {
+		e.Gain = val & 0x3F
+	}
+}
+
+// clock step gain every 8 * (speed + 1) * master speed CPU cycles
+func (e *fdsEnvelope) clock(master byte) {
+	if e.Control&0x80 != 0 {
+		return
+	}
+	if e.Timer++; e.Timer < 8*(uint32(e.Control&0x3F)+1)*uint32(master) {
+		return
+	}
+	e.Timer = 0
+	switch {
+	case e.Control&0x40 != 0 && e.Gain < 32:
+		e.Gain++
+	case e.Control&0x40 == 0 && e.Gain > 0:
+		e.Gain--
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// buttons of a gamepad in a FM2 input log, from bit 7 to bit 0
+const fm2Buttons = "RLDUTSBA"
+
+// ReadFM2 read a movie in FCEUX text format
+// http://fceux.com/web/help/fceux.html?fm2.html
+func ReadFM2(r io.Reader) (*Movie, error) {
+	m := new(Movie)
+	scanner := bufio.NewScanner(r)
+	ports := [3]int{1, 1, 0}
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if line[0] == '|' {
+			f, err := parseFM2Frame(line, ports)
+			if err != nil {
+				return nil, fmt.Errorf("fm2 line %d: %s", n, err)
+			}
+			m.Frames = append(m.Frames, f)
+			continue
+		}
+
+		key, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+		var err error
+		switch key {
+		case "version":
+			if value != "3" {
+				err = errors.New("unsupported version")
+			}
+		case "binary", "fourscore":
+			if value != "0" && value != "false" {
+				err = fmt.Errorf("%s is not supported", key)
+			}
+		case "port0", "port1", "port2":
+			ports[key[4]-'0'], err = strconv.Atoi(value)
+		case "rerecordCount":
+			var count uint64
+			count, err = strconv.ParseUint(value, 10, 32)
+			m.RerecordCount = uint32(count)
+		case "romFilename":
+			m.ROMName = value
+		case "romChecksum":
+			var sum []byte
+			sum, err = decodeFM2Blob(value)
+			copy(m.ROMChecksum[:], sum)
+		case "savestate":
+			// a state of FCEUX, which LoadState cannot read
+			err = errors.New("movies starting from a savestate are not supported")
+		case "comment":
+			m.Comments = append(m.Comments, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fm2 line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseFM2Frame(line string, ports [3]int) (MovieFrame, error) {
+	var f MovieFrame
+	fields := strings.Split(line, "|")
+	if len(fields) < 5 {
+		return f, errors.New("malformed input")
+	}
+	command, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return f, err
+	}
+	f.Command = byte(command)
+	for i := 0; i < 2; i++ {
+		pad := fields[2+i]
+		if ports[i] != 1 {
+			continue
+		}
+		if len(pad) != len(fm2Buttons) {
+			return f, errors.New("malformed gamepad input")
+		}
+		for j := 0; j < len(pad); j++ {
+			if pad[j] != '.' && pad[j] != ' ' {
+				f.Buttons[i] |= 0x80 >> uint(j)
+			}
+		}
+	}
+	return f, nil
+}
+
+// blobs are either "base64:..." or "0x..." hex
+func decodeFM2Blob(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "base64:"):
+		return base64.StdEncoding.DecodeString(value[7:])
+	case strings.HasPrefix(value, "0x"):
+		return hex.DecodeString(value[2:])
+	}
+	return nil, errors.New("invalid blob")
+}
+
+// WriteFM2 write the movie in FCEUX text format, RAM checksums are not kept.
+// Movies starting from a save state cannot be written, as FCEUX cannot
+// load it
+func (m *Movie) WriteFM2(w io.Writer) error {
+	if m.State != nil {
+		return errors.New("movie starting from a save state cannot be written as FM2")
+	}
+	guid := make([]byte, 16)
+	if _, err := rand.Read(guid); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "version 3\n")
+	fmt.Fprintf(bw, "emuVersion 22020\n")
+	fmt.Fprintf(bw, "rerecordCount %d\n", m.RerecordCount)
+	fmt.Fprintf(bw, "palFlag 0\n")
+	fmt.Fprintf(bw, "romFilename %s\n", m.ROMName)
+	fmt.Fprintf(bw, "romChecksum base64:%s\n", base64.StdEncoding.EncodeToString(m.ROMChecksum[:]))
+	fmt.Fprintf(bw, "guid %X-%X-%X-%X-%X\n", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:])
+	fmt.Fprintf(bw, "fourscore 0\n")
+	fmt.Fprintf(bw, "microphone 0\n")
+	fmt.Fprintf(bw, "port0 1\nport1 1\nport2 0\n")
+	fmt.Fprintf(bw, "FDS 0\n")
+	fmt.Fprintf(bw, "NewPPU 0\n")
+	for _, c := range m.Comments {
+		fmt.Fprintf(bw, "comment %s\n", c)
+	}
+
+	var pad [2][8]byte
+	for _, f := range m.Frames {
+		for i := range pad {
+			for j := range pad[i] {
+				if f.Buttons[i]&(0x80>>uint(j)) != 0 {
+					pad[i][j] = fm2Buttons[j]
+				} else {
+					pad[i][j] = '.'
+				}
+			}
+		}
+		fmt.Fprintf(bw, "|%d|%s|%s||\n", f.Command, pad[0][:], pad[1][:])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// GameDB - boards of known ROMs by CRC32 of PRG and CHR ROM, read from
+// the NES 2.0 XML database, to correct iNES headers that lack a
+// submapper, such as of bus conflicts
+// https://forums.nesdev.org/viewtopic.php?t=19940
+type GameDB map[uint32]GameInfo
+
+// GameInfo - board of a ROM
+type GameInfo struct {
+	Mapper    uint16
+	Submapper byte
+	Mirroring byte
+}
+
+type nes20db struct {
+	Games []struct {
+		ROM struct {
+			CRC32 string `xml:"crc32,attr"`
+		} `xml:"rom"`
+		PCB struct {
+			Mapper    int    `xml:"mapper,attr"`
+			Submapper int    `xml:"submapper,attr"`
+			Mirroring string `xml:"mirroring,attr"`
+		} `xml:"pcb"`
+	} `xml:"game"`
+}
+
+// loadGameDBFile read the NES 2.0 XML database at path, an empty one if
+// there is no file
+func loadGameDBFile(path string) (GameDB, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return GameDB{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadGameDB(file)
+}
+
+// ReadGameDB read the NES 2.0 XML database
+func ReadGameDB(r io.Reader) (GameDB, error) {
+	var doc nes20db
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	db := GameDB{}
+	for _, g := range doc.Games {
+		crc, err := strconv.ParseUint(g.ROM.CRC32, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRC32 %q", g.ROM.CRC32)
+		}
+		info := GameInfo{Mapper: uint16(g.PCB.Mapper), Submapper: byte(g.PCB.Submapper), Mirroring: 0xFF}
+		switch g.PCB.Mirroring {
+		case "H":
+			info.Mirroring = mirrorHorizontal
+		case "V":
+			info.Mirroring = mirrorVertical
+		case "4":
+			info.Mirroring = mirrorFour
+		}
+		db[uint32(crc)] = info
+	}
+	return db, nil
+}
+
+// Apply correct board of cartridge if it is in database, and tell if it
+// is. The cartridge must not be connected yet, see Console.ApplyGameDB
+func (db GameDB) Apply(cart *Cartridge) bool {
+	crc := crc32.ChecksumIEEE(cart.PRG)
+	if !cart.ChrRAM {
+		crc = crc32.Update(crc, crc32.IEEETable, cart.Chr)
+	}
+	info, ok := db[crc]
+	if !ok {
+		return false
+	}
+	cart.Mapper, cart.Submapper = info.Mapper, info.Submapper
+	if info.Mirroring != 0xFF {
+		cart.Mirroring = info.Mirroring
+	}
+	return true
+}
+
+// ApplyGameDB correct board of the connected cartridge if it is in
+// database, attaching it again if that changes its mapper, and power cycle
+// the console for the board to take effect
+func (con *Console) ApplyGameDB(db GameDB) (bool, error) {
+	cart := con.Cartridge
+	mapper := cart.Mapper
+	if !db.Apply(cart) {
+		return false, nil
+	}
+	if cart.Mapper != mapper {
+		if err := con.Connect(cart); err != nil {
+			return true, err
+		}
+	}
+	con.Reset()
+	return true, nil
+}
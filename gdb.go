@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gdbStopTimeout is how long a pause or a step is waited for. A console
+// which is not run, or is jammed by KIL, executes no instruction to stop
+// before, its state is not accessed until it stops
+var gdbStopTimeout = time.Second
+
+// registers in g packets, 8-bit a, x, y, p, sp and 16-bit little endian pc
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.nes.cpu">
+    <reg name="a" bitsize="8" regnum="0"/>
+    <reg name="x" bitsize="8" regnum="1"/>
+    <reg name="y" bitsize="8" regnum="2"/>
+    <reg name="p" bitsize="8" regnum="3"/>
+    <reg name="sp" bitsize="8" regnum="4"/>
+    <reg name="pc" bitsize="16" type="code_ptr" regnum="5"/>
+  </feature>
+</target>
+`
+
+// GDBServer - GDB remote serial protocol stub of CPU, a client at a time
+// https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html
+// The console must be run by another goroutine, it is paused when a client
+// connects, and resumed when the client detaches.
+type GDBServer struct {
+	console  *Console
+	debugger *Debugger
+	stops    chan *BreakEvent
+	listener net.Listener
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// ListenGDB listen for GDB clients on a TCP address, e.g. "localhost:2345".
+// A debugger is attached to console, so call it before running the console.
+func ListenGDB(con *Console, addr string) (*GDBServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &GDBServer{console: con, listener: l, stops: make(chan *BreakEvent, 1)}
+	s.debugger = NewDebugger(con)
+	s.debugger.OnBreak = func(e *BreakEvent) {
+		select {
+		case s.stops <- e:
+		default:
+		}
+	}
+	return s, nil
+}
+
+// Addr return the address the server listens on
+func (s *GDBServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accept clients until Close is called
+func (s *GDBServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conn = conn
+		s.mu.Unlock()
+		newGDBConn(s, conn).serve()
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+	}
+}
+
+// Close stop listening and disconnect the client, the debugger stays
+// attached to the console
+func (s *GDBServer) Close() error {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+type gdbConn struct {
+	console  *Console
+	debugger *Debugger
+	conn     net.Conn
+	w        *bufio.Writer
+	packets  chan string // "\x03" for interrupt
+	stops    chan *BreakEvent
+	noAck    bool
+	stopped  bool // state of the console can be accessed
+
+	// debugger id by Z packet type and address
+	breakpoints map[string]int
+}
+
+func newGDBConn(s *GDBServer, conn net.Conn) *gdbConn {
+	return &gdbConn{
+		console:     s.console,
+		debugger:    s.debugger,
+		conn:        conn,
+		w:           bufio.NewWriter(conn),
+		packets:     make(chan string),
+		stops:       s.stops,
+		breakpoints: make(map[string]int),
+	}
+}
+
+func (c *gdbConn) serve() {
+	defer c.close()
+	go c.readPackets()
+
+	// a stop left by the previous client
+	select {
+	case <-c.stops:
+	default:
+	}
+	c.debugger.Pause()
+	select {
+	case <-c.stops:
+		c.stopped = true
+	case <-time.After(gdbStopTimeout):
+	}
+	for pkt := range c.packets {
+		if pkt == "\x03" {
+			continue // not running
+		}
+		if !c.noAck {
+			c.w.WriteByte('+')
+			c.w.Flush()
+		}
+		reply, resume := c.handle(pkt)
+		if resume {
+			e := c.waitStop(pkt[0] == 's')
+			if e == nil {
+				return
+			}
+			reply = "E01"
+			if c.stopped {
+				reply = gdbStopReply(e)
+			}
+		}
+		if reply == "\x00" {
+			return // killed or detached
+		}
+		c.send(reply)
+		if pkt == "QStartNoAckMode" {
+			c.noAck = true
+		}
+	}
+}
+
+// close remove breakpoints of the client and resume the console
+func (c *gdbConn) close() {
+	c.conn.Close()
+	for _, id := range c.breakpoints {
+		c.debugger.RemoveBreakpoint(id)
+	}
+	c.debugger.Resume()
+	for range c.packets {
+	}
+}
+
+// waitStop wait for the console to stop after it is resumed, a step or
+// an interrupt by the client is waited for up to gdbStopTimeout, after
+// which the console is not taken as stopped
+func (c *gdbConn) waitStop(step bool) *BreakEvent {
+	var timeout <-chan time.Time
+	if step {
+		timeout = time.After(gdbStopTimeout)
+	}
+	for {
+		select {
+		case e := <-c.stops:
+			c.stopped = true
+			return e
+		case <-timeout:
+			c.debugger.Pause()
+			return &BreakEvent{Reason: BreakPaused}
+		case pkt, ok := <-c.packets:
+			if !ok {
+				return nil
+			}
+			if pkt == "\x03" {
+				c.debugger.Pause()
+				timeout = time.After(gdbStopTimeout)
+			}
+		}
+	}
+}
+
+func (c *gdbConn) readPackets() {
+	defer close(c.packets)
+	r := bufio.NewReader(c.conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x03:
+			c.packets <- "\x03"
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			data = data[:len(data)-1]
+			var sum [2]byte
+			if _, err := r.Read(sum[:1]); err != nil {
+				return
+			}
+			if _, err := r.Read(sum[1:]); err != nil {
+				return
+			}
+			if n, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(n) != gdbChecksum(data) {
+				c.conn.Write([]byte{'-'})
+				continue
+			}
+			c.packets <- gdbUnescape(data)
+		}
+	}
+}
+
+func (c *gdbConn) send(data string) {
+	fmt.Fprintf(c.w, "$%s#%02x", data, gdbChecksum(data))
+	c.w.Flush()
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func gdbUnescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+		} else {
+			b.WriteByte(data[i])
+		}
+	}
+	return b.String()
+}
+
+func gdbStopReply(e *BreakEvent) string {
+	if e.Reason != BreakWatchpoint || e.Space != SpaceCPU {
+		return "T05"
+	}
+	kind := "rwatch"
+	if e.Write {
+		kind = "watch"
+	}
+	if e.Breakpoint.Kind == BreakRead|BreakWrite {
+		kind = "awatch"
+	}
+	return fmt.Sprintf("T05%s:%04x;", kind, e.Addr)
+}
+
+// paused tell if the console is stopped, one which did not stop in
+// gdbStopTimeout may stop later
+func (c *gdbConn) paused() bool {
+	if !c.stopped {
+		select {
+		case <-c.stops:
+			c.stopped = true
+		default:
+		}
+	}
+	return c.stopped
+}
+
+// handle reply a packet, resume tells the console is resumed and the
+// reply is to be a stop reply
+func (c *gdbConn) handle(pkt string) (reply string, resume bool) {
+	cpu := c.console.CPU
+	if pkt == "" {
+		return "", false
+	}
+	cmd, args := pkt[0], pkt[1:]
+	switch cmd {
+	case '?', 'g', 'G', 'p', 'P', 'm', 'M':
+		if !c.paused() {
+			return "E01", false
+		}
+	case 'c', 's':
+		if args != "" && !c.paused() {
+			return "E01", false
+		}
+	}
+	switch cmd {
+	case '?':
+		_, e := c.debugger.Paused()
+		if e == nil {
+			e = &BreakEvent{}
+		}
+		return gdbStopReply(e), false
+	case 'g':
+		return fmt.Sprintf("%02x%02x%02x%02x%02x%02x%02x",
+			cpu.A, cpu.X, cpu.Y, cpu.flag()|0x20, cpu.S, byte(cpu.PC), byte(cpu.PC>>8)), false
+	case 'G':
+		regs, err := hex.DecodeString(args)
+		if err != nil || len(regs) != 7 {
+			return "E01", false
+		}
+		cpu.A, cpu.X, cpu.Y, cpu.S = regs[0], regs[1], regs[2], regs[4]
+		cpu.setFlags(regs[3])
+		cpu.PC = uint16(regs[6])<<8 | uint16(regs[5])
+		return "OK", false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n > 5 {
+			return "E01", false
+		}
+		regs := []byte{cpu.A, cpu.X, cpu.Y, cpu.flag() | 0x20, cpu.S}
+		if n == 5 {
+			return fmt.Sprintf("%02x%02x", byte(cpu.PC), byte(cpu.PC>>8)), false
+		}
+		return fmt.Sprintf("%02x", regs[n]), false
+	case 'P':
+		i := strings.IndexByte(args, '=')
+		if i < 0 {
+			return "E01", false
+		}
+		n, err1 := strconv.ParseUint(args[:i], 16, 8)
+		val, err2 := hex.DecodeString(args[i+1:])
+		if err1 != nil || err2 != nil || len(val) == 0 {
+			return "E01", false
+		}
+		switch n {
+		case 0:
+			cpu.A = val[0]
+		case 1:
+			cpu.X = val[0]
+		case 2:
+			cpu.Y = val[0]
+		case 3:
+			cpu.setFlags(val[0])
+		case 4:
+			cpu.S = val[0]
+		case 5:
+			if len(val) < 2 {
+				return "E01", false
+			}
+			cpu.PC = uint16(val[1])<<8 | uint16(val[0])
+		default:
+			return "E01", false
+		}
+		return "OK", false
+	case 'm':
+		addr, n, err := gdbAddrLen(args)
+		if err != nil {
+			return "E01", false
+		}
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = cpu.console.Peek(uint16(addr + i))
+		}
+		return hex.EncodeToString(data), false
+	case 'M':
+		i := strings.IndexByte(args, ':')
+		if i < 0 {
+			return "E01", false
+		}
+		addr, n, err := gdbAddrLen(args[:i])
+		data, err2 := hex.DecodeString(args[i+1:])
+		if err != nil || err2 != nil || len(data) != n {
+			return "E01", false
+		}
+		for j, v := range data {
+			cpu.writeBus(uint16(addr+j), v)
+		}
+		return "OK", false
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return "E01", false
+			}
+			cpu.PC = uint16(addr)
+		}
+		// a stop of a console which did not stop in gdbStopTimeout
+		select {
+		case <-c.stops:
+		default:
+		}
+		c.stopped = false
+		if cmd == 'c' {
+			c.debugger.Resume()
+		} else if err := c.debugger.StepInto(); err != nil {
+			return "E01", false
+		}
+		return "", true
+	case 'Z', 'z':
+		return c.handleBreakpoint(cmd == 'Z', args), false
+	case 'k':
+		return "\x00", false
+	case 'D':
+		c.send("OK")
+		return "\x00", false
+	case 'H', 'T':
+		return "OK", false
+	case 'q':
+		return c.handleQuery(args), false
+	case 'Q':
+		if args == "StartNoAckMode" {
+			return "OK", false
+		}
+	}
+	return "", false
+}
+
+func (c *gdbConn) handleQuery(args string) string {
+	switch {
+	case strings.HasPrefix(args, "Supported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+"
+	case args == "Attached":
+		return "1"
+	case args == "C":
+		return "QC1"
+	case args == "fThreadInfo":
+		return "m1"
+	case args == "sThreadInfo":
+		return "l"
+	case strings.HasPrefix(args, "Xfer:features:read:target.xml:"):
+		offset, n, err := gdbAddrLen(strings.TrimPrefix(args, "Xfer:features:read:target.xml:"))
+		if err != nil {
+			return "E01"
+		}
+		if offset >= len(gdbTargetXML) {
+			return "l"
+		}
+		if offset+n >= len(gdbTargetXML) {
+			return "l" + gdbTargetXML[offset:]
+		}
+		return "m" + gdbTargetXML[offset:offset+n]
+	}
+	return ""
+}
+
+// Z0/Z1 breakpoint, Z2 write, Z3 read and Z4 access watchpoint
+func (c *gdbConn) handleBreakpoint(insert bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return "E01"
+	}
+	addr, err1 := strconv.ParseUint(fields[1], 16, 16)
+	size, err2 := strconv.ParseUint(fields[2], 16, 16)
+	if err1 != nil || err2 != nil {
+		return "E01"
+	}
+	key := fields[0] + "," + fields[1]
+	if !insert {
+		if id, ok := c.breakpoints[key]; ok {
+			c.debugger.RemoveBreakpoint(id)
+			delete(c.breakpoints, key)
+		}
+		return "OK"
+	}
+
+	from := uint16(addr)
+	to := from
+	if size > 1 {
+		to = from + uint16(size) - 1
+	}
+	var (
+		id  int
+		err error
+	)
+	switch fields[0] {
+	case "0", "1":
+		id, err = c.debugger.AddBreakpoint(from, -1, "")
+	case "2":
+		id, err = c.debugger.AddWatchpoint(SpaceCPU, BreakWrite, from, to, "")
+	case "3":
+		id, err = c.debugger.AddWatchpoint(SpaceCPU, BreakRead, from, to, "")
+	case "4":
+		id, err = c.debugger.AddWatchpoint(SpaceCPU, BreakRead|BreakWrite, from, to, "")
+	default:
+		return ""
+	}
+	if err != nil {
+		return "E01"
+	}
+	if old, ok := c.breakpoints[key]; ok {
+		c.debugger.RemoveBreakpoint(old)
+	}
+	c.breakpoints[key] = id
+	return "OK"
+}
+
+func gdbAddrLen(args string) (addr, n int, err error) {
+	i := strings.IndexByte(args, ',')
+	if i < 0 {
+		return 0, 0, errors.New("missing length")
+	}
+	a, err := strconv.ParseUint(args[:i], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	l, err := strconv.ParseUint(args[i+1:], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l > 0x10000 {
+		return 0, 0, errors.New("length too large")
+	}
+	return int(a), int(l), nil
+}
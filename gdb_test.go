@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gdbTestProgram loops at $8000: LDA #1; STA $10; INX; LDA $10; JMP $8000
+var gdbTestProgram = []byte{0xA9, 0x01, 0x85, 0x10, 0xE8, 0xA5, 0x10, 0x4C, 0x00, 0x80}
+
+type gdbTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *gdbTestClient) send(data string) {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", data, gdbChecksum(data))
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("%s: no ack: %q %v", data, b, err)
+	}
+}
+
+func (c *gdbTestClient) reply() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var sum [2]byte
+	if _, err := c.r.Read(sum[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.Write([]byte{'+'})
+	return strings.TrimSuffix(data, "#")
+}
+
+func (c *gdbTestClient) expect(cmd, want string) {
+	c.t.Helper()
+	c.send(cmd)
+	if got := c.reply(); got != want {
+		c.t.Errorf("%s: got %q, want %q", cmd, got, want)
+	}
+}
+
+func TestGDBServer(t *testing.T) {
+	cart := &Cartridge{PRG: make([]byte, 0x4000), Chr: make([]byte, 0x2000), ChrRAM: true}
+	copy(cart.PRG, gdbTestProgram)
+	cart.PRG[0x3FFC], cart.PRG[0x3FFD] = 0x00, 0x80
+	con := new(Console)
+	con.Connect(new(CPU))
+	if err := con.Connect(cart); err != nil {
+		t.Fatal(err)
+	}
+	con.Reset()
+
+	server, err := ListenGDB(con, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				con.Step()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &gdbTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.send("qSupported:xmlRegisters=i386")
+	if got := c.reply(); !strings.Contains(got, "qXfer:features:read+") {
+		t.Errorf("qSupported: %q", got)
+	}
+	c.expect("?", "T05")
+	c.expect("Z0,8004,1", "OK")
+	c.expect("c", "T05")
+	c.expect("P1=00", "OK")
+	c.expect("p5", "0480")
+	c.expect("m0010,1", "01")
+	c.expect("s", "T05")
+	c.expect("p1", "01")
+	c.expect("p5", "0580")
+	c.expect("z0,8004,1", "OK")
+
+	c.expect("M0010,1:07", "OK")
+	c.expect("Z3,0010,1", "OK")
+	c.expect("c", "T05rwatch:0010;")
+	c.expect("p0", "07")
+	c.expect("z3,0010,1", "OK")
+	c.expect("Z2,0010,1", "OK")
+	c.expect("c", "T05watch:0010;")
+	c.expect("m0010,1", "01")
+	c.expect("z2,0010,1", "OK")
+
+	c.send("c")
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte{0x03})
+	if got := c.reply(); got != "T05" {
+		t.Errorf("interrupt: got %q", got)
+	}
+	c.expect("D", "OK")
+}
+
+func TestGDBIdleConsole(t *testing.T) {
+	defer func(timeout time.Duration) { gdbStopTimeout = timeout }(gdbStopTimeout)
+	gdbStopTimeout = 50 * time.Millisecond
+	// a console nobody runs never stops by itself
+	con := newProgramConsole(t, new(CPU), gdbTestProgram, false)
+	server, err := ListenGDB(con, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &gdbTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.expect("", "")
+	c.expect("?", "E01")
+	c.expect("p5", "E01")
+	c.expect("mc000,1", "E01")
+	c.expect("cc000", "E01")
+	c.send("c")
+	conn.Write([]byte{0x03})
+	if got := c.reply(); got != "E01" {
+		t.Errorf("interrupt: got %q", got)
+	}
+
+	// the pause is still requested, the console stops once it is run
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				con.Step()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.send("?")
+		if got := c.reply(); got == "T05" {
+			break
+		} else if got != "E01" || time.Now().After(deadline) {
+			t.Fatalf("?: got %q after the console is run", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.expect("p5", "00c0")
+	c.expect("D", "OK")
+}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // Cartridge -
@@ -15,9 +16,69 @@ type Cartridge struct {
 	PRG       []byte
 	Chr       []byte
 	SRAM      []byte
-	Mapper    byte
+	Mapper    uint16 // up to 4095 with NES 2.0 header
+	Submapper byte   // of NES 2.0 header, 0 if not specified
 	Mirroring byte
 	Battery   byte
+	ChrRAM    bool
+	Disk      *fdsImage // of FDS, whose BIOS is PRG
+	NSF       *NSF      // played by NSFPlayer rather than a mapper of iNES
+}
+
+// Attach cartridge to console, mapping $4020-$FFFF to its mapper. Only
+// $6000-$FFFF can be peeked, registers below are read by Mapper.Read,
+// unless the mapper can peek them
+func (c *Cartridge) Attach(con *Console) error {
+	var mapper Mapper = new(NSFPlayer)
+	if c.NSF == nil {
+		var err error
+		if mapper, err = GetMapper(int(c.Mapper)); err != nil {
+			return err
+		}
+	}
+	con.Cartridge = c
+	con.Mapper = mapper
+	con.mirroring = c.Mirroring
+	con.fetcher, _ = mapper.(fetchMapper)
+	con.nameTables, _ = mapper.(nameTableMapper)
+	con.renderer, _ = mapper.(renderMapper)
+	con.audio, _ = mapper.(audioMapper)
+	con.clocked, _ = mapper.(cycleMapper)
+	con.Bus.Map(0x4020, 0xFFFF, BusHandler{
+		Read: func(addr uint16) byte { return con.Mapper.Read(addr) },
+		Write: func(addr uint16, val byte) {
+			if m, ok := con.Mapper.(conflictMapper); ok && addr >= 0x8000 && m.busConflicts() {
+				val &= con.Mapper.Read(addr)
+			}
+			con.Mapper.Write(addr, val)
+		},
+		Peek: func(addr uint16) (byte, bool) {
+			if m, ok := con.Mapper.(peekMapper); ok {
+				return m.peek(addr)
+			}
+			if addr < 0x6000 {
+				return 0, false
+			}
+			return con.Mapper.Read(addr), true
+		},
+		Poke: func(addr uint16, val byte) { c.poke(con.Mapper, addr, val) },
+	})
+	mapper.Init(con)
+	return nil
+}
+
+// poke patch the byte of PRG ROM addr is mapped to, or SRAM at
+// $6000-$7FFF
+func (c *Cartridge) poke(mapper Mapper, addr uint16, val byte) {
+	if m, ok := mapper.(prgMapper); ok {
+		if off := m.prgOffset(addr); off >= 0 && off < len(c.PRG) {
+			c.PRG[off] = val
+			return
+		}
+	}
+	if addr >= 0x6000 && addr < 0x8000 && len(c.SRAM) > 0 {
+		c.SRAM[int(addr-0x6000)%len(c.SRAM)] = val
+	}
 }
 
 type nesHeader struct {
@@ -32,6 +93,21 @@ type nesHeader struct {
 	_       [5]byte
 }
 
+// loadCartridge load the iNES file at path, its board corrected by db,
+// or the FDS disk image if it is a .fds file, with the BIOS of the same
+// directory
+func loadCartridge(path string, db GameDB) (*Cartridge, error) {
+	if strings.EqualFold(filepath.Ext(path), ".fds") {
+		return loadFDSFile(path, filepath.Join(filepath.Dir(path), fdsBIOSFile))
+	}
+	cart, err := loadRomFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db.Apply(cart)
+	return cart, nil
+}
+
 func loadRomFile(path string) (*Cartridge, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -47,14 +123,32 @@ func loadRomFile(path string) (*Cartridge, error) {
 		return nil, errors.New("invalid rom file")
 	}
 
+	prgBanks, chrBanks := int(header.PrgSize), int(header.ChrSize)
 	cart := Cartridge{
-		Mapper:    header.Flag6>>4 | header.Flag7&0xf0,
-		Mirroring: header.Flag6>>2&0x02 | header.Flag6&0x08,
+		Mapper:    uint16(header.Flag6>>4 | header.Flag7&0xf0),
+		Mirroring: header.Flag6 & 0x01,
 		Battery:   header.Flag6 & 0x02,
-		PRG:       make([]byte, int(header.PrgSize)*1024*16),
-		Chr:       make([]byte, int(header.ChrSize)*1024*8),
 		SRAM:      make([]byte, 1024*8),
 	}
+	if header.Flag6&0x08 != 0 {
+		cart.Mirroring = mirrorFour
+	}
+	// http://wiki.nesdev.com/w/index.php/NES_2.0
+	if header.Flag7&0x0C == 0x08 {
+		cart.Mapper |= uint16(header.Flag8&0x0F) << 8
+		cart.Submapper = header.Flag8 >> 4
+		if header.Flag9&0x0F == 0x0F || header.Flag9&0xF0 == 0xF0 {
+			return nil, errors.New("ROM size in exponent-multiplier notation not supported")
+		}
+		prgBanks |= int(header.Flag9&0x0F) << 8
+		chrBanks |= int(header.Flag9&0xF0) << 4
+	}
+	cart.PRG = make([]byte, prgBanks*1024*16)
+	cart.Chr = make([]byte, chrBanks*1024*8)
+	if chrBanks == 0 {
+		cart.Chr = make([]byte, 1024*8)
+		cart.ChrRAM = true
+	}
 
 	if header.Flag6&0x04 > 0 {
 		if _, err := file.Seek(512, 1); err != nil {
@@ -64,69 +158,16 @@ func loadRomFile(path string) (*Cartridge, error) {
 	if _, err := io.ReadFull(file, cart.PRG); err != nil {
 		return nil, err
 	}
-	if _, err := io.ReadFull(file, cart.Chr); err != nil {
+	if _, err := io.ReadFull(file, cart.Chr[:chrBanks*1024*8]); err != nil {
 		return nil, err
 	}
 
 	return &cart, nil
 }
 
+// disassembly return a listing of PRG, see Disassembler
 func (c *Cartridge) disassembly() string {
-	var (
-		buf  bytes.Buffer
-		pc   int
-		nums [2]byte
-	)
-	for {
-		if pc >= len(c.PRG) {
-			break
-		}
-		var (
-			op      = c.PRG[pc]
-			ins     = instructions[op]
-			insName = instructionNames[ins.id]
-			size    = instructionSizes[ins.addrMode]
-		)
-		for i := 1; i < int(size); i++ {
-			if pc+i < len(c.PRG) {
-				nums[i-1] = c.PRG[pc+i]
-			} else {
-				nums[i-1] = 0
-			}
-		}
-		buf.WriteString(insName)
-		if size > 1 {
-			buf.WriteByte('\t')
-		}
-		switch ins.addrMode {
-		case addrImplied: // do nothing
-		case addrAccumulator:
-			buf.WriteString("A")
-		case addrImmediate:
-			buf.WriteString(fmt.Sprintf("#$%02x", nums[0]))
-		case addrZeroPage:
-			buf.WriteString(fmt.Sprintf("$%02x", nums[0]))
-		case addrZeroPageX:
-			buf.WriteString(fmt.Sprintf("$%02x,X", nums[0]))
-		case addrZeroPageY:
-			buf.WriteString(fmt.Sprintf("$%02x,Y", nums[0]))
-		case addrRelative:
-			buf.WriteString(fmt.Sprintf("*%+d", nums[0]))
-		case addrAbsolute:
-			buf.WriteString(fmt.Sprintf("$%02x%02x", nums[1], nums[0]))
-		case addrAbsoluteX:
-			buf.WriteString(fmt.Sprintf("$%02x%02x,X", nums[1], nums[0]))
-		case addrAbsoluteY:
-			buf.WriteString(fmt.Sprintf("$%02x%02x,Y", nums[1], nums[0]))
-		case addrIndirect:
-			buf.WriteString(fmt.Sprintf("($%02x%02x)", nums[1], nums[0]))
-		case addrIndexedIndirect:
-			buf.WriteString(fmt.Sprintf("($%02x,X)", nums[0]))
-		case addrIndirectIndexed:
-			buf.WriteString(fmt.Sprintf("($%02x),Y", nums[0]))
-		}
-		buf.WriteByte('\n')
-		pc += int(size)
-	}
+	var buf bytes.Buffer
+	NewDisassembler(c).Listing(&buf)
 	return buf.String()
 }
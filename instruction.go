@@ -14,6 +14,11 @@ const (
 	addrZeroPage
 	addrZeroPageX
 	addrZeroPageY
+
+	// 65C02
+	addrZeroPageIndirect
+	addrAbsoluteIndexedIndirect
+	addrZeroPageRelative // BBR and BBS, zero page address then branch offset
 )
 const (
 	insADC = uint8(iota)
@@ -99,6 +104,23 @@ const (
 	insTOP
 	insXAA
 	insXAS
+
+	// 65C02 instructions, BBR, BBS, RMB and SMB of Rockwell and WDC
+	// see http://6502.org/tutorials/65c02opcodes.html
+	insBBR
+	insBBS
+	insBRA
+	insPHX
+	insPHY
+	insPLX
+	insPLY
+	insRMB
+	insSMB
+	insSTP
+	insSTZ
+	insTRB
+	insTSB
+	insWAI
 )
 
 type instruction struct {
@@ -109,7 +131,7 @@ type instruction struct {
 }
 
 var (
-	instructionSizes = [...]uint8{3, 3, 3, 1, 2, 1, 2, 3, 2, 2, 2, 2, 2}
+	instructionSizes = [...]uint8{3, 3, 3, 1, 2, 1, 2, 3, 2, 2, 2, 2, 2, 2, 3, 3}
 	instructionNames = [...]string{
 		"ADC", "AND", "ASL", "BCC", "BCS", "BEQ", "BIT", "BMI", "BNE", "BPL",
 		"BRK", "BVC", "BVS", "CLC", "CLD", "CLI", "CLV", "CMP", "CPX", "CPY",
@@ -121,6 +143,17 @@ var (
 		"AAC", "AAX", "ARR", "ASR", "ATX", "AXA", "AXS", "DCP", "DOP", "ISC",
 		"KIL", "LAR", "LAX", "RLA", "RRA", "SLO", "SRE", "SXA", "SYA", "TOP",
 		"XAA", "XAS",
+		// 65C02
+		"BBR", "BBS", "BRA", "PHX", "PHY", "PLX", "PLY", "RMB", "SMB", "STP",
+		"STZ", "TRB", "TSB", "WAI",
+	}
+	// names of unofficial instructions used by Nintendulator and most
+	// tools today, those not listed keep the name above
+	unofficialNames = map[uint8]string{
+		insAAC: "ANC", insAAX: "SAX", insASR: "ALR", insATX: "LXA",
+		insAXA: "AHX", insAXS: "SBX", insDOP: "NOP", insISC: "ISB",
+		insLAR: "LAS", insSXA: "SHX", insSYA: "SHY", insTOP: "NOP",
+		insXAA: "ANE", insXAS: "TAS",
 	}
 	instructions = [256]instruction{
 		0x69: instruction{insADC, 2, 0, addrImmediate},
@@ -383,3 +416,72 @@ var (
 		0x9B: instruction{insXAS, 5, 0, addrAbsoluteY},
 	}
 )
+
+// unofficial tell if an opcode is not documented by MOS
+func unofficial(opcode byte) bool {
+	ins := instructions[opcode]
+	return ins.id >= insAAC ||
+		ins.id == insNOP && opcode != 0xEA ||
+		ins.id == insSBC && opcode == 0xEB
+}
+
+// instructions65C02 - opcodes of 65C02, those of NMOS 6502 less the
+// unofficial ones, which are NOPs of various sizes on 65C02
+// http://6502.org/tutorials/65c02opcodes.html
+var instructions65C02 [256]instruction
+
+func init() {
+	t := &instructions65C02
+	for op, ins := range instructions {
+		switch {
+		case !unofficial(byte(op)):
+			t[op] = ins
+		case op&0x0F == 0x03, op&0x0F == 0x0B:
+			t[op] = instruction{insNOP, 1, 0, addrImplied}
+		case op&0x0F == 0x02:
+			t[op] = instruction{insNOP, 2, 0, addrImmediate}
+		case op == 0x44:
+			t[op] = instruction{insNOP, 3, 0, addrZeroPage}
+		case op&0x0F == 0x04:
+			t[op] = instruction{insNOP, 4, 0, addrZeroPageX}
+		case op == 0x5C:
+			t[op] = instruction{insNOP, 8, 0, addrAbsolute}
+		case op&0x0F == 0x0C:
+			t[op] = instruction{insNOP, 4, 0, addrAbsolute}
+		}
+	}
+	for bit := 0; bit < 8; bit++ {
+		t[bit<<4|0x07] = instruction{insRMB, 5, 0, addrZeroPage}
+		t[bit<<4|0x87] = instruction{insSMB, 5, 0, addrZeroPage}
+		t[bit<<4|0x0F] = instruction{insBBR, 5, 0, addrZeroPageRelative}
+		t[bit<<4|0x8F] = instruction{insBBS, 5, 0, addrZeroPageRelative}
+	}
+	for _, op := range []byte{0x12, 0x32, 0x52, 0x72, 0x92, 0xB2, 0xD2, 0xF2} {
+		t[op] = instruction{t[op-0x11].id, 5, 0, addrZeroPageIndirect}
+	}
+	for _, op := range []byte{0x1E, 0x3E, 0x5E, 0x7E} {
+		t[op].cycles, t[op].exCyc = 6, 1 // shifts and rotates absolute,X
+	}
+	t[0x6C].cycles = 6 // JMP ($nnnn) without page wrap
+	t[0x04] = instruction{insTSB, 5, 0, addrZeroPage}
+	t[0x0C] = instruction{insTSB, 6, 0, addrAbsolute}
+	t[0x14] = instruction{insTRB, 5, 0, addrZeroPage}
+	t[0x1A] = instruction{insINC, 2, 0, addrAccumulator}
+	t[0x1C] = instruction{insTRB, 6, 0, addrAbsolute}
+	t[0x34] = instruction{insBIT, 4, 0, addrZeroPageX}
+	t[0x3A] = instruction{insDEC, 2, 0, addrAccumulator}
+	t[0x3C] = instruction{insBIT, 4, 1, addrAbsoluteX}
+	t[0x5A] = instruction{insPHY, 3, 0, addrImplied}
+	t[0x64] = instruction{insSTZ, 3, 0, addrZeroPage}
+	t[0x74] = instruction{insSTZ, 4, 0, addrZeroPageX}
+	t[0x7A] = instruction{insPLY, 4, 0, addrImplied}
+	t[0x7C] = instruction{insJMP, 6, 0, addrAbsoluteIndexedIndirect}
+	t[0x80] = instruction{insBRA, 2, 0, addrRelative}
+	t[0x89] = instruction{insBIT, 2, 0, addrImmediate}
+	t[0x9C] = instruction{insSTZ, 4, 0, addrAbsolute}
+	t[0x9E] = instruction{insSTZ, 5, 0, addrAbsoluteX}
+	t[0xCB] = instruction{insWAI, 3, 0, addrImplied}
+	t[0xDA] = instruction{insPHX, 3, 0, addrImplied}
+	t[0xDB] = instruction{insSTP, 3, 0, addrImplied}
+	t[0xFA] = instruction{insPLX, 4, 0, addrImplied}
+}
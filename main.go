@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"image/color"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"fyne.io/fyne/canvas"
 
@@ -14,13 +15,28 @@ import (
 	"fyne.io/fyne/app"
 )
 
-type logLine struct {
-	pc     uint16
-	opcode byte
-	num    [2]byte
-}
-
 func main() {
+	// nes nsf2wav [-stems] file.nsf [dir] renders each track to WAV,
+	// headless, with stems a file of each channel
+	if len(os.Args) > 2 && os.Args[1] == "nsf2wav" {
+		args := os.Args[2:]
+		stems := args[0] == "-stems"
+		if stems {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			log.Fatal("usage: nsf2wav [-stems] file.nsf [dir]")
+		}
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		if err := renderNSF(args[0], dir, stems); err != nil {
+			log.Fatalf("nsf2wav: %s", err)
+		}
+		return
+	}
+
 	app := app.New()
 
 	w := app.NewWindow("Hello")
@@ -33,53 +49,63 @@ func main() {
 }
 
 func main2() {
-	logFile, _ := os.Open("nestest.log")
-	defer logFile.Close()
-	reader := bufio.NewReader(logFile)
-
-	console := new(Console)
-	cart, err := loadRomFile("nestest.nes")
+	path := "nestest.nes"
+	console, err := openROM(path)
 	if err != nil {
 		log.Fatalf("open rom file: %s", err)
 	}
+	cpu := console.CPU
+	cpu.SetTracer(NewTracer(os.Stdout, TraceNestest))
 
-	cpu := new(CPU)
-	console.Connect(cpu)
-	console.Connect(cart)
-
+	// automation mode, nestest returns to RAM when all tests are done
 	cpu.PC = 0xC000
 	cpu.cycles = 7
-	for i := 1; ; i++ {
-		mycyc := cpu.cycles
-		fmt.Printf("%-5d ", i)
-		info := cpu.step()
-		var opnumsText string
-		switch instructionSizes[info.ins.addrMode] {
-		case 3:
-			opnumsText = fmt.Sprintf("%02X %02X", info.opnums[0], info.opnums[1])
-		case 2:
-			opnumsText = fmt.Sprintf("%02X", info.opnums[0])
-		}
-		var addrText string
-		if info.ins.addrMode == addrRelative {
-			addrText = fmt.Sprintf("*%+X", info.opnums[0])
-		} else {
-			switch instructionSizes[info.ins.addrMode] {
-			case 3:
-				addrText = fmt.Sprintf("$%02X%02X", info.opnums[1], info.opnums[0])
-			case 2:
-				addrText = fmt.Sprintf("$%02X", info.opnums[0])
-			}
-			if info.ins.addrMode == addrImmediate {
-				addrText = "#" + addrText
-			}
+	for cpu.PC >= 0x8000 && !cpu.halted {
+		cpu.Step()
+	}
+	fmt.Printf("result: %02X %02X\n", cpu.read(0x02), cpu.read(0x03))
+	if err := closeROM(console, path); err != nil {
+		log.Fatalf("write save file: %s", err)
+	}
+}
+
+// openROM connect the iNES file or FDS disk image at path to a new
+// console, with the game database nes20db.xml, and the battery save and
+// disk patch of the same name
+func openROM(path string) (*Console, error) {
+	db, err := loadGameDBFile("nes20db.xml")
+	if err != nil {
+		return nil, err
+	}
+	cart, err := loadCartridge(path, db)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if cart.Disk != nil {
+		if err := cart.loadDiskIPSFile(base + ".ips"); err != nil {
+			return nil, err
 		}
-		l := fmt.Sprintf("%04X  %02X %-5s  %s %-5s", info.PC, info.opcode, opnumsText, instructionNames[info.ins.id], addrText)
-		line, _, _ := reader.ReadLine()
-		fmt.Print(l)
-		fmt.Printf(" A:%02X X:%02X Y:%02X S:%02X P:%02X Z:%d C:%d CYC:%d", cpu.A, cpu.X, cpu.Y, cpu.S, cpu.flag(), cpu.Z, cpu.C, mycyc)
-		fmt.Printf("|  %s", string(line))
+	}
+	console := new(Console)
+	console.Connect(new(CPU))
+	console.Connect(new(PPU))
+	console.Connect(new(APU))
+	if err := console.Connect(cart); err != nil {
+		return nil, err
+	}
+	console.Reset()
+	return console, console.loadBatteryFile(base + ".sav")
+}
 
-		fmt.Println()
+// closeROM write the battery save and disk patch of the ROM opened by
+// openROM
+func closeROM(console *Console, path string) error {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if console.Cartridge.Disk != nil {
+		if err := console.Cartridge.saveDiskIPSFile(base + ".ips"); err != nil {
+			return err
+		}
 	}
+	return console.saveBatteryFile(base + ".sav")
 }
@@ -8,21 +8,85 @@ type Mapper interface {
 	Init(con *Console)
 	Read(addr uint16) byte
 	Write(addr uint16, val byte)
+	// PPURead and PPUWrite access pattern tables at PPU $0000-$1FFF
+	PPURead(addr uint16) byte
+	PPUWrite(addr uint16, val byte)
 }
 
-var mappers [768]Mapper
+// prgMapper is implemented by mappers to tell which byte of PRG ROM a CPU
+// address is mapped to, -1 if it is not mapped to PRG ROM
+type prgMapper interface {
+	prgOffset(addr uint16) int
+}
+
+// chrMapper is implemented by mappers to tell which byte of CHR ROM a PPU
+// pattern table address is mapped to, -1 if it is not mapped to CHR ROM
+type chrMapper interface {
+	chrOffset(addr uint16) int
+}
+
+// fetchMapper is implemented by mappers which watch PPU reading pattern
+// tables, to switch banks as it renders. It is told after a byte is read,
+// by rendering or PPUDATA, but not by PPURead, so peeking CHR does not
+// switch banks
+type fetchMapper interface {
+	ppuFetch(addr uint16)
+}
 
-// RegisterMapper - register a mapper by id
-func RegisterMapper(id int, mapper Mapper) {
+// nameTableMapper is implemented by mappers which map nametables at PPU
+// $2000-$2FFF themselves, rather than by mirroring the console's 2 KiB
+type nameTableMapper interface {
+	readNameTable(addr uint16) byte
+	writeNameTable(addr uint16, val byte)
+}
+
+// renderMapper is implemented by mappers taking part in rendering, which
+// supply each byte PPU fetches, of a kind such as fetchNameTable, and may
+// count scanlines by the pattern of fetches
+type renderMapper interface {
+	renderFetch(addr uint16, kind int) byte
+}
+
+// peekMapper is implemented by mappers whose Read has side effects, such
+// as acknowledging an IRQ, to read $4020-$FFFF without them
+type peekMapper interface {
+	peek(addr uint16) (byte, bool)
+}
+
+// cycleMapper is implemented by mappers clocked every CPU cycle, such as
+// by an IRQ counter
+type cycleMapper interface {
+	cpuCycle()
+}
+
+// conflictMapper is implemented by discrete mappers whose registers are
+// latched with ROM enabled, so a value written to $8000-$FFFF is ANDed
+// with the ROM byte at that address
+// http://wiki.nesdev.com/w/index.php/Bus_conflict
+type conflictMapper interface {
+	busConflicts() bool
+}
+
+// batteryMapper is implemented by mappers with memory kept while the
+// console is off besides SRAM, such as EEPROM, nil if the board has none
+type batteryMapper interface {
+	battery() []byte
+}
+
+var mappers [768]func() Mapper
+
+// RegisterMapper - register the constructor of a mapper by id
+func RegisterMapper(id int, mapper func() Mapper) {
 	mappers[id] = mapper
 }
 
-// GetMapper - get a mapper by id
-func GetMapper(id int) (mapper Mapper, err error) {
+// GetMapper - get a new mapper by id, so consoles never share one
+func GetMapper(id int) (Mapper, error) {
 	if id < 0 || id >= len(mappers) {
-		err = fmt.Errorf("invalid mapper id")
-	} else if mapper = mappers[id]; mapper == nil {
-		err = fmt.Errorf("mapper %d not implemented", id)
+		return nil, fmt.Errorf("invalid mapper id")
+	}
+	if mappers[id] == nil {
+		return nil, fmt.Errorf("mapper %d not implemented", id)
 	}
-	return
+	return mappers[id](), nil
 }
@@ -8,7 +8,7 @@ type NROM struct {
 }
 
 func init() {
-	RegisterMapper(0, &NROM{})
+	RegisterMapper(0, func() Mapper { return &NROM{} })
 }
 
 // Init initialize mapper
@@ -35,14 +35,35 @@ func (m *NROM) Read(addr uint16) byte {
 	return data
 }
 
+// Write write SRAM, PRG ROM is read only
 func (m *NROM) Write(addr uint16, val byte) {
-	if addr < 0x8000 {
+	if addr >= 0x6000 && addr < 0x8000 {
 		m.console.Cartridge.SRAM[addr-0x6000] = val
-	} else {
-		addr -= 0x8000
-		if m.PRGBankSize == 1 {
-			addr -= 0x4000
-		}
-		m.console.Cartridge.PRG[addr] = val
 	}
 }
+
+// PPURead read CHR
+func (m *NROM) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[addr]
+}
+
+// PPUWrite write CHR RAM, CHR ROM is read only
+func (m *NROM) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[addr] = val
+	}
+}
+
+func (m *NROM) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	return int(addr-0x8000) % len(m.console.Cartridge.PRG)
+}
+
+func (m *NROM) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return -1
+	}
+	return int(addr)
+}
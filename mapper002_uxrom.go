@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// UxROM mapper 002, a 16 KiB PRG bank switched at $8000 and the last bank
+// fixed at $C000. Submapper 2 has bus conflicts
+// http://wiki.nesdev.com/w/index.php/UxROM
+type UxROM struct {
+	console *Console
+	bank    byte
+}
+
+func init() {
+	RegisterMapper(2, func() Mapper { return &UxROM{} })
+}
+
+// Init initialize mapper
+func (m *UxROM) Init(con *Console) {
+	m.console = con
+	m.bank = 0
+}
+
+func (m *UxROM) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	return 0
+}
+
+// Write select PRG bank at $8000
+func (m *UxROM) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		return
+	}
+	m.bank = val
+}
+
+// PPURead read CHR
+func (m *UxROM) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[addr]
+}
+
+// PPUWrite write CHR RAM, CHR ROM is read only
+func (m *UxROM) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[addr] = val
+	}
+}
+
+func (m *UxROM) busConflicts() bool {
+	return m.console.Cartridge.Submapper == 2
+}
+
+func (m *UxROM) prgOffset(addr uint16) int {
+	prg := m.console.Cartridge.PRG
+	switch {
+	case addr < 0x8000:
+		return -1
+	case addr < 0xC000:
+		return (int(m.bank)*0x4000 + int(addr&0x3FFF)) % len(prg)
+	default:
+		return len(prg) - 0x4000 + int(addr&0x3FFF)
+	}
+}
+
+func (m *UxROM) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return -1
+	}
+	return int(addr)
+}
+
+func (m *UxROM) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, m.bank)
+}
+
+func (m *UxROM) loadState(r io.Reader) error {
+	return binary.Read(r, binary.LittleEndian, &m.bank)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// CNROM mapper 003, PRG as NROM and an 8 KiB CHR bank switched by writes
+// to $8000-$FFFF. Submapper 2 has bus conflicts
+// http://wiki.nesdev.com/w/index.php/CNROM
+type CNROM struct {
+	console *Console
+	bank    byte
+}
+
+func init() {
+	RegisterMapper(3, func() Mapper { return &CNROM{} })
+}
+
+// Init initialize mapper
+func (m *CNROM) Init(con *Console) {
+	m.console = con
+	m.bank = 0
+}
+
+func (m *CNROM) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	return 0
+}
+
+// Write select CHR bank
+func (m *CNROM) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		return
+	}
+	m.bank = val
+}
+
+// PPURead read CHR of selected bank
+func (m *CNROM) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrAddress(addr)]
+}
+
+// PPUWrite write CHR RAM, CHR ROM is read only
+func (m *CNROM) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrAddress(addr)] = val
+	}
+}
+
+func (m *CNROM) chrAddress(addr uint16) int {
+	return (int(m.bank)*0x2000 + int(addr)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *CNROM) busConflicts() bool {
+	return m.console.Cartridge.Submapper == 2
+}
+
+func (m *CNROM) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	return int(addr-0x8000) % len(m.console.Cartridge.PRG)
+}
+
+func (m *CNROM) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return -1
+	}
+	return m.chrAddress(addr)
+}
+
+func (m *CNROM) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, m.bank)
+}
+
+func (m *CNROM) loadState(r io.Reader) error {
+	return binary.Read(r, binary.LittleEndian, &m.bank)
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// MMC5 mapper 005, of many PRG and CHR banking modes, 1 KiB of ExRAM
+// usable as nametable, extended attributes or RAM, a fill mode nametable,
+// a vertical split screen, a scanline IRQ, a multiplier and expansion
+// audio of two pulses and PCM
+// http://wiki.nesdev.com/w/index.php/MMC5
+type MMC5 struct {
+	console *Console
+	mmc5State
+}
+
+type mmc5State struct {
+	PRGMode, CHRMode byte
+	PRGProtect       [2]byte
+	ExRAMMode        byte
+	NameTables       byte // source of each nametable, 2 bits each
+	FillTile         byte
+	FillColor        byte
+	PRG              [5]byte    // $5113-$5117
+	CHR              [12]uint16 // $5120-$512B, with upper bits
+	CHRUpper         byte
+	CHRSetB          bool // the last CHR register written is of set B
+
+	SplitControl byte
+	SplitScroll  byte
+	SplitBank    byte
+
+	IRQCompare byte
+	IRQEnabled bool
+	IRQPending bool
+	InFrame    bool
+	Scanline   byte
+	LastFetch  uint16 // address of the last nametable fetch
+	Matches    byte   // times it was fetched again in a row
+
+	MulA, MulB byte
+	ExRAM      [1024]byte
+
+	// tile being fetched, its extended attribute or place in the split
+	ExAttribute byte
+	SplitTile   bool
+	SplitX      byte
+	SplitY      byte
+
+	Pulse         [2]apuPulse
+	PCM           byte
+	PCMRead       bool
+	PCMIRQEnabled bool
+	PCMIRQ        bool
+	AudioCycle    uint16
+}
+
+// sources of a nametable, by $5105
+const (
+	mmc5CIRAM0 = iota
+	mmc5CIRAM1
+	mmc5ExRAM
+	mmc5Fill
+)
+
+func init() {
+	RegisterMapper(5, func() Mapper { return &MMC5{} })
+}
+
+// Init initialize mapper, PRG is in mode 3 with the last bank at $E000
+func (m *MMC5) Init(con *Console) {
+	m.console = con
+	m.mmc5State = mmc5State{PRGMode: 3, CHRMode: 3}
+	m.PRG = [5]byte{0, 0xFF, 0xFF, 0xFF, 0xFF}
+	m.Pulse[0].NoSweep = true
+	m.Pulse[1].NoSweep = true
+}
+
+func (m *MMC5) peek(addr uint16) (byte, bool) {
+	switch {
+	case addr == 0x5010:
+		if m.PCMIRQ {
+			return 0x80, true
+		}
+		return 0, true
+	case addr == 0x5015:
+		var val byte
+		for i := range m.Pulse {
+			if m.Pulse[i].Length > 0 {
+				val |= 1 << uint(i)
+			}
+		}
+		return val, true
+	case addr == 0x5204:
+		var val byte
+		if m.IRQPending {
+			val |= 0x80
+		}
+		if m.InFrame {
+			val |= 0x40
+		}
+		return val, true
+	case addr == 0x5205:
+		return byte(uint16(m.MulA) * uint16(m.MulB)), true
+	case addr == 0x5206:
+		return byte(uint16(m.MulA) * uint16(m.MulB) >> 8), true
+	case addr >= 0x5C00 && addr < 0x6000:
+		if m.ExRAMMode >= 2 {
+			return m.ExRAM[addr-0x5C00], true
+		}
+		return 0, false
+	case addr >= 0x6000:
+		bank, rom := m.prgBank(addr)
+		if rom {
+			prg := m.console.Cartridge.PRG
+			return prg[(bank*0x2000+int(addr&0x1FFF))%len(prg)], true
+		}
+		if off := m.ramOffset(bank, addr); off >= 0 {
+			return m.console.Cartridge.SRAM[off], true
+		}
+	}
+	return 0, false
+}
+
+// Read registers, ExRAM and PRG. Reading $5204 or $5010 acknowledges an
+// IRQ, reading the NMI vector ends the frame, and reads of $8000-$BFFF
+// are taken as PCM samples in read mode
+func (m *MMC5) Read(addr uint16) byte {
+	switch addr {
+	case 0x5204, 0xFFFA, 0xFFFB:
+		m.checkFrame(addr >= 0xFFFA)
+	}
+	val, _ := m.peek(addr)
+	switch {
+	case addr == 0x5010:
+		m.PCMIRQ = false
+		m.updateIRQ()
+	case addr == 0x5204:
+		m.IRQPending = false
+		m.updateIRQ()
+	case m.PCMRead && addr >= 0x8000 && addr < 0xC000:
+		if val == 0 {
+			m.PCMIRQ = true
+			m.updateIRQ()
+		} else {
+			m.PCM = val
+		}
+	}
+	return val
+}
+
+// checkFrame clear in-frame flag once PPU stops rendering, as MMC5 sees
+// no more fetches, or on NMI
+func (m *MMC5) checkFrame(nmi bool) {
+	ppu := m.console.PPU
+	if nmi || ppu == nil || !ppu.renderingEnabled() || ppu.ScanLine >= 240 && ppu.ScanLine < 261 {
+		m.InFrame = false
+	}
+}
+
+// Write registers, ExRAM and PRG RAM
+func (m *MMC5) Write(addr uint16, val byte) {
+	switch {
+	case addr >= 0x5000 && addr < 0x5008:
+		if reg := addr & 3; reg != 1 {
+			m.Pulse[addr>>2&1].write(reg, val)
+		}
+	case addr == 0x5010:
+		m.PCMRead = val&0x01 != 0
+		m.PCMIRQEnabled = val&0x80 != 0
+		m.updateIRQ()
+	case addr == 0x5011:
+		if !m.PCMRead && val != 0 {
+			m.PCM = val
+		}
+	case addr == 0x5015:
+		m.Pulse[0].setEnabled(val&0x01 != 0)
+		m.Pulse[1].setEnabled(val&0x02 != 0)
+	case addr == 0x5100:
+		m.PRGMode = val & 0x03
+	case addr == 0x5101:
+		m.CHRMode = val & 0x03
+	case addr == 0x5102 || addr == 0x5103:
+		m.PRGProtect[addr-0x5102] = val & 0x03
+	case addr == 0x5104:
+		m.ExRAMMode = val & 0x03
+	case addr == 0x5105:
+		m.NameTables = val
+	case addr == 0x5106:
+		m.FillTile = val
+	case addr == 0x5107:
+		m.FillColor = val & 0x03
+	case addr >= 0x5113 && addr <= 0x5117:
+		m.PRG[addr-0x5113] = val
+	case addr >= 0x5120 && addr <= 0x512B:
+		m.CHR[addr-0x5120] = uint16(m.CHRUpper)<<8 | uint16(val)
+		m.CHRSetB = addr >= 0x5128
+	case addr == 0x5130:
+		m.CHRUpper = val & 0x03
+	case addr == 0x5200:
+		m.SplitControl = val
+	case addr == 0x5201:
+		m.SplitScroll = val
+	case addr == 0x5202:
+		m.SplitBank = val
+	case addr == 0x5203:
+		m.IRQCompare = val
+	case addr == 0x5204:
+		m.IRQEnabled = val&0x80 != 0
+		m.updateIRQ()
+	case addr == 0x5205:
+		m.MulA = val
+	case addr == 0x5206:
+		m.MulB = val
+	case addr >= 0x5C00 && addr < 0x6000:
+		m.writeExRAM(addr-0x5C00, val)
+	case addr >= 0x6000:
+		if m.PRGProtect != [2]byte{2, 1} {
+			return
+		}
+		if bank, rom := m.prgBank(addr); !rom {
+			if off := m.ramOffset(bank, addr); off >= 0 {
+				m.console.Cartridge.SRAM[off] = val
+			}
+		}
+	}
+}
+
+// writeExRAM by CPU, in modes 0 and 1 ExRAM is written only while PPU
+// renders, else 0 is written
+func (m *MMC5) writeExRAM(addr uint16, val byte) {
+	switch m.ExRAMMode {
+	case 0, 1:
+		if !m.InFrame {
+			val = 0
+		}
+		m.ExRAM[addr] = val
+	case 2:
+		m.ExRAM[addr] = val
+	}
+}
+
+func (m *MMC5) updateIRQ() {
+	irq := m.IRQPending && m.IRQEnabled || m.PCMIRQ && m.PCMIRQEnabled
+	m.console.CPU.setIRQ(irqMapper, irq)
+}
+
+// prgBank return the 8 KiB bank addr is mapped to, and whether it is of
+// ROM or of PRG RAM. $6000-$7FFF is always RAM and $E000-$FFFF ROM
+func (m *MMC5) prgBank(addr uint16) (bank int, rom bool) {
+	if addr < 0x8000 {
+		return int(m.PRG[0] & 0x0F), false
+	}
+	slot := int(addr-0x8000) >> 13
+	reg, size := 4, 1 // register $5113+reg, of banks of size 8 KiB
+	switch m.PRGMode {
+	case 0:
+		size = 4
+	case 1:
+		size = 2
+		if slot < 2 {
+			reg = 2
+		}
+	case 2:
+		if slot < 2 {
+			reg, size = 2, 2
+		} else {
+			reg = slot + 1
+		}
+	case 3:
+		reg = slot + 1
+	}
+	val := m.PRG[reg]
+	return int(val&0x7F)&^(size-1) | slot&(size-1), val&0x80 != 0 || reg == 4
+}
+
+// ramOffset return the byte of PRG RAM of bank addr is mapped to, -1 if
+// there is no PRG RAM
+func (m *MMC5) ramOffset(bank int, addr uint16) int {
+	sram := m.console.Cartridge.SRAM
+	if len(sram) == 0 {
+		return -1
+	}
+	return (bank*0x2000 + int(addr&0x1FFF)) % len(sram)
+}
+
+func (m *MMC5) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	bank, rom := m.prgBank(addr)
+	if !rom {
+		return -1
+	}
+	return (bank*0x2000 + int(addr&0x1FFF)) % len(m.console.Cartridge.PRG)
+}
+
+// chrBank return the byte of CHR addr is mapped to by set A or B. Set B
+// has 4 registers for 4 KiB, repeated for both pattern tables
+func (m *MMC5) chrBank(addr uint16, setB bool) int {
+	size := 0x2000 >> m.CHRMode
+	regs, first := size/0x400, 0
+	if setB {
+		first = 8
+		if regs > 4 {
+			regs = 4
+		}
+		if size < 0x2000 {
+			addr &= 0x0FFF
+		}
+	}
+	slot := int(addr) / size
+	bank := int(m.CHR[first+(slot+1)*regs-1])
+	return (bank*size + int(addr)%size) % len(m.console.Cartridge.Chr)
+}
+
+// chrOffset of CPU access to CHR, by the set last written
+func (m *MMC5) chrOffset(addr uint16) int {
+	return m.chrBank(addr, m.CHRSetB)
+}
+
+// PPURead read CHR by the set last written
+func (m *MMC5) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *MMC5) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+// readNameTable read the source $5105 selects for the nametable
+func (m *MMC5) readNameTable(addr uint16) byte {
+	addr &= 0x0FFF
+	switch src := m.NameTables >> (addr >> 10 * 2) & 3; src {
+	case mmc5CIRAM0, mmc5CIRAM1:
+		return m.console.PPU.NameTable[uint16(src)*0x400+addr&0x3FF]
+	case mmc5ExRAM:
+		if m.ExRAMMode <= 1 {
+			return m.ExRAM[addr&0x3FF]
+		}
+		return 0
+	default:
+		if addr&0x3FF >= 0x3C0 {
+			return m.FillColor * 0x55
+		}
+		return m.FillTile
+	}
+}
+
+func (m *MMC5) writeNameTable(addr uint16, val byte) {
+	addr &= 0x0FFF
+	switch src := m.NameTables >> (addr >> 10 * 2) & 3; src {
+	case mmc5CIRAM0, mmc5CIRAM1:
+		m.console.PPU.NameTable[uint16(src)*0x400+addr&0x3FF] = val
+	case mmc5ExRAM:
+		if m.ExRAMMode <= 1 {
+			m.ExRAM[addr&0x3FF] = val
+		}
+	}
+}
+
+// renderFetch supply PPU fetches: tiles of the split from ExRAM, tiles of
+// extended attributes from the 4 KiB bank and palette ExRAM gives, and
+// with 8x16 sprites, sprites from CHR set A and background from set B
+func (m *MMC5) renderFetch(addr uint16, kind int) byte {
+	ppu := m.console.PPU
+	chr := m.console.Cartridge.Chr
+	switch kind {
+	case fetchNameTable:
+		m.countScanline(addr)
+		m.startTile()
+		if m.SplitTile {
+			return m.ExRAM[uint16(m.SplitY)/8*32+uint16(m.SplitX)]
+		}
+		if m.ExRAMMode == 1 {
+			m.ExAttribute = m.ExRAM[addr&0x3FF]
+		}
+	case fetchAttribute:
+		if m.SplitTile {
+			x, y := m.SplitX, m.SplitY
+			shift := y/16&1*4 | x/2&1*2
+			return (m.ExRAM[0x3C0+uint16(y)/32*8+uint16(x)/4] >> shift & 3) * 0x55
+		}
+		if m.ExRAMMode == 1 {
+			return (m.ExAttribute >> 6) * 0x55
+		}
+	case fetchBackground:
+		if m.SplitTile {
+			off := int(m.SplitBank)*0x1000 + int(addr&0x0FF8) + int(m.SplitY%8)
+			return chr[off%len(chr)]
+		}
+		if m.ExRAMMode == 1 {
+			bank := int(m.ExAttribute&0x3F) | int(m.CHRUpper)<<6
+			return chr[(bank*0x1000+int(addr&0x0FFF))%len(chr)]
+		}
+		if ppu.spriteHeight() == 16 {
+			return chr[m.chrBank(addr, true)]
+		}
+		return chr[m.chrOffset(addr)]
+	case fetchSprite:
+		if ppu.spriteHeight() == 16 {
+			return chr[m.chrBank(addr, false)]
+		}
+		return chr[m.chrOffset(addr)]
+	}
+	return ppu.read(addr)
+}
+
+// countScanline detect a scanline by PPU fetching the same nametable byte
+// three times in a row, which it does only at its end. Fetches of the
+// pre-render line follow vertical blank, when MMC5 has seen no fetches
+// and left the frame
+// http://wiki.nesdev.com/w/index.php/MMC5#Scanline_Detection_and_Scanline_IRQ
+func (m *MMC5) countScanline(addr uint16) {
+	if ppu := m.console.PPU; ppu.ScanLine == 261 && ppu.Cycle < 321 {
+		m.InFrame = false
+	}
+	if addr != m.LastFetch {
+		m.LastFetch, m.Matches = addr, 0
+		return
+	}
+	m.Matches++
+	if m.Matches != 2 {
+		return
+	}
+	if !m.InFrame {
+		m.InFrame = true
+		m.Scanline = 0
+		m.IRQPending = false
+	} else {
+		m.Scanline++
+		if m.Scanline == m.IRQCompare {
+			m.IRQPending = true
+		}
+	}
+	m.updateIRQ()
+}
+
+// startTile find whether the tile whose nametable byte is fetched is in
+// the split, tiles are counted from the first one fetched at dot 321
+// http://wiki.nesdev.com/w/index.php/MMC5#Vertical_Split_Mode
+func (m *MMC5) startTile() {
+	ppu := m.console.PPU
+	line, tile := int(ppu.ScanLine), int(ppu.Cycle-1)/8+2
+	if ppu.Cycle >= 321 {
+		line, tile = (line+1)%262, int(ppu.Cycle-321)/8
+	}
+	m.SplitTile = false
+	if m.SplitControl&0x80 == 0 || m.ExRAMMode > 1 {
+		return
+	}
+	count := int(m.SplitControl & 0x1F)
+	if m.SplitControl&0x40 == 0 && tile >= count || m.SplitControl&0x40 != 0 && tile < count {
+		return
+	}
+	m.SplitTile = true
+	m.SplitX = byte(tile & 31)
+	m.SplitY = byte((int(m.SplitScroll) + line) % 240)
+}
+
+// audioStep clock the pulses every other cycle, and their envelopes and
+// length counters at a fixed 240 Hz
+func (m *MMC5) audioStep() {
+	m.AudioCycle++
+	if m.AudioCycle%2 == 0 {
+		m.Pulse[0].clock()
+		m.Pulse[1].clock()
+	}
+	if m.AudioCycle == 7458 {
+		m.AudioCycle = 0
+		for i := range m.Pulse {
+			m.Pulse[i].Envelope.clock()
+			m.Pulse[i].clockLength()
+		}
+	}
+}
+
+// audioOutput mix the pulses as APU mixes its own, and PCM as DMC
+func (m *MMC5) audioOutput() float32 {
+	return pulseMix[m.Pulse[0].output()+m.Pulse[1].output()] + tndMix[m.PCM>>1]
+}
+
+func (m *MMC5) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.mmc5State)
+}
+
+func (m *MMC5) loadState(r io.Reader) error {
+	return binary.Read(r, binary.LittleEndian, &m.mmc5State)
+}
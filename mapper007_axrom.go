@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// AxROM mapper 007, a 32 KiB PRG bank and single screen mirroring
+// selected by writes to $8000-$FFFF. Submapper 2 (AMROM) has bus conflicts
+// http://wiki.nesdev.com/w/index.php/AxROM
+type AxROM struct {
+	console *Console
+	reg     byte
+}
+
+func init() {
+	RegisterMapper(7, func() Mapper { return &AxROM{} })
+}
+
+// Init initialize mapper
+func (m *AxROM) Init(con *Console) {
+	m.console = con
+	m.set(0)
+}
+
+func (m *AxROM) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	return 0
+}
+
+// Write select PRG bank by bits 0-2 and nametable by bit 4
+func (m *AxROM) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		return
+	}
+	m.set(val)
+}
+
+func (m *AxROM) set(val byte) {
+	m.reg = val
+	if val&0x10 == 0 {
+		m.console.mirroring = mirrorSingle0
+	} else {
+		m.console.mirroring = mirrorSingle1
+	}
+}
+
+// PPURead read CHR
+func (m *AxROM) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[addr]
+}
+
+// PPUWrite write CHR RAM, CHR ROM is read only
+func (m *AxROM) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[addr] = val
+	}
+}
+
+func (m *AxROM) busConflicts() bool {
+	return m.console.Cartridge.Submapper == 2
+}
+
+func (m *AxROM) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	return (int(m.reg&0x07)*0x8000 + int(addr&0x7FFF)) % len(m.console.Cartridge.PRG)
+}
+
+func (m *AxROM) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return -1
+	}
+	return int(addr)
+}
+
+func (m *AxROM) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, m.reg)
+}
+
+func (m *AxROM) loadState(r io.Reader) error {
+	var reg byte
+	if err := binary.Read(r, binary.LittleEndian, &reg); err != nil {
+		return err
+	}
+	m.set(reg)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// MMC2 mapper 009 and MMC4 mapper 010. Each 4 KiB pattern table has two
+// CHR banks, switched by a latch when PPU fetches tile $FD or $FE, so a
+// game can change the tiles mid-screen. MMC2 switches an 8 KiB PRG bank,
+// MMC4 a 16 KiB one and has PRG RAM
+// http://wiki.nesdev.com/w/index.php/MMC2
+// http://wiki.nesdev.com/w/index.php/MMC4
+type MMC2 struct {
+	console *Console
+	mmc4    bool
+	mmc2State
+}
+
+type mmc2State struct {
+	PRG       byte
+	CHR       [2][2]byte // by pattern table, then latch $FD or $FE
+	Latch     [2]byte    // 0 for $FD, 1 for $FE
+	Mirroring byte
+}
+
+func init() {
+	RegisterMapper(9, func() Mapper { return &MMC2{} })
+	RegisterMapper(10, func() Mapper { return &MMC2{mmc4: true} })
+}
+
+// Init initialize mapper
+func (m *MMC2) Init(con *Console) {
+	m.console = con
+	m.mmc2State = mmc2State{Latch: [2]byte{1, 1}}
+	m.setMirroring(0)
+}
+
+func (m *MMC2) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	if m.mmc4 && addr >= 0x6000 {
+		return m.console.Cartridge.SRAM[addr-0x6000]
+	}
+	return 0
+}
+
+// Write registers at $A000-$FFFF, each 4 KiB wide
+func (m *MMC2) Write(addr uint16, val byte) {
+	switch addr & 0xF000 {
+	case 0x6000, 0x7000:
+		if m.mmc4 {
+			m.console.Cartridge.SRAM[addr-0x6000] = val
+		}
+	case 0xA000:
+		m.PRG = val & 0x0F
+	case 0xB000, 0xC000, 0xD000, 0xE000:
+		i := (addr - 0xB000) >> 12
+		m.CHR[i/2][i%2] = val & 0x1F
+	case 0xF000:
+		m.setMirroring(val & 1)
+	}
+}
+
+func (m *MMC2) setMirroring(val byte) {
+	m.Mirroring = val
+	if val == 0 {
+		m.console.mirroring = mirrorVertical
+	} else {
+		m.console.mirroring = mirrorHorizontal
+	}
+}
+
+// PPURead read CHR of banks selected by latches
+func (m *MMC2) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite ignored, CHR is ROM
+func (m *MMC2) PPUWrite(addr uint16, val byte) {
+}
+
+// ppuFetch set latch after the high bit plane of tile $FD or $FE is
+// fetched, MMC2 watches only its first row in pattern table 0
+func (m *MMC2) ppuFetch(addr uint16) {
+	table := addr >> 12
+	if addr&0x08 == 0 || table == 0 && !m.mmc4 && addr&0x0F != 8 {
+		return
+	}
+	switch addr & 0x0FF0 {
+	case 0x0FD0:
+		m.Latch[table] = 0
+	case 0x0FE0:
+		m.Latch[table] = 1
+	}
+}
+
+func (m *MMC2) prgOffset(addr uint16) int {
+	prg := m.console.Cartridge.PRG
+	switch {
+	case addr < 0x8000:
+		return -1
+	case m.mmc4 && addr < 0xC000:
+		return (int(m.PRG)*0x4000 + int(addr&0x3FFF)) % len(prg)
+	case !m.mmc4 && addr < 0xA000:
+		return (int(m.PRG)*0x2000 + int(addr&0x1FFF)) % len(prg)
+	default:
+		// fixed banks at end of PRG, mirrored when it is under 64 KiB
+		n := len(prg)
+		return (n - (0x10000-int(addr))%n) % n
+	}
+}
+
+func (m *MMC2) chrOffset(addr uint16) int {
+	table := addr >> 12
+	bank := int(m.CHR[table][m.Latch[table]])
+	return (bank*0x1000 + int(addr&0x0FFF)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *MMC2) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.mmc2State)
+}
+
+func (m *MMC2) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.mmc2State); err != nil {
+		return err
+	}
+	m.setMirroring(m.Mirroring)
+	return nil
+}
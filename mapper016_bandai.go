@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Bandai - Bandai FCG-1, FCG-2 and LZ93D50, mapper 016, 153 with 8 KiB of
+// PRG RAM and PRG of 512 KiB, 157 of Datach Joint ROM System and 159. FCG
+// registers are at $6000-$7FFF (submapper 4), those of LZ93D50 at
+// $8000-$FFFF (submapper 5), both if there is no submapper. LZ93D50 boards
+// save to a serial EEPROM, 24C02 of 256 bytes, or 24C01 of 128 bytes on
+// 159. The barcode reader and second EEPROM of Datach are not emulated
+// http://wiki.nesdev.com/w/index.php/INES_Mapper_016
+type Bandai struct {
+	console *Console
+	id      byte       // iNES mapper
+	cart    *Cartridge // EEPROM is kept through reset of the same cartridge
+	bandaiState
+}
+
+type bandaiState struct {
+	CHR       [8]byte
+	PRG       byte
+	Outer     byte // PRG bank of 256 KiB of 153
+	Mirroring byte
+	IRQ       bool
+	Counter   uint16
+	Latch     uint16 // LZ93D50 loads counter from latch as IRQ is enabled
+	Control   byte   // $800D: EEPROM clock and data, PRG RAM enable of 153
+	EEPROM    eeprom
+	Memory    [256]byte // of EEPROM
+}
+
+func init() {
+	for _, id := range []byte{16, 153, 157, 159} {
+		id := id
+		RegisterMapper(int(id), func() Mapper { return &Bandai{id: id} })
+	}
+}
+
+// Init initialize mapper, keeping EEPROM on reset
+func (m *Bandai) Init(con *Console) {
+	mem := m.Memory
+	if m.cart != con.Cartridge {
+		mem = [256]byte{}
+	}
+	m.console, m.cart = con, con.Cartridge
+	m.bandaiState = bandaiState{Memory: mem, EEPROM: eeprom{Out: true}}
+	m.setMirroring(0)
+}
+
+// eepromMemory return memory of the EEPROM of the board, nil if it has none
+func (m *Bandai) eepromMemory() []byte {
+	switch {
+	case m.id == 159:
+		return m.Memory[:128]
+	case m.id == 153, m.id == 16 && m.console.Cartridge.Submapper == 4:
+		return nil
+	}
+	return m.Memory[:]
+}
+
+// Read PRG ROM, PRG RAM of 153, or EEPROM data at bit 4 of $6000-$7FFF
+func (m *Bandai) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	switch {
+	case addr < 0x6000:
+	case m.id == 153 && m.Control&0x20 != 0:
+		return m.console.Cartridge.SRAM[addr-0x6000]
+	case m.eepromMemory() != nil && m.EEPROM.Out:
+		return 0x10
+	}
+	return 0
+}
+
+// Write registers, 16 repeated through each range they are mapped to
+func (m *Bandai) Write(addr uint16, val byte) {
+	fcg := addr >= 0x6000 && addr < 0x8000
+	switch sub := m.console.Cartridge.Submapper; {
+	case addr < 0x6000:
+		return
+	case m.id == 153 && fcg:
+		if m.Control&0x20 != 0 {
+			m.console.Cartridge.SRAM[addr-0x6000] = val
+		}
+		return
+	case m.id != 16 || sub == 5:
+		if fcg {
+			return
+		}
+	case sub == 4 && !fcg:
+		return
+	}
+	switch reg := addr & 0x0F; {
+	case reg < 8:
+		m.CHR[reg] = val
+		m.Outer = val & 1
+	case reg == 0x08:
+		m.PRG = val & 0x0F
+	case reg == 0x09:
+		m.setMirroring(val & 3)
+	case reg == 0x0A:
+		m.IRQ = val&1 != 0
+		if !fcg {
+			m.Counter = m.Latch
+		}
+		m.console.CPU.setIRQ(irqMapper, false)
+	case reg == 0x0B, reg == 0x0C:
+		shift := (reg - 0x0B) * 8
+		if fcg {
+			m.Counter = m.Counter&^(0xFF<<shift) | uint16(val)<<shift
+		} else {
+			m.Latch = m.Latch&^(0xFF<<shift) | uint16(val)<<shift
+		}
+	case reg == 0x0D:
+		m.Control = val
+		if mem := m.eepromMemory(); mem != nil {
+			m.EEPROM.write(mem, val&0x20 != 0, val&0x40 != 0)
+		}
+	}
+}
+
+func (m *Bandai) setMirroring(val byte) {
+	m.Mirroring = val
+	m.console.mirroring = vrcMirroring[val]
+}
+
+// cpuCycle count down while enabled, raising IRQ as the counter wraps
+// from 0
+func (m *Bandai) cpuCycle() {
+	if !m.IRQ {
+		return
+	}
+	if m.Counter == 0 {
+		m.console.CPU.setIRQ(irqMapper, true)
+	}
+	m.Counter--
+}
+
+// PPURead read CHR ROM of 1 KiB banks, or 8 KiB of CHR RAM
+func (m *Bandai) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *Bandai) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+// prgOffset map a bank of 16 KiB at $8000, $C000 is the last bank, of the
+// outer bank of 153
+func (m *Bandai) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	prg := m.console.Cartridge.PRG
+	bank := int(m.PRG)
+	switch {
+	case m.id == 153 && addr >= 0xC000:
+		bank = int(m.Outer)<<4 | 0x0F
+	case m.id == 153:
+		bank |= int(m.Outer) << 4
+	case addr >= 0xC000:
+		return len(prg) - 0x4000 + int(addr&0x3FFF)
+	}
+	return (bank*0x4000 + int(addr&0x3FFF)) % len(prg)
+}
+
+func (m *Bandai) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return int(addr) % len(m.console.Cartridge.Chr)
+	}
+	return (int(m.CHR[addr>>10])*0x400 + int(addr&0x3FF)) % len(m.console.Cartridge.Chr)
+}
+
+// battery return memory of EEPROM, which keeps it without a battery
+func (m *Bandai) battery() []byte {
+	return m.eepromMemory()
+}
+
+func (m *Bandai) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.bandaiState)
+}
+
+func (m *Bandai) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.bandaiState); err != nil {
+		return err
+	}
+	m.setMirroring(m.Mirroring)
+	return nil
+}
+
+// eeprom - serial EEPROM of I2C, clocked by writes of its clock and data
+// lines. 24C02 is addressed by a device byte and then a word address,
+// X24C01 of 128 bytes by a single byte of address and direction, least
+// significant bit first. A byte received is acknowledged by the EEPROM
+// pulling data low, a byte sent by the other side doing so
+// http://wiki.nesdev.com/w/index.php/X24C01
+type eeprom struct {
+	Mode  byte
+	Bit   byte // of the byte being shifted, 8 during acknowledge
+	Shift byte
+	Addr  byte
+	Ack   bool // EEPROM acknowledges the byte received
+	SCL   bool
+	SDA   bool
+	Out   bool // data line as driven by EEPROM, high if released
+}
+
+// eeprom modes
+const (
+	eepromIdle = iota
+	eepromDevice
+	eepromAddress
+	eepromWrite
+	eepromRead
+)
+
+// write clock and data lines, data changing while clock is high starts or
+// stops a transfer, a bit is shifted in as clock rises and out as it falls
+func (e *eeprom) write(mem []byte, scl, sda bool) {
+	switch {
+	case e.SCL && scl && e.SDA && !sda:
+		e.Mode = eepromDevice
+		if len(mem) == 128 {
+			e.Mode = eepromAddress
+		}
+		e.Bit, e.Ack, e.Out = 0, false, true
+	case e.SCL && scl && !e.SDA && sda:
+		e.Mode, e.Out = eepromIdle, true
+	case !e.SCL && scl:
+		e.rise(mem, sda)
+	case e.SCL && !scl:
+		e.fall(mem)
+	}
+	e.SCL, e.SDA = scl, sda
+}
+
+func (e *eeprom) rise(mem []byte, sda bool) {
+	switch {
+	case e.Mode == eepromIdle:
+	case e.Bit == 8:
+		if e.Mode == eepromRead && !e.Ack && sda {
+			e.Mode = eepromIdle // not acknowledged, no more bytes to send
+		}
+		e.Bit, e.Ack = 0, false
+	case e.Mode == eepromRead:
+		if e.Bit++; e.Bit == 8 {
+			e.Addr = byte((int(e.Addr) + 1) % len(mem))
+		}
+	default:
+		var bit byte
+		if sda {
+			bit = 1
+		}
+		if len(mem) == 128 {
+			e.Shift = e.Shift>>1 | bit<<7
+		} else {
+			e.Shift = e.Shift<<1 | bit
+		}
+		if e.Bit++; e.Bit == 8 {
+			e.receive(mem)
+		}
+	}
+}
+
+func (e *eeprom) fall(mem []byte) {
+	switch {
+	case e.Ack:
+		e.Out = false
+	case e.Mode == eepromRead && e.Bit < 8:
+		shift := 7 - e.Bit
+		if len(mem) == 128 {
+			shift = e.Bit
+		}
+		e.Out = mem[e.Addr]>>shift&1 != 0
+	default:
+		e.Out = true
+	}
+}
+
+// receive a byte, acknowledging it unless addressed to another device
+func (e *eeprom) receive(mem []byte) {
+	e.Ack = true
+	switch e.Mode {
+	case eepromDevice:
+		switch {
+		case e.Shift&0xF0 != 0xA0:
+			e.Mode, e.Ack = eepromIdle, false
+		case e.Shift&1 != 0:
+			e.Mode = eepromRead
+		default:
+			e.Mode = eepromAddress
+		}
+	case eepromAddress:
+		e.Addr, e.Mode = e.Shift, eepromWrite
+		if len(mem) == 128 {
+			e.Addr = e.Shift & 0x7F
+			if e.Shift&0x80 != 0 {
+				e.Mode = eepromRead
+			}
+		}
+	case eepromWrite:
+		mem[e.Addr] = e.Shift
+		e.Addr = byte((int(e.Addr) + 1) % len(mem))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Namco163 - Namco 129 and 163, mapper 019. It has 128 bytes of internal
+// RAM, accessed through a port at $4800, which holds the wavetables and
+// registers of up to 8 channels of audio. CHR banks of $E0 or more map
+// the console's nametables, so do those of nametables, which may also map
+// CHR ROM
+// http://wiki.nesdev.com/w/index.php/INES_Mapper_019
+type Namco163 struct {
+	console *Console
+	namco163State
+}
+
+type namco163State struct {
+	PRG     [3]byte // $E000 bit 6 disables sound, $E800 bits 6-7 CHR RAM
+	CHR     [8]byte
+	NT      [4]byte
+	Counter uint16 // bit 15 enables IRQ
+	Port    byte   // $F800: RAM address, bit 7 to increment it
+	RAM     [128]byte
+
+	// http://wiki.nesdev.com/w/index.php/Namco_163_audio
+	Cycle   byte
+	Channel byte // updated next
+	Out     [8]int8
+}
+
+// a channel at full volume is about two APU pulses at full volume
+var namco163Level = pulseMix[15] / 120
+
+func init() {
+	RegisterMapper(19, func() Mapper { return &Namco163{} })
+}
+
+// Init initialize mapper
+func (m *Namco163) Init(con *Console) {
+	m.console = con
+	m.namco163State = namco163State{Channel: 7}
+}
+
+// Read the RAM port, IRQ counter, SRAM and PRG ROM. Reading the port
+// increments the address if bit 7 of $F800 is set
+func (m *Namco163) Read(addr uint16) byte {
+	val, _ := m.peek(addr)
+	if addr&0xF800 == 0x4800 && m.Port&0x80 != 0 {
+		m.Port = 0x80 | (m.Port+1)&0x7F
+	}
+	return val
+}
+
+func (m *Namco163) peek(addr uint16) (byte, bool) {
+	switch {
+	case addr >= 0x8000:
+		return m.console.Cartridge.PRG[m.prgOffset(addr)], true
+	case addr >= 0x6000:
+		return m.console.Cartridge.SRAM[addr-0x6000], true
+	case addr >= 0x5800:
+		return byte(m.Counter >> 8), true
+	case addr >= 0x5000:
+		return byte(m.Counter), true
+	case addr >= 0x4800:
+		return m.RAM[m.Port&0x7F], true
+	}
+	return 0, false
+}
+
+// Write registers, each of 2 KiB from $5000, and the RAM port at $4800
+func (m *Namco163) Write(addr uint16, val byte) {
+	switch {
+	case addr < 0x4800:
+	case addr < 0x5000:
+		m.RAM[m.Port&0x7F] = val
+		if m.Port&0x80 != 0 {
+			m.Port = 0x80 | (m.Port+1)&0x7F
+		}
+	case addr < 0x5800:
+		m.Counter = m.Counter&0xFF00 | uint16(val)
+		m.console.CPU.setIRQ(irqMapper, false)
+	case addr < 0x6000:
+		m.Counter = m.Counter&0x00FF | uint16(val)<<8
+		m.console.CPU.setIRQ(irqMapper, false)
+	case addr < 0x8000:
+		m.console.Cartridge.SRAM[addr-0x6000] = val
+	case addr < 0xC000:
+		m.CHR[(addr-0x8000)>>11] = val
+	case addr < 0xE000:
+		m.NT[(addr-0xC000)>>11] = val
+	case addr < 0xF800:
+		m.PRG[(addr-0xE000)>>11] = val
+	default:
+		m.Port = val
+	}
+}
+
+// cpuCycle count up to $7FFF, raising IRQ as it gets there
+func (m *Namco163) cpuCycle() {
+	if c := m.Counter; c&0x8000 != 0 && c&0x7FFF != 0x7FFF {
+		m.Counter++
+		if m.Counter&0x7FFF == 0x7FFF {
+			m.console.CPU.setIRQ(irqMapper, true)
+		}
+	}
+}
+
+// PPURead read CHR of 1 KiB banks, or a nametable
+func (m *Namco163) PPURead(addr uint16) byte {
+	if off := m.chrOffset(addr); off >= 0 {
+		return m.console.Cartridge.Chr[off]
+	}
+	return m.console.PPU.NameTable[uint16(m.CHR[addr>>10]&1)*0x400+addr&0x3FF]
+}
+
+// PPUWrite write CHR RAM or a nametable
+func (m *Namco163) PPUWrite(addr uint16, val byte) {
+	if off := m.chrOffset(addr); off < 0 {
+		m.console.PPU.NameTable[uint16(m.CHR[addr>>10]&1)*0x400+addr&0x3FF] = val
+	} else if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[off] = val
+	}
+}
+
+// readNameTable read a nametable, or a bank of CHR ROM below $E0
+func (m *Namco163) readNameTable(addr uint16) byte {
+	bank := m.NT[addr>>10&3]
+	if bank < 0xE0 {
+		chr := m.console.Cartridge.Chr
+		return chr[(int(bank)*0x400+int(addr&0x3FF))%len(chr)]
+	}
+	return m.console.PPU.NameTable[uint16(bank&1)*0x400+addr&0x3FF]
+}
+
+func (m *Namco163) writeNameTable(addr uint16, val byte) {
+	if bank := m.NT[addr>>10&3]; bank >= 0xE0 {
+		m.console.PPU.NameTable[uint16(bank&1)*0x400+addr&0x3FF] = val
+	}
+}
+
+// prgOffset map 8 KiB banks, $E000 is the last bank
+func (m *Namco163) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	prg := m.console.Cartridge.PRG
+	if slot := (addr - 0x8000) >> 13; slot < 3 {
+		return (int(m.PRG[slot]&0x3F)*0x2000 + int(addr&0x1FFF)) % len(prg)
+	}
+	return len(prg) - 0x2000 + int(addr&0x1FFF)
+}
+
+// chrOffset return -1 for banks of $E0 or more mapping nametables, unless
+// bit 6 or 7 of $E800 disables that for $0000 or $1000
+func (m *Namco163) chrOffset(addr uint16) int {
+	bank := m.CHR[addr>>10]
+	if bank >= 0xE0 && m.PRG[1]>>(6+addr>>12)&1 == 0 {
+		return -1
+	}
+	return (int(bank)*0x400 + int(addr&0x3FF)) % len(m.console.Cartridge.Chr)
+}
+
+// audioStep update a channel every 15 cycles, from channel 7 down to the
+// lowest enabled by bits 4-6 of $7F
+func (m *Namco163) audioStep() {
+	if m.Cycle++; m.Cycle < 15 {
+		return
+	}
+	m.Cycle = 0
+	if m.PRG[0]&0x40 != 0 {
+		return
+	}
+	ch := m.Channel
+	m.Out[ch] = m.updateChannel(ch)
+	if ch--; ch < m.lowestChannel() || ch > 7 {
+		ch = 7
+	}
+	m.Channel = ch
+}
+
+func (m *Namco163) lowestChannel() byte {
+	return 7 - m.RAM[0x7F]>>4&7
+}
+
+// updateChannel add frequency to phase, of 8 registers of a channel from
+// $40, and return its sample of 4 bits, centered, times volume
+func (m *Namco163) updateChannel(ch byte) int8 {
+	r := m.RAM[0x40+int(ch)*8:][:8]
+	freq := uint32(r[0]) | uint32(r[2])<<8 | uint32(r[4]&3)<<16
+	phase := uint32(r[1]) | uint32(r[3])<<8 | uint32(r[5])<<16
+	length := 256 - uint32(r[4]&0xFC)
+	phase = (phase + freq) % (length << 16)
+	r[1], r[3], r[5] = byte(phase), byte(phase>>8), byte(phase>>16)
+
+	i := byte(phase>>16) + r[6]
+	sample := m.RAM[i>>1&0x7F] >> (i & 1 * 4) & 0x0F
+	return (int8(sample) - 8) * int8(r[7]&0x0F)
+}
+
+// audioOutput average enabled channels, as they take turns on the output
+func (m *Namco163) audioOutput() float32 {
+	if m.PRG[0]&0x40 != 0 {
+		return 0
+	}
+	low := m.lowestChannel()
+	var sum int
+	for ch := low; ch <= 7; ch++ {
+		sum += int(m.Out[ch])
+	}
+	return float32(sum) / float32(8-low) * namco163Level
+}
+
+// battery return internal RAM, which boards with a battery keep
+func (m *Namco163) battery() []byte {
+	if m.console.Cartridge.Battery == 0 {
+		return nil
+	}
+	return m.RAM[:]
+}
+
+func (m *Namco163) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.namco163State)
+}
+
+func (m *Namco163) loadState(r io.Reader) error {
+	return binary.Read(r, binary.LittleEndian, &m.namco163State)
+}
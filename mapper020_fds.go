@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// FDS - RAM adapter of Famicom Disk System, as mapper 020. It has 32 KiB
+// of PRG RAM at $6000-$DFFF, BIOS at $E000, 8 KiB of CHR RAM, a timer IRQ,
+// the disk drive's registers and wavetable audio. The drive transfers a
+// byte of the track of a side every 150 CPU cycles, with an IRQ for each
+// http://wiki.nesdev.com/w/index.php/Family_Computer_Disk_System
+type FDS struct {
+	console *Console
+	cart    *Cartridge // side inserted is kept through reset of the same disk
+	fdsState
+}
+
+type fdsState struct {
+	Reload    uint16 // $4020-$4021
+	Timer     uint16
+	TimerCtl  byte // $4022: bit 0 repeats, bit 1 enables
+	IO        byte // $4023: bit 0 enables disk registers, bit 1 sound
+	WriteData byte // $4024
+	Control   byte // $4025
+	ReadData  byte
+	TimerIRQ  bool
+	DiskIRQ   bool
+	Transfer  bool // a byte was transferred, bit 1 of $4030
+
+	Side      int8 // inserted, -1 if none
+	Insert    int8 // side to insert once InsertIn runs out
+	InsertIn  int32
+	Scanning  bool
+	EndOfHead bool
+	GapEnded  bool
+	Position  int32
+	Delay     int32
+	CRC       uint16
+	LastCRC   bool // CRC control as the last byte was transferred
+
+	Audio fdsAudio
+}
+
+// $4025 bits
+const (
+	fdsMotor   = 0x01
+	fdsReset   = 0x02 // transfer reset, holding the head at the start
+	fdsRead    = 0x04
+	fdsMirror  = 0x08 // horizontal mirroring
+	fdsCRCCtl  = 0x10 // transfer CRC
+	fdsReady   = 0x40 // past the gap, or writing a block
+	fdsDiskIRQ = 0x80
+)
+
+// drive timing in CPU cycles
+const (
+	fdsByteTime = 150                 // a byte takes to transfer
+	fdsHeadTime = 50000               // the head takes back to the start
+	fdsSwapTime = cyclesPerFrame * 60 // a second without a disk, as sides are switched
+)
+
+func init() {
+	RegisterMapper(fdsMapper, func() Mapper { return &FDS{} })
+}
+
+// Init initialize mapper, side A inserted unless reset keeps the side
+func (m *FDS) Init(con *Console) {
+	side, insert, in := int8(0), int8(0), int32(0)
+	if m.cart == con.Cartridge {
+		side, insert, in = m.Side, m.Insert, m.InsertIn
+	}
+	m.console, m.cart = con, con.Cartridge
+	m.fdsState = fdsState{Side: side, Insert: insert, InsertIn: in, EndOfHead: true}
+	m.Audio.reset()
+}
+
+func (m *FDS) Read(addr uint16) byte {
+	val, _ := m.peek(addr)
+	switch addr {
+	case 0x4030:
+		m.Transfer, m.TimerIRQ, m.DiskIRQ = false, false, false
+		m.updateIRQ()
+	case 0x4031:
+		m.Transfer, m.DiskIRQ = false, false
+		m.updateIRQ()
+	}
+	return val
+}
+
+func (m *FDS) peek(addr uint16) (byte, bool) {
+	switch {
+	case addr >= 0x6000:
+		if addr >= 0xE000 {
+			return m.console.Cartridge.PRG[addr-0xE000], true
+		}
+		return m.console.Cartridge.SRAM[addr-0x6000], true
+	case addr == 0x4030:
+		var val byte
+		if m.TimerIRQ {
+			val |= 0x01
+		}
+		if m.Transfer {
+			val |= 0x02
+		}
+		return val, true
+	case addr == 0x4031:
+		return m.ReadData, true
+	case addr == 0x4032:
+		val := byte(0x40)
+		if m.Side < 0 {
+			val |= 0x07 // not inserted, not ready, write protected
+		} else if !m.Scanning {
+			val |= 0x02
+		}
+		return val, true
+	case addr == 0x4033:
+		return 0x80, true // battery good
+	case addr >= 0x4040 && addr < 0x4098:
+		return m.Audio.read(addr)
+	}
+	return 0, false
+}
+
+// Write PRG RAM and registers, those of disk and sound if enabled by $4023
+func (m *FDS) Write(addr uint16, val byte) {
+	switch {
+	case addr >= 0xE000:
+	case addr >= 0x6000:
+		m.console.Cartridge.SRAM[addr-0x6000] = val
+	case addr >= 0x4040:
+		if m.IO&2 != 0 {
+			m.Audio.write(addr, val)
+		}
+	case addr == 0x4023:
+		m.IO = val
+		if val&1 == 0 {
+			m.TimerCtl &^= 2
+			m.TimerIRQ, m.DiskIRQ = false, false
+			m.updateIRQ()
+		}
+	case m.IO&1 == 0:
+	case addr == 0x4020:
+		m.Reload = m.Reload&0xFF00 | uint16(val)
+	case addr == 0x4021:
+		m.Reload = m.Reload&0x00FF | uint16(val)<<8
+	case addr == 0x4022:
+		m.TimerCtl = val & 3
+		if val&2 != 0 {
+			m.Timer = m.Reload
+		} else {
+			m.TimerIRQ = false
+			m.updateIRQ()
+		}
+	case addr == 0x4024:
+		m.WriteData = val
+		m.Transfer, m.DiskIRQ = false, false
+		m.updateIRQ()
+	case addr == 0x4025:
+		m.Control = val
+		m.DiskIRQ = false
+		m.updateIRQ()
+		if val&fdsMirror != 0 {
+			m.console.mirroring = mirrorHorizontal
+		} else {
+			m.console.mirroring = mirrorVertical
+		}
+	}
+}
+
+func (m *FDS) updateIRQ() {
+	m.console.CPU.setIRQ(irqMapper, m.TimerIRQ || m.DiskIRQ)
+}
+
+// cpuCycle clock the timer and the drive
+func (m *FDS) cpuCycle() {
+	if m.TimerCtl&2 != 0 {
+		if m.Timer == 0 {
+			m.TimerIRQ = true
+			m.updateIRQ()
+			m.Timer = m.Reload
+			if m.TimerCtl&1 == 0 {
+				m.TimerCtl &^= 2
+			}
+		} else {
+			m.Timer--
+		}
+	}
+	m.clockDrive()
+}
+
+// clockDrive move the head along the track while the motor is on, from the
+// start after it has been returned, transferring a byte every 150 cycles
+// until the end, where the motor stops
+func (m *FDS) clockDrive() {
+	if m.InsertIn > 0 {
+		if m.InsertIn--; m.InsertIn == 0 {
+			m.Side = m.Insert
+		}
+	}
+	switch {
+	case m.Side < 0 || m.Control&fdsMotor == 0:
+		m.EndOfHead, m.Scanning = true, false
+		return
+	case m.Control&fdsReset != 0 && !m.Scanning:
+		return
+	case m.EndOfHead:
+		m.EndOfHead, m.GapEnded = false, false
+		m.Position, m.Delay = 0, fdsHeadTime
+		return
+	case m.Delay > 0:
+		m.Delay--
+		return
+	}
+	m.Scanning = true
+	track := m.cart.Disk.Tracks[m.Side]
+	if m.Control&fdsRead != 0 {
+		m.readByte(track[m.Position])
+	} else {
+		track[m.Position] = m.writeByte()
+	}
+	m.LastCRC = m.Control&fdsCRCCtl != 0
+	if m.Position++; int(m.Position) >= len(track) {
+		m.Control &^= fdsMotor
+	} else {
+		m.Delay = fdsByteTime
+	}
+}
+
+// readByte transfer a byte read once the mark ending a gap has been
+// passed, which is not transferred itself
+func (m *FDS) readByte(data byte) {
+	switch {
+	case m.Control&fdsReady == 0:
+		m.GapEnded = false
+	case !m.GapEnded && data != 0:
+		m.GapEnded = true
+		return
+	}
+	if m.GapEnded {
+		m.ReadData = data
+		m.transferred()
+	}
+}
+
+// writeByte return the byte to write, that of $4024, or CRC of the block
+// so far while CRC control is set, gap before the drive is ready
+func (m *FDS) writeByte() byte {
+	data := m.WriteData
+	if m.Control&fdsCRCCtl == 0 {
+		m.transferred()
+	}
+	if m.Control&fdsReady == 0 {
+		data, m.CRC = 0, 0
+	}
+	m.GapEnded = false
+	if m.Control&fdsCRCCtl == 0 {
+		m.CRC = fdsCRC(m.CRC, data)
+		return data
+	}
+	if !m.LastCRC {
+		m.CRC = fdsCRC(fdsCRC(m.CRC, 0), 0)
+	}
+	data = byte(m.CRC)
+	m.CRC >>= 8
+	return data
+}
+
+func (m *FDS) transferred() {
+	m.Transfer = true
+	if m.Control&fdsDiskIRQ != 0 {
+		m.DiskIRQ = true
+		m.updateIRQ()
+	}
+}
+
+// PPURead read 8 KiB of CHR RAM
+func (m *FDS) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[addr&0x1FFF]
+}
+
+// PPUWrite write CHR RAM
+func (m *FDS) PPUWrite(addr uint16, val byte) {
+	m.console.Cartridge.Chr[addr&0x1FFF] = val
+}
+
+func (m *FDS) prgOffset(addr uint16) int {
+	if addr < 0xE000 {
+		return -1
+	}
+	return int(addr - 0xE000)
+}
+
+func (m *FDS) audioStep() {
+	m.Audio.step()
+}
+
+func (m *FDS) audioOutput() float32 {
+	return m.Audio.output()
+}
+
+// saveState write registers, then tracks as written
+func (m *FDS) saveState(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, &m.fdsState); err != nil {
+		return err
+	}
+	for _, track := range m.cart.Disk.Tracks {
+		if _, err := w.Write(track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FDS) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.fdsState); err != nil {
+		return err
+	}
+	for _, track := range m.cart.Disk.Tracks {
+		if _, err := io.ReadFull(r, track); err != nil {
+			return err
+		}
+	}
+	if m.Control&fdsMirror != 0 {
+		m.console.mirroring = mirrorHorizontal
+	} else {
+		m.console.mirroring = mirrorVertical
+	}
+	return nil
+}
+
+func (con *Console) fds() (*FDS, error) {
+	if m, ok := con.Mapper.(*FDS); ok && con.Cartridge.Disk != nil {
+		return m, nil
+	}
+	return nil, errors.New("not a Famicom Disk System")
+}
+
+// DiskSides return the number of sides of the FDS disk, two for each disk
+// of the image, side A first
+func (con *Console) DiskSides() int {
+	if _, err := con.fds(); err != nil {
+		return 0
+	}
+	return len(con.Cartridge.Disk.Tracks)
+}
+
+// DiskSide return the side of FDS disk inserted, -1 if none
+func (con *Console) DiskSide() int {
+	m, err := con.fds()
+	if err != nil || m.InsertIn > 0 {
+		return -1
+	}
+	return int(m.Side)
+}
+
+// InsertDisk insert a side of FDS disk. A disk in the drive is ejected
+// first, the side is inserted a second later, for BIOS to see it change
+func (con *Console) InsertDisk(side int) error {
+	m, err := con.fds()
+	if err != nil {
+		return err
+	}
+	if side < 0 || side >= len(m.cart.Disk.Tracks) {
+		return errors.New("no such disk side")
+	}
+	if m.Side < 0 && m.InsertIn == 0 {
+		m.Side = int8(side)
+		return nil
+	}
+	m.Side, m.Insert, m.InsertIn = -1, int8(side), fdsSwapTime
+	return nil
+}
+
+// EjectDisk eject the FDS disk
+func (con *Console) EjectDisk() error {
+	m, err := con.fds()
+	if err != nil {
+		return err
+	}
+	m.Side, m.InsertIn = -1, 0
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// VRC4 - Konami VRC2 and VRC4, mappers 021, 022, 023 and 025. Boards wire
+// CPU address lines to the two register select pins differently, told
+// apart by NES 2.0 submapper, or by decoding both wirings of the mapper
+// if there is none. VRC2 has no IRQ nor PRG swap mode
+// http://wiki.nesdev.com/w/index.php/VRC2_and_VRC4
+type VRC4 struct {
+	console *Console
+	id      byte // iNES mapper
+	vrc4State
+}
+
+type vrc4State struct {
+	PRG       [2]byte
+	CHR       [8]uint16 // 1 KiB banks
+	Mirroring byte
+	Control   byte // $9002, bit 1 swaps $8000 and $C000
+	IRQ       vrcIRQ
+}
+
+// vrcWiring - CPU address lines of the register select pins of a board
+type vrcWiring struct {
+	a0, a1 uint16
+	vrc2   bool
+}
+
+// wirings by mapper and submapper, submapper 0 ORs lines of all boards
+var vrcWirings = map[byte][4]vrcWiring{
+	21: {{0x42, 0x84, false}, {0x02, 0x04, false}, {0x40, 0x80, false}},                     // VRC4a, VRC4c
+	22: {{0x02, 0x01, true}},                                                                // VRC2a
+	23: {{0x05, 0x0A, false}, {0x01, 0x02, false}, {0x04, 0x08, false}, {0x01, 0x02, true}}, // VRC4f, VRC4e, VRC2b
+	25: {{0x0A, 0x05, false}, {0x02, 0x01, false}, {0x08, 0x04, false}, {0x02, 0x01, true}}, // VRC4b, VRC4d, VRC2c
+}
+
+// $9000 of VRC4, VRC6 and VRC7
+var vrcMirroring = [4]byte{mirrorVertical, mirrorHorizontal, mirrorSingle0, mirrorSingle1}
+
+func init() {
+	for id := range vrcWirings {
+		id := id
+		RegisterMapper(int(id), func() Mapper { return &VRC4{id: id} })
+	}
+}
+
+// Init initialize mapper
+func (m *VRC4) Init(con *Console) {
+	m.console = con
+	m.vrc4State = vrc4State{}
+	m.setMirroring(0)
+}
+
+func (m *VRC4) wiring() vrcWiring {
+	w := vrcWirings[m.id]
+	if sub := m.console.Cartridge.Submapper; int(sub) < len(w) && w[sub].a0 != 0 {
+		return w[sub]
+	}
+	return w[0]
+}
+
+func (m *VRC4) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	if addr >= 0x6000 {
+		return m.console.Cartridge.SRAM[addr-0x6000]
+	}
+	return 0
+}
+
+// Write registers at $8000-$FFFF, each 4 KiB has up to 4 of them
+func (m *VRC4) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 {
+			m.console.Cartridge.SRAM[addr-0x6000] = val
+		}
+		return
+	}
+	w := m.wiring()
+	var line uint16
+	if addr&w.a0 != 0 {
+		line |= 1
+	}
+	if addr&w.a1 != 0 {
+		line |= 2
+	}
+	switch reg := addr & 0xF000; {
+	case reg == 0x8000:
+		m.PRG[0] = val & 0x1F
+	case reg == 0xA000:
+		m.PRG[1] = val & 0x1F
+	case reg == 0x9000 && (w.vrc2 || line < 2):
+		if w.vrc2 {
+			val &= 1
+		}
+		m.setMirroring(val & 3)
+	case reg == 0x9000 && line == 2:
+		m.Control = val
+	case reg >= 0xB000 && reg < 0xF000:
+		i := (reg-0xB000)>>11 | line>>1
+		if line&1 == 0 {
+			m.CHR[i] = m.CHR[i]&0x1F0 | uint16(val&0x0F)
+		} else if w.vrc2 {
+			m.CHR[i] = m.CHR[i]&0x0F | uint16(val&0x0F)<<4
+		} else {
+			m.CHR[i] = m.CHR[i]&0x0F | uint16(val&0x1F)<<4
+		}
+	case reg == 0xF000 && !w.vrc2:
+		m.IRQ.write(line, val)
+		m.console.CPU.setIRQ(irqMapper, m.IRQ.Pending)
+	}
+}
+
+func (m *VRC4) setMirroring(val byte) {
+	m.Mirroring = val
+	m.console.mirroring = vrcMirroring[val]
+}
+
+func (m *VRC4) cpuCycle() {
+	if m.IRQ.clock() {
+		m.console.CPU.setIRQ(irqMapper, true)
+	}
+}
+
+// PPURead read CHR of 1 KiB banks
+func (m *VRC4) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *VRC4) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+// prgOffset map 8 KiB banks, $C000 is the second last bank, or swapped
+// with $8000 by VRC4
+func (m *VRC4) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	n := len(m.console.Cartridge.PRG) / 0x2000
+	bank := n - 1
+	switch slot := int(addr-0x8000) >> 13; {
+	case slot == 1:
+		bank = int(m.PRG[1])
+	case slot == 3:
+	case slot == 0 && m.Control&2 == 0, slot == 2 && m.Control&2 != 0:
+		bank = int(m.PRG[0])
+	default:
+		bank = n - 2
+	}
+	return bank%n*0x2000 + int(addr&0x1FFF)
+}
+
+// chrOffset map 1 KiB banks, VRC2a ignores the low bit of bank numbers
+func (m *VRC4) chrOffset(addr uint16) int {
+	bank := int(m.CHR[addr>>10])
+	if m.id == 22 {
+		bank >>= 1
+	}
+	return (bank*0x400 + int(addr&0x3FF)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *VRC4) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.vrc4State)
+}
+
+func (m *VRC4) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.vrc4State); err != nil {
+		return err
+	}
+	m.setMirroring(m.Mirroring)
+	return nil
+}
+
+// vrcIRQ - IRQ counter of VRC4, VRC6 and VRC7, counting up to $FF by CPU
+// cycles, or by scanlines which a prescaler derives from CPU cycles
+// http://wiki.nesdev.com/w/index.php/VRC_IRQ
+type vrcIRQ struct {
+	Latch     byte
+	Counter   byte
+	Control   byte // bit 0 enables on acknowledge, 1 enables, 2 cycle mode
+	Prescaler int16
+	Pending   bool
+}
+
+// write register 0 or 1, the low or high nibble of latch of VRC4, 2 for
+// control and 3 to acknowledge
+func (q *vrcIRQ) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		q.Latch = q.Latch&0xF0 | val&0x0F
+	case 1:
+		q.Latch = q.Latch&0x0F | val<<4
+	case 2:
+		q.writeControl(val)
+	case 3:
+		q.acknowledge()
+	}
+}
+
+func (q *vrcIRQ) writeControl(val byte) {
+	q.Control = val & 0x07
+	q.Pending = false
+	if q.Control&2 != 0 {
+		q.Counter = q.Latch
+		q.Prescaler = 341
+	}
+}
+
+func (q *vrcIRQ) acknowledge() {
+	q.Pending = false
+	q.Control = q.Control&^2 | q.Control<<1&2
+}
+
+// clock the counter by a CPU cycle, true when it raises IRQ
+func (q *vrcIRQ) clock() bool {
+	if q.Control&2 == 0 {
+		return false
+	}
+	if q.Control&4 == 0 {
+		q.Prescaler -= 3
+		if q.Prescaler > 0 {
+			return false
+		}
+		q.Prescaler += 341
+	}
+	if q.Counter != 0xFF {
+		q.Counter++
+		return false
+	}
+	q.Counter = q.Latch
+	q.Pending = true
+	return true
+}
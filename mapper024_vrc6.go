@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// VRC6 - Konami VRC6, mapper 024 and 026 which swaps the register select
+// lines, with expansion audio of two pulses and a sawtooth
+// http://wiki.nesdev.com/w/index.php/VRC6
+type VRC6 struct {
+	console *Console
+	swapped bool
+	vrc6State
+}
+
+type vrc6State struct {
+	PRG16   byte // $8000-$BFFF
+	PRG8    byte // $C000-$DFFF
+	CHR     [8]byte
+	Banking byte // $B003: CHR mode, mirroring and PRG RAM enable
+	IRQ     vrcIRQ
+
+	// http://wiki.nesdev.com/w/index.php/VRC6_audio
+	Pulse     [2]vrc6Pulse
+	Saw       vrc6Saw
+	Frequency byte // $9003: halt, and periods shifted by 4 or 8 bits
+}
+
+type vrc6Pulse struct {
+	Volume  byte
+	Duty    byte
+	Mode    bool // ignore duty, output volume
+	Enabled bool
+	Period  uint16
+	Timer   uint16
+	Step    byte
+}
+
+type vrc6Saw struct {
+	Rate    byte
+	Enabled bool
+	Period  uint16
+	Timer   uint16
+	Step    byte
+	Accum   byte
+}
+
+// VRC6 output of a pulse at volume 15 is about that of an APU pulse
+var vrc6Level = pulseMix[15] / 15
+
+func init() {
+	RegisterMapper(24, func() Mapper { return &VRC6{} })
+	RegisterMapper(26, func() Mapper { return &VRC6{swapped: true} })
+}
+
+// Init initialize mapper
+func (m *VRC6) Init(con *Console) {
+	m.console = con
+	m.vrc6State = vrc6State{}
+	m.setBanking(0)
+}
+
+func (m *VRC6) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	if addr >= 0x6000 && m.Banking&0x80 != 0 {
+		return m.console.Cartridge.SRAM[addr-0x6000]
+	}
+	return 0
+}
+
+// Write registers at $8000-$FFFF, 4 in each 4 KiB
+func (m *VRC6) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 && m.Banking&0x80 != 0 {
+			m.console.Cartridge.SRAM[addr-0x6000] = val
+		}
+		return
+	}
+	reg := addr & 0x0003
+	if m.swapped {
+		reg = reg>>1 | reg<<1&2
+	}
+	switch addr & 0xF000 {
+	case 0x8000:
+		m.PRG16 = val & 0x0F
+	case 0x9000, 0xA000:
+		if addr&0xF000 == 0x9000 && reg == 3 {
+			m.Frequency = val
+		} else {
+			m.Pulse[addr>>13&1].write(reg, val)
+		}
+	case 0xB000:
+		if reg == 3 {
+			m.setBanking(val)
+		} else {
+			m.Saw.write(reg, val)
+		}
+	case 0xC000:
+		m.PRG8 = val & 0x1F
+	case 0xD000, 0xE000:
+		m.CHR[(addr-0xD000)>>10&4|reg] = val
+	case 0xF000:
+		switch reg {
+		case 0:
+			m.IRQ.Latch = val
+		case 1:
+			m.IRQ.writeControl(val)
+		case 2:
+			m.IRQ.acknowledge()
+		}
+		m.console.CPU.setIRQ(irqMapper, m.IRQ.Pending)
+	}
+}
+
+func (m *VRC6) setBanking(val byte) {
+	m.Banking = val
+	m.console.mirroring = vrcMirroring[val>>2&3]
+}
+
+func (m *VRC6) cpuCycle() {
+	if m.IRQ.clock() {
+		m.console.CPU.setIRQ(irqMapper, true)
+	}
+}
+
+// PPURead read CHR of banks by the mode of $B003
+func (m *VRC6) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *VRC6) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+func (m *VRC6) prgOffset(addr uint16) int {
+	prg := m.console.Cartridge.PRG
+	switch {
+	case addr < 0x8000:
+		return -1
+	case addr < 0xC000:
+		return (int(m.PRG16)*0x4000 + int(addr&0x3FFF)) % len(prg)
+	case addr < 0xE000:
+		return (int(m.PRG8)*0x2000 + int(addr&0x1FFF)) % len(prg)
+	default:
+		return len(prg) - 0x2000 + int(addr&0x1FFF)
+	}
+}
+
+// chrOffset map 1 KiB banks in mode 0, 2 KiB in mode 1, and 1 KiB then
+// 2 KiB banks in modes 2 and 3
+func (m *VRC6) chrOffset(addr uint16) int {
+	var off int
+	switch mode := m.Banking & 3; {
+	case mode == 0 || mode >= 2 && addr < 0x1000:
+		off = int(m.CHR[addr>>10])*0x400 + int(addr&0x3FF)
+	case mode == 1:
+		off = int(m.CHR[addr>>11])*0x800 + int(addr&0x7FF)
+	default:
+		off = int(m.CHR[4+addr>>11&1])*0x800 + int(addr&0x7FF)
+	}
+	return off % len(m.console.Cartridge.Chr)
+}
+
+// audioStep clock channels, unless halted by $9003
+func (m *VRC6) audioStep() {
+	if m.Frequency&1 != 0 {
+		return
+	}
+	var shift uint
+	switch {
+	case m.Frequency&4 != 0:
+		shift = 8
+	case m.Frequency&2 != 0:
+		shift = 4
+	}
+	m.Pulse[0].clock(shift)
+	m.Pulse[1].clock(shift)
+	m.Saw.clock(shift)
+}
+
+func (m *VRC6) audioOutput() float32 {
+	out := m.Pulse[0].output() + m.Pulse[1].output() + m.Saw.output()
+	return float32(out) * vrc6Level
+}
+
+func (p *vrc6Pulse) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		p.Mode = val&0x80 != 0
+		p.Duty = val >> 4 & 0x07
+		p.Volume = val & 0x0F
+	case 1:
+		p.Period = p.Period&0x0F00 | uint16(val)
+	case 2:
+		p.Period = p.Period&0x00FF | uint16(val&0x0F)<<8
+		p.Enabled = val&0x80 != 0
+		if !p.Enabled {
+			p.Step = 0
+		}
+	}
+}
+
+func (p *vrc6Pulse) clock(shift uint) {
+	if !p.Enabled {
+		return
+	}
+	if p.Timer > 0 {
+		p.Timer--
+		return
+	}
+	p.Timer = p.Period >> shift
+	p.Step = (p.Step + 1) & 15
+}
+
+// output volume for duty+1 of 16 steps
+func (p *vrc6Pulse) output() byte {
+	if !p.Enabled || !p.Mode && p.Step > p.Duty {
+		return 0
+	}
+	return p.Volume
+}
+
+func (s *vrc6Saw) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		s.Rate = val & 0x3F
+	case 1:
+		s.Period = s.Period&0x0F00 | uint16(val)
+	case 2:
+		s.Period = s.Period&0x00FF | uint16(val&0x0F)<<8
+		s.Enabled = val&0x80 != 0
+		if !s.Enabled {
+			s.Step, s.Accum = 0, 0
+		}
+	}
+}
+
+// clock the timer, the rate is added to the accumulator every other step,
+// which resets after 7 additions
+func (s *vrc6Saw) clock(shift uint) {
+	if !s.Enabled {
+		return
+	}
+	if s.Timer > 0 {
+		s.Timer--
+		return
+	}
+	s.Timer = s.Period >> shift
+	s.Step++
+	switch {
+	case s.Step == 14:
+		s.Step, s.Accum = 0, 0
+	case s.Step&1 == 0:
+		s.Accum += s.Rate
+	}
+}
+
+func (s *vrc6Saw) output() byte {
+	return s.Accum >> 3
+}
+
+func (m *VRC6) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.vrc6State)
+}
+
+func (m *VRC6) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.vrc6State); err != nil {
+		return err
+	}
+	m.setBanking(m.Banking)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// GxROM mapper 066, also MHROM, a 32 KiB PRG bank selected by bits 4-5
+// and an 8 KiB CHR bank by bits 0-1 of writes to $8000-$FFFF, always with
+// bus conflicts
+// http://wiki.nesdev.com/w/index.php/GxROM
+type GxROM struct {
+	console *Console
+	reg     byte
+}
+
+func init() {
+	RegisterMapper(66, func() Mapper { return &GxROM{} })
+}
+
+// Init initialize mapper
+func (m *GxROM) Init(con *Console) {
+	m.console = con
+	m.reg = 0
+}
+
+func (m *GxROM) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	return 0
+}
+
+// Write select PRG and CHR banks
+func (m *GxROM) Write(addr uint16, val byte) {
+	if addr >= 0x8000 {
+		m.reg = val
+	}
+}
+
+// PPURead read CHR of selected bank
+func (m *GxROM) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrAddress(addr)]
+}
+
+// PPUWrite write CHR RAM, CHR ROM is read only
+func (m *GxROM) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrAddress(addr)] = val
+	}
+}
+
+func (m *GxROM) chrAddress(addr uint16) int {
+	return (int(m.reg&0x03)*0x2000 + int(addr)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *GxROM) busConflicts() bool {
+	return true
+}
+
+func (m *GxROM) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	return (int(m.reg>>4&0x03)*0x8000 + int(addr&0x7FFF)) % len(m.console.Cartridge.PRG)
+}
+
+func (m *GxROM) chrOffset(addr uint16) int {
+	if m.console.Cartridge.ChrRAM {
+		return -1
+	}
+	return m.chrAddress(addr)
+}
+
+func (m *GxROM) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, m.reg)
+}
+
+func (m *GxROM) loadState(r io.Reader) error {
+	return binary.Read(r, binary.LittleEndian, &m.reg)
+}
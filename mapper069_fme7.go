@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// FME7 - Sunsoft FME-7 mapper 069, and 5B which adds audio of 3 square
+// channels with noise and an envelope, as AY-3-8910. A command is written
+// to $8000-$9FFF and its parameter to $A000-$BFFF, audio registers are
+// selected at $C000-$DFFF and written at $E000-$FFFF
+// http://wiki.nesdev.com/w/index.php/Sunsoft_FME-7
+type FME7 struct {
+	console *Console
+	fme7State
+}
+
+type fme7State struct {
+	Command   byte
+	CHR       [8]byte
+	PRG       [4]byte // $6000, $8000, $A000 and $C000, bit 6 of $6000 selects RAM
+	Mirroring byte
+	IRQ       byte // bit 0 enables IRQ, bit 7 counting
+	Counter   uint16
+	Audio     sunsoft5B
+}
+
+// sunsoft5B - audio of 5B
+// http://wiki.nesdev.com/w/index.php/Sunsoft_5B_audio
+type sunsoft5B struct {
+	Address  byte
+	Regs     [16]byte
+	Tone     [3]uint16 // timers, counting CPU cycles
+	Square   [3]bool
+	Noise    uint16
+	LFSR     uint32
+	Envelope uint16
+	EnvStep  byte // 0-31
+	EnvHold  bool
+	EnvDown  bool
+}
+
+// a channel at full volume is about an APU pulse at full volume
+var sunsoft5BLevels = func() (t [32]float32) {
+	for i := 1; i < len(t); i++ {
+		t[i] = pulseMix[15] * float32(math.Pow(10, -1.5*float64(31-i)/20))
+	}
+	return
+}()
+
+func init() {
+	RegisterMapper(69, func() Mapper { return &FME7{} })
+}
+
+// Init initialize mapper
+func (m *FME7) Init(con *Console) {
+	m.console = con
+	m.fme7State = fme7State{}
+	m.Audio.LFSR = 1
+	m.setMirroring(0)
+}
+
+func (m *FME7) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	if addr >= 0x6000 && m.PRG[0]&0xC0 == 0xC0 {
+		return m.console.Cartridge.SRAM[m.ramOffset(addr)]
+	}
+	return 0
+}
+
+// Write PRG RAM, commands and audio registers
+func (m *FME7) Write(addr uint16, val byte) {
+	switch {
+	case addr < 0x6000:
+	case addr < 0x8000:
+		if m.PRG[0]&0xC0 == 0xC0 {
+			m.console.Cartridge.SRAM[m.ramOffset(addr)] = val
+		}
+	case addr < 0xA000:
+		m.Command = val & 0x0F
+	case addr < 0xC000:
+		m.writeParameter(val)
+	case addr < 0xE000:
+		m.Audio.Address = val
+	default:
+		m.Audio.write(val)
+	}
+}
+
+func (m *FME7) writeParameter(val byte) {
+	switch c := m.Command; {
+	case c < 8:
+		m.CHR[c] = val
+	case c < 0x0C:
+		m.PRG[c-8] = val
+	case c == 0x0C:
+		m.setMirroring(val & 3)
+	case c == 0x0D:
+		m.IRQ = val
+		m.console.CPU.setIRQ(irqMapper, false)
+	case c == 0x0E:
+		m.Counter = m.Counter&0xFF00 | uint16(val)
+	case c == 0x0F:
+		m.Counter = m.Counter&0x00FF | uint16(val)<<8
+	}
+}
+
+func (m *FME7) setMirroring(val byte) {
+	m.Mirroring = val
+	m.console.mirroring = vrcMirroring[val]
+}
+
+// cpuCycle count down, raising IRQ as the counter wraps from 0 to $FFFF
+func (m *FME7) cpuCycle() {
+	if m.IRQ&0x80 == 0 {
+		return
+	}
+	m.Counter--
+	if m.Counter == 0xFFFF && m.IRQ&1 != 0 {
+		m.console.CPU.setIRQ(irqMapper, true)
+	}
+}
+
+// PPURead read CHR of 1 KiB banks
+func (m *FME7) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *FME7) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+// prgOffset map 8 KiB banks, $E000 is the last bank, $6000 a bank of ROM
+// unless RAM is selected
+func (m *FME7) prgOffset(addr uint16) int {
+	prg := m.console.Cartridge.PRG
+	slot := int(addr-0x6000) >> 13
+	switch {
+	case addr < 0x6000 || slot == 0 && m.PRG[0]&0x40 != 0:
+		return -1
+	case slot == 4:
+		return len(prg) - 0x2000 + int(addr&0x1FFF)
+	}
+	return (int(m.PRG[slot]&0x3F)*0x2000 + int(addr&0x1FFF)) % len(prg)
+}
+
+func (m *FME7) ramOffset(addr uint16) int {
+	sram := m.console.Cartridge.SRAM
+	return (int(m.PRG[0]&0x3F)*0x2000 + int(addr&0x1FFF)) % len(sram)
+}
+
+func (m *FME7) chrOffset(addr uint16) int {
+	return (int(m.CHR[addr>>10])*0x400 + int(addr&0x3FF)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *FME7) audioStep() {
+	m.Audio.step()
+}
+
+func (m *FME7) audioOutput() float32 {
+	return m.Audio.output()
+}
+
+func (m *FME7) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.fme7State)
+}
+
+func (m *FME7) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.fme7State); err != nil {
+		return err
+	}
+	m.setMirroring(m.Mirroring)
+	return nil
+}
+
+func (a *sunsoft5B) write(val byte) {
+	if a.Address > 0x0F {
+		return
+	}
+	a.Regs[a.Address] = val
+	if a.Address == 0x0D {
+		a.Envelope = 0
+		a.EnvStep = 0
+		a.EnvHold = false
+		a.EnvDown = val&0x04 == 0 // attack counts up
+	}
+}
+
+// step a CPU cycle. Squares toggle every 16 cycles of their period, the
+// noise shifts every 32 and the envelope steps every 16
+func (a *sunsoft5B) step() {
+	for i := range a.Tone {
+		period := uint16(a.Regs[i*2]) | uint16(a.Regs[i*2+1]&0x0F)<<8
+		if a.Tone[i]++; a.Tone[i] >= period*16 {
+			a.Tone[i] = 0
+			a.Square[i] = !a.Square[i]
+		}
+	}
+	if a.Noise++; a.Noise >= uint16(a.Regs[6]&0x1F)*32 {
+		a.Noise = 0
+		bit := (a.LFSR ^ a.LFSR>>3) & 1
+		a.LFSR = a.LFSR>>1 | bit<<16
+	}
+	period := uint32(a.Regs[11]) | uint32(a.Regs[12])<<8
+	if a.Envelope++; uint32(a.Envelope) >= period*16 || a.Envelope == 0xFFFF {
+		a.Envelope = 0
+		a.stepEnvelope()
+	}
+}
+
+// stepEnvelope advance the envelope along the shape of register 13:
+// continue, attack, alternate and hold
+func (a *sunsoft5B) stepEnvelope() {
+	if a.EnvHold {
+		return
+	}
+	if a.EnvStep++; a.EnvStep < 32 {
+		return
+	}
+	shape := a.Regs[13]
+	switch {
+	case shape&0x08 == 0:
+		a.EnvHold, a.EnvStep, a.EnvDown = true, 31, true
+	case shape&0x01 != 0:
+		a.EnvHold, a.EnvStep = true, 31
+		if shape&0x02 != 0 {
+			a.EnvDown = !a.EnvDown
+		}
+	default:
+		a.EnvStep = 0
+		if shape&0x02 != 0 {
+			a.EnvDown = !a.EnvDown
+		}
+	}
+}
+
+// envelope level 0-31
+func (a *sunsoft5B) envelope() byte {
+	if a.EnvDown {
+		return 31 - a.EnvStep
+	}
+	return a.EnvStep
+}
+
+func (a *sunsoft5B) output() float32 {
+	mixer := a.Regs[7]
+	var out float32
+	for i := range a.Tone {
+		tone := a.Square[i] || mixer>>uint(i)&1 != 0
+		noise := a.LFSR&1 != 0 || mixer>>uint(i+3)&1 != 0
+		if !tone || !noise {
+			continue
+		}
+		vol := a.Regs[8+i]
+		if vol&0x10 != 0 {
+			out += sunsoft5BLevels[a.envelope()]
+		} else if vol&0x0F != 0 {
+			out += sunsoft5BLevels[vol&0x0F*2+1]
+		}
+	}
+	return out
+}
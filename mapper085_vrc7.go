@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// VRC7 - Konami VRC7 mapper 085, with FM synthesis. Boards select the
+// second register of each 4 KiB by A4 (VRC7a, submapper 2) or A3 (VRC7b,
+// submapper 1), either if there is no submapper
+// http://wiki.nesdev.com/w/index.php/VRC7
+type VRC7 struct {
+	console *Console
+	vrc7State
+}
+
+type vrc7State struct {
+	PRG     [3]byte
+	CHR     [8]byte
+	Control byte // $E000: mirroring, PRG RAM enable and sound reset
+	IRQ     vrcIRQ
+	OPLL    opll
+}
+
+func init() {
+	RegisterMapper(85, func() Mapper { return &VRC7{} })
+}
+
+// Init initialize mapper
+func (m *VRC7) Init(con *Console) {
+	m.console = con
+	m.vrc7State = vrc7State{}
+	m.OPLL.reset()
+	m.setControl(0)
+}
+
+func (m *VRC7) Read(addr uint16) byte {
+	if off := m.prgOffset(addr); off >= 0 {
+		return m.console.Cartridge.PRG[off]
+	}
+	if addr >= 0x6000 && m.Control&0x80 != 0 {
+		return m.console.Cartridge.SRAM[addr-0x6000]
+	}
+	return 0
+}
+
+// Write registers at $8000-$FFFF, 2 in each 4 KiB, and the sound chip at
+// $9010 and $9030
+func (m *VRC7) Write(addr uint16, val byte) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 && m.Control&0x80 != 0 {
+			m.console.Cartridge.SRAM[addr-0x6000] = val
+		}
+		return
+	}
+	var mask uint16
+	switch m.console.Cartridge.Submapper {
+	case 1:
+		mask = 0x08
+	case 2:
+		mask = 0x10
+	default:
+		mask = 0x18
+	}
+	second := addr&mask != 0
+	switch reg := addr & 0xF000; {
+	case reg == 0x8000 && !second:
+		m.PRG[0] = val & 0x3F
+	case reg == 0x8000:
+		m.PRG[1] = val & 0x3F
+	case reg == 0x9000 && !second:
+		m.PRG[2] = val & 0x3F
+	case reg == 0x9000 && addr&0x20 != 0:
+		if m.Control&0x40 == 0 {
+			m.OPLL.writeData(val)
+		}
+	case reg == 0x9000:
+		m.OPLL.writeAddress(val)
+	case reg < 0xE000:
+		i := (reg - 0xA000) >> 11
+		if second {
+			i++
+		}
+		m.CHR[i] = val
+	case reg == 0xE000 && !second:
+		m.setControl(val)
+	case reg == 0xE000:
+		m.IRQ.Latch = val
+	case reg == 0xF000:
+		if second {
+			m.IRQ.acknowledge()
+		} else {
+			m.IRQ.writeControl(val)
+		}
+		m.console.CPU.setIRQ(irqMapper, m.IRQ.Pending)
+	}
+}
+
+// setControl write $E000, bit 6 holds the sound chip in reset
+func (m *VRC7) setControl(val byte) {
+	m.Control = val
+	m.console.mirroring = vrcMirroring[val&3]
+	if val&0x40 != 0 {
+		m.OPLL.reset()
+	}
+}
+
+func (m *VRC7) cpuCycle() {
+	if m.IRQ.clock() {
+		m.console.CPU.setIRQ(irqMapper, true)
+	}
+}
+
+// PPURead read CHR of 1 KiB banks
+func (m *VRC7) PPURead(addr uint16) byte {
+	return m.console.Cartridge.Chr[m.chrOffset(addr)]
+}
+
+// PPUWrite write CHR RAM
+func (m *VRC7) PPUWrite(addr uint16, val byte) {
+	if m.console.Cartridge.ChrRAM {
+		m.console.Cartridge.Chr[m.chrOffset(addr)] = val
+	}
+}
+
+func (m *VRC7) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	prg := m.console.Cartridge.PRG
+	if slot := (addr - 0x8000) >> 13; slot < 3 {
+		return (int(m.PRG[slot])*0x2000 + int(addr&0x1FFF)) % len(prg)
+	}
+	return len(prg) - 0x2000 + int(addr&0x1FFF)
+}
+
+func (m *VRC7) chrOffset(addr uint16) int {
+	return (int(m.CHR[addr>>10])*0x400 + int(addr&0x3FF)) % len(m.console.Cartridge.Chr)
+}
+
+func (m *VRC7) audioStep() {
+	m.OPLL.step()
+}
+
+func (m *VRC7) audioOutput() float32 {
+	return float32(m.OPLL.Output)
+}
+
+func (m *VRC7) saveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &m.vrc7State)
+}
+
+func (m *VRC7) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.vrc7State); err != nil {
+		return err
+	}
+	m.console.mirroring = vrcMirroring[m.Control&3]
+	return nil
+}
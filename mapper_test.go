@@ -0,0 +1,838 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newMapperConsole connect a cartridge whose every byte of PRG and CHR
+// is the number of its 8 KiB bank
+func newMapperConsole(t *testing.T, mapper uint16, submapper byte, prgBanks, chrBanks int) *Console {
+	t.Helper()
+	cart := &Cartridge{
+		Mapper:    mapper,
+		Submapper: submapper,
+		PRG:       make([]byte, prgBanks*0x2000),
+		Chr:       make([]byte, chrBanks*0x2000),
+		SRAM:      make([]byte, 0x2000),
+	}
+	for i := range cart.PRG {
+		cart.PRG[i] = byte(i / 0x2000)
+	}
+	for i := range cart.Chr {
+		cart.Chr[i] = byte(i / 0x2000)
+	}
+	con := new(Console)
+	con.Connect(new(CPU))
+	con.Connect(new(PPU))
+	if err := con.Connect(cart); err != nil {
+		t.Fatal(err)
+	}
+	con.Reset()
+	return con
+}
+
+func TestDiscreteMappers(t *testing.T) {
+	tests := []struct {
+		name             string
+		mapper           uint16
+		submapper        byte
+		prg, chr         int
+		write            uint16 // address of bank select, holding PRG bank byte
+		val              byte
+		open             bool // poke $FF at write, letting all bits through bus conflicts
+		prgAddr          uint16
+		prgBank, chrBank byte
+		mirroring        byte
+	}{
+		{"UxROM", 2, 0, 16, 0, 0x8000, 3, false, 0x8000, 6, 0, mirrorHorizontal},
+		{"UxROM last bank", 2, 0, 16, 0, 0x8000, 3, false, 0xE000, 15, 0, mirrorHorizontal},
+		{"UxROM bus conflict", 2, 2, 16, 0, 0x8000, 3, false, 0x8000, 0, 0, mirrorHorizontal},
+		{"CNROM", 3, 0, 4, 4, 0x8000, 2, false, 0xC000, 2, 2, mirrorHorizontal},
+		{"AxROM", 7, 0, 16, 0, 0x8000, 0x13, false, 0xA000, 13, 0, mirrorSingle1},
+		{"AMROM bus conflict", 7, 2, 16, 0, 0x8000, 0x13, false, 0xA000, 1, 0, mirrorSingle0},
+		{"GxROM", 66, 0, 16, 4, 0xE000, 0x23, true, 0xA000, 9, 3, mirrorHorizontal},
+	}
+	for _, tt := range tests {
+		con := newMapperConsole(t, tt.mapper, tt.submapper, tt.prg, tt.chr)
+		if tt.chr == 0 {
+			con.Cartridge.Chr, con.Cartridge.ChrRAM = make([]byte, 0x2000), true
+		}
+		if tt.open {
+			con.Poke(tt.write, 0xFF)
+		}
+		con.CPU.write(tt.write, tt.val)
+		if v := con.Peek(tt.prgAddr); v != tt.prgBank {
+			t.Errorf("%s: $%04X reads bank %d, want %d", tt.name, tt.prgAddr, v, tt.prgBank)
+		}
+		if v := con.PeekPPU(0x1000); v != tt.chrBank {
+			t.Errorf("%s: CHR bank %d, want %d", tt.name, v, tt.chrBank)
+		}
+		if con.mirroring != tt.mirroring {
+			t.Errorf("%s: mirroring %d, want %d", tt.name, con.mirroring, tt.mirroring)
+		}
+	}
+}
+
+func TestNES20Header(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.nes")
+	header := []byte{'N', 'E', 'S', 0x1A, 2, 1, 0x51, 0x08, 0x21, 0x10, 0, 0, 0, 0, 0, 0}
+	rom := append(header, make([]byte, 2*0x4000+257*0x2000)...)
+	if err := os.WriteFile(path, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := loadRomFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.Mapper != 0x105 || cart.Submapper != 2 || len(cart.PRG) != 2*0x4000 || len(cart.Chr) != 257*0x2000 {
+		t.Errorf("mapper %d.%d, %d bytes of PRG and %d of CHR", cart.Mapper, cart.Submapper, len(cart.PRG), len(cart.Chr))
+	}
+
+	rom[9] = 0x0F
+	os.WriteFile(path, rom, 0644)
+	if _, err := loadRomFile(path); err == nil {
+		t.Error("loaded PRG size in exponent-multiplier notation")
+	}
+}
+
+func TestMapperInstances(t *testing.T) {
+	a := newMapperConsole(t, 2, 0, 16, 4)
+	b := newMapperConsole(t, 2, 0, 16, 4)
+	a.CPU.write(0x8000, 3)
+	if v := b.Peek(0x8000); v != 0 {
+		t.Errorf("bank %d selected by the mapper of another console, want 0", v)
+	}
+}
+
+func TestBusConflictByGameDB(t *testing.T) {
+	con := newMapperConsole(t, 3, 0, 2, 4)
+	cart := con.Cartridge
+	cart.PRG[0x10] = 0x01
+	db, err := ReadGameDB(strings.NewReader(fmt.Sprintf(`<nes20db>
+<game>
+  <!-- test -->
+  <prgrom size="16384" crc32="00000000"/>
+  <rom size="49152" crc32="%08X"/>
+  <pcb mapper="3" submapper="2" mirroring="V" battery="0"/>
+</game>
+</nes20db>`, crc32.Update(crc32.ChecksumIEEE(cart.PRG), crc32.IEEETable, cart.Chr))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	con.CPU.write(0x8010, 0x03)
+	if v := con.PeekPPU(0); v != 3 {
+		t.Errorf("CHR bank %d without bus conflicts, want 3", v)
+	}
+	if found, err := con.ApplyGameDB(db); !found || err != nil || cart.Submapper != 2 || cart.Mirroring != mirrorVertical {
+		t.Fatalf("cartridge not found in database: %v, submapper %d", err, cart.Submapper)
+	}
+	con.CPU.write(0x8010, 0x03)
+	if v := con.PeekPPU(0); v != 1 {
+		t.Errorf("CHR bank %d with bus conflicts, want 3 & 1", v)
+	}
+
+	db[crc32.Update(crc32.ChecksumIEEE(cart.PRG), crc32.IEEETable, cart.Chr)] = GameInfo{Mapper: 2, Mirroring: 0xFF}
+	if _, err := con.ApplyGameDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := con.Mapper.(*UxROM); !ok {
+		t.Errorf("mapper %T after database changed it, want UxROM", con.Mapper)
+	}
+}
+
+func TestMMC2Latch(t *testing.T) {
+	for _, mapper := range []uint16{9, 10} {
+		con := newMapperConsole(t, mapper, 0, 16, 0)
+		cart := con.Cartridge
+		cart.Chr = make([]byte, 32*0x1000)
+		for i := range cart.Chr {
+			cart.Chr[i] = byte(i / 0x1000)
+		}
+		for i, addr := range []uint16{0xB000, 0xC000, 0xD000, 0xE000} {
+			con.CPU.write(addr, byte(i+4))
+		}
+		con.CPU.write(0xA000, 3)
+		want := byte(3)
+		if mapper == 10 {
+			want = 6 // 16 KiB bank
+		}
+		if v, last := con.Peek(0x8000), con.Peek(0xE000); v != want || last != 15 {
+			t.Errorf("mapper %d: PRG banks %d at $8000 and %d at $E000, want %d and 15", mapper, v, last, want)
+		}
+		ppu := con.PPU
+		check := func(step string, bank0, bank1 byte) {
+			t.Helper()
+			if v0, v1 := con.PeekPPU(0x0000), con.PeekPPU(0x1000); v0 != bank0 || v1 != bank1 {
+				t.Errorf("mapper %d %s: CHR banks %d %d, want %d %d", mapper, step, v0, v1, bank0, bank1)
+			}
+		}
+		check("at power up", 5, 7)
+		ppu.fetch(0x0FD8, fetchBackground)
+		check("after $0FD8", 4, 7)
+		ppu.fetch(0x1FDA, fetchBackground)
+		check("after $1FDA", 4, 6)
+		ppu.fetch(0x0FEA, fetchBackground)
+		if mapper == 9 {
+			check("after $0FEA", 4, 6)
+		} else {
+			check("after $0FEA", 5, 6)
+		}
+		ppu.fetch(0x1FE0, fetchBackground) // low bit plane
+		check("after $1FE0", con.PeekPPU(0), 6)
+	}
+}
+
+func TestMMC2SmallPRG(t *testing.T) {
+	for _, mapper := range []uint16{9, 10} {
+		con := newMapperConsole(t, mapper, 0, 2, 4)
+		for addr, want := range map[uint16]byte{0xA000: 1, 0xC000: 0, 0xE000: 1} {
+			if v := con.Peek(addr); v != want {
+				t.Errorf("mapper %d: bank %d at $%04X of 16 KiB PRG, want %d", mapper, v, addr, want)
+			}
+		}
+	}
+}
+
+func TestMMC5Banking(t *testing.T) {
+	con := newMapperConsole(t, 5, 0, 16, 16)
+	cpu := con.CPU
+	check := func(mode string, addr uint16, want byte) {
+		t.Helper()
+		if v := con.Peek(addr); v != want {
+			t.Errorf("%s: $%04X reads %d, want %d", mode, addr, v, want)
+		}
+	}
+	check("power up", 0xE000, 15)
+	cpu.write(0x5114, 0x83)
+	check("mode 3", 0x8000, 3)
+	cpu.write(0x5100, 1)
+	cpu.write(0x5115, 0x85)
+	check("mode 1", 0x8000, 4)
+	check("mode 1", 0xA000, 5)
+	check("mode 1", 0xC000, 14)
+
+	// PRG RAM is writable once unprotected
+	cpu.write(0x5100, 3)
+	cpu.write(0x5114, 0x00)
+	cpu.write(0x8000, 0x42)
+	check("protected RAM", 0x8000, 0)
+	cpu.write(0x5102, 2)
+	cpu.write(0x5103, 1)
+	cpu.write(0x8000, 0x42)
+	check("RAM at $8000", 0x8000, 0x42)
+	check("RAM at $6000", 0x6000, 0x42)
+
+	// with 8x16 sprites, background has CHR set B
+	cpu.write(0x5101, 1)
+	cpu.write(0x5123, 2)
+	cpu.write(0x5127, 4)
+	cpu.write(0x512B, 6)
+	con.PPU.Ctrl = ctrlSpriteSize
+	m := con.Mapper.(*MMC5)
+	if v := m.renderFetch(0x1000, fetchSprite); v != 2 {
+		t.Errorf("sprite CHR bank %d, want 2", v)
+	}
+	if v0, v1 := m.renderFetch(0x0000, fetchBackground), m.renderFetch(0x1000, fetchBackground); v0 != 3 || v1 != 3 {
+		t.Errorf("background CHR banks %d %d, want 3 3", v0, v1)
+	}
+	if v := con.PeekPPU(0x0000); v != 3 {
+		t.Errorf("CHR bank %d by set B written last, want 3", v)
+	}
+	cpu.write(0x5123, 2)
+	if v := con.PeekPPU(0x0000); v != 1 {
+		t.Errorf("CHR bank %d by set A written last, want 1", v)
+	}
+
+	cpu.write(0x5205, 200)
+	cpu.write(0x5206, 100)
+	if lo, hi := cpu.read(0x5205), cpu.read(0x5206); lo != 0x20 || hi != 0x4E {
+		t.Errorf("200*100 = $%02X%02X, want $4E20", hi, lo)
+	}
+}
+
+func TestMMC5NameTables(t *testing.T) {
+	con := newMapperConsole(t, 5, 0, 16, 16)
+	cpu := con.CPU
+	m := con.Mapper.(*MMC5)
+
+	cpu.write(0x5105, 0xFF)
+	cpu.write(0x5106, 0x12)
+	cpu.write(0x5107, 2)
+	if v, a := con.PeekPPU(0x2C00), con.PeekPPU(0x27C0); v != 0x12 || a != 0xAA {
+		t.Errorf("fill mode tile %02X attribute %02X, want 12 AA", v, a)
+	}
+	cpu.write(0x5104, 2)
+	cpu.write(0x5C05, 0x34)
+	if v := con.Peek(0x5C05); v != 0x34 {
+		t.Errorf("ExRAM reads %02X, want 34", v)
+	}
+	cpu.write(0x5104, 0)
+	cpu.write(0x5105, 0x48) // ExRAM at $2400, CIRAM page 1 at $2C00
+	if v := con.PeekPPU(0x2405); v != 0x34 {
+		t.Errorf("ExRAM nametable reads %02X, want 34", v)
+	}
+	con.PPU.write(0x2C00, 0x56)
+	if con.PPU.NameTable[0x400] != 0x56 {
+		t.Error("$2C00 not written to CIRAM page 1")
+	}
+
+	// extended attributes, palette 2 and 4 KiB CHR bank 2
+	cpu.write(0x5104, 1)
+	m.ExRAM[5] = 0x82
+	m.renderFetch(0x2005, fetchNameTable)
+	if a, p := m.renderFetch(0x23C1, fetchAttribute), m.renderFetch(0x0010, fetchBackground); a != 0xAA || p != 1 {
+		t.Errorf("extended attribute %02X pattern %d, want AA 1", a, p)
+	}
+
+	// split of the left 4 tiles, from ExRAM and 4 KiB CHR bank 4
+	cpu.write(0x5104, 0)
+	cpu.write(0x5200, 0x84)
+	cpu.write(0x5202, 4)
+	m.ExRAM[2] = 0x77
+	ppu := con.PPU
+	ppu.ScanLine, ppu.Cycle = 0, 1
+	if v, p := m.renderFetch(0x2003, fetchNameTable), m.renderFetch(0x0770, fetchBackground); v != 0x77 || p != 2 {
+		t.Errorf("split tile %02X pattern %d, want 77 2", v, p)
+	}
+	ppu.Cycle = 33
+	if v := m.renderFetch(0x2007, fetchNameTable); v != 0 {
+		t.Errorf("tile %02X right of split, want 0 of nametable", v)
+	}
+}
+
+func TestMMC5ScanlineIRQ(t *testing.T) {
+	con := newMapperConsole(t, 5, 0, 16, 16)
+	cpu, ppu := con.CPU, con.PPU
+	ppu.Mask = maskBg
+	cpu.write(0x5203, 10)
+	cpu.write(0x5204, 0x80)
+	for ppu.ScanLine != 261 {
+		ppu.step()
+	}
+	cpu.read(0x5204) // IRQ of the partial first frame
+	for i := 0; cpu.irq == 0 && i < 341*262; i++ {
+		ppu.step()
+	}
+	if ppu.ScanLine != 10 || ppu.Cycle > 8 {
+		t.Errorf("IRQ at scanline %d dot %d, want start of scanline 10", ppu.ScanLine, ppu.Cycle)
+	}
+	if v := cpu.read(0x5204); v != 0xC0 || cpu.irq != 0 {
+		t.Errorf("$5204 = %02X, IRQ line %02X, want C0 and acknowledged", v, cpu.irq)
+	}
+	cpu.read(0xFFFA)
+	if v := con.Peek(0x5204); v != 0 {
+		t.Errorf("$5204 = %02X after NMI, want 0", v)
+	}
+}
+
+func TestMMC5Audio(t *testing.T) {
+	con := newMapperConsole(t, 5, 0, 16, 16)
+	con.Connect(new(APU))
+	cpu := con.CPU
+	m := con.Mapper.(*MMC5)
+	cpu.write(0x5015, 0x01)
+	cpu.write(0x5000, 0xBF)
+	cpu.write(0x5002, 0x04) // too high for APU pulses, but not muted
+	cpu.write(0x5003, 0x08)
+	high := false
+	for i := 0; i < 100; i++ {
+		con.APU.step()
+		high = high || m.audioOutput() == pulseMix[15]
+	}
+	if !high || con.Peek(0x5015) != 0x01 {
+		t.Error("pulse 1 not playing")
+	}
+	cpu.write(0x5015, 0)
+	cpu.write(0x5011, 0x80)
+	if v := m.audioOutput(); v != tndMix[0x40] {
+		t.Errorf("PCM output %v, want %v", v, tndMix[0x40])
+	}
+
+	// in read mode, reading 0 raises IRQ
+	cpu.write(0x5010, 0x81)
+	cpu.write(0x5114, 0x80)
+	cpu.read(0x8000)
+	if con.Peek(0x5010) != 0x80 || cpu.irq != irqMapper {
+		t.Error("PCM read of 0 did not raise IRQ")
+	}
+	cpu.read(0x5010)
+	if cpu.irq != 0 {
+		t.Error("reading $5010 did not acknowledge IRQ")
+	}
+}
+
+func TestVRC4Wirings(t *testing.T) {
+	tests := []struct {
+		mapper    uint16
+		submapper byte
+		low, high uint16 // nibbles of CHR bank 1
+		want      byte
+	}{
+		{21, 1, 0xB004, 0xB006, 2},
+		{21, 2, 0xB080, 0xB0C0, 2},
+		{21, 0, 0xB004, 0xB0C0, 2},
+		{22, 0, 0xB001, 0xB003, 1},
+		{23, 1, 0xB002, 0xB003, 2},
+		{23, 2, 0xB008, 0xB00C, 2},
+		{23, 3, 0xB002, 0xB003, 2},
+		{25, 1, 0xB001, 0xB003, 2},
+		{25, 2, 0xB004, 0xB00C, 2},
+		{25, 0, 0xB004, 0xB003, 2},
+	}
+	for _, tt := range tests {
+		con := newMapperConsole(t, tt.mapper, tt.submapper, 16, 4)
+		con.CPU.write(tt.low, 5)
+		con.CPU.write(tt.high, 1)
+		if v := con.PeekPPU(0x0400); v != tt.want {
+			t.Errorf("mapper %d.%d: CHR bank 1 in 8 KiB bank %d, want %d", tt.mapper, tt.submapper, v, tt.want)
+		}
+	}
+
+	con := newMapperConsole(t, 21, 1, 16, 4)
+	con.CPU.write(0x8000, 3)
+	con.CPU.write(0x9004, 2)
+	if v0, v2 := con.Peek(0x8000), con.Peek(0xC000); v0 != 14 || v2 != 3 {
+		t.Errorf("swapped PRG banks %d at $8000 %d at $C000, want 14 and 3", v0, v2)
+	}
+	con.CPU.write(0x9000, 3)
+	if con.mirroring != mirrorSingle1 {
+		t.Errorf("mirroring %d, want single screen 1", con.mirroring)
+	}
+}
+
+func TestVRCIRQ(t *testing.T) {
+	con := newMapperConsole(t, 21, 1, 16, 4)
+	cpu, m := con.CPU, con.Mapper.(*VRC4)
+	cpu.write(0xF000, 0x0E)
+	cpu.write(0xF002, 0x0F)
+	cpu.write(0xF004, 0x06) // cycle mode
+	m.cpuCycle()
+	if cpu.irq != 0 {
+		t.Fatal("IRQ a cycle early")
+	}
+	m.cpuCycle()
+	if cpu.irq != irqMapper {
+		t.Fatal("no IRQ after 2 cycles from $FE")
+	}
+	cpu.write(0xF006, 0)
+	if cpu.irq != 0 {
+		t.Error("IRQ not acknowledged")
+	}
+
+	cpu.write(0xF000, 0x0F)
+	cpu.write(0xF004, 0x02) // scanline mode
+	for i := 0; i < 113; i++ {
+		m.cpuCycle()
+	}
+	if cpu.irq != 0 {
+		t.Fatal("IRQ before a scanline")
+	}
+	m.cpuCycle()
+	if cpu.irq != irqMapper {
+		t.Error("no IRQ after a scanline of 341 dots")
+	}
+}
+
+func TestVRC6(t *testing.T) {
+	for _, mapper := range []uint16{24, 26} {
+		con := newMapperConsole(t, mapper, 0, 16, 8)
+		con.Connect(new(APU))
+		cpu, m := con.CPU, con.Mapper.(*VRC6)
+		r1, r2 := uint16(1), uint16(2)
+		if mapper == 26 {
+			r1, r2 = r2, r1
+		}
+		cpu.write(0x8000, 2)
+		cpu.write(0xC000, 7)
+		cpu.write(0xD000|r1, 0x18)
+		if v0, v1, v2 := con.Peek(0x8000), con.Peek(0xA000), con.Peek(0xC000); v0 != 4 || v1 != 5 || v2 != 7 {
+			t.Errorf("mapper %d: PRG banks %d %d %d, want 4 5 7", mapper, v0, v1, v2)
+		}
+		if v := con.PeekPPU(0x0400); v != 3 {
+			t.Errorf("mapper %d: CHR bank 1 in 8 KiB bank %d, want 3", mapper, v)
+		}
+
+		cpu.write(0x9000, 0x8F) // volume 15 ignoring duty
+		cpu.write(0x9000|r2, 0x80)
+		cpu.write(0xB000, 42)
+		cpu.write(0xB000|r2, 0x80)
+		for i := 0; i < 12; i++ {
+			con.APU.step()
+		}
+		if p, s := m.Pulse[0].output(), m.Saw.output(); p != 15 || s != 31 {
+			t.Errorf("mapper %d: pulse %d saw %d, want 15 31", mapper, p, s)
+		}
+		if out := con.APU.Output() - mix(0, 0, 15, 0, 0); out < 46*vrc6Level-1e-6 || out > 46*vrc6Level+1e-6 {
+			t.Errorf("mapper %d: expansion mixed at %v, want %v", mapper, out, 46*vrc6Level)
+		}
+		con.APU.step()
+		con.APU.step()
+		if s := m.Saw.output(); s != 0 {
+			t.Errorf("mapper %d: saw %d after 14 steps, want 0", mapper, s)
+		}
+	}
+}
+
+func TestVRC7(t *testing.T) {
+	con := newMapperConsole(t, 85, 0, 16, 8)
+	con.Connect(new(APU))
+	cpu := con.CPU
+	cpu.write(0x8000, 2)
+	cpu.write(0x8010, 3)
+	cpu.write(0x9000, 4)
+	cpu.write(0xA010, 0x10)
+	if v0, v1, v2, v3 := con.Peek(0x8000), con.Peek(0xA000), con.Peek(0xC000), con.Peek(0xE000); v0 != 2 || v1 != 3 || v2 != 4 || v3 != 15 {
+		t.Errorf("PRG banks %d %d %d %d, want 2 3 4 15", v0, v1, v2, v3)
+	}
+	if v := con.PeekPPU(0x0400); v != 2 {
+		t.Errorf("CHR bank 1 in 8 KiB bank %d, want 2", v)
+	}
+	cpu.write(0xE000, 0x81)
+	if con.mirroring != mirrorHorizontal {
+		t.Errorf("mirroring %d, want horizontal", con.mirroring)
+	}
+
+	write := func(reg, val byte) {
+		cpu.write(0x9010, reg)
+		cpu.write(0x9030, val)
+	}
+	peak := func(cycles int) float32 {
+		var peak float32
+		for i := 0; i < cycles; i++ {
+			con.APU.step()
+			if v := con.Mapper.(*VRC7).audioOutput(); v > peak {
+				peak = v
+			}
+		}
+		return peak
+	}
+	write(0x30, 0x40) // flute at full volume
+	write(0x10, 0xAC)
+	write(0x20, 0x18) // A4, key on
+	if p := peak(1 << 16); p < 0.05 || p > opllChanLevel {
+		t.Errorf("peak %v of a note, want 0.05 to %v", p, opllChanLevel)
+	}
+	write(0x20, 0x08) // key off
+	peak(1 << 20)
+	if p := peak(1 << 10); p != 0 {
+		t.Errorf("peak %v long after key off, want silence", p)
+	}
+}
+
+func TestFME7(t *testing.T) {
+	con := newMapperConsole(t, 69, 0, 16, 8)
+	con.Connect(new(APU))
+	cpu, m := con.CPU, con.Mapper.(*FME7)
+	param := func(cmd, val byte) {
+		cpu.write(0x8000, cmd)
+		cpu.write(0xA000, val)
+	}
+	param(0x08, 5)
+	param(0x09, 3)
+	param(0x0B, 7)
+	param(0x02, 9)
+	if v0, v1, v2, v3 := con.Peek(0x6000), con.Peek(0x8000), con.Peek(0xC000), con.Peek(0xE000); v0 != 5 || v1 != 3 || v2 != 7 || v3 != 15 {
+		t.Errorf("PRG banks %d %d %d %d, want 5 3 7 15", v0, v1, v2, v3)
+	}
+	if v := con.PeekPPU(0x0800); v != 1 {
+		t.Errorf("CHR bank 2 in 8 KiB bank %d, want 1", v)
+	}
+	param(0x08, 0xC0)
+	cpu.write(0x6000, 42)
+	if v := con.Peek(0x6000); v != 42 {
+		t.Errorf("PRG RAM %d, want 42", v)
+	}
+
+	param(0x0E, 10)
+	param(0x0F, 0)
+	param(0x0D, 0x81)
+	for i := 0; i < 10; i++ {
+		m.cpuCycle()
+	}
+	if cpu.irq != 0 {
+		t.Errorf("IRQ at counter %d, want none before it wraps", m.Counter)
+	}
+	m.cpuCycle()
+	if cpu.irq&irqMapper == 0 {
+		t.Error("no IRQ as counter wraps")
+	}
+	param(0x0D, 0)
+	if cpu.irq != 0 {
+		t.Error("IRQ not acknowledged")
+	}
+
+	audio := func(reg, val byte) {
+		cpu.write(0xC000, reg)
+		cpu.write(0xE000, val)
+	}
+	audio(0, 1)
+	audio(7, 0x3E) // tone of channel A only
+	audio(8, 0x0F)
+	var high, low int
+	for i := 0; i < 64; i++ {
+		con.APU.step()
+		switch m.audioOutput() {
+		case pulseMix[15]:
+			high++
+		case 0:
+			low++
+		}
+	}
+	if high != 32 || low != 32 {
+		t.Errorf("square high %d low %d of 64 cycles, want 32 32", high, low)
+	}
+
+	audio(8, 0x10) // envelope, decaying once
+	audio(11, 1)
+	audio(13, 0)
+	if e := m.Audio.envelope(); e != 31 {
+		t.Errorf("envelope %d, want 31", e)
+	}
+	for i := 0; i < 32*16; i++ {
+		m.Audio.step()
+	}
+	if e := m.Audio.envelope(); e != 0 || !m.Audio.EnvHold {
+		t.Errorf("envelope %d held %v, want 0 held", e, m.Audio.EnvHold)
+	}
+}
+
+func TestNamco163(t *testing.T) {
+	con := newMapperConsole(t, 19, 0, 16, 8)
+	con.Connect(new(APU))
+	cpu, m := con.CPU, con.Mapper.(*Namco163)
+	cpu.write(0xE000, 3)
+	cpu.write(0xE800, 4)
+	cpu.write(0x8000, 8)
+	cpu.write(0x8800, 0xE1)
+	cpu.write(0xC000, 0xE1)
+	cpu.write(0xC800, 16)
+	if v0, v1, v2 := con.Peek(0x8000), con.Peek(0xA000), con.Peek(0xE000); v0 != 3 || v1 != 4 || v2 != 15 {
+		t.Errorf("PRG banks %d %d %d, want 3 4 15", v0, v1, v2)
+	}
+	con.PPU.NameTable[0x400] = 0x55
+	if v0, v1, v2, v3 := con.PeekPPU(0x0000), con.PeekPPU(0x0400), con.PeekPPU(0x2000), con.PeekPPU(0x2400); v0 != 1 || v1 != 0x55 || v2 != 0x55 || v3 != 2 {
+		t.Errorf("CHR %d, nametable %02X, nametables %02X %d, want 1 55 55 2", v0, v1, v2, v3)
+	}
+	cpu.write(0xE800, 0x44)
+	if v := con.PeekPPU(0x0400); v != 4 {
+		t.Errorf("CHR bank $E1 with CHR RAM disabled in 8 KiB bank %d, want 4", v)
+	}
+
+	cpu.write(0xF800, 0x90)
+	cpu.write(0x4800, 0x12)
+	cpu.write(0x4800, 0x34)
+	cpu.write(0xF800, 0x90)
+	if v := con.Peek(0x4800); v != 0x12 {
+		t.Errorf("peek RAM %02X, want 12", v)
+	}
+	if v0, v1 := cpu.read(0x4800), cpu.read(0x4800); v0 != 0x12 || v1 != 0x34 {
+		t.Errorf("RAM %02X %02X, want 12 34", v0, v1)
+	}
+
+	cpu.write(0x5000, 0xFD)
+	cpu.write(0x5800, 0xFF)
+	m.cpuCycle()
+	if cpu.irq != 0 {
+		t.Error("IRQ before counter reaches $7FFF")
+	}
+	m.cpuCycle()
+	if cpu.irq&irqMapper == 0 || cpu.read(0x5000) != 0xFF {
+		t.Errorf("no IRQ as counter reaches $7FFF, at %04X", m.Counter)
+	}
+	cpu.write(0x5000, 0)
+	if cpu.irq != 0 {
+		t.Error("IRQ not acknowledged")
+	}
+
+	// channel 7 alone, at full volume, of a wave of 4 samples at $00
+	cpu.write(0xE000, 0)
+	cpu.write(0xF800, 0x80)
+	cpu.write(0x4800, 0xF0)
+	cpu.write(0xF800, 0xFC)
+	for _, v := range []byte{0xFC, 0, 0, 0x0F} {
+		cpu.write(0x4800, v)
+	}
+	for i := 0; i < 15; i++ {
+		con.APU.step()
+	}
+	if out := m.audioOutput(); out != -120*namco163Level {
+		t.Errorf("output %v, want %v", out, -120*namco163Level)
+	}
+	m.RAM[0x7D] = 1 // phase of sample 1
+	for i := 0; i < 15; i++ {
+		con.APU.step()
+	}
+	if out := m.audioOutput(); out != 105*namco163Level {
+		t.Errorf("output %v, want %v", out, 105*namco163Level)
+	}
+}
+
+// i2cBus bit-bang EEPROM lines of a Bandai board through $800D
+type i2cBus struct {
+	cpu *CPU
+	lsb bool // least significant bit first, as X24C01
+}
+
+func (b *i2cBus) set(scl, sda bool) {
+	var val byte
+	if scl {
+		val |= 0x20
+	}
+	if sda {
+		val |= 0x40
+	}
+	b.cpu.write(0x800D, val)
+}
+
+func (b *i2cBus) start() {
+	b.set(false, true)
+	b.set(true, true)
+	b.set(true, false)
+	b.set(false, false)
+}
+
+func (b *i2cBus) stop() {
+	b.set(false, false)
+	b.set(true, false)
+	b.set(true, true)
+}
+
+func (b *i2cBus) bit(i int) uint {
+	if b.lsb {
+		return uint(i)
+	}
+	return uint(7 - i)
+}
+
+// writeByte return true if the EEPROM acknowledged
+func (b *i2cBus) writeByte(val byte) bool {
+	for i := 0; i < 8; i++ {
+		sda := val>>b.bit(i)&1 != 0
+		b.set(false, sda)
+		b.set(true, sda)
+		b.set(false, sda)
+	}
+	b.set(true, true)
+	ack := b.cpu.read(0x6000)&0x10 == 0
+	b.set(false, true)
+	return ack
+}
+
+func (b *i2cBus) readByte(ack bool) (val byte) {
+	for i := 0; i < 8; i++ {
+		b.set(true, true)
+		val |= b.cpu.read(0x6000) >> 4 & 1 << b.bit(i)
+		b.set(false, true)
+	}
+	b.set(false, !ack)
+	b.set(true, !ack)
+	b.set(false, !ack)
+	return val
+}
+
+func TestBandai(t *testing.T) {
+	for _, sub := range []byte{4, 5} {
+		con := newMapperConsole(t, 16, sub, 16, 8)
+		base, other := uint16(0x8000), uint16(0x6000)
+		if sub == 4 {
+			base, other = other, base
+		}
+		con.CPU.write(base|8, 2)
+		con.CPU.write(other|8, 5)
+		con.CPU.write(base|3, 9)
+		if v0, v1 := con.Peek(0x8000), con.Peek(0xC000); v0 != 4 || v1 != 14 {
+			t.Errorf("submapper %d: PRG banks %d %d, want 4 14", sub, v0, v1)
+		}
+		if v := con.PeekPPU(0x0C00); v != 1 {
+			t.Errorf("submapper %d: CHR bank 3 in 8 KiB bank %d, want 1", sub, v)
+		}
+	}
+
+	con := newMapperConsole(t, 16, 5, 16, 8)
+	cpu, m := con.CPU, con.Mapper.(*Bandai)
+	cpu.write(0x800B, 3)
+	cpu.write(0x800C, 0)
+	cpu.write(0x800A, 1)
+	for i := 0; i < 3; i++ {
+		m.cpuCycle()
+	}
+	if cpu.irq != 0 {
+		t.Error("IRQ before counter reaches 0")
+	}
+	m.cpuCycle()
+	if cpu.irq&irqMapper == 0 {
+		t.Error("no IRQ at counter 0")
+	}
+	cpu.write(0x800A, 0)
+	if cpu.irq != 0 {
+		t.Error("IRQ not acknowledged")
+	}
+
+	// 24C02: write 2 bytes at $10, then read them back at random address
+	bus := &i2cBus{cpu: cpu}
+	bus.start()
+	for _, v := range []byte{0xA0, 0x10, 0x5A, 0xC3} {
+		if !bus.writeByte(v) {
+			t.Errorf("write %02X not acknowledged", v)
+		}
+	}
+	bus.stop()
+	if v0, v1 := m.Memory[0x10], m.Memory[0x11]; v0 != 0x5A || v1 != 0xC3 {
+		t.Errorf("EEPROM %02X %02X, want 5A C3", v0, v1)
+	}
+	bus.start()
+	bus.writeByte(0xA0)
+	bus.writeByte(0x10)
+	bus.start()
+	bus.writeByte(0xA1)
+	if v0, v1 := bus.readByte(true), bus.readByte(false); v0 != 0x5A || v1 != 0xC3 {
+		t.Errorf("read EEPROM %02X %02X, want 5A C3", v0, v1)
+	}
+	bus.stop()
+
+	// EEPROM is kept on reset, and saved as a battery would
+	con.Reset()
+	save := filepath.Join(t.TempDir(), "game.sav")
+	if err := con.saveBatteryFile(save); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(save); len(b) != 256 || b[0x10] != 0x5A {
+		t.Errorf("saved %d bytes, want 256 of EEPROM", len(b))
+	}
+	con = newMapperConsole(t, 16, 5, 16, 8)
+	m = con.Mapper.(*Bandai)
+	if v := m.Memory[0x10]; v != 0 {
+		t.Errorf("EEPROM %02X at $10 of another cartridge, want 0", v)
+	}
+	if err := con.loadBatteryFile(save + ".missing"); err != nil || m.Memory[0x10] != 0 {
+		t.Errorf("loaded missing save file: %v", err)
+	}
+	if err := con.loadBatteryFile(save); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.Memory[0x10]; v != 0x5A {
+		t.Errorf("loaded EEPROM %02X at $10, want 5A", v)
+	}
+
+	con = newMapperConsole(t, 159, 0, 16, 8)
+	m = con.Mapper.(*Bandai)
+
+	// X24C01: address and direction in a byte, least significant bit first
+	bus = &i2cBus{cpu: con.CPU, lsb: true}
+	bus.start()
+	bus.writeByte(0x05)
+	bus.writeByte(0x81)
+	bus.stop()
+	bus.start()
+	bus.writeByte(0x85)
+	if v := bus.readByte(false); v != 0x81 || m.Memory[5] != 0x81 {
+		t.Errorf("X24C01 read %02X of %02X, want 81", v, m.Memory[5])
+	}
+	bus.stop()
+}
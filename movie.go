@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// commands of a movie frame, same bits as FCEUX uses
+const (
+	movieSoftReset = 1 << iota
+	moviePower
+)
+
+const movieMagic = 0x1a564d4e // "NMV\x1a"
+
+// Movie - controller input recorded frame by frame
+type Movie struct {
+	// State is the save state the movie starts from, a movie without
+	// state starts from power up
+	State  []byte
+	Frames []MovieFrame
+	// Checksums holds the CRC32 of CPU RAM after each frame, used to
+	// detect desyncs on playback. It is empty if the source had none.
+	Checksums []uint32
+
+	ROMName       string
+	ROMChecksum   [16]byte // MD5 of PRG and CHR
+	RerecordCount uint32
+	Comments      []string
+}
+
+// MovieFrame - input of a single frame
+type MovieFrame struct {
+	Command byte
+	Buttons [2]byte
+}
+
+// DesyncError is reported when the playback does not match the recording
+type DesyncError struct {
+	Frame    int // frame of movie
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *DesyncError) Error() string {
+	return fmt.Sprintf("movie desync at frame %d: RAM checksum %08X, expected %08X", e.Frame, e.Actual, e.Expected)
+}
+
+type moviePlayer struct {
+	movie     *Movie
+	start     uint64 // console frame of movie frame 0
+	recording bool
+	desync    *DesyncError
+}
+
+// StartRecording start recording a new movie. With powerUp the console is
+// power cycled first, otherwise the movie starts from the current state.
+func (con *Console) StartRecording(powerUp bool) (*Movie, error) {
+	m := &Movie{
+		ROMChecksum: con.Cartridge.checksum(),
+	}
+	if powerUp {
+		con.powerUp()
+	} else {
+		var buf bytes.Buffer
+		if err := con.SaveState(&buf); err != nil {
+			return nil, err
+		}
+		m.State = buf.Bytes()
+	}
+	con.movie = &moviePlayer{movie: m, start: con.frame, recording: true}
+	return m, nil
+}
+
+// PlayMovie start playing a movie, input of controllers is taken from the
+// movie until it ends
+func (con *Console) PlayMovie(m *Movie) error {
+	if m.ROMChecksum != ([16]byte{}) && m.ROMChecksum != con.Cartridge.checksum() {
+		return errors.New("movie is recorded with another rom")
+	}
+	if m.State != nil {
+		if err := con.LoadState(bytes.NewReader(m.State)); err != nil {
+			return err
+		}
+	} else {
+		con.powerUp()
+	}
+	con.movie = &moviePlayer{movie: m, start: con.frame}
+	return nil
+}
+
+// ReplayMovie play a movie to its end, the first desync is returned
+func (con *Console) ReplayMovie(m *Movie) error {
+	if err := con.PlayMovie(m); err != nil {
+		return err
+	}
+	for con.movie != nil {
+		con.StepFrame()
+		if err := con.MovieDesync(); err != nil {
+			con.StopMovie()
+			return err
+		}
+	}
+	return nil
+}
+
+// StopMovie stop recording or playing, the movie is returned
+func (con *Console) StopMovie() *Movie {
+	if con.movie == nil {
+		return nil
+	}
+	m := con.movie.movie
+	con.movie = nil
+	return m
+}
+
+// MovieDesync return the first desync of current playback, or nil
+func (con *Console) MovieDesync() error {
+	if con.movie == nil || con.movie.desync == nil {
+		return nil
+	}
+	return con.movie.desync
+}
+
+// powerUp power cycle the console with blank battery RAM, as movies from
+// power up expect
+func (con *Console) powerUp() {
+	for i := range con.Cartridge.SRAM {
+		con.Cartridge.SRAM[i] = 0
+	}
+	con.Reset()
+}
+
+func (p *moviePlayer) before(con *Console) {
+	if con.frame < p.start {
+		// rewound past the start of the movie
+		con.movie = nil
+		return
+	}
+	i := int(con.frame - p.start)
+	m := p.movie
+	if p.recording {
+		if i < len(m.Frames) {
+			// rewound while recording, the rest is to be recorded again
+			m.Frames = m.Frames[:i]
+			m.Checksums = m.Checksums[:i]
+			m.RerecordCount++
+		}
+		m.Frames = append(m.Frames, MovieFrame{Buttons: [2]byte{
+			con.Controllers[0].buttons,
+			con.Controllers[1].buttons,
+		}})
+		return
+	}
+
+	if i >= len(m.Frames) {
+		con.movie = nil
+		return
+	}
+	f := m.Frames[i]
+	switch {
+	case f.Command&moviePower != 0:
+		con.Reset()
+	case f.Command&movieSoftReset != 0:
+		con.SoftReset()
+	}
+	con.Controllers[0].buttons = f.Buttons[0]
+	con.Controllers[1].buttons = f.Buttons[1]
+}
+
+func (p *moviePlayer) after(con *Console) {
+	i := int(con.frame-p.start) - 1
+	m := p.movie
+	sum := crc32.ChecksumIEEE(con.CPU.ram[:])
+	if p.recording {
+		m.Checksums = append(m.Checksums, sum)
+		return
+	}
+	if p.desync == nil && i < len(m.Checksums) && m.Checksums[i] != sum {
+		p.desync = &DesyncError{i, m.Checksums[i], sum}
+	}
+	if i+1 >= len(m.Frames) {
+		con.movie = nil
+	}
+}
+
+func (c *Cartridge) checksum() [16]byte {
+	h := md5.New()
+	h.Write(c.PRG)
+	h.Write(c.Chr)
+	var sum [16]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+type movieHeader struct {
+	Magic         uint32
+	Version       uint16
+	Flags         uint16
+	FrameCount    uint32
+	RerecordCount uint32
+	ROMChecksum   [16]byte
+	StateSize     uint32
+	NameSize      uint16
+}
+
+const (
+	movieHasState = 1 << iota
+	movieHasChecksums
+)
+
+// ReadMovie read a movie in native binary format
+func ReadMovie(r io.Reader) (*Movie, error) {
+	header := new(movieHeader)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	if header.Magic != movieMagic {
+		return nil, errors.New("invalid movie file")
+	}
+	if header.Version != 1 {
+		return nil, errors.New("unsupported movie version")
+	}
+
+	m := &Movie{
+		Frames:        make([]MovieFrame, header.FrameCount),
+		RerecordCount: header.RerecordCount,
+		ROMChecksum:   header.ROMChecksum,
+	}
+	if header.Flags&movieHasState != 0 {
+		m.State = make([]byte, header.StateSize)
+		if _, err := io.ReadFull(r, m.State); err != nil {
+			return nil, err
+		}
+	}
+	name := make([]byte, header.NameSize)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+	m.ROMName = string(name)
+	if err := binary.Read(r, binary.LittleEndian, m.Frames); err != nil {
+		return nil, err
+	}
+	if header.Flags&movieHasChecksums != 0 {
+		m.Checksums = make([]uint32, header.FrameCount)
+		if err := binary.Read(r, binary.LittleEndian, m.Checksums); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Write write the movie in native binary format, comments are not kept
+func (m *Movie) Write(w io.Writer) error {
+	header := movieHeader{
+		Magic:         movieMagic,
+		Version:       1,
+		FrameCount:    uint32(len(m.Frames)),
+		RerecordCount: m.RerecordCount,
+		ROMChecksum:   m.ROMChecksum,
+		StateSize:     uint32(len(m.State)),
+		NameSize:      uint16(len(m.ROMName)),
+	}
+	if m.State != nil {
+		header.Flags |= movieHasState
+	}
+	if len(m.Checksums) > 0 {
+		if len(m.Checksums) != len(m.Frames) {
+			return errors.New("movie checksums do not match frames")
+		}
+		header.Flags |= movieHasChecksums
+	}
+	values := []interface{}{&header, m.State, []byte(m.ROMName), m.Frames}
+	if len(m.Checksums) > 0 {
+		values = append(values, m.Checksums)
+	}
+	for _, v := range values {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordMovie record frames of inputProgram, pressing A every third frame
+func recordMovie(t *testing.T, frames int) (*Movie, []byte) {
+	t.Helper()
+	con := newInputConsole(t)
+	if _, err := con.StartRecording(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		con.Controllers[0].SetButtons(byte(i % 3 / 2))
+		con.Controllers[1].SetButtons(byte(i))
+		con.StepFrame()
+	}
+	return con.StopMovie(), append([]byte(nil), con.RAM()...)
+}
+
+func TestMovieReplay(t *testing.T) {
+	m, ram := recordMovie(t, 20)
+	if len(m.Frames) != 20 || len(m.Checksums) != 20 || m.Frames[2].Buttons != [2]byte{1, 2} {
+		t.Fatalf("recorded %d frames, %d checksums", len(m.Frames), len(m.Checksums))
+	}
+	con := newInputConsole(t)
+	con.StepFrame()
+	if err := con.ReplayMovie(m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(con.RAM(), ram) {
+		t.Error("RAM after replay differs from recording")
+	}
+
+	m.Frames[5].Buttons[0] ^= 1
+	err := newInputConsole(t).ReplayMovie(m)
+	var desync *DesyncError
+	if !errors.As(err, &desync) || desync.Frame != 5 {
+		t.Errorf("replay of changed input: %v, want desync at frame 5", err)
+	}
+}
+
+func TestMovieFormats(t *testing.T) {
+	m, _ := recordMovie(t, 10)
+	m.ROMName = "test.nes"
+	m.RerecordCount = 3
+
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMovie(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, m) {
+		t.Errorf("binary movie read as %+v, want %+v", read, m)
+	}
+
+	buf.Reset()
+	m.Comments = []string{"author tester"}
+	if err := m.WriteFM2(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err = ReadFM2(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *m
+	want.Checksums = nil
+	if !reflect.DeepEqual(read, &want) {
+		t.Errorf("FM2 movie read as %+v, want %+v", read, &want)
+	}
+
+	fm2 := "version 3\nsavestate base64:AAAA\n|0|........|........||\n"
+	if _, err := ReadFM2(strings.NewReader(fm2)); err == nil {
+		t.Error("read FM2 starting from a savestate of FCEUX")
+	}
+	m.State = []byte{0}
+	if err := m.WriteFM2(&buf); err == nil {
+		t.Error("wrote FM2 starting from a save state")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// nestest.nes and its reference log are not part of the repository
+// http://www.qmtpro.com/~nes/misc/nestest.nes
+// http://www.qmtpro.com/~nes/misc/nestest.log
+const (
+	nestestROM = "testdata/nestest.nes"
+	nestestLog = "testdata/nestest.log"
+	// lines shown before and after the divergence
+	nestestContext = 8
+	nestestAfter   = 4
+)
+
+// nestestLine format the fields compared against the reference log
+func nestestLine(pc uint16, ops []byte, a, x, y, p, sp byte, scanline, dot int, cyc uint64) string {
+	var bytes [3]string
+	for i, op := range ops {
+		bytes[i] = fmt.Sprintf("%02X", op)
+	}
+	return fmt.Sprintf("%04X  %-8s  A:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		pc, strings.TrimSpace(strings.Join(bytes[:], " ")), a, x, y, p, sp, scanline, dot, cyc)
+}
+
+// parseNestestLine parse a line of nestest.log into nestestLine format
+func parseNestestLine(line string) (string, error) {
+	var (
+		pc            uint16
+		a, x, y, p, s byte
+		scanline, dot int
+		cyc           uint64
+	)
+	if len(line) < 16 {
+		return "", fmt.Errorf("malformed line %q", line)
+	}
+	if _, err := fmt.Sscanf(line[:4], "%04X", &pc); err != nil {
+		return "", err
+	}
+	var ops []byte
+	for _, field := range strings.Fields(line[6:15]) {
+		var op byte
+		if _, err := fmt.Sscanf(field, "%02X", &op); err != nil {
+			return "", err
+		}
+		ops = append(ops, op)
+	}
+	i := strings.Index(line, "A:")
+	j := strings.Index(line, "PPU:")
+	k := strings.Index(line, "CYC:")
+	if i < 0 || j < 0 || k < 0 {
+		return "", fmt.Errorf("malformed line %q", line)
+	}
+	if _, err := fmt.Sscanf(line[i:], "A:%02X X:%02X Y:%02X P:%02X SP:%02X", &a, &x, &y, &p, &s); err != nil {
+		return "", err
+	}
+	if _, err := fmt.Sscanf(line[j:], "PPU:%d,%d", &scanline, &dot); err != nil {
+		return "", err
+	}
+	if _, err := fmt.Sscanf(line[k:], "CYC:%d", &cyc); err != nil {
+		return "", err
+	}
+	return nestestLine(pc, ops, a, x, y, p, s, scanline, dot, cyc), nil
+}
+
+func TestNestest(t *testing.T) {
+	logFile, err := os.Open(nestestLog)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer logFile.Close()
+	cart, err := loadRomFile(nestestROM)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	con := new(Console)
+	cpu, ppu := new(CPU), new(PPU)
+	con.Connect(cpu)
+	con.Connect(ppu)
+	if err := con.Connect(cart); err != nil {
+		t.Fatal(err)
+	}
+	// automation mode starts at $C000, 7 CPU cycles after power up
+	cpu.PC = 0xC000
+	cpu.cycles = 7
+	ppu.Cycle = 7 * 3
+
+	trace := func() string {
+		op := con.Peek(cpu.PC)
+		ops := make([]byte, instructionSizes[instructions[op].addrMode])
+		for i := range ops {
+			ops[i] = con.Peek(cpu.PC + uint16(i))
+		}
+		return nestestLine(cpu.PC, ops, cpu.A, cpu.X, cpu.Y, cpu.flag()|0x20, cpu.S, int(ppu.ScanLine), int(ppu.Cycle), cpu.cycles)
+	}
+
+	scanner := bufio.NewScanner(logFile)
+	var expected, actual []string
+	fail := func(format string, args ...interface{}) {
+		n := len(expected)
+		for i := 0; i < nestestAfter && stepNestest(con) == nil && scanner.Scan(); i++ {
+			want, err := parseNestestLine(scanner.Text())
+			if err != nil {
+				break
+			}
+			expected = append(expected, want)
+			actual = append(actual, trace())
+		}
+		var diff strings.Builder
+		from := n - nestestContext
+		if from < 0 {
+			from = 0
+		}
+		for i := from; i < n-1; i++ {
+			fmt.Fprintf(&diff, "  %5d %s\n", i+1, expected[i])
+		}
+		for i := n - 1; i < len(expected); i++ {
+			fmt.Fprintf(&diff, "- %5d %s\n", i+1, expected[i])
+		}
+		for i := n - 1; i < len(actual); i++ {
+			fmt.Fprintf(&diff, "+ %5d %s\n", i+1, actual[i])
+		}
+		t.Fatalf("%s\n%s", fmt.Sprintf(format, args...), diff.String())
+	}
+
+	for scanner.Scan() {
+		want, err := parseNestestLine(scanner.Text())
+		if err != nil {
+			t.Fatalf("line %d: %s", len(expected)+1, err)
+		}
+		expected = append(expected, want)
+		got := trace()
+		actual = append(actual, got)
+		if got != want {
+			fail("diverged at line %d", len(expected))
+		}
+
+		if err := stepNestest(con); err != nil {
+			fail("line %d: %s", len(expected), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nestest leaves the codes of failed tests at $02 and $03
+	if code := [2]byte{con.Peek(0x02), con.Peek(0x03)}; code != [2]byte{} {
+		t.Errorf("nestest reports failure %02X %02X", code[0], code[1])
+	}
+}
+
+func stepNestest(con *Console) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	con.Step()
+	return nil
+}
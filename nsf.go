@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NSF - music ripped from a game, its code and data, the addresses of
+// routines to initialize a track and to play it, called at a fixed rate,
+// and the expansion audio chips it uses. NSFe files hold the same in
+// chunks, with titles and lengths of tracks
+// http://wiki.nesdev.com/w/index.php/NSF
+// http://wiki.nesdev.com/w/index.php/NSFe
+type NSF struct {
+	Version   byte
+	Songs     int
+	Start     int // track played first, from 0
+	LoadAddr  uint16
+	InitAddr  uint16
+	PlayAddr  uint16
+	Title     string
+	Artist    string
+	Copyright string
+	Ripper    string
+	Speed     uint16  // microseconds between calls of PLAY, NTSC
+	PALSpeed  uint16  // of PAL
+	Banks     [8]byte // initial banks of $8000-$FFFF, bankswitched if any is not 0
+	Region    byte    // bit 0 PAL, bit 1 both
+	Chips     byte    // expansion audio, see nsfVRC6
+	Data      []byte
+	Tracks    []NSFTrack // Songs of them
+}
+
+// NSFTrack - a track of NSF, lengths are -1 if not known
+type NSFTrack struct {
+	Title    string
+	Duration time.Duration
+	Fade     time.Duration
+}
+
+// expansion audio chips of NSF
+const (
+	nsfVRC6 = 1 << iota
+	nsfVRC7
+	nsfFDS
+	nsfMMC5
+	nsfN163
+	nsf5B
+)
+
+// rates of PLAY in microseconds, about 60.1 Hz and 50 Hz
+const (
+	nsfNTSCSpeed = 16639
+	nsfPALSpeed  = 19997
+)
+
+// length of tracks of unknown length
+const (
+	nsfDefaultDuration = 150 * time.Second
+	nsfDefaultFade     = 8 * time.Second
+)
+
+const nsfHeaderSize = 0x80
+
+var (
+	nsfMagic  = []byte("NESM\x1a")
+	nsfeMagic = []byte("NSFE")
+)
+
+// loadNSFFile load an NSF or NSFe file as a cartridge of NSFPlayer
+func loadNSFFile(path string) (*Cartridge, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	nsf, err := parseNSF(data)
+	if err != nil {
+		return nil, err
+	}
+	return nsf.cartridge(), nil
+}
+
+// parseNSF parse an NSF or NSFe file
+func parseNSF(data []byte) (*NSF, error) {
+	n := &NSF{Songs: 1, Speed: nsfNTSCSpeed, PALSpeed: nsfPALSpeed}
+	switch {
+	case bytes.HasPrefix(data, nsfMagic) && len(data) > nsfHeaderSize:
+		n.parseHeader(data)
+	case bytes.HasPrefix(data, nsfeMagic):
+		if err := n.parseChunks(data[4:], false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid NSF file")
+	}
+	switch base := n.base(); {
+	case n.Songs == 0 || len(n.Data) == 0:
+		return nil, errors.New("invalid NSF file, no tracks")
+	case n.LoadAddr < base && !n.bankswitched():
+		return nil, fmt.Errorf("invalid NSF load address $%04X", n.LoadAddr)
+	}
+	if n.Start < 0 || n.Start >= n.Songs {
+		n.Start = 0
+	}
+	n.track(n.Songs - 1)
+	n.Tracks = n.Tracks[:n.Songs]
+	return n, nil
+}
+
+// parseHeader parse NSF, and metadata chunks of NSF2 after its data
+func (n *NSF) parseHeader(data []byte) {
+	h := data[:nsfHeaderSize]
+	le := binary.LittleEndian
+	n.Version = h[5]
+	n.Songs, n.Start = int(h[6]), int(h[7])-1
+	n.LoadAddr, n.InitAddr, n.PlayAddr = le.Uint16(h[8:]), le.Uint16(h[0x0A:]), le.Uint16(h[0x0C:])
+	n.Title, n.Artist, n.Copyright = nsfString(h[0x0E:0x2E]), nsfString(h[0x2E:0x4E]), nsfString(h[0x4E:0x6E])
+	n.Speed, n.PALSpeed = le.Uint16(h[0x6E:]), le.Uint16(h[0x78:])
+	copy(n.Banks[:], h[0x70:0x78])
+	n.Region, n.Chips = h[0x7A], h[0x7B]
+	n.Data = data[nsfHeaderSize:]
+	size := int(h[0x7D]) | int(h[0x7E])<<8 | int(h[0x7F])<<16
+	if n.Version >= 2 && size > 0 && size < len(n.Data) {
+		// metadata is optional, a player may ignore it if it is not valid
+		n.parseChunks(n.Data[size:], true)
+		n.Data = n.Data[:size]
+	}
+}
+
+// parseChunks parse chunks of NSFe, or only those of metadata, until
+// NEND. Unknown chunks are skipped, unless their first letter is upper
+// case, which marks them as needed to play the file
+func (n *NSF) parseChunks(data []byte, metadata bool) error {
+	le := binary.LittleEndian
+	for {
+		if len(data) < 8 {
+			return errors.New("invalid NSFe file, no NEND chunk")
+		}
+		size, id := le.Uint32(data), string(data[4:8])
+		if uint64(size) > uint64(len(data)-8) {
+			return fmt.Errorf("invalid NSFe chunk %q", id)
+		}
+		chunk := data[8 : 8+size]
+		data = data[8+size:]
+		switch id {
+		case "INFO", "DATA", "BANK", "RATE":
+			if metadata {
+				return fmt.Errorf("NSFe chunk %q in metadata", id)
+			}
+			if err := n.parseChunk(id, chunk); err != nil {
+				return err
+			}
+		case "NEND":
+			return nil
+		case "auth":
+			fields := strings.SplitN(string(chunk), "\x00", 5)
+			for i, s := range []*string{&n.Title, &n.Artist, &n.Copyright, &n.Ripper} {
+				if i < len(fields) {
+					*s = fields[i]
+				}
+			}
+		case "tlbl":
+			for i, title := range strings.Split(strings.TrimSuffix(string(chunk), "\x00"), "\x00") {
+				n.track(i).Title = title
+			}
+		case "time", "fade":
+			for i := 0; i+4 <= len(chunk); i += 4 {
+				t := time.Duration(int32(le.Uint32(chunk[i:]))) * time.Millisecond
+				if t < 0 {
+					t = -1
+				}
+				if id == "time" {
+					n.track(i / 4).Duration = t
+				} else {
+					n.track(i / 4).Fade = t
+				}
+			}
+		default:
+			if id[0] >= 'A' && id[0] <= 'Z' {
+				return fmt.Errorf("unsupported NSFe chunk %q", id)
+			}
+		}
+	}
+}
+
+func (n *NSF) parseChunk(id string, chunk []byte) error {
+	le := binary.LittleEndian
+	switch id {
+	case "INFO":
+		if len(chunk) < 8 {
+			return errors.New("invalid NSFe INFO chunk")
+		}
+		n.LoadAddr, n.InitAddr, n.PlayAddr = le.Uint16(chunk), le.Uint16(chunk[2:]), le.Uint16(chunk[4:])
+		n.Region, n.Chips = chunk[6], chunk[7]
+		if len(chunk) > 8 {
+			n.Songs = int(chunk[8])
+		}
+		if len(chunk) > 9 {
+			n.Start = int(chunk[9])
+		}
+	case "DATA":
+		n.Data = chunk
+	case "BANK":
+		copy(n.Banks[:], chunk)
+	case "RATE":
+		if len(chunk) >= 2 {
+			n.Speed = le.Uint16(chunk)
+		}
+		if len(chunk) >= 4 {
+			n.PALSpeed = le.Uint16(chunk[2:])
+		}
+	}
+	return nil
+}
+
+// track return a track, added with those before it if there are not as
+// many
+func (n *NSF) track(i int) *NSFTrack {
+	for len(n.Tracks) <= i {
+		n.Tracks = append(n.Tracks, NSFTrack{Duration: -1, Fade: -1})
+	}
+	return &n.Tracks[i]
+}
+
+func nsfString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (n *NSF) bankswitched() bool {
+	return n.Banks != [8]byte{}
+}
+
+// base return the lowest address code is loaded to, FDS has RAM from $6000
+func (n *NSF) base() uint16 {
+	if n.Chips&nsfFDS != 0 {
+		return 0x6000
+	}
+	return 0x8000
+}
+
+// pal tell whether the tune is only for PAL, whose rate of PLAY is used
+func (n *NSF) pal() bool {
+	return n.Region&3 == 1
+}
+
+// length return how long a track plays and fades out, the defaults if not
+// known
+func (n *NSF) length(track int) (time.Duration, time.Duration) {
+	t := n.Tracks[track]
+	if t.Duration < 0 {
+		t.Duration = nsfDefaultDuration
+	}
+	if t.Fade < 0 {
+		t.Fade = nsfDefaultFade
+	}
+	return t.Duration, t.Fade
+}
+
+// cartridge make a cartridge, data padded to banks of 4 KiB in PRG. Data
+// is loaded at the offset of the load address in its bank if the tune is
+// bankswitched, at banks from the base address in order otherwise
+func (n *NSF) cartridge() *Cartridge {
+	pad := int(n.LoadAddr & 0x0FFF)
+	if !n.bankswitched() {
+		pad = int(n.LoadAddr - n.base())
+	}
+	prg := make([]byte, (pad+len(n.Data)+0x0FFF)&^0x0FFF)
+	copy(prg[pad:], n.Data)
+	sram := 0x2000
+	if n.Chips&nsfFDS != 0 {
+		sram = 0xA000
+	}
+	return &Cartridge{
+		PRG:    prg,
+		Chr:    make([]byte, 0x2000),
+		ChrRAM: true,
+		SRAM:   make([]byte, sram),
+		NSF:    n,
+	}
+}
+
+// initialBanks return banks of 4 KiB of $6000-$FFFF, as written to
+// $5FF6-$5FFF. Those of $6000-$7FFF are only switched for FDS
+func (n *NSF) initialBanks() (banks [10]byte) {
+	if n.bankswitched() {
+		banks[0], banks[1] = n.Banks[6], n.Banks[7]
+		copy(banks[2:], n.Banks[:])
+		return
+	}
+	first := int(n.base()>>12) - 6
+	for i := first; i < len(banks); i++ {
+		banks[i] = byte(i - first)
+	}
+	return
+}
+
+// driver calling INIT with the track in A and region in X, after setting
+// up APU, then PLAY whenever it is due, as told by bit 7 of nsfPlayDue.
+// It is assembled from nsfDriverSource at nsfDriverCode, its vectors last
+const (
+	nsfDriverAddr = 0x5300
+	nsfTrack      = 0x5300
+	nsfRegion     = 0x5301
+	nsfPlayDue    = 0x5302 // reading clears it
+	nsfInit       = 0x5304
+	nsfPlay       = 0x5306
+	nsfDriverCode = 0x5310
+)
+
+const nsfDriverSource = `
+reset:  SEI
+        CLD
+        LDX #$FF
+        TXS
+        LDA #0
+        LDX #$13
+clear:  STA $4000,X
+        DEX
+        BPL clear
+        STA $4015
+        LDA #$0F
+        STA $4015
+        LDA #$40
+        STA $4017
+        LDA $5300
+        LDX $5301
+        JSR init
+loop:   BIT $5302
+        BPL loop
+        JSR play
+        JMP loop
+init:   JMP ($5304)
+play:   JMP ($5306)
+nmi:    RTI
+        .word nmi, reset, nmi
+`
+
+var nsfDriver = []byte{
+	0x78, 0xD8, 0xA2, 0xFF, 0x9A, 0xA9, 0x00, 0xA2, 0x13, 0x9D, 0x00, 0x40, 0xCA, 0x10, 0xFA, 0x8D,
+	0x15, 0x40, 0xA9, 0x0F, 0x8D, 0x15, 0x40, 0xA9, 0x40, 0x8D, 0x17, 0x40, 0xAD, 0x00, 0x53, 0xAE,
+	0x01, 0x53, 0x20, 0x40, 0x53, 0x2C, 0x02, 0x53, 0x10, 0xFB, 0x20, 0x43, 0x53, 0x4C, 0x35, 0x53,
+	0x6C, 0x04, 0x53, 0x6C, 0x06, 0x53, 0x40, 0x46, 0x53, 0x10, 0x53, 0x46, 0x53,
+}
+
+// NSFPlayer - mapper playing NSF, of banks of 4 KiB switched by
+// $5FF8-$5FFF, and RAM at $6000-$7FFF. FDS tunes have RAM at $6000-$FFFF
+// instead, to which a bank is copied as it is switched, $6000 and $7000
+// too by $5FF6-$5FF7. It runs a driver at $5300, whose vectors override
+// those at $FFFA. Expansion audio is mapped at the addresses of each chip
+type NSFPlayer struct {
+	console *Console
+	cart    *Cartridge // track is kept through reset of the same cartridge
+	vrc6    VRC6
+	mmc5    MMC5
+	n163    Namco163
+	nsfState
+}
+
+type nsfState struct {
+	Track   byte
+	Banks   [10]byte // $5FF6-$5FFF
+	Timer   uint64   // in millionths of CPU cycles
+	PlayDue bool
+	FDS     fdsAudio
+	OPLL    opll
+	Audio5B sunsoft5B
+}
+
+// Init initialize player to play the track set, or the first one of NSF,
+// clearing RAM and switching the initial banks
+func (m *NSFPlayer) Init(con *Console) {
+	nsf := con.Cartridge.NSF
+	track := byte(nsf.Start)
+	if m.cart == con.Cartridge {
+		track = m.Track
+	}
+	m.console, m.cart = con, con.Cartridge
+	m.nsfState = nsfState{Track: track}
+	m.FDS.reset()
+	m.OPLL.reset()
+	m.Audio5B.LFSR = 1
+	m.vrc6.Init(con)
+	m.mmc5.Init(con)
+	m.mmc5.ExRAMMode = 2
+	m.n163.Init(con)
+	sram := con.Cartridge.SRAM
+	for i := range sram {
+		sram[i] = 0
+	}
+	for i, bank := range nsf.initialBanks() {
+		m.setBank(i, bank)
+	}
+}
+
+func (m *NSFPlayer) chips() byte {
+	return m.cart.NSF.Chips
+}
+
+// Read PRG, RAM, the driver and registers of chips, reading nsfPlayDue
+// clears it
+func (m *NSFPlayer) Read(addr uint16) byte {
+	switch {
+	case addr == nsfPlayDue:
+		val, _ := m.peek(addr)
+		m.PlayDue = false
+		return val
+	case addr&0xF800 == 0x4800 && m.chips()&nsfN163 != 0:
+		return m.n163.Read(addr)
+	}
+	val, _ := m.peek(addr)
+	return val
+}
+
+func (m *NSFPlayer) peek(addr uint16) (byte, bool) {
+	cart, chips := m.cart, m.chips()
+	switch {
+	case addr >= 0xFFFA:
+		return nsfDriver[len(nsfDriver)-6+int(addr-0xFFFA)], true
+	case addr >= 0x6000:
+		if off := m.prgOffset(addr); off >= 0 {
+			return cart.PRG[off], true
+		}
+		return cart.SRAM[addr-0x6000], true
+	case addr >= nsfDriverCode && int(addr) < nsfDriverCode+len(nsfDriver):
+		return nsfDriver[addr-nsfDriverCode], true
+	case addr == nsfTrack:
+		return m.Track, true
+	case addr == nsfRegion:
+		if cart.NSF.pal() {
+			return 1, true
+		}
+		return 0, true
+	case addr == nsfPlayDue:
+		if m.PlayDue {
+			return 0x80, true
+		}
+		return 0, true
+	case addr >= nsfInit && addr < nsfInit+4:
+		vec := [4]byte{byte(cart.NSF.InitAddr), byte(cart.NSF.InitAddr >> 8), byte(cart.NSF.PlayAddr), byte(cart.NSF.PlayAddr >> 8)}
+		return vec[addr-nsfInit], true
+	case addr >= 0x4040 && addr < 0x4098 && chips&nsfFDS != 0:
+		return m.FDS.read(addr)
+	case addr&0xF800 == 0x4800 && chips&nsfN163 != 0:
+		return m.n163.peek(addr)
+	case (addr == 0x5015 || addr == 0x5205 || addr == 0x5206 || addr >= 0x5C00 && addr < 0x5FF6) && chips&nsfMMC5 != 0:
+		return m.mmc5.peek(addr)
+	}
+	return 0, false
+}
+
+// Write banks, RAM and registers of expansion audio
+func (m *NSFPlayer) Write(addr uint16, val byte) {
+	chips := m.chips()
+	switch {
+	case addr >= 0x5FF6 && addr < 0x6000:
+		m.setBank(int(addr-0x5FF6), val)
+	case addr >= 0x6000 && m.prgOffset(addr) < 0:
+		m.cart.SRAM[addr-0x6000] = val
+	}
+	switch {
+	case chips&nsfVRC6 != 0 && (addr >= 0x9000 && addr <= 0x9003 || addr >= 0xA000 && addr <= 0xA002 || addr >= 0xB000 && addr <= 0xB002):
+		m.vrc6.Write(addr, val)
+	case chips&nsfVRC7 != 0 && addr == 0x9010:
+		m.OPLL.writeAddress(val)
+	case chips&nsfVRC7 != 0 && addr == 0x9030:
+		m.OPLL.writeData(val)
+	case chips&nsfFDS != 0 && addr >= 0x4040 && addr < 0x4098:
+		m.FDS.write(addr, val)
+	case chips&nsfMMC5 != 0 && (addr >= 0x5000 && addr <= 0x5015 || addr == 0x5205 || addr == 0x5206 || addr >= 0x5C00 && addr < 0x5FF6):
+		m.mmc5.Write(addr, val)
+	case chips&nsfN163 != 0 && (addr&0xF800 == 0x4800 || addr >= 0xF800):
+		m.n163.Write(addr, val)
+	case chips&nsf5B != 0 && addr == 0xC000:
+		m.Audio5B.Address = val
+	case chips&nsf5B != 0 && addr == 0xE000:
+		m.Audio5B.write(val)
+	}
+}
+
+// setBank switch a bank of 4 KiB from $6000, copied to RAM for FDS
+func (m *NSFPlayer) setBank(i int, bank byte) {
+	m.Banks[i] = bank
+	if m.chips()&nsfFDS == 0 {
+		return
+	}
+	prg := m.cart.PRG
+	off := int(bank) * 0x1000 % len(prg)
+	copy(m.cart.SRAM[i*0x1000:(i+1)*0x1000], prg[off:off+0x1000])
+}
+
+// cpuCycle flag PLAY due at the rate of the tune
+func (m *NSFPlayer) cpuCycle() {
+	nsf := m.cart.NSF
+	speed := nsf.Speed
+	if nsf.pal() {
+		speed = nsf.PALSpeed
+	}
+	if speed == 0 {
+		speed = nsfNTSCSpeed
+	}
+	if m.Timer += 1000000; m.Timer >= uint64(speed)*cpuClock {
+		m.Timer -= uint64(speed) * cpuClock
+		m.PlayDue = true
+	}
+}
+
+// PPURead read 8 KiB of CHR RAM, as NSF does not render
+func (m *NSFPlayer) PPURead(addr uint16) byte {
+	return m.cart.Chr[addr&0x1FFF]
+}
+
+// PPUWrite write CHR RAM
+func (m *NSFPlayer) PPUWrite(addr uint16, val byte) {
+	m.cart.Chr[addr&0x1FFF] = val
+}
+
+// prgOffset map banks of $8000-$FFFF, -1 for RAM
+func (m *NSFPlayer) prgOffset(addr uint16) int {
+	if addr < 0x8000 || m.chips()&nsfFDS != 0 {
+		return -1
+	}
+	prg := m.cart.PRG
+	return (int(m.Banks[addr>>12-6])*0x1000 + int(addr&0x0FFF)) % len(prg)
+}
+
+func (m *NSFPlayer) audioStep() {
+	chips := m.chips()
+	if chips&nsfVRC6 != 0 {
+		m.vrc6.audioStep()
+	}
+	if chips&nsfVRC7 != 0 {
+		m.OPLL.step()
+	}
+	if chips&nsfFDS != 0 {
+		m.FDS.step()
+	}
+	if chips&nsfMMC5 != 0 {
+		m.mmc5.audioStep()
+	}
+	if chips&nsfN163 != 0 {
+		m.n163.audioStep()
+	}
+	if chips&nsf5B != 0 {
+		m.Audio5B.step()
+	}
+}
+
+// audioOutput sum the chips of the tune
+func (m *NSFPlayer) audioOutput() float32 {
+	var out float32
+	chips := m.chips()
+	if chips&nsfVRC6 != 0 {
+		out += m.vrc6.audioOutput()
+	}
+	if chips&nsfVRC7 != 0 {
+		out += float32(m.OPLL.Output)
+	}
+	if chips&nsfFDS != 0 {
+		out += m.FDS.output()
+	}
+	if chips&nsfMMC5 != 0 {
+		out += m.mmc5.audioOutput()
+	}
+	if chips&nsfN163 != 0 {
+		out += m.n163.audioOutput()
+	}
+	if chips&nsf5B != 0 {
+		out += m.Audio5B.output()
+	}
+	return out
+}
+
+// saveState write state of player, then those of the chips it shares
+// with mappers
+func (m *NSFPlayer) saveState(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, &m.nsfState); err != nil {
+		return err
+	}
+	for _, chip := range []stateMapper{&m.vrc6, &m.mmc5, &m.n163} {
+		if err := chip.saveState(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *NSFPlayer) loadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.nsfState); err != nil {
+		return err
+	}
+	for _, chip := range []stateMapper{&m.vrc6, &m.mmc5, &m.n163} {
+		if err := chip.loadState(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (con *Console) nsfPlayer() (*NSFPlayer, error) {
+	if m, ok := con.Mapper.(*NSFPlayer); ok {
+		return m, nil
+	}
+	return nil, errors.New("not an NSF")
+}
+
+// PlayTrack play a track of NSF from the start, counting from 0
+func (con *Console) PlayTrack(track int) error {
+	m, err := con.nsfPlayer()
+	if err != nil {
+		return err
+	}
+	if track < 0 || track >= m.cart.NSF.Songs {
+		return errors.New("no such track")
+	}
+	m.Track = byte(track)
+	con.Reset()
+	return nil
+}
+
+// Track return the track of NSF playing, -1 if not an NSF
+func (con *Console) Track() int {
+	m, err := con.nsfPlayer()
+	if err != nil {
+		return -1
+	}
+	return int(m.Track)
+}
+
+// nsfSampleRate of WAV files tracks are rendered to
+const nsfSampleRate = 44100
+
+// renderNSF render each track of an NSF to a WAV file in dir, named after
+// the file and the track, for as long as the track plays and fades out.
+// With stems, each channel is rendered to a file of its own
+func renderNSF(path, dir string, stems bool) error {
+	cart, err := loadNSFFile(path)
+	if err != nil {
+		return err
+	}
+	con := new(Console)
+	con.Connect(new(CPU))
+	con.Connect(new(APU))
+	if err := con.Connect(cart); err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for track := 0; track < cart.NSF.Songs; track++ {
+		base := filepath.Join(dir, fmt.Sprintf("%s-%02d", name, track+1))
+		var sink AudioSink
+		if stems {
+			var split SplitSink
+			for _, stem := range StemNames {
+				wav, err := createWAVFile(base + "-" + stem + ".wav")
+				if err != nil {
+					split.Close()
+					return err
+				}
+				split = append(split, wav)
+			}
+			sink = split
+		} else if sink, err = createWAVFile(base + ".wav"); err != nil {
+			return err
+		}
+		if err := con.recordTrack(track, sink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wavFile - WAV sink of a file, which is closed with the sink
+type wavFile struct {
+	*WAVSink
+	file *os.File
+}
+
+func createWAVFile(path string) (*wavFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := NewWAVSink(file, nsfSampleRate, 1)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &wavFile{sink, file}, nil
+}
+
+func (f *wavFile) Close() error {
+	err := f.WAVSink.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recordTrack play a track of NSF for its length, fading out at its end,
+// writing its audio to a sink, which is closed when it ends or fails
+func (con *Console) recordTrack(track int, sink AudioSink) error {
+	s := &fadeSink{AudioSink: sink}
+	if err := con.PlayTrack(track); err != nil {
+		s.Close()
+		return err
+	}
+	rate, channels := sink.Format()
+	length, fade := con.Cartridge.NSF.length(track)
+	s.channels = channels
+	s.from = int64(length.Seconds() * float64(rate))
+	s.to = s.from + int64(fade.Seconds()*float64(rate))
+	if err := con.StartAudio(s); err != nil {
+		s.Close()
+		return err
+	}
+	for con.AudioFrames() < s.to {
+		con.Step()
+	}
+	return con.StopAudio()
+}
+
+// fadeSink - sink fading out frames to silence, from a frame to another,
+// those past it are dropped
+type fadeSink struct {
+	AudioSink
+	channels int
+	from, to int64
+	frame    int64
+}
+
+func (s *fadeSink) WriteAudio(samples []float32) error {
+	n := 0
+	for i := 0; i < len(samples) && s.frame < s.to; i += s.channels {
+		if s.frame >= s.from {
+			gain := float32(s.to-s.frame) / float32(s.to-s.from)
+			for ch := 0; ch < s.channels; ch++ {
+				samples[i+ch] *= gain
+			}
+		}
+		s.frame++
+		n = i + s.channels
+	}
+	if n == 0 {
+		return nil
+	}
+	return s.AudioSink.WriteAudio(samples[:n])
+}
+
+func (s *fadeSink) Close() error {
+	if c, ok := s.AudioSink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTune increments $02 on PLAY at $8000, INIT at $8003 stores the track
+// and region at $00 and $01
+const testTune = `
+play:   INC $02
+        RTS
+init:   STA $00
+        STX $01
+        RTS
+`
+
+// testNSF make an NSF of songs tracks starting at the second one
+func testNSF(t *testing.T, data []byte, load uint16, banks [8]byte, chips byte) []byte {
+	t.Helper()
+	h := make([]byte, nsfHeaderSize)
+	copy(h, nsfMagic)
+	h[5], h[6], h[7] = 1, 3, 2
+	binary.LittleEndian.PutUint16(h[8:], load)
+	binary.LittleEndian.PutUint16(h[0x0A:], 0x8003)
+	binary.LittleEndian.PutUint16(h[0x0C:], 0x8000)
+	copy(h[0x0E:], "Title")
+	copy(h[0x2E:], "Artist")
+	copy(h[0x4E:], "Copyright")
+	binary.LittleEndian.PutUint16(h[0x6E:], nsfNTSCSpeed)
+	copy(h[0x70:], banks[:])
+	h[0x7B] = chips
+	return append(h, data...)
+}
+
+func nsfeChunk(id string, data []byte) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	return append(append(size[:], id...), data...)
+}
+
+// testNSFe make an NSFe of the tune of 2 tracks, the first of 100 ms and
+// a fade of 50 ms, the second of 20 ms without a title
+func testNSFe(t *testing.T) []byte {
+	t.Helper()
+	code, err := Assemble(testTune, 0x8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	info := []byte{0, 0x80, 3, 0x80, 0, 0x80, 0, nsfVRC6, 2, 1}
+	times := le.AppendUint32(le.AppendUint32(nil, 100), 20)
+	data := append([]byte(nil), nsfeMagic...)
+	data = append(data, nsfeChunk("INFO", info)...)
+	data = append(data, nsfeChunk("DATA", code)...)
+	data = append(data, nsfeChunk("auth", []byte("Game\x00Artist\x00Copyright\x00Ripper\x00"))...)
+	data = append(data, nsfeChunk("tlbl", []byte("One\x00"))...)
+	data = append(data, nsfeChunk("time", times)...)
+	data = append(data, nsfeChunk("fade", le.AppendUint32(le.AppendUint32(nil, 50), 0))...)
+	data = append(data, nsfeChunk("plst", []byte{1, 0})...)
+	return append(data, nsfeChunk("NEND", nil)...)
+}
+
+func newNSFConsole(t *testing.T, file []byte) *Console {
+	t.Helper()
+	nsf, err := parseNSF(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := new(Console)
+	con.Connect(new(CPU))
+	con.Connect(new(APU))
+	if err := con.Connect(nsf.cartridge()); err != nil {
+		t.Fatal(err)
+	}
+	con.Reset()
+	return con
+}
+
+func TestNSFDriver(t *testing.T) {
+	code, err := Assemble(nsfDriverSource, nsfDriverCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(code, nsfDriver) {
+		t.Errorf("driver % X, want % X as assembled", nsfDriver, code)
+	}
+}
+
+func TestNSFFile(t *testing.T) {
+	n, err := parseNSF(testNSF(t, make([]byte, 16), 0x8000, [8]byte{}, nsfFDS|nsf5B))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Songs != 3 || n.Start != 1 || n.InitAddr != 0x8003 || n.Title != "Title" || n.Copyright != "Copyright" || n.Chips != nsfFDS|nsf5B {
+		t.Errorf("parsed %+v", n)
+	}
+	if len(n.Tracks) != 3 || n.Tracks[2].Duration != -1 {
+		t.Errorf("tracks %+v, want 3 of unknown length", n.Tracks)
+	}
+	if length, fade := n.length(2); length != nsfDefaultDuration || fade != nsfDefaultFade {
+		t.Errorf("track of unknown length %v and fade %v, want defaults", length, fade)
+	}
+	if _, err := parseNSF(testNSF(t, make([]byte, 16), 0x7000, [8]byte{}, 0)); err == nil {
+		t.Error("parsed NSF loaded at $7000 without FDS")
+	}
+
+	n, err = parseNSF(testNSFe(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Songs != 2 || n.Start != 1 || n.PlayAddr != 0x8000 || n.Title != "Game" || n.Ripper != "Ripper" || n.Speed != nsfNTSCSpeed {
+		t.Errorf("parsed %+v", n)
+	}
+	want := []NSFTrack{{"One", 100 * time.Millisecond, 50 * time.Millisecond}, {"", 20 * time.Millisecond, 0}}
+	if len(n.Tracks) != 2 || n.Tracks[0] != want[0] || n.Tracks[1] != want[1] {
+		t.Errorf("tracks %+v, want %+v", n.Tracks, want)
+	}
+
+	file := testNSFe(t)
+	bad := append(file[:len(file)-8:len(file)-8], nsfeChunk("VRC7", nil)...)
+	if _, err := parseNSF(append(bad, nsfeChunk("NEND", nil)...)); err == nil {
+		t.Error("parsed NSFe of an unknown chunk needed to play it")
+	}
+	if _, err := parseNSF(file[:len(file)-8]); err == nil {
+		t.Error("parsed NSFe without NEND")
+	}
+}
+
+func TestNSFPlayer(t *testing.T) {
+	code, err := Assemble(testTune, 0x8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newNSFConsole(t, testNSF(t, code, 0x8000, [8]byte{}, 0))
+	ram := &con.CPU.ram
+	for con.CPU.cycles < cpuClock {
+		con.Step()
+	}
+	if ram[0] != 1 || ram[1] != 0 || con.Track() != 1 {
+		t.Errorf("INIT of track %d region %d, want 1 of NTSC", ram[0], ram[1])
+	}
+	if n := ram[2]; n < 59 || n > 61 {
+		t.Errorf("PLAY called %d times a second, want 60", n)
+	}
+
+	con.Cartridge.SRAM[0] = 1
+	if err := con.PlayTrack(2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		con.Step()
+	}
+	if ram[0] != 2 || ram[2] != 0 || con.Track() != 2 || con.Cartridge.SRAM[0] != 0 {
+		t.Errorf("INIT of track %d, PLAY %d times, want track 2 from the start", ram[0], ram[2])
+	}
+	if err := con.PlayTrack(3); err == nil {
+		t.Error("played track 3 of 3")
+	}
+	if newMapperConsole(t, 0, 0, 2, 1).Track() != -1 {
+		t.Error("track of NROM")
+	}
+}
+
+func TestNSFBanks(t *testing.T) {
+	data := make([]byte, 0x3000)
+	for i := range data {
+		data[i] = byte(i >> 12)
+	}
+	con := newNSFConsole(t, testNSF(t, data[0x100:], 0x8100, [8]byte{0, 1, 2, 0, 0, 0, 0, 2}, 0))
+	for addr, want := range map[uint16]byte{0x8000: 0, 0x8100: 0, 0x9000: 1, 0xA000: 2, 0xF000: 2} {
+		if v := con.Peek(addr); v != want {
+			t.Errorf("$%04X = %d, want %d", addr, v, want)
+		}
+	}
+	if v := con.Peek(0xFFFC); v != byte(nsfDriverCode&0xFF) {
+		t.Errorf("reset vector low byte %02X, want that of driver", v)
+	}
+	con.CPU.write(0x5FF8, 2)
+	con.CPU.write(0x6000, 0x55)
+	if v := con.Peek(0x8000); v != 2 || con.Peek(0x6000) != 0x55 {
+		t.Errorf("$8000 = %d after switching bank 2", v)
+	}
+
+	// FDS has RAM, to which banks are copied
+	con = newNSFConsole(t, testNSF(t, data, 0x6000, [8]byte{}, nsfFDS))
+	if v0, v2 := con.Peek(0x6000), con.Peek(0x8000); v0 != 0 || v2 != 2 {
+		t.Errorf("$6000 = %d, $8000 = %d, want 0 and 2", v0, v2)
+	}
+	con.CPU.write(0x9000, 0x55)
+	con.CPU.write(0x5FF6, 1)
+	if v0, v1 := con.Peek(0x6000), con.Peek(0x9000); v0 != 1 || v1 != 0x55 {
+		t.Errorf("$6000 = %d, $9000 = %02X, want 1 switched and 55 written", v0, v1)
+	}
+}
+
+func TestNSFExpansion(t *testing.T) {
+	con := newNSFConsole(t, testNSFe(t))
+	cpu, m := con.CPU, con.Mapper.(*NSFPlayer)
+	cpu.write(0x9000, 0x8F) // volume 15 regardless of duty
+	cpu.write(0x9002, 0x80)
+	m.audioStep()
+	if out := m.audioOutput(); out != 15*vrc6Level {
+		t.Errorf("output %v, want %v of VRC6 pulse", out, 15*vrc6Level)
+	}
+	cpu.write(0xF800, 0x80)
+	cpu.write(0x4800, 0x12)
+	cpu.write(0xF800, 0x00)
+	if v := cpu.read(0x4800); v != 0 || m.n163.RAM[0] != 0 {
+		t.Errorf("N163 RAM %02X written without N163", v)
+	}
+}
+
+func TestNSFRender(t *testing.T) {
+	con := newNSFConsole(t, testNSFe(t))
+	sink := &MemorySink{Rate: nsfSampleRate, Channels: 1}
+	if err := con.recordTrack(0, sink); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.Samples); n != nsfSampleRate*150/1000 {
+		t.Errorf("%d samples, want %d for 100 ms and a fade of 50 ms", n, nsfSampleRate*150/1000)
+	}
+	if last := sink.Samples[len(sink.Samples)-1]; last > 0.001 || last < -0.001 {
+		t.Errorf("last sample %v, want faded out", last)
+	}
+
+	closer := &closeSink{MemorySink: MemorySink{Rate: 8000, Channels: 1}}
+	if err := con.recordTrack(2, closer); err == nil || !closer.closed {
+		t.Errorf("sink closed %v after recording track 2 of 2: %v", closer.closed, err)
+	}
+	closer = &closeSink{MemorySink: MemorySink{Rate: 1, Channels: 1}}
+	if err := con.recordTrack(0, closer); err == nil || !closer.closed {
+		t.Errorf("sink closed %v after recording at an invalid rate: %v", closer.closed, err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tune.nsfe")
+	if err := os.WriteFile(file, testNSFe(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := renderNSF(file, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	wav, err := os.ReadFile(filepath.Join(dir, "tune-01.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wav) != 44+2*len(sink.Samples) || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" {
+		t.Errorf("WAV of %d bytes %q, want %d", len(wav), wav[:12], 44+2*len(sink.Samples))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tune-02.wav")); err != nil {
+		t.Error(err)
+	}
+	if err := renderNSF(file, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tune-02-expansion.wav")); err != nil {
+		t.Error(err)
+	}
+}
+
+// closeSink - MemorySink telling if it was closed
+type closeSink struct {
+	MemorySink
+	closed bool
+}
+
+func (s *closeSink) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import "math"
+
+// opll - FM synthesis of Yamaha YM2413, as in VRC7 which has 6 of its 9
+// channels and a set of instruments of its own. Each channel is a
+// modulator slot changing the phase of a carrier slot. It makes a sample
+// every 36 CPU cycles, at about 49.7 kHz
+// http://wiki.nesdev.com/w/index.php/VRC7_audio
+type opll struct {
+	Address byte
+	Custom  [8]byte // instrument 0, defined by registers $00-$07
+	FNum    [6]uint16
+	Block   [6]byte
+	Key     [6]bool
+	Sustain [6]bool
+	Patch   [6]byte // instrument
+	Volume  [6]byte // attenuation of carrier, 3 dB steps
+
+	Slots  [12]opllSlot // modulator and carrier of each channel
+	Cycle  byte
+	AM     float64 // phase of tremolo and vibrato, in cycles
+	VIB    float64
+	Output float64
+}
+
+type opllSlot struct {
+	Phase    float64 // in cycles
+	Envelope float64 // attenuation in dB
+	State    byte
+	Out      [2]float64 // last outputs, for modulator feedback
+}
+
+// envelope states
+const (
+	opllAttack = iota
+	opllDecay
+	opllSustain
+	opllRelease
+	opllOff
+)
+
+const (
+	opllRate      = 3579545.0 / 72 // samples per second
+	opllMaxAtten  = 48.0           // dB of the envelope generator
+	opllSilence   = 96.0           // dB of all attenuations a slot is silent at
+	opllModDepth  = 2.0            // carrier phase shift by a full modulator, in cycles
+	opllAMDepth   = 4.8            // dB
+	opllVIBDepth  = 0.004          // of frequency, about 7 cents
+	opllAMRate    = 3.7            // Hz
+	opllVIBRate   = 6.4            // Hz
+	opllChanLevel = 0.15           // a channel at full volume, about an APU pulse
+)
+
+// instruments 1-15 of VRC7, 8 bytes as registers $00-$07
+var vrc7Patches = [15][8]byte{
+	{0x03, 0x21, 0x05, 0x06, 0xE8, 0x81, 0x42, 0x27}, // buzzy bell
+	{0x13, 0x41, 0x14, 0x0D, 0xD8, 0xF6, 0x23, 0x12}, // guitar
+	{0x11, 0x11, 0x08, 0x08, 0xFA, 0xB2, 0x20, 0x12}, // wurly
+	{0x31, 0x61, 0x0C, 0x07, 0xA8, 0x64, 0x61, 0x27}, // flute
+	{0x32, 0x21, 0x1E, 0x06, 0xE1, 0x76, 0x01, 0x28}, // clarinet
+	{0x02, 0x01, 0x06, 0x00, 0xA3, 0xE2, 0xF4, 0xF4}, // synth
+	{0x21, 0x61, 0x1D, 0x07, 0x82, 0x81, 0x11, 0x07}, // trumpet
+	{0x23, 0x21, 0x22, 0x17, 0xA2, 0x72, 0x01, 0x17}, // organ
+	{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01}, // bells
+	{0xB5, 0x01, 0x0F, 0x0F, 0xA8, 0xA5, 0x51, 0x02}, // vibes
+	{0x17, 0xC1, 0x24, 0x07, 0xF8, 0xF8, 0x22, 0x12}, // vibraphone
+	{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16}, // tutti
+	{0x01, 0x02, 0xD3, 0x05, 0xC9, 0x95, 0x03, 0x02}, // fretless
+	{0x61, 0x63, 0x0C, 0x00, 0x94, 0xC0, 0x33, 0xF6}, // synth bass
+	{0x21, 0x72, 0x0D, 0x00, 0xC1, 0xD5, 0x56, 0x06}, // sweep
+}
+
+var opllMultiples = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+
+// attenuation in dB by the top 4 bits of F-number, at block 7
+var opllKeyScale = [16]float64{0, 18, 24, 27.75, 30, 32.25, 33.75, 35.25, 36, 37.5, 38.25, 39, 39.75, 40.5, 41.25, 42}
+
+// feedback phase shift of the modulator, in cycles
+var opllFeedback = [8]float64{0, 1.0 / 32, 1.0 / 16, 1.0 / 8, 1.0 / 4, 1.0 / 2, 1, 2}
+
+func (o *opll) reset() {
+	*o = opll{}
+	for i := range o.Slots {
+		o.Slots[i].State = opllOff
+		o.Slots[i].Envelope = opllMaxAtten
+	}
+}
+
+func (o *opll) writeAddress(val byte) {
+	o.Address = val
+}
+
+func (o *opll) writeData(val byte) {
+	reg := o.Address
+	ch := int(reg & 0x0F)
+	switch {
+	case reg < 0x08:
+		o.Custom[reg] = val
+	case ch > 5:
+	case reg&0xF0 == 0x10:
+		o.FNum[ch] = o.FNum[ch]&0x100 | uint16(val)
+	case reg&0xF0 == 0x20:
+		o.FNum[ch] = o.FNum[ch]&0xFF | uint16(val&1)<<8
+		o.Block[ch] = val >> 1 & 0x07
+		o.Sustain[ch] = val&0x20 != 0
+		key := val&0x10 != 0
+		if key && !o.Key[ch] {
+			o.Slots[ch*2] = opllSlot{State: opllAttack, Envelope: o.Slots[ch*2].Envelope}
+			o.Slots[ch*2+1] = opllSlot{State: opllAttack, Envelope: o.Slots[ch*2+1].Envelope}
+		} else if !key && o.Key[ch] {
+			o.Slots[ch*2].State = opllRelease
+			o.Slots[ch*2+1].State = opllRelease
+		}
+		o.Key[ch] = key
+	case reg&0xF0 == 0x30:
+		o.Patch[ch] = val >> 4
+		o.Volume[ch] = val & 0x0F
+	}
+}
+
+func (o *opll) patch(ch int) *[8]byte {
+	if o.Patch[ch] == 0 {
+		return &o.Custom
+	}
+	return &vrc7Patches[o.Patch[ch]-1]
+}
+
+// step a CPU cycle, making a sample every 36
+func (o *opll) step() {
+	if o.Cycle++; o.Cycle < 36 {
+		return
+	}
+	o.Cycle = 0
+	o.AM = math.Mod(o.AM+opllAMRate/opllRate, 1)
+	o.VIB = math.Mod(o.VIB+opllVIBRate/opllRate, 1)
+	var out float64
+	for ch := 0; ch < 6; ch++ {
+		out += o.channel(ch)
+	}
+	o.Output = out * opllChanLevel
+}
+
+// channel make a sample of a channel, from -1 to 1
+func (o *opll) channel(ch int) float64 {
+	p := o.patch(ch)
+	mod, car := &o.Slots[ch*2], &o.Slots[ch*2+1]
+
+	// modulator, with feedback of its last two outputs
+	o.advance(mod, ch, p[0], p[4], p[6])
+	atten := mod.Envelope + float64(p[2]&0x3F)*0.75 + o.keyScale(ch, p[2]>>6) + o.tremolo(p[0])
+	shift := (mod.Out[0] + mod.Out[1]) / 2 * opllFeedback[p[3]&7]
+	m := opllWave(mod.Phase+shift, p[3]&0x08 != 0) * opllGain(atten)
+	mod.Out[1], mod.Out[0] = mod.Out[0], m
+
+	o.advance(car, ch, p[1], p[5], p[7])
+	if car.State == opllOff {
+		return 0
+	}
+	atten = car.Envelope + float64(o.Volume[ch])*3 + o.keyScale(ch, p[3]>>6) + o.tremolo(p[1])
+	return opllWave(car.Phase+m*opllModDepth, p[3]&0x10 != 0) * opllGain(atten)
+}
+
+// advance the phase and envelope of a slot by a sample. flags are AM,
+// vibrato, sustained envelope, key scale rate and multiple
+func (o *opll) advance(s *opllSlot, ch int, flags, attackDecay, sustainRelease byte) {
+	freq := float64(o.FNum[ch]) * float64(uint(1)<<o.Block[ch]) / (1 << 19)
+	if flags&0x40 != 0 {
+		freq *= 1 + opllVIBDepth*math.Sin(2*math.Pi*o.VIB)
+	}
+	s.Phase = math.Mod(s.Phase+freq*opllMultiples[flags&0x0F], 1)
+
+	// rate key scaling, by block and the top bit of F-number
+	rks := int(o.Block[ch])<<1 | int(o.FNum[ch]>>8)
+	if flags&0x10 == 0 {
+		rks >>= 2
+	}
+	rate := func(r byte) int {
+		if r == 0 {
+			return 0
+		}
+		if r := 4*int(r) + rks; r < 63 {
+			return r
+		}
+		return 63
+	}
+	sustained := flags&0x20 != 0
+	level := float64(sustainRelease>>4) * 3
+	switch s.State {
+	case opllAttack:
+		r := rate(attackDecay >> 4)
+		switch {
+		case r >= 60:
+			s.Envelope = 0
+		case r > 0:
+			s.Envelope -= s.Envelope * 6.2 / (opllAttackTime(r) * opllRate)
+		}
+		if s.Envelope < 0.1 {
+			s.Envelope = 0
+			s.State = opllDecay
+		}
+	case opllDecay:
+		s.Envelope += opllDecayStep(rate(attackDecay & 0x0F))
+		if s.Envelope >= level {
+			s.Envelope = level
+			s.State = opllSustain
+		}
+	case opllSustain:
+		if !sustained {
+			s.Envelope += opllDecayStep(rate(sustainRelease & 0x0F))
+		}
+	case opllRelease:
+		r := sustainRelease & 0x0F
+		switch {
+		case o.Sustain[ch]:
+			r = 5
+		case !sustained:
+			r = 7
+		}
+		s.Envelope += opllDecayStep(rate(r))
+	}
+	if s.Envelope >= opllMaxAtten {
+		s.Envelope = opllMaxAtten
+		if s.State != opllAttack {
+			s.State = opllOff
+		}
+	}
+}
+
+// seconds from silence to full volume at rate r
+func opllAttackTime(r int) float64 {
+	return 2.826 * math.Exp2(-float64(r-4)/4)
+}
+
+// dB a sample of decay at rate r, which takes 39.28 s at rate 4 for the
+// full range
+func opllDecayStep(r int) float64 {
+	if r == 0 {
+		return 0
+	}
+	return opllMaxAtten / (39.28 * math.Exp2(-float64(r-4)/4) * opllRate)
+}
+
+// keyScale return attenuation of higher notes, by the key scale level of
+// 0, 1.5, 3 or 6 dB per octave
+func (o *opll) keyScale(ch int, level byte) float64 {
+	if level == 0 {
+		return 0
+	}
+	atten := opllKeyScale[o.FNum[ch]>>5] - 6*float64(7-o.Block[ch])
+	if atten <= 0 {
+		return 0
+	}
+	return atten / float64(uint(1)<<(3-level))
+}
+
+func (o *opll) tremolo(flags byte) float64 {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return opllAMDepth * (1 + math.Sin(2*math.Pi*o.AM)) / 2
+}
+
+// opllWave return sine at phase in cycles, with its negative half cut off
+// if rectified
+func opllWave(phase float64, rectified bool) float64 {
+	v := math.Sin(2 * math.Pi * phase)
+	if rectified && v < 0 {
+		return 0
+	}
+	return v
+}
+
+func opllGain(atten float64) float64 {
+	if atten >= opllSilence {
+		return 0
+	}
+	return math.Pow(10, -atten/20)
+}
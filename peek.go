@@ -0,0 +1,65 @@
+package main
+
+// Peek read a byte at a CPU address without side effect, through the
+// current banking of mapper. Registers read as they would be, but without
+// acknowledging anything, and those which can not be peeked read 0
+func (con *Console) Peek(addr uint16) byte {
+	v, _ := con.Bus.Peek(addr)
+	return v
+}
+
+// Poke write a byte to memory at a CPU address: RAM, SRAM or the byte of
+// PRG ROM it is mapped to. Writes to registers are ignored
+func (con *Console) Poke(addr uint16, val byte) {
+	con.Bus.Poke(addr, val)
+}
+
+// PeekPPU read a byte at a PPU address, $0000-$3FFF, without side effect
+func (con *Console) PeekPPU(addr uint16) byte {
+	if con.PPU == nil || con.Mapper == nil {
+		return 0
+	}
+	return con.PPU.read(addr)
+}
+
+// RAM return the 2 KiB of CPU RAM. Like the other accessors below, the
+// memory of console is returned, not a copy
+func (con *Console) RAM() []byte {
+	return con.CPU.ram[:]
+}
+
+// OAM return the 256 bytes of sprite attributes
+func (con *Console) OAM() []byte {
+	return con.PPU.OAM[:]
+}
+
+// PaletteRAM return the 32 bytes of palette, $3F10/$3F14/$3F18/$3F1C are
+// not used as they mirror $3F00/$3F04/$3F08/$3F0C
+func (con *Console) PaletteRAM() []byte {
+	return con.PPU.Palette[:]
+}
+
+// NameTables return the nametable RAM, 4 KiB of which only the first 2 KiB
+// are used unless the cartridge has four screen mirroring
+func (con *Console) NameTables() []byte {
+	return con.PPU.NameTable[:]
+}
+
+// PRGBank return bank n of PRG ROM in banks of size bytes, nil if there
+// is no such bank
+func (c *Cartridge) PRGBank(n, size int) []byte {
+	return bank(c.PRG, n, size)
+}
+
+// CHRBank return bank n of CHR ROM or RAM in banks of size bytes, nil if
+// there is no such bank
+func (c *Cartridge) CHRBank(n, size int) []byte {
+	return bank(c.Chr, n, size)
+}
+
+func bank(mem []byte, n, size int) []byte {
+	if size <= 0 || n < 0 || (n+1)*size > len(mem) {
+		return nil
+	}
+	return mem[n*size : (n+1)*size : (n+1)*size]
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestPeekPoke(t *testing.T) {
+	con := newProgramConsole(t, new(CPU), []byte{0xEA}, true)
+	ppu := con.PPU
+	ppu.Status = statusVBlank
+	if v := con.Peek(0x2002); v&statusVBlank == 0 || ppu.Status&statusVBlank == 0 {
+		t.Errorf("peek $2002 = %02X, status %02X, want VBlank kept", v, ppu.Status)
+	}
+	con.Controllers[0].SetButtons(0x01)
+	con.CPU.write(0x4016, 1)
+	con.CPU.write(0x4016, 0)
+	for i := 0; i < 2; i++ {
+		if v := con.Peek(0x4016); v != 1 {
+			t.Errorf("peek %d of $4016 = %d, want 1", i, v)
+		}
+	}
+
+	con.Poke(0x0801, 0x12)
+	if con.RAM()[1] != 0x12 || con.Peek(0x1801) != 0x12 {
+		t.Errorf("poke $0801: RAM[1] = %02X", con.RAM()[1])
+	}
+	con.Poke(0x2000, 0x80)
+	if ppu.Ctrl != 0 {
+		t.Errorf("poke $2000 wrote PPUCTRL %02X", ppu.Ctrl)
+	}
+	con.Poke(0xC000, 0x60) // NROM-128 mirrors $8000
+	if con.Peek(0x8000) != 0x60 || con.Cartridge.PRGBank(0, 0x2000)[0] != 0x60 {
+		t.Errorf("poke $C000: $8000 = %02X", con.Peek(0x8000))
+	}
+
+	con.PaletteRAM()[0] = 0x0F
+	if v := con.PeekPPU(0x3F10); v != 0x0F {
+		t.Errorf("peek PPU $3F10 = %02X, want 0F of $3F00", v)
+	}
+	if b := con.Cartridge.CHRBank(1, 0x2000); b != nil {
+		t.Errorf("CHR bank 1 of 8 KiB is %d bytes, want nil", len(b))
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+// PPU - Picture Processing Unit 2C02
+// http://wiki.nesdev.com/w/index.php/PPU
+type PPU struct {
+	ppuState
+	console *Console
+
+	// NES color of each pixel of the last frame
+	// http://wiki.nesdev.com/w/index.php/PPU_palettes
+	picture [256 * 240]byte
+	back    [256 * 240]byte
+}
+
+// all the state of PPU, the fields are exported for encoding/binary
+type ppuState struct {
+	Cycle    uint16 // dot of scanline, 0-340
+	ScanLine uint16 // 0-261, 240 is post-render, 261 is pre-render
+	Frame    uint64
+
+	// http://wiki.nesdev.com/w/index.php/PPU_registers
+	Ctrl, Mask, Status byte
+	OAMAddr            byte
+	Buffer             byte // PPUDATA read buffer
+	Bus                byte // last value written to a register
+
+	// http://wiki.nesdev.com/w/index.php/PPU_scrolling
+	V, T uint16 // current and temporary VRAM address
+	X    byte   // fine X scroll
+	W    byte   // first or second write toggle
+
+	NameTable [4096]byte // 2 KiB in console, 4 KiB for four screen carts
+	Palette   [32]byte
+	OAM       [256]byte
+
+	// background tiles being fetched and rendered
+	NameTableByte byte
+	AttributeByte byte
+	LowTileByte   byte
+	HighTileByte  byte
+	TileData      uint64
+
+	// sprites of the next scanline
+	SpriteCount      byte
+	SpriteIndexes    [8]byte
+	SpriteRows       [8]byte
+	SpritePatterns   [8]uint32
+	SpritePositions  [8]byte
+	SpritePriorities [8]byte
+	SpriteLowByte    byte
+}
+
+// PPUCTRL and PPUMASK bits
+const (
+	ctrlIncrement   = 0x04
+	ctrlSpriteTable = 0x08
+	ctrlBgTable     = 0x10
+	ctrlSpriteSize  = 0x20
+	ctrlNMI         = 0x80
+
+	maskBgLeft     = 0x02
+	maskSpriteLeft = 0x04
+	maskBg         = 0x08
+	maskSprite     = 0x10
+
+	statusOverflow = 0x20
+	statusSprite0  = 0x40
+	statusVBlank   = 0x80
+)
+
+// nametable mirroring
+// http://wiki.nesdev.com/w/index.php/Mirroring
+const (
+	mirrorHorizontal = iota
+	mirrorVertical
+	mirrorSingle0
+	mirrorSingle1
+	mirrorFour
+)
+
+var mirrorTables = [...][4]uint16{
+	mirrorHorizontal: {0, 0, 1, 1},
+	mirrorVertical:   {0, 1, 0, 1},
+	mirrorSingle0:    {0, 0, 0, 0},
+	mirrorSingle1:    {1, 1, 1, 1},
+	mirrorFour:       {0, 1, 2, 3},
+}
+
+// kinds of PPU fetches for rendering
+const (
+	fetchNameTable = iota
+	fetchAttribute
+	fetchBackground
+	fetchSprite
+)
+
+// Attach PPU to console, mapping its registers at $2000-$3FFF and OAM DMA
+func (ppu *PPU) Attach(con *Console) error {
+	con.PPU = ppu
+	ppu.console = con
+	con.Bus.Map(0x2000, 0x3FFF, BusHandler{
+		Read:  func(addr uint16) byte { return ppu.readRegister(0x2000 | addr&0x0007) },
+		Write: func(addr uint16, val byte) { ppu.writeRegister(0x2000|addr&0x0007, val) },
+		Peek:  func(addr uint16) (byte, bool) { return ppu.peekRegister(0x2000 | addr&0x0007), true },
+	})
+	con.Bus.Map(0x4014, 0x4014, BusHandler{
+		Write: func(_ uint16, val byte) { ppu.writeDMA(val) },
+	})
+	ppu.Reset()
+	return nil
+}
+
+// Reset PPU to power up state
+// http://wiki.nesdev.com/w/index.php/PPU_power_up_state
+func (ppu *PPU) Reset() {
+	ppu.ppuState = ppuState{}
+}
+
+// Picture return NES colors of pixels of the last complete frame
+func (ppu *PPU) Picture() []byte {
+	return ppu.picture[:]
+}
+
+func (ppu *PPU) renderingEnabled() bool {
+	return ppu.Mask&(maskBg|maskSprite) != 0
+}
+
+// read from PPU memory map
+// http://wiki.nesdev.com/w/index.php/PPU_memory_map
+func (ppu *PPU) read(addr uint16) byte {
+	addr &= 0x3FFF
+	switch {
+	case addr < 0x2000:
+		return ppu.console.Mapper.PPURead(addr)
+	case ppu.console.nameTables != nil && addr < 0x3F00:
+		return ppu.console.nameTables.readNameTable(0x2000 | addr&0x0FFF)
+	case addr < 0x3F00:
+		return ppu.NameTable[ppu.mirrorAddress(addr)]
+	default:
+		return ppu.Palette[paletteAddress(addr)]
+	}
+}
+
+func (ppu *PPU) write(addr uint16, val byte) {
+	addr &= 0x3FFF
+	switch {
+	case addr < 0x2000:
+		ppu.console.Mapper.PPUWrite(addr, val)
+	case ppu.console.nameTables != nil && addr < 0x3F00:
+		ppu.console.nameTables.writeNameTable(0x2000|addr&0x0FFF, val)
+	case addr < 0x3F00:
+		ppu.NameTable[ppu.mirrorAddress(addr)] = val
+	default:
+		ppu.Palette[paletteAddress(addr)] = val & 0x3F
+	}
+}
+
+func (ppu *PPU) mirrorAddress(addr uint16) uint16 {
+	addr = (addr - 0x2000) % 0x1000
+	return mirrorTables[ppu.console.mirroring][addr/0x400]*0x400 + addr%0x400
+}
+
+// $3F10/$3F14/$3F18/$3F1C are mirrors of $3F00/$3F04/$3F08/$3F0C
+func paletteAddress(addr uint16) uint16 {
+	addr %= 32
+	if addr >= 16 && addr%4 == 0 {
+		addr -= 16
+	}
+	return addr
+}
+
+func (ppu *PPU) readRegister(addr uint16) byte {
+	switch addr {
+	case 0x2002:
+		ppu.Bus = ppu.Status&0xE0 | ppu.Bus&0x1F
+		ppu.Status &^= statusVBlank
+		ppu.W = 0
+	case 0x2004:
+		ppu.Bus = ppu.OAM[ppu.OAMAddr]
+	case 0x2007:
+		ppu.Bus = ppu.readData()
+	}
+	return ppu.Bus
+}
+
+// peekRegister return what reading a register would, without clearing
+// VBlank or moving the address
+func (ppu *PPU) peekRegister(addr uint16) byte {
+	switch addr {
+	case 0x2002:
+		return ppu.Status&0xE0 | ppu.Bus&0x1F
+	case 0x2004:
+		return ppu.OAM[ppu.OAMAddr]
+	case 0x2007:
+		if addr := ppu.V & 0x3FFF; addr >= 0x3F00 {
+			return ppu.read(addr)
+		}
+		return ppu.Buffer
+	}
+	return ppu.Bus
+}
+
+func (ppu *PPU) writeRegister(addr uint16, val byte) {
+	ppu.Bus = val
+	switch addr {
+	case 0x2000:
+		if ppu.Ctrl&ctrlNMI == 0 && val&ctrlNMI != 0 && ppu.Status&statusVBlank != 0 {
+			ppu.console.CPU.triggerNMI()
+		}
+		ppu.Ctrl = val
+		ppu.T = ppu.T&0xF3FF | uint16(val&0x03)<<10
+	case 0x2001:
+		ppu.Mask = val
+	case 0x2003:
+		ppu.OAMAddr = val
+	case 0x2004:
+		ppu.OAM[ppu.OAMAddr] = val
+		ppu.OAMAddr++
+	case 0x2005:
+		if ppu.W == 0 {
+			ppu.T = ppu.T&0xFFE0 | uint16(val)>>3
+			ppu.X = val & 0x07
+		} else {
+			ppu.T = ppu.T&0x8FFF | uint16(val&0x07)<<12
+			ppu.T = ppu.T&0xFC1F | uint16(val&0xF8)<<2
+		}
+		ppu.W ^= 1
+	case 0x2006:
+		if ppu.W == 0 {
+			ppu.T = ppu.T&0x80FF | uint16(val&0x3F)<<8
+		} else {
+			ppu.T = ppu.T&0xFF00 | uint16(val)
+			ppu.V = ppu.T
+		}
+		ppu.W ^= 1
+	case 0x2007:
+		ppu.writeData(val)
+	}
+}
+
+// PPUDATA reads are delayed by the buffer, except for palette
+func (ppu *PPU) readData() byte {
+	addr := ppu.V & 0x3FFF
+	val := ppu.read(addr)
+	if ppu.console.CPU.debugger != nil {
+		ppu.console.CPU.debugger.ppuAccess(addr, val, false)
+	}
+	if ppu.console.cdl != nil && addr < 0x2000 {
+		ppu.console.cdl.logCHR(ppu.console, addr, cdlRead)
+	}
+	if ppu.console.fetcher != nil && addr < 0x2000 {
+		ppu.console.fetcher.ppuFetch(addr)
+	}
+	if addr < 0x3F00 {
+		val, ppu.Buffer = ppu.Buffer, val
+	} else {
+		ppu.Buffer = ppu.read(addr - 0x1000)
+	}
+	ppu.incrementAddress()
+	return val
+}
+
+func (ppu *PPU) writeData(val byte) {
+	addr := ppu.V & 0x3FFF
+	if ppu.console.CPU.debugger != nil {
+		ppu.console.CPU.debugger.ppuAccess(addr, val, true)
+	}
+	ppu.write(addr, val)
+	ppu.incrementAddress()
+}
+
+func (ppu *PPU) incrementAddress() {
+	if ppu.Ctrl&ctrlIncrement == 0 {
+		ppu.V++
+	} else {
+		ppu.V += 32
+	}
+}
+
+// writeDMA copy a page of CPU memory to OAM, CPU is suspended meanwhile
+// http://wiki.nesdev.com/w/index.php/PPU_registers#OAMDMA
+func (ppu *PPU) writeDMA(val byte) {
+	cpu := ppu.console.CPU
+	addr := uint16(val) << 8
+	for i := 0; i < 256; i++ {
+		ppu.OAM[ppu.OAMAddr] = cpu.read(addr)
+		ppu.OAMAddr++
+		addr++
+	}
+	cpu.cycles += 513 + cpu.cycles%2
+}
+
+// http://wiki.nesdev.com/w/index.php/PPU_scrolling#Wrapping_around
+func (ppu *PPU) incrementX() {
+	if ppu.V&0x001F == 31 {
+		ppu.V &^= 0x001F
+		ppu.V ^= 0x0400
+	} else {
+		ppu.V++
+	}
+}
+
+func (ppu *PPU) incrementY() {
+	if ppu.V&0x7000 != 0x7000 {
+		ppu.V += 0x1000
+		return
+	}
+	ppu.V &^= 0x7000
+	y := (ppu.V & 0x03E0) >> 5
+	switch y {
+	case 29:
+		y = 0
+		ppu.V ^= 0x0800
+	case 31:
+		y = 0
+	default:
+		y++
+	}
+	ppu.V = ppu.V&^0x03E0 | y<<5
+}
+
+func (ppu *PPU) copyX() {
+	ppu.V = ppu.V&0xFBE0 | ppu.T&0x041F
+}
+
+func (ppu *PPU) copyY() {
+	ppu.V = ppu.V&0x841F | ppu.T&0x7BE0
+}
+
+// http://wiki.nesdev.com/w/index.php/PPU_rendering
+func (ppu *PPU) fetchNameTableByte() {
+	ppu.NameTableByte = ppu.fetch(0x2000|ppu.V&0x0FFF, fetchNameTable)
+}
+
+func (ppu *PPU) fetchAttributeByte() {
+	v := ppu.V
+	addr := 0x23C0 | v&0x0C00 | v>>4&0x38 | v>>2&0x07
+	shift := v>>4&0x04 | v&0x02
+	ppu.AttributeByte = ppu.fetch(addr, fetchAttribute) >> shift & 0x03
+}
+
+func (ppu *PPU) bgTileAddress() uint16 {
+	addr := uint16(ppu.NameTableByte)*16 + ppu.V>>12&0x07
+	if ppu.Ctrl&ctrlBgTable != 0 {
+		addr += 0x1000
+	}
+	return addr
+}
+
+func (ppu *PPU) fetchLowTileByte() {
+	ppu.LowTileByte = ppu.fetch(ppu.bgTileAddress(), fetchBackground)
+}
+
+func (ppu *PPU) fetchHighTileByte() {
+	ppu.HighTileByte = ppu.fetch(ppu.bgTileAddress()+8, fetchBackground)
+}
+
+// fetch read PPU memory for rendering, a byte of kind. A mapper taking
+// part in rendering supplies it
+func (ppu *PPU) fetch(addr uint16, kind int) byte {
+	con := ppu.console
+	pattern := kind == fetchBackground || kind == fetchSprite
+	if con.cdl != nil && pattern {
+		con.cdl.logCHR(con, addr, cdlRendered)
+	}
+	var data byte
+	if con.renderer != nil {
+		data = con.renderer.renderFetch(addr, kind)
+	} else {
+		data = ppu.read(addr)
+	}
+	if con.fetcher != nil && pattern {
+		con.fetcher.ppuFetch(addr)
+	}
+	return data
+}
+
+// storeTileData put the 8 pixels of fetched tile, 4 bits each, to the
+// lower half of TileData
+func (ppu *PPU) storeTileData() {
+	var data uint32
+	for i := 0; i < 8; i++ {
+		p := ppu.AttributeByte<<2 | ppu.HighTileByte>>6&0x02 | ppu.LowTileByte>>7
+		ppu.LowTileByte <<= 1
+		ppu.HighTileByte <<= 1
+		data = data<<4 | uint32(p)
+	}
+	ppu.TileData |= uint64(data)
+}
+
+func (ppu *PPU) bgPixel() byte {
+	if ppu.Mask&maskBg == 0 {
+		return 0
+	}
+	data := uint32(ppu.TileData>>32) >> ((7 - ppu.X) * 4)
+	return byte(data & 0x0F)
+}
+
+func (ppu *PPU) spritePixel(x int) (index int, color byte) {
+	if ppu.Mask&maskSprite == 0 {
+		return 0, 0
+	}
+	for i := 0; i < int(ppu.SpriteCount); i++ {
+		offset := x - int(ppu.SpritePositions[i])
+		if offset < 0 || offset > 7 {
+			continue
+		}
+		color := byte(ppu.SpritePatterns[i] >> uint((7-offset)*4) & 0x0F)
+		if color%4 == 0 {
+			continue
+		}
+		return i, color
+	}
+	return 0, 0
+}
+
+func (ppu *PPU) renderPixel() {
+	x, y := int(ppu.Cycle)-1, int(ppu.ScanLine)
+	bg := ppu.bgPixel()
+	i, sprite := ppu.spritePixel(x)
+	if x < 8 {
+		if ppu.Mask&maskBgLeft == 0 {
+			bg = 0
+		}
+		if ppu.Mask&maskSpriteLeft == 0 {
+			sprite = 0
+		}
+	}
+	bgOpaque, spriteOpaque := bg%4 != 0, sprite%4 != 0
+	var color byte
+	switch {
+	case !bgOpaque && !spriteOpaque:
+		color = 0
+	case !bgOpaque:
+		color = sprite | 0x10
+	case !spriteOpaque:
+		color = bg
+	default:
+		if ppu.SpriteIndexes[i] == 0 && x < 255 {
+			ppu.Status |= statusSprite0
+		}
+		if ppu.SpritePriorities[i] == 0 {
+			color = sprite | 0x10
+		} else {
+			color = bg
+		}
+	}
+	ppu.back[y*256+x] = ppu.Palette[paletteAddress(uint16(color))]
+}
+
+func (ppu *PPU) spriteHeight() int {
+	if ppu.Ctrl&ctrlSpriteSize != 0 {
+		return 16
+	}
+	return 8
+}
+
+// evaluateSprites find sprites on the next scanline, up to 8
+// http://wiki.nesdev.com/w/index.php/PPU_sprite_evaluation
+func (ppu *PPU) evaluateSprites() {
+	h := ppu.spriteHeight()
+	count := 0
+	for i := 0; i < 64; i++ {
+		y := ppu.OAM[i*4]
+		row := int(ppu.ScanLine) - int(y)
+		if row < 0 || row >= h {
+			continue
+		}
+		if count == 8 {
+			ppu.Status |= statusOverflow
+			break
+		}
+		ppu.SpriteIndexes[count] = byte(i)
+		ppu.SpriteRows[count] = byte(row)
+		count++
+	}
+	ppu.SpriteCount = byte(count)
+}
+
+// spriteAddress return address of the pattern row of a sprite slot, empty
+// slots fetch tile $FF as the hardware does
+func (ppu *PPU) spriteAddress(slot int) uint16 {
+	tile, attributes, row := byte(0xFF), byte(0), 0
+	if slot < int(ppu.SpriteCount) {
+		i := int(ppu.SpriteIndexes[slot]) * 4
+		tile, attributes, row = ppu.OAM[i+1], ppu.OAM[i+2], int(ppu.SpriteRows[slot])
+	}
+	if attributes&0x80 != 0 {
+		row = ppu.spriteHeight() - 1 - row
+	}
+	if ppu.spriteHeight() == 8 {
+		addr := uint16(tile)*16 + uint16(row)
+		if ppu.Ctrl&ctrlSpriteTable != 0 {
+			addr += 0x1000
+		}
+		return addr
+	}
+	table := uint16(tile&1) * 0x1000
+	tile &= 0xFE
+	if row > 7 {
+		tile++
+		row -= 8
+	}
+	return table + uint16(tile)*16 + uint16(row)
+}
+
+// fetchSprite fetch pattern of a sprite slot during dots 257-320
+func (ppu *PPU) fetchSprite(slot int, dot int) {
+	switch dot {
+	case 4:
+		ppu.SpriteLowByte = ppu.fetch(ppu.spriteAddress(slot), fetchSprite)
+	case 6:
+		high := ppu.fetch(ppu.spriteAddress(slot)+8, fetchSprite)
+		if slot >= int(ppu.SpriteCount) {
+			return
+		}
+		i := int(ppu.SpriteIndexes[slot]) * 4
+		low, attributes := ppu.SpriteLowByte, ppu.OAM[i+2]
+		var data uint32
+		for j := 0; j < 8; j++ {
+			var p1, p2 byte
+			if attributes&0x40 != 0 {
+				p1, p2 = low&1, high&1<<1
+				low >>= 1
+				high >>= 1
+			} else {
+				p1, p2 = low>>7, high>>6&0x02
+				low <<= 1
+				high <<= 1
+			}
+			data = data<<4 | uint32(attributes&0x03<<2|p2|p1)
+		}
+		ppu.SpritePatterns[slot] = data
+		ppu.SpritePositions[slot] = ppu.OAM[i+3]
+		ppu.SpritePriorities[slot] = attributes >> 5 & 1
+	}
+}
+
+// tick advance a dot, the last dot of pre-render line is skipped on odd
+// frames when rendering
+func (ppu *PPU) tick() {
+	if ppu.ScanLine == 261 && ppu.Cycle == 339 && ppu.Frame%2 == 1 && ppu.renderingEnabled() {
+		ppu.Cycle = 340
+	}
+	ppu.Cycle++
+	if ppu.Cycle > 340 {
+		ppu.Cycle = 0
+		ppu.ScanLine++
+		if ppu.ScanLine > 261 {
+			ppu.ScanLine = 0
+			ppu.Frame++
+		}
+	}
+}
+
+// step run a dot
+func (ppu *PPU) step() {
+	ppu.tick()
+
+	cycle, line := ppu.Cycle, ppu.ScanLine
+	preLine := line == 261
+	visibleLine := line < 240
+	renderLine := preLine || visibleLine
+	visibleCycle := cycle >= 1 && cycle <= 256
+	fetchCycle := visibleCycle || cycle >= 321 && cycle <= 336
+
+	if ppu.renderingEnabled() {
+		if visibleLine && visibleCycle {
+			ppu.renderPixel()
+		}
+		if renderLine && fetchCycle {
+			ppu.TileData <<= 4
+			switch cycle % 8 {
+			case 1:
+				ppu.fetchNameTableByte()
+			case 3:
+				ppu.fetchAttributeByte()
+			case 5:
+				ppu.fetchLowTileByte()
+			case 7:
+				ppu.fetchHighTileByte()
+			case 0:
+				ppu.storeTileData()
+				ppu.incrementX()
+			}
+		}
+		if renderLine {
+			switch {
+			case cycle == 256:
+				ppu.incrementY()
+			case cycle == 257:
+				ppu.copyX()
+				if visibleLine {
+					ppu.evaluateSprites()
+				} else {
+					ppu.SpriteCount = 0
+				}
+			case cycle >= 280 && cycle <= 304 && preLine:
+				ppu.copyY()
+			case cycle == 337 || cycle == 339:
+				// unused nametable fetches, some mappers watch them
+				ppu.fetchNameTableByte()
+			}
+			if cycle >= 257 && cycle <= 320 {
+				ppu.fetchSprite(int(cycle-257)/8, int(cycle-257)%8)
+			}
+		}
+	}
+
+	switch {
+	case line == 241 && cycle == 1:
+		ppu.picture, ppu.back = ppu.back, ppu.picture
+		ppu.Status |= statusVBlank
+		if ppu.Ctrl&ctrlNMI != 0 {
+			ppu.console.CPU.triggerNMI()
+		}
+	case preLine && cycle == 1:
+		ppu.Status &^= statusVBlank | statusSprite0 | statusOverflow
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import "fmt"
+
+// comparisons of RAM search
+const (
+	SearchEqual = iota
+	SearchNotEqual
+	SearchLess
+	SearchGreater
+	SearchLessOrEqual
+	SearchGreaterOrEqual
+)
+
+// RAMSearch - find where a game keeps a variable, such as lives or health,
+// by narrowing down addresses of CPU RAM and PRG RAM whose value changes
+// the way the variable does. Values are of Size bytes, little endian, and
+// a change of Size or Signed takes effect at Reset
+type RAMSearch struct {
+	Size   int // 1 or 2
+	Signed bool
+
+	con        *Console
+	candidates []uint16
+	previous   []int // value of each candidate at last snapshot
+}
+
+// RAMSearchResult - an address left by a search
+type RAMSearchResult struct {
+	Addr            uint16
+	Value, Previous int
+}
+
+// RAMWatch - a value of memory shown while a game runs
+type RAMWatch struct {
+	Name   string
+	Addr   uint16
+	Size   int
+	Signed bool
+}
+
+// NewRAMSearch start a search of values of size bytes, every address is a
+// candidate
+func NewRAMSearch(con *Console, size int, signed bool) (*RAMSearch, error) {
+	s := &RAMSearch{Size: size, Signed: signed, con: con}
+	if err := s.Reset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reset make every address a candidate again, and take a snapshot. An
+// invalid Size is an error, candidates are then kept
+func (s *RAMSearch) Reset() error {
+	if s.Size != 1 && s.Size != 2 {
+		return fmt.Errorf("RAM search of %d-byte values, want 1 or 2", s.Size)
+	}
+	s.candidates = s.candidates[:0]
+	add := func(lo, hi int) {
+		for addr := lo; addr+s.Size-1 <= hi; addr++ {
+			s.candidates = append(s.candidates, uint16(addr))
+		}
+	}
+	add(0x0000, 0x07FF)
+	if s.con.Cartridge != nil && len(s.con.Cartridge.SRAM) > 0 {
+		add(0x6000, 0x7FFF)
+	}
+	s.snapshot()
+	return nil
+}
+
+func (s *RAMSearch) snapshot() {
+	s.previous = s.previous[:0]
+	for _, addr := range s.candidates {
+		s.previous = append(s.previous, s.value(addr))
+	}
+}
+
+// value read the value at addr, as the search views memory
+func (s *RAMSearch) value(addr uint16) int {
+	return readValue(s.con, addr, s.Size, s.Signed)
+}
+
+func readValue(con *Console, addr uint16, size int, signed bool) int {
+	v := int(con.Peek(addr))
+	if size == 2 {
+		v |= int(con.Peek(addr+1)) << 8
+		if signed {
+			return int(int16(v))
+		}
+		return v
+	}
+	if signed {
+		return int(int8(v))
+	}
+	return v
+}
+
+// filter keep candidates for which keep is true, given their value now
+// and at the last snapshot, then take a snapshot. The number of
+// candidates left is returned
+func (s *RAMSearch) filter(keep func(value, previous int) bool) int {
+	candidates, previous := s.candidates[:0], s.previous[:0]
+	for i, addr := range s.candidates {
+		if v := s.value(addr); keep(v, s.previous[i]) {
+			candidates = append(candidates, addr)
+			previous = append(previous, v)
+		}
+	}
+	s.candidates, s.previous = candidates, previous
+	return len(s.candidates)
+}
+
+func searchCompare(op, a, b int) bool {
+	switch op {
+	case SearchEqual:
+		return a == b
+	case SearchNotEqual:
+		return a != b
+	case SearchLess:
+		return a < b
+	case SearchGreater:
+		return a > b
+	case SearchLessOrEqual:
+		return a <= b
+	case SearchGreaterOrEqual:
+		return a >= b
+	}
+	panic(fmt.Sprintf("unknown comparison %d", op))
+}
+
+// Compare keep candidates whose value compares by op to that of last
+// snapshot, so SearchNotEqual keeps those changed
+func (s *RAMSearch) Compare(op int) int {
+	return s.filter(func(value, previous int) bool { return searchCompare(op, value, previous) })
+}
+
+// CompareValue keep candidates whose value compares by op to value
+func (s *RAMSearch) CompareValue(op, value int) int {
+	return s.filter(func(v, _ int) bool { return searchCompare(op, v, value) })
+}
+
+// ChangedBy keep candidates whose value increased by delta since last
+// snapshot, or decreased if delta is negative. Values wrap around as in a
+// byte or word
+func (s *RAMSearch) ChangedBy(delta int) int {
+	mask := 1<<(8*uint(s.Size)) - 1
+	return s.filter(func(value, previous int) bool { return (value-previous-delta)&mask == 0 })
+}
+
+// Results return the candidates left, in order of address
+func (s *RAMSearch) Results() []RAMSearchResult {
+	results := make([]RAMSearchResult, len(s.candidates))
+	for i, addr := range s.candidates {
+		results[i] = RAMSearchResult{addr, s.value(addr), s.previous[i]}
+	}
+	return results
+}
+
+// Cheats return cheats keeping the value at addr as it is now, one for
+// each byte
+func (s *RAMSearch) Cheats(addr uint16, name string) []*Cheat {
+	cheats := make([]*Cheat, s.Size)
+	for i := range cheats {
+		a := addr + uint16(i)
+		cheats[i] = &Cheat{Name: name, Addr: a, Value: s.con.Peek(a), Compare: -1, Enabled: true}
+	}
+	return cheats
+}
+
+// Watch return a RAM watch of the value at addr
+func (s *RAMSearch) Watch(addr uint16, name string) RAMWatch {
+	return RAMWatch{name, addr, s.Size, s.Signed}
+}
+
+// Value read the watched value
+func (w RAMWatch) Value(con *Console) int {
+	return readValue(con, w.Addr, w.Size, w.Signed)
+}
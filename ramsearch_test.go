@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestRAMSearch(t *testing.T) {
+	con := newProgramConsole(t, new(CPU), []byte{0xEA}, false)
+	ram := con.RAM()
+	ram[0x42], ram[0x300] = 3, 3
+	s, err := NewRAMSearch(con, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.CompareValue(SearchEqual, 3); n != 2 {
+		t.Fatalf("%d candidates equal to 3, want 2", n)
+	}
+	ram[0x42], ram[0x300] = 2, 4 // lose a life
+	if n := s.ChangedBy(-1); n != 1 || s.Results()[0] != (RAMSearchResult{0x42, 2, 2}) {
+		t.Fatalf("decreased by 1: %v", s.Results())
+	}
+	ram[0x42] = 0xFF
+	if n := s.Compare(SearchLess); n != 0 {
+		t.Errorf("$FF less than 2 unsigned, %d left", n)
+	}
+
+	s, err = NewRAMSearch(con, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ram[0x10], ram[0x11] = 0xFF, 0x00
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	ram[0x10], ram[0x11] = 0x01, 0x01
+	s.ChangedBy(2) // $00FF to $0101
+	results := s.Results()
+	if len(results) != 1 || results[0].Addr != 0x10 || results[0].Value != 0x0101 {
+		t.Fatalf("16-bit increased by 2: %v", results)
+	}
+	ram[0x11] = 0x80
+	if s.Compare(SearchLess) != 1 {
+		t.Error("$8001 not less than $0101 signed")
+	}
+	w := s.Watch(0x10, "score")
+	if v := w.Value(con); v != -0x7FFF {
+		t.Errorf("watch = %d, want %d", v, -0x7FFF)
+	}
+	cheats := s.Cheats(0x10, "score")
+	if len(cheats) != 2 || cheats[1].Addr != 0x11 || cheats[1].Value != 0x80 || cheats[1].Substitute {
+		t.Errorf("cheats %+v %+v", *cheats[0], *cheats[1])
+	}
+}
+
+func TestRAMSearchSize(t *testing.T) {
+	con := newProgramConsole(t, new(CPU), []byte{0xEA}, false)
+	for _, size := range []int{0, 3, -1} {
+		if _, err := NewRAMSearch(con, size, false); err == nil {
+			t.Errorf("search of %d-byte values is created", size)
+		}
+	}
+	s, err := NewRAMSearch(con, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(s.Results())
+	s.Size = 4
+	if err := s.Reset(); err == nil {
+		t.Error("Reset accepts size 4")
+	}
+	if len(s.Results()) != n {
+		t.Errorf("%d candidates after a failed Reset, want %d", len(s.Results()), n)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// rewindBuffer keep console states of recent frames in a bounded ring.
+// Only the newest state is stored as is, every older state is stored as
+// the compressed XOR delta against its successor, so going back is a
+// matter of undoing deltas from the newest one.
+type rewindBuffer struct {
+	interval uint64
+	entries  []rewindEntry // ring of deltas, oldest at head
+	head     int
+	size     int
+
+	last      []byte // newest state
+	lastFrame uint64
+
+	inputBase uint64 // frame of inputs[0]
+	inputs    [][2]byte
+	replaying bool
+
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+type rewindEntry struct {
+	frame uint64
+	delta []byte
+}
+
+// EnableRewind capture the console state every interval frames and keep at
+// most capacity states, so the console can go back up to about
+// interval*capacity frames
+func (con *Console) EnableRewind(interval, capacity int) error {
+	if interval < 1 || capacity < 1 {
+		return errors.New("invalid rewind interval or capacity")
+	}
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	con.rewind = &rewindBuffer{
+		interval: uint64(interval),
+		entries:  make([]rewindEntry, capacity),
+		fw:       fw,
+	}
+	con.rewind.capture(con)
+	return nil
+}
+
+// DisableRewind stop capturing and drop all captured states
+func (con *Console) DisableRewind() {
+	con.rewind = nil
+}
+
+// Rewind step the console back by the given number of frames, or as far
+// as the captured history allows.
+// It restores the nearest captured state before the target frame, and
+// replays the recorded input from there, so the result is frame accurate.
+func (con *Console) Rewind(frames int) error {
+	rb := con.rewind
+	if rb == nil {
+		return errors.New("rewind is not enabled")
+	}
+	if frames <= 0 {
+		return nil
+	}
+	target := rb.lastFrame
+	if rb.size > 0 {
+		target = rb.entries[rb.head].frame
+	}
+	if con.frame-target > uint64(frames) {
+		target = con.frame - uint64(frames)
+	}
+	for rb.lastFrame > target {
+		if err := rb.pop(); err != nil {
+			return err
+		}
+	}
+
+	// the buttons pressed now are what the player is holding, keep them
+	// rather than those of the restored state
+	held := [2]byte{con.Controllers[0].buttons, con.Controllers[1].buttons}
+	if err := con.LoadState(bytes.NewReader(rb.last)); err != nil {
+		return err
+	}
+	rb.replaying = true
+	for con.frame < target {
+		input := rb.inputs[con.frame-rb.inputBase]
+		con.Controllers[0].buttons = input[0]
+		con.Controllers[1].buttons = input[1]
+		con.StepFrame()
+	}
+	rb.replaying = false
+	con.Controllers[0].buttons = held[0]
+	con.Controllers[1].buttons = held[1]
+	rb.inputs = rb.inputs[:target-rb.inputBase]
+	return nil
+}
+
+func (rb *rewindBuffer) recordInput(con *Console) {
+	if rb.replaying {
+		return
+	}
+	if con.frame < rb.lastFrame || con.frame-rb.inputBase > uint64(len(rb.inputs)) {
+		// a state was loaded from elsewhere, the history no longer applies
+		rb.reset()
+		rb.capture(con)
+	}
+	rb.inputs = append(rb.inputs[:con.frame-rb.inputBase], [2]byte{
+		con.Controllers[0].buttons,
+		con.Controllers[1].buttons,
+	})
+}
+
+func (rb *rewindBuffer) capture(con *Console) {
+	if rb.replaying || (rb.last != nil && con.frame < rb.lastFrame+rb.interval) {
+		return
+	}
+	var state bytes.Buffer
+	if err := con.SaveState(&state); err != nil {
+		return
+	}
+	if rb.last != nil {
+		rb.push(rewindEntry{rb.lastFrame, rb.compress(rb.last, state.Bytes())})
+	} else {
+		rb.inputBase = con.frame
+	}
+	rb.last = state.Bytes()
+	rb.lastFrame = con.frame
+}
+
+func (rb *rewindBuffer) reset() {
+	for i := range rb.entries {
+		rb.entries[i] = rewindEntry{}
+	}
+	rb.head, rb.size = 0, 0
+	rb.last, rb.inputs = nil, nil
+}
+
+// push append an entry, the oldest one is dropped when the ring is full
+func (rb *rewindBuffer) push(e rewindEntry) {
+	if rb.size == len(rb.entries) {
+		rb.head = (rb.head + 1) % len(rb.entries)
+		rb.size--
+		oldest := rb.entries[rb.head].frame
+		if rb.size == 0 {
+			oldest = e.frame
+		}
+		rb.inputs = rb.inputs[oldest-rb.inputBase:]
+		rb.inputBase = oldest
+	}
+	rb.entries[(rb.head+rb.size)%len(rb.entries)] = e
+	rb.size++
+}
+
+// pop restore the state before the newest one
+func (rb *rewindBuffer) pop() error {
+	if rb.size == 0 {
+		return errors.New("rewind beyond the oldest captured state")
+	}
+	i := (rb.head + rb.size - 1) % len(rb.entries)
+	e := rb.entries[i]
+	state, err := rb.decompress(e.delta, rb.last)
+	if err != nil {
+		return err
+	}
+	rb.entries[i] = rewindEntry{}
+	rb.size--
+	rb.last = state
+	rb.lastFrame = e.frame
+	return nil
+}
+
+// compress encode old as its length followed by the deflated XOR of old and new
+func (rb *rewindBuffer) compress(old, new []byte) []byte {
+	rb.buf.Reset()
+	var n [binary.MaxVarintLen64]byte
+	rb.buf.Write(n[:binary.PutUvarint(n[:], uint64(len(old)))])
+	rb.fw.Reset(&rb.buf)
+	rb.fw.Write(xorBytes(old, new))
+	rb.fw.Close()
+	return append([]byte(nil), rb.buf.Bytes()...)
+}
+
+func (rb *rewindBuffer) decompress(delta, new []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := io.ReadAll(flate.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	old := xorBytes(diff, new)
+	if uint64(len(old)) < size {
+		return nil, errors.New("corrupted rewind state")
+	}
+	return old[:size], nil
+}
+
+// xorBytes return a XOR b, the shorter one is padded with zero
+func xorBytes(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	out := make([]byte, len(a))
+	copy(out, a)
+	for i, v := range b {
+		out[i] ^= v
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+// inputProgram sums the A button into $00 as often as it can poll it, and
+// counts polls in $01, so RAM depends on the input of every frame
+const inputProgram = `
+loop:   LDA #1
+        STA $4016
+        LDA #0
+        STA $4016
+        LDA $4016
+        AND #1
+        CLC
+        ADC $00
+        STA $00
+        INC $01
+        JMP loop
+`
+
+func newInputConsole(t *testing.T) *Console {
+	t.Helper()
+	code, err := Assemble(inputProgram, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newProgramConsole(t, new(CPU), code, false)
+}
+
+func TestRewind(t *testing.T) {
+	con := newInputConsole(t)
+	if err := con.EnableRewind(2, 4); err != nil {
+		t.Fatal(err)
+	}
+	ram := map[uint64][]byte{}
+	for con.Frame() < 12 {
+		ram[con.Frame()] = append([]byte(nil), con.RAM()...)
+		con.Controllers[0].SetButtons(byte(con.Frame() % 3 / 2))
+		con.StepFrame()
+	}
+	rb := con.rewind
+	if rb.size != 4 || rb.entries[rb.head].frame != 4 || rb.lastFrame != 12 {
+		t.Errorf("%d states, oldest of frame %d, want 4 from frame 4", rb.size, rb.entries[rb.head].frame)
+	}
+
+	con.Controllers[0].SetButtons(0x80)
+	if err := con.Rewind(3); err != nil {
+		t.Fatal(err)
+	}
+	if con.Frame() != 9 || !bytes.Equal(con.RAM(), ram[9]) {
+		t.Errorf("rewound to frame %d, want 9 as it was", con.Frame())
+	}
+	if b := con.Controllers[0].buttons; b != 0x80 {
+		t.Errorf("buttons %02X after rewind, want 80 held", b)
+	}
+	if err := con.Rewind(100); err != nil {
+		t.Fatal(err)
+	}
+	if con.Frame() != 4 || !bytes.Equal(con.RAM(), ram[4]) {
+		t.Errorf("rewound to frame %d, want 4 of the oldest state", con.Frame())
+	}
+}
+
+func TestRewindDelta(t *testing.T) {
+	rb := &rewindBuffer{}
+	rb.fw, _ = flate.NewWriter(nil, flate.BestSpeed)
+	short, long := []byte("state of frame 1"), []byte("state of the next frame, longer")
+	for _, tt := range [][2][]byte{{short, long}, {long, short}, {short, short}} {
+		old, new := tt[0], tt[1]
+		state, err := rb.decompress(rb.compress(old, new), new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(state, old) {
+			t.Errorf("%q restored as %q", old, state)
+		}
+	}
+	if _, err := rb.decompress([]byte{0x40}, short); err == nil {
+		t.Error("restored a corrupted delta")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	stateMagic   = 0x1a53534e // "NSS\x1a"
+	stateVersion = 7
+)
+
+type stateHeader struct {
+	Magic    uint32
+	Version  uint16
+	Frame    uint64
+	FrameEnd uint64
+}
+
+type cpuState struct {
+	A, X, Y, S byte
+	PC         uint16
+	Flags      byte
+	Cycles     uint64
+	Halted     bool
+	Waiting    bool
+	NMI        bool
+	IRQ        byte
+	IRQMask    byte
+	RAM        [2048]byte
+}
+
+type controllerState struct {
+	Buttons, Index, Strobe byte
+}
+
+// stateMapper is implemented by mappers that have internal registers,
+// such as bank selects, to be stored in save states
+type stateMapper interface {
+	saveState(w io.Writer) error
+	loadState(r io.Reader) error
+}
+
+// SaveState write a snapshot of console state to w
+func (con *Console) SaveState(w io.Writer) error {
+	cpu := con.CPU
+	values := []interface{}{
+		&stateHeader{stateMagic, stateVersion, con.frame, con.frameEnd},
+		&cpuState{cpu.A, cpu.X, cpu.Y, cpu.S, cpu.PC, cpu.flag(), cpu.cycles, cpu.halted, cpu.waiting, cpu.nmi, cpu.irq, cpu.irqMask, cpu.ram},
+	}
+	for i := range con.Controllers {
+		c := &con.Controllers[i]
+		values = append(values, &controllerState{c.buttons, c.index, c.strobe})
+	}
+	if con.PPU != nil {
+		values = append(values, &con.PPU.ppuState)
+	}
+	if con.APU != nil {
+		values = append(values, &con.APU.apuState)
+	}
+	if con.Cartridge != nil {
+		values = append(values, con.Cartridge.SRAM)
+		if con.Cartridge.ChrRAM {
+			values = append(values, con.Cartridge.Chr)
+		}
+	}
+	for _, v := range values {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	if m, ok := con.Mapper.(stateMapper); ok {
+		return m.saveState(w)
+	}
+	return nil
+}
+
+// LoadState restore console state from a snapshot written by SaveState
+func (con *Console) LoadState(r io.Reader) error {
+	header := new(stateHeader)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if header.Magic != stateMagic {
+		return errors.New("invalid state file")
+	}
+	if header.Version != stateVersion {
+		return errors.New("unsupported state version")
+	}
+
+	cs := new(cpuState)
+	if err := binary.Read(r, binary.LittleEndian, cs); err != nil {
+		return err
+	}
+	var controllers [2]controllerState
+	if err := binary.Read(r, binary.LittleEndian, &controllers); err != nil {
+		return err
+	}
+	var ppu *ppuState
+	if con.PPU != nil {
+		ppu = new(ppuState)
+		if err := binary.Read(r, binary.LittleEndian, ppu); err != nil {
+			return err
+		}
+	}
+	var apu *apuState
+	if con.APU != nil {
+		apu = new(apuState)
+		if err := binary.Read(r, binary.LittleEndian, apu); err != nil {
+			return err
+		}
+	}
+	var sram, chr []byte
+	if con.Cartridge != nil {
+		sram = make([]byte, len(con.Cartridge.SRAM))
+		if _, err := io.ReadFull(r, sram); err != nil {
+			return err
+		}
+		if con.Cartridge.ChrRAM {
+			chr = make([]byte, len(con.Cartridge.Chr))
+			if _, err := io.ReadFull(r, chr); err != nil {
+				return err
+			}
+		}
+	}
+	if m, ok := con.Mapper.(stateMapper); ok {
+		if err := m.loadState(r); err != nil {
+			return err
+		}
+	}
+
+	cpu := con.CPU
+	cpu.A, cpu.X, cpu.Y, cpu.S, cpu.PC = cs.A, cs.X, cs.Y, cs.S, cs.PC
+	cpu.setFlags(cs.Flags)
+	cpu.cycles = cs.Cycles
+	cpu.halted = cs.Halted
+	cpu.waiting = cs.Waiting
+	cpu.nmi = cs.NMI
+	cpu.irq = cs.IRQ
+	cpu.irqMask = cs.IRQMask
+	cpu.ram = cs.RAM
+	for i, s := range controllers {
+		c := &con.Controllers[i]
+		c.buttons, c.index, c.strobe = s.Buttons, s.Index, s.Strobe
+	}
+	if ppu != nil {
+		con.PPU.ppuState = *ppu
+	}
+	if apu != nil {
+		con.APU.apuState = *apu
+	}
+	if con.Cartridge != nil {
+		copy(con.Cartridge.SRAM, sram)
+		copy(con.Cartridge.Chr, chr)
+	}
+	con.frame = header.Frame
+	con.frameEnd = header.FrameEnd
+	return nil
+}
+
+// SaveBattery write memory the cartridge keeps while the console is off,
+// as a .sav file: SRAM if it has a battery, then that of its mapper
+func (con *Console) SaveBattery(w io.Writer) error {
+	for _, mem := range con.batteryMemory() {
+		if _, err := w.Write(mem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadBattery read memory written by SaveBattery
+func (con *Console) LoadBattery(r io.Reader) error {
+	for _, mem := range con.batteryMemory() {
+		if _, err := io.ReadFull(r, mem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBatteryFile read the .sav file at path, if there is one
+func (con *Console) loadBatteryFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return con.LoadBattery(file)
+}
+
+// saveBatteryFile write the .sav file at path, if the cartridge keeps
+// memory while the console is off
+func (con *Console) saveBatteryFile(path string) error {
+	if len(con.batteryMemory()) == 0 {
+		return nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := con.SaveBattery(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (con *Console) batteryMemory() (mems [][]byte) {
+	if con.Cartridge == nil {
+		return nil
+	}
+	if con.Cartridge.Battery != 0 {
+		mems = append(mems, con.Cartridge.SRAM)
+	}
+	if m, ok := con.Mapper.(batteryMapper); ok && m.battery() != nil {
+		mems = append(mems, m.battery())
+	}
+	return mems
+}
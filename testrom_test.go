@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test ROMs are not part of the repository, clone
+// https://github.com/christopherpow/nes-test-roms into testROMDir to run them.
+const testROMDir = "testdata/nes-test-roms"
+
+// blargg's test ROMs report their status at $6000, valid once the
+// signature DE B0 61 is written at $6001-$6003, the text output follows at $6004
+const (
+	blarggRunning    = 0x80
+	blarggNeedsReset = 0x81
+	// the ROM expects reset be pressed at least 100ms later
+	blarggResetDelay = 6
+)
+
+// PPU and APU are clocked after each instruction, so registers are
+// accessed at its first cycle rather than at the cycle they are on
+const accessTiming = "registers are not accessed at the cycle of the instruction"
+
+// suites of accuracy test ROMs. ROMs known to fail tell why, their
+// failures are logged rather than reported
+var testROMSuites = []struct {
+	dir     string
+	frames  int               // time out after this number of frames
+	skip    string            // why the suite cannot run
+	failing map[string]string // known to fail by ROM file
+}{
+	{"instr_test-v5/rom_singles", 60 * 60, "", nil},
+	{"ppu_vbl_nmi/rom_singles", 60 * 30, "", map[string]string{
+		"02-vbl_set_time.nes":    accessTiming,
+		"03-vbl_clear_time.nes":  accessTiming,
+		"05-nmi_timing.nes":      accessTiming,
+		"06-suppression.nes":     "reading $2002 as VBlank is set does not suppress it",
+		"07-nmi_on_timing.nes":   accessTiming,
+		"08-nmi_off_timing.nes":  accessTiming,
+		"10-even_odd_timing.nes": accessTiming,
+	}},
+	{"apu_test/rom_singles", 60 * 30, "", map[string]string{
+		"5-len_timing.nes":      accessTiming,
+		"6-irq_flag_timing.nes": accessTiming,
+	}},
+	{"mmc3_test_2/rom_singles", 60 * 30, "mapper 4 (MMC3) is not implemented", nil},
+}
+
+type testROMResult struct {
+	status  byte
+	text    string
+	frames  int
+	halted  bool
+	timeout bool
+}
+
+func (r *testROMResult) String() string {
+	switch {
+	case r.halted:
+		return fmt.Sprintf("CPU halted at frame %d", r.frames)
+	case r.timeout:
+		return fmt.Sprintf("timed out after %d frames", r.frames)
+	}
+	return fmt.Sprintf("status %d at frame %d", r.status, r.frames)
+}
+
+// runTestROM run a ROM headlessly until it reports a result through the
+// $6000 protocol, the CPU halts, or maxFrames is reached
+func runTestROM(path string, maxFrames int) (*testROMResult, error) {
+	cart, err := loadRomFile(path)
+	if err != nil {
+		return nil, err
+	}
+	con := new(Console)
+	con.Connect(new(CPU))
+	con.Connect(new(PPU))
+	if err := con.Connect(cart); err != nil {
+		return nil, err
+	}
+	con.Reset()
+
+	result := &testROMResult{status: blarggRunning}
+	resetAt := -1
+	for result.frames = 1; ; result.frames++ {
+		if err := stepTestFrame(con); err != nil {
+			return result, fmt.Errorf("frame %d: %s", result.frames, err)
+		}
+		if blarggValid(con) {
+			result.status = con.Peek(0x6000)
+			result.text = blarggText(con)
+			if result.status < blarggRunning {
+				break
+			}
+			if result.status == blarggNeedsReset && resetAt < 0 {
+				resetAt = result.frames + blarggResetDelay
+			}
+		}
+		if con.CPU.halted {
+			result.halted = true
+			break
+		}
+		if result.frames == resetAt {
+			con.SoftReset()
+			resetAt = -1
+		}
+		if result.frames >= maxFrames {
+			result.timeout = true
+			break
+		}
+	}
+	return result, nil
+}
+
+// stepTestFrame run a frame, an unimplemented opcode is reported as error
+func stepTestFrame(con *Console) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	con.StepFrame()
+	return nil
+}
+
+func blarggValid(con *Console) bool {
+	return con.Peek(0x6001) == 0xDE &&
+		con.Peek(0x6002) == 0xB0 &&
+		con.Peek(0x6003) == 0x61
+}
+
+func blarggText(con *Console) string {
+	var text []byte
+	for addr := uint16(0x6004); addr < 0x8000; addr++ {
+		c := con.Peek(addr)
+		if c == 0 {
+			break
+		}
+		text = append(text, c)
+	}
+	return strings.TrimSpace(string(text))
+}
+
+func TestBlarggROMs(t *testing.T) {
+	for _, suite := range testROMSuites {
+		suite := suite
+		t.Run(filepath.Dir(suite.dir), func(t *testing.T) {
+			if suite.skip != "" {
+				t.Skip(suite.skip)
+			}
+			roms, _ := filepath.Glob(filepath.Join(testROMDir, suite.dir, "*.nes"))
+			if len(roms) == 0 {
+				t.Skipf("no test ROMs in %s", filepath.Join(testROMDir, suite.dir))
+			}
+			for _, rom := range roms {
+				rom := rom
+				t.Run(filepath.Base(rom), func(t *testing.T) {
+					result, err := runTestROM(rom, suite.frames)
+					if err != nil {
+						t.Fatal(err)
+					}
+					passed := !result.halted && !result.timeout && result.status == 0
+					switch why, known := suite.failing[filepath.Base(rom)]; {
+					case passed && known:
+						t.Logf("known to fail, %s, but passed", why)
+					case passed:
+					case known:
+						t.Logf("known to fail, %s: %s\n%s", why, result, result.text)
+					default:
+						t.Errorf("%s\n%s", result, result.text)
+					}
+				})
+			}
+		})
+	}
+}
+
+// protocolROM asks for a reset, then passes, as blargg's ROMs report at $6000
+const protocolROM = `
+reset:  LDA $10
+        CMP #$A5
+        BEQ second
+        LDA #$A5
+        STA $10
+        LDA #$80
+        STA $6000
+        LDA #$DE
+        STA $6001
+        LDA #$B0
+        STA $6002
+        LDA #$61
+        STA $6003
+        LDA #$81
+        STA $6000
+loop:   JMP loop
+second: LDX #0
+text:   LDA msg,X
+        STA $6004,X
+        INX
+        CPX #8
+        BNE text
+        LDA #0
+        STA $6000
+        JMP loop
+msg:    .byte "Passed", $0A, 0
+`
+
+// writeTestROM write code at $C000 of an NROM iNES file
+func writeTestROM(t *testing.T, code string) string {
+	t.Helper()
+	prg, err := Assemble(code, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := make([]byte, 16+0x4000+0x2000)
+	copy(rom, "NES\x1a\x01\x01")
+	copy(rom[16:], prg)
+	rom[16+0x3FFC], rom[16+0x3FFD] = 0x00, 0xC0
+	path := filepath.Join(t.TempDir(), "test.nes")
+	if err := os.WriteFile(path, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlarggProtocol(t *testing.T) {
+	result, err := runTestROM(writeTestROM(t, protocolROM), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.status != 0 || result.text != "Passed" || result.halted || result.timeout {
+		t.Errorf("%s %q, want status 0 and Passed", result, result.text)
+	}
+	if result.frames <= blarggResetDelay {
+		t.Errorf("passed at frame %d, before reset", result.frames)
+	}
+
+	result, err = runTestROM(writeTestROM(t, "JMP $C000"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.timeout || result.frames != 10 {
+		t.Errorf("%s, want timeout after 10 frames", result)
+	}
+	result, err = runTestROM(writeTestROM(t, ".byte $02"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.halted {
+		t.Errorf("%s, want CPU halted by KIL", result)
+	}
+}
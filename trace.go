@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// built-in trace formats
+const (
+	TraceNestest = iota // Nintendulator, same as nestest.log
+	TraceMesen
+	TraceFCEUX
+)
+
+// TraceRecord - state of CPU before an instruction is executed, it is
+// also the data passed to trace templates
+type TraceRecord struct {
+	PC            uint16
+	Bytes         []byte // opcode and operands
+	Mnemonic      string // unofficial ones are prefixed with *
+	Operand       string // operand with effective address and value
+	A, X, Y, P    byte
+	SP            byte
+	Cycles        uint64
+	Scanline, Dot int
+	Frame         uint64
+	Bank          int // 16 KiB PRG bank of PC, -1 if PC is not in PRG ROM
+}
+
+// Tracer write a line per instruction executed by CPU
+type Tracer struct {
+	w      io.Writer
+	format int
+	tmpl   *template.Template
+	err    error
+
+	pcRanges   [][2]uint16
+	banks      []int
+	frameFrom  uint64
+	frameTo    uint64
+	frameRange bool
+
+	ring    []string
+	ringPos int
+	buf     bytes.Buffer
+}
+
+// NewTracer create a tracer writing in one of built-in formats
+func NewTracer(w io.Writer, format int) *Tracer {
+	return &Tracer{w: w, format: format}
+}
+
+// NewTemplateTracer create a tracer writing lines by a text/template,
+// executed with a *TraceRecord, e.g.
+//
+//	{{printf "%04X" .PC}} {{.Mnemonic}} {{.Operand}} A:{{printf "%02X" .A}}
+func NewTemplateTracer(w io.Writer, text string) (*Tracer, error) {
+	tmpl, err := template.New("trace").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{w: w, tmpl: tmpl}, nil
+}
+
+// SetTracer set the tracer invoked before each instruction, nil to disable
+func (cpu *CPU) SetTracer(t *Tracer) {
+	cpu.tracer = t
+}
+
+// AddPCRange only trace instructions with PC in [from, to], can be called
+// multiple times for more ranges
+func (t *Tracer) AddPCRange(from, to uint16) {
+	t.pcRanges = append(t.pcRanges, [2]uint16{from, to})
+}
+
+// AddBank only trace instructions in the 16 KiB PRG bank, can be called
+// multiple times for more banks
+func (t *Tracer) AddBank(bank int) {
+	t.banks = append(t.banks, bank)
+}
+
+// SetFrames only trace frames in [from, to]
+func (t *Tracer) SetFrames(from, to uint64) {
+	t.frameFrom, t.frameTo, t.frameRange = from, to, true
+}
+
+// SetRing keep only last n lines in memory instead of writing them,
+// they are written by Dump, it is called on a crash of CPU. n <= 0 turns
+// the ring off
+func (t *Tracer) SetRing(n int) {
+	t.ring = nil
+	if n > 0 {
+		t.ring = make([]string, n)
+	}
+	t.ringPos = 0
+}
+
+// Dump write lines kept in ring buffer, the buffer is emptied
+func (t *Tracer) Dump() error {
+	n := len(t.ring)
+	for i := 0; i < n; i++ {
+		line := &t.ring[(t.ringPos+i)%n]
+		if *line != "" {
+			t.write(*line)
+			*line = ""
+		}
+	}
+	return t.err
+}
+
+// Err return the first error from writer
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+func (t *Tracer) trace(cpu *CPU) {
+	con := cpu.console
+	if t.frameRange && (con.frame < t.frameFrom || con.frame > t.frameTo) {
+		return
+	}
+	if len(t.pcRanges) > 0 {
+		in := false
+		for _, r := range t.pcRanges {
+			if cpu.PC >= r[0] && cpu.PC <= r[1] {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return
+		}
+	}
+	bank := con.prgBank(cpu.PC)
+	if len(t.banks) > 0 {
+		in := false
+		for _, b := range t.banks {
+			if b == bank {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return
+		}
+	}
+
+	r := cpu.traceRecord()
+	r.Bank = bank
+	t.buf.Reset()
+	switch {
+	case t.tmpl != nil:
+		if err := t.tmpl.Execute(&t.buf, r); err != nil && t.err == nil {
+			t.err = err
+		}
+		if t.buf.Len() == 0 || t.buf.Bytes()[t.buf.Len()-1] != '\n' {
+			t.buf.WriteByte('\n')
+		}
+	case t.format == TraceMesen:
+		writeMesenTrace(&t.buf, r)
+	case t.format == TraceFCEUX:
+		writeFCEUXTrace(&t.buf, r)
+	default:
+		writeNestestTrace(&t.buf, r)
+	}
+
+	if t.ring != nil {
+		t.ring[t.ringPos] = t.buf.String()
+		t.ringPos = (t.ringPos + 1) % len(t.ring)
+	} else {
+		t.write(t.buf.String())
+	}
+}
+
+func (t *Tracer) write(line string) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = io.WriteString(t.w, line)
+}
+
+func hexBytes(b []byte, prefix string) string {
+	s := make([]string, len(b))
+	for i, v := range b {
+		s[i] = fmt.Sprintf("%s%02X", prefix, v)
+	}
+	return strings.Join(s, " ")
+}
+
+// C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+func writeNestestTrace(w io.Writer, r *TraceRecord) {
+	mnemonic := r.Mnemonic
+	if mnemonic[0] != '*' {
+		mnemonic = " " + mnemonic
+	}
+	fmt.Fprintf(w, "%04X  %-8s %-33sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d\n",
+		r.PC, hexBytes(r.Bytes, ""), mnemonic+" "+r.Operand,
+		r.A, r.X, r.Y, r.P, r.SP, r.Scanline, r.Dot, r.Cycles)
+}
+
+// C000 $4C $F5 $C5  JMP $C5F5                     A:00 X:00 Y:00 P:24 SP:FD CYC:21  SL:0   FC:0 CPU Cycle:7
+func writeMesenTrace(w io.Writer, r *TraceRecord) {
+	fmt.Fprintf(w, "%04X %-13s %-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%-3d SL:%-3d FC:%d CPU Cycle:%d\n",
+		r.PC, hexBytes(r.Bytes, "$"), strings.TrimPrefix(r.Mnemonic, "*")+" "+r.Operand,
+		r.A, r.X, r.Y, r.P, r.SP, r.Dot, r.Scanline, r.Frame, r.Cycles)
+}
+
+// A:00 X:00 Y:00 S:FD P:nvUbdIzc  $C000:4C F5 C5  JMP $C5F5
+func writeFCEUXTrace(w io.Writer, r *TraceRecord) {
+	flags := []byte("nvubdizc")
+	for i := range flags {
+		if r.P&(0x80>>uint(i)) != 0 {
+			flags[i] -= 'a' - 'A'
+		}
+	}
+	var bank string
+	if r.Bank >= 0 {
+		bank = fmt.Sprintf("%02X:", r.Bank)
+	}
+	fmt.Fprintf(w, "A:%02X X:%02X Y:%02X S:%02X P:%s  $%s%04X:%-9s %s\n",
+		r.A, r.X, r.Y, r.SP, flags, bank, r.PC, hexBytes(r.Bytes, ""),
+		strings.TrimSpace(strings.TrimPrefix(r.Mnemonic, "*")+" "+r.Operand))
+}
+
+// traceRecord collect state of CPU before the instruction at PC. Memory is
+// only read where it has no side effect, so tracing does not change how
+// the program runs
+func (cpu *CPU) traceRecord() *TraceRecord {
+	op, _ := cpu.tracePeek(cpu.PC)
+	ins := cpu.table()[op]
+	size := instructionSizes[ins.addrMode]
+	r := &TraceRecord{
+		PC:       cpu.PC,
+		Bytes:    make([]byte, size),
+		Mnemonic: instructionNames[ins.id],
+		A:        cpu.A,
+		X:        cpu.X,
+		Y:        cpu.Y,
+		P:        cpu.flag() | 0x20,
+		SP:       cpu.S,
+		Cycles:   cpu.cycles,
+		Frame:    cpu.console.frame,
+	}
+	r.Scanline, r.Dot = cpu.console.ppuPosition()
+	for i := range r.Bytes {
+		r.Bytes[i], _ = cpu.tracePeek(cpu.PC + uint16(i))
+	}
+	switch {
+	case cpu.Variant == CPU65C02:
+		if ins.id == insBBR || ins.id == insBBS || ins.id == insRMB || ins.id == insSMB {
+			r.Mnemonic += string('0' + op>>4&7)
+		}
+	case unofficial(op):
+		if name, ok := unofficialNames[ins.id]; ok {
+			r.Mnemonic = name
+		}
+		r.Mnemonic = "*" + r.Mnemonic
+	}
+
+	var arg uint16
+	if size > 1 {
+		arg = uint16(r.Bytes[1])
+	}
+	if size > 2 {
+		arg |= uint16(r.Bytes[2]) << 8
+	}
+	value := func(addr uint16) string {
+		if v, ok := cpu.tracePeek(addr); ok {
+			return fmt.Sprintf(" = %02X", v)
+		}
+		return ""
+	}
+	pointer := func(addr uint16) uint16 {
+		lo, _ := cpu.tracePeek(addr)
+		hi, _ := cpu.tracePeek(addr&0xFF00 | (addr+1)&0x00FF)
+		return uint16(hi)<<8 | uint16(lo)
+	}
+	switch ins.addrMode {
+	case addrAccumulator:
+		r.Operand = "A"
+	case addrImmediate:
+		r.Operand = fmt.Sprintf("#$%02X", arg)
+	case addrZeroPage:
+		r.Operand = fmt.Sprintf("$%02X", arg) + value(arg)
+	case addrZeroPageX:
+		addr := (arg + uint16(cpu.X)) & 0xFF
+		r.Operand = fmt.Sprintf("$%02X,X @ %02X", arg, addr) + value(addr)
+	case addrZeroPageY:
+		addr := (arg + uint16(cpu.Y)) & 0xFF
+		r.Operand = fmt.Sprintf("$%02X,Y @ %02X", arg, addr) + value(addr)
+	case addrAbsolute:
+		r.Operand = fmt.Sprintf("$%04X", arg)
+		if ins.id != insJMP && ins.id != insJSR {
+			r.Operand += value(arg)
+		}
+	case addrAbsoluteX:
+		addr := arg + uint16(cpu.X)
+		r.Operand = fmt.Sprintf("$%04X,X @ %04X", arg, addr) + value(addr)
+	case addrAbsoluteY:
+		addr := arg + uint16(cpu.Y)
+		r.Operand = fmt.Sprintf("$%04X,Y @ %04X", arg, addr) + value(addr)
+	case addrIndirect:
+		r.Operand = fmt.Sprintf("($%04X) = %04X", arg, pointer(arg))
+	case addrIndexedIndirect:
+		ptr := (arg + uint16(cpu.X)) & 0xFF
+		addr := pointer(ptr)
+		r.Operand = fmt.Sprintf("($%02X,X) @ %02X = %04X", arg, ptr, addr) + value(addr)
+	case addrIndirectIndexed:
+		base := pointer(arg)
+		addr := base + uint16(cpu.Y)
+		r.Operand = fmt.Sprintf("($%02X),Y = %04X @ %04X", arg, base, addr) + value(addr)
+	case addrRelative:
+		r.Operand = fmt.Sprintf("$%04X", cpu.PC+2+uint16(int8(arg)))
+	case addrZeroPageIndirect:
+		addr := pointer(arg)
+		r.Operand = fmt.Sprintf("($%02X) = %04X", arg, addr) + value(addr)
+	case addrAbsoluteIndexedIndirect:
+		ptr := arg + uint16(cpu.X)
+		lo, _ := cpu.tracePeek(ptr)
+		hi, _ := cpu.tracePeek(ptr + 1)
+		r.Operand = fmt.Sprintf("($%04X,X) @ %04X = %04X", arg, ptr, uint16(hi)<<8|uint16(lo))
+	case addrZeroPageRelative:
+		r.Operand = fmt.Sprintf("$%02X", arg&0xFF) + value(arg&0xFF) +
+			fmt.Sprintf(", $%04X", cpu.PC+3+uint16(int8(arg>>8)))
+	}
+	return r
+}
+
+// tracePeek read RAM and cartridge memory without side effect
+func (cpu *CPU) tracePeek(addr uint16) (byte, bool) {
+	if addr >= 0x2000 && addr < 0x6000 {
+		return 0, false // registers, shown as Nintendulator does
+	}
+	return cpu.console.Bus.Peek(addr)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const traceProgram = `
+        LDX #$02
+        LDA $10,X
+        STA $0300
+        JMP $C000
+`
+
+// traceLines run traceProgram for n instructions with the tracer, it
+// returns lines written to b
+func traceLines(t *testing.T, tracer *Tracer, b *strings.Builder, n int) []string {
+	code, err := Assemble(traceProgram, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con := newProgramConsole(t, new(CPU), code, false)
+	con.Poke(0x0012, 0x55)
+	con.Poke(0x0300, 0xAA)
+	con.CPU.SetTracer(tracer)
+	for i := 0; i < n; i++ {
+		con.Step()
+	}
+	if err := tracer.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(b.String(), "\n")
+}
+
+func TestTraceFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format int
+		want   []string
+	}{
+		{"nestest", TraceNestest, []string{
+			"C000  A2 02     LDX #$02                        A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7\n",
+			"C002  B5 10     LDA $10,X @ 12 = 55             A:00 X:02 Y:00 P:24 SP:FD PPU:  0, 27 CYC:9\n",
+			"C004  8D 00 03  STA $0300 = AA                  A:55 X:02 Y:00 P:24 SP:FD PPU:  0, 39 CYC:13\n",
+			"C007  4C 00 C0  JMP $C000                       A:55 X:02 Y:00 P:24 SP:FD PPU:  0, 51 CYC:17\n",
+		}},
+		{"Mesen", TraceMesen, []string{
+			"C000 $A2 $02       LDX #$02                        A:00 X:00 Y:00 P:24 SP:FD CYC:21  SL:0   FC:0 CPU Cycle:7\n",
+			"C002 $B5 $10       LDA $10,X @ 12 = 55             A:00 X:02 Y:00 P:24 SP:FD CYC:27  SL:0   FC:0 CPU Cycle:9\n",
+			"C004 $8D $00 $03   STA $0300 = AA                  A:55 X:02 Y:00 P:24 SP:FD CYC:39  SL:0   FC:0 CPU Cycle:13\n",
+			"C007 $4C $00 $C0   JMP $C000                       A:55 X:02 Y:00 P:24 SP:FD CYC:51  SL:0   FC:0 CPU Cycle:17\n",
+		}},
+		{"FCEUX", TraceFCEUX, []string{
+			"A:00 X:00 Y:00 S:FD P:nvUbdIzc  $00:C000:A2 02     LDX #$02\n",
+			"A:00 X:02 Y:00 S:FD P:nvUbdIzc  $00:C002:B5 10     LDA $10,X @ 12 = 55\n",
+			"A:55 X:02 Y:00 S:FD P:nvUbdIzc  $00:C004:8D 00 03  STA $0300 = AA\n",
+			"A:55 X:02 Y:00 S:FD P:nvUbdIzc  $00:C007:4C 00 C0  JMP $C000\n",
+		}},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		got := traceLines(t, NewTracer(&b, tt.format), &b, len(tt.want))
+		for i, want := range tt.want {
+			if got[i] != want {
+				t.Errorf("%s line %d:\n got %q\nwant %q", tt.name, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestTraceTemplate(t *testing.T) {
+	var b strings.Builder
+	tracer, err := NewTemplateTracer(&b, `{{printf "%04X" .PC}} {{.Mnemonic}} {{.Operand}} bank {{.Bank}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(traceLines(t, tracer, &b, 3), "")
+	want := "C000 LDX #$02 bank 0\nC002 LDA $10,X @ 12 = 55 bank 0\nC004 STA $0300 = AA bank 0\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := NewTemplateTracer(&b, "{{.PC"); err == nil {
+		t.Error("unterminated action is accepted")
+	}
+	b.Reset()
+	tracer, _ = NewTemplateTracer(&b, "{{.Missing}}")
+	con := newProgramConsole(t, new(CPU), []byte{0xEA}, false)
+	con.CPU.SetTracer(tracer)
+	con.Step()
+	if tracer.Err() == nil {
+		t.Error("unknown field is not reported by Err")
+	}
+}
+
+func TestTraceRing(t *testing.T) {
+	var b strings.Builder
+	ring, _ := NewTemplateTracer(&b, `{{printf "%04X" .PC}}`)
+	ring.SetRing(3)
+	traceLines(t, ring, &b, 6)
+	if b.Len() != 0 {
+		t.Fatalf("ring wrote %q before Dump", b.String())
+	}
+	if err := ring.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "C007\nC000\nC002\n"; got != want {
+		t.Errorf("dump %q, want %q", got, want)
+	}
+	b.Reset()
+	ring.Dump()
+	if b.Len() != 0 {
+		t.Errorf("second dump wrote %q", b.String())
+	}
+
+	for _, n := range []int{0, -1} {
+		b.Reset()
+		off, _ := NewTemplateTracer(&b, `{{printf "%04X" .PC}}`)
+		off.SetRing(2)
+		off.SetRing(n)
+		if got, want := strings.Join(traceLines(t, off, &b, 2), ""), "C000\nC002\n"; got != want {
+			t.Errorf("SetRing(%d) wrote %q, want %q", n, got, want)
+		}
+	}
+}
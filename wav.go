@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// wavHeader - RIFF header of a WAV file of PCM
+// http://soundfile.sapp.org/doc/WaveFormat/
+type wavHeader struct {
+	RIFF          [4]byte
+	Size          uint32
+	WAVE          [4]byte
+	Fmt           [4]byte
+	FmtSize       uint32
+	Format        uint16 // 1 for PCM
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	Data          [4]byte
+	DataSize      uint32
+}
+
+func newWAVHeader(rate, channels, dataSize int) *wavHeader {
+	return &wavHeader{
+		RIFF:          [4]byte{'R', 'I', 'F', 'F'},
+		Size:          uint32(36 + dataSize),
+		WAVE:          [4]byte{'W', 'A', 'V', 'E'},
+		Fmt:           [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		Format:        1,
+		Channels:      uint16(channels),
+		SampleRate:    uint32(rate),
+		ByteRate:      uint32(rate * channels * 2),
+		BlockAlign:    uint16(channels * 2),
+		BitsPerSample: 16,
+		Data:          [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      uint32(dataSize),
+	}
+}
+
+// PCMSink - sink writing raw PCM, samples of 16 bits little-endian with
+// channels interleaved
+type PCMSink struct {
+	w        io.Writer
+	rate     int
+	channels int
+	buf      []int16
+	size     int // bytes written
+}
+
+// NewPCMSink create a sink of raw PCM
+func NewPCMSink(w io.Writer, rate, channels int) *PCMSink {
+	return &PCMSink{w: w, rate: rate, channels: channels}
+}
+
+// Format return rate and channels of the sink
+func (s *PCMSink) Format() (int, int) {
+	return s.rate, s.channels
+}
+
+// WriteAudio write samples, clipped to 16 bits
+func (s *PCMSink) WriteAudio(samples []float32) error {
+	s.buf = s.buf[:0]
+	for _, x := range samples {
+		s.buf = append(s.buf, pcm16(float64(x)))
+	}
+	s.size += 2 * len(s.buf)
+	return binary.Write(s.w, binary.LittleEndian, s.buf)
+}
+
+// WAVSink - sink writing a WAV file of 16-bit PCM, whose header tells the
+// size of data once the sink is closed
+type WAVSink struct {
+	PCMSink
+	ws io.WriteSeeker
+}
+
+// NewWAVSink create a sink writing a WAV file to w, from its current
+// offset
+func NewWAVSink(w io.WriteSeeker, rate, channels int) (*WAVSink, error) {
+	if err := binary.Write(w, binary.LittleEndian, newWAVHeader(rate, channels, 0)); err != nil {
+		return nil, err
+	}
+	return &WAVSink{PCMSink{w: w, rate: rate, channels: channels}, w}, nil
+}
+
+// Close write the size of data to the header, the file is left open at
+// its end
+func (s *WAVSink) Close() error {
+	header := newWAVHeader(s.rate, s.channels, s.size)
+	if _, err := s.ws.Seek(-int64(s.size)-int64(binary.Size(header)), io.SeekCurrent); err != nil {
+		return err
+	}
+	if err := binary.Write(s.ws, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := s.ws.Seek(int64(s.size), io.SeekCurrent)
+	return err
+}
+
+// pcm16 convert a level of -1 to 1 to a 16-bit sample, clipped
+func pcm16(x float64) int16 {
+	switch {
+	case x >= 1:
+		return 32767
+	case x <= -1:
+		return -32767
+	}
+	return int16(x * 32767)
+}